@@ -252,9 +252,10 @@ For time options, the value is a comma separated list of key/value pairs:
   set=${time}: time to set in rfc3339 format, e.g. 2006-01-02T15:04:05Z
   from-label=${label}: label used to extract time in rfc3339 format
   after=${time_in_rfc3339}: adjust any time after this
+  clamp=${time_in_rfc3339}: reduce any time after this to this value, applied after set
   base-ref=${image}: image to lookup base layers, which are skipped
   base-layers=${count}: number of layers to skip changing (from the base image)
-  Note: set or from-label is required in the time options`,
+  Note: set, from-label, or clamp is required in the time options`,
 		Example: `
 # add an annotation to all images, replacing the v1 tag with the new image
 regctl image mod registry.example.org/repo:v1 \
@@ -467,6 +468,8 @@ regctl image ratelimit alpine --format '{{.Remain}}'`,
 			err := json.Unmarshal([]byte(val), &vSlice)
 			if err != nil && val != "" {
 				vSlice = []string{"/bin/sh", "-c", val}
+			} else if val == "" {
+				vSlice = nil
 			}
 			imageOpts.modOpts = append(imageOpts.modOpts,
 				mod.WithConfigCmd(vSlice),
@@ -481,6 +484,8 @@ regctl image ratelimit alpine --format '{{.Remain}}'`,
 			err := json.Unmarshal([]byte(val), &vSlice)
 			if err != nil && val != "" {
 				vSlice = []string{"/bin/sh", "-c", val}
+			} else if val == "" {
+				vSlice = nil
 			}
 			imageOpts.modOpts = append(imageOpts.modOpts,
 				mod.WithConfigEntrypoint(vSlice),
@@ -982,6 +987,12 @@ func imageParseOptTime(s string) (mod.OptTime, map[string]string, error) {
 				return ot, otherFields, fmt.Errorf("after time must be formatted %s: %w", time.RFC3339, err)
 			}
 			ot.After = t
+		case "clamp":
+			t, err := time.Parse(time.RFC3339, kv[1])
+			if err != nil {
+				return ot, otherFields, fmt.Errorf("clamp time must be formatted %s: %w", time.RFC3339, err)
+			}
+			ot.Clamp = t
 		case "from-label":
 			ot.FromLabel = kv[1]
 		case "base-ref":
@@ -899,19 +899,22 @@ func (wt *wrapTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // HTTPError returns an error based on the status code.
+// The returned error is an [errs.HTTPStatusError] that includes the status code.
 func HTTPError(statusCode int) error {
+	var err error
 	switch statusCode {
 	case 401:
-		return fmt.Errorf("%w [http %d]", errs.ErrHTTPUnauthorized, statusCode)
+		err = fmt.Errorf("%w [http %d]", errs.ErrHTTPUnauthorized, statusCode)
 	case 403:
-		return fmt.Errorf("%w [http %d]", errs.ErrHTTPUnauthorized, statusCode)
+		err = fmt.Errorf("%w [http %d]", errs.ErrHTTPUnauthorized, statusCode)
 	case 404:
-		return fmt.Errorf("%w [http %d]", errs.ErrNotFound, statusCode)
+		err = fmt.Errorf("%w [http %d]", errs.ErrNotFound, statusCode)
 	case 429:
-		return fmt.Errorf("%w [http %d]", errs.ErrHTTPRateLimit, statusCode)
+		err = fmt.Errorf("%w [http %d]", errs.ErrHTTPRateLimit, statusCode)
 	default:
-		return fmt.Errorf("%w: %s [http %d]", errs.ErrHTTPStatus, http.StatusText(statusCode), statusCode)
+		err = fmt.Errorf("%w: %s [http %d]", errs.ErrHTTPStatus, http.StatusText(statusCode), statusCode)
 	}
+	return &errs.HTTPStatusError{StatusCode: statusCode, Err: err}
 }
 
 func makeRootPool(rootCAPool [][]byte, rootCADirs []string, hostname string, hostcert string) (*x509.CertPool, error) {
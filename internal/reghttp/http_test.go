@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -1713,3 +1714,36 @@ func TestRegHttp(t *testing.T) {
 	})
 	// TODO: test various TLS configs (custom root for all hosts, custom root for one host, insecure)
 }
+
+func TestHTTPError(t *testing.T) {
+	t.Parallel()
+	tt := []struct {
+		statusCode int
+		expectErr  error
+	}{
+		{statusCode: 401, expectErr: errs.ErrHTTPUnauthorized},
+		{statusCode: 403, expectErr: errs.ErrHTTPUnauthorized},
+		{statusCode: 404, expectErr: errs.ErrNotFound},
+		{statusCode: 429, expectErr: errs.ErrHTTPRateLimit},
+		{statusCode: 500, expectErr: errs.ErrHTTPStatus},
+		{statusCode: 503, expectErr: errs.ErrHTTPStatus},
+	}
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%d", tc.statusCode), func(t *testing.T) {
+			err := fmt.Errorf("request failed: %w", HTTPError(tc.statusCode))
+			if !errors.Is(err, tc.expectErr) {
+				t.Errorf("unexpected error, expected %v, received %v", tc.expectErr, err)
+			}
+			var errStatus *errs.HTTPStatusError
+			if !errors.As(err, &errStatus) {
+				t.Fatalf("status error not found in %v", err)
+			}
+			if errStatus.StatusCode != tc.statusCode {
+				t.Errorf("unexpected status code, expected %d, received %d", tc.statusCode, errStatus.StatusCode)
+			}
+			if expect := fmt.Sprintf("[http %d]", tc.statusCode); !strings.Contains(err.Error(), expect) {
+				t.Errorf("message %q does not include %q", err.Error(), expect)
+			}
+		})
+	}
+}
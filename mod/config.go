@@ -1,17 +1,33 @@
 package mod
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 
 	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/pkg/archive"
 	"github.com/regclient/regclient/types/blob"
+	"github.com/regclient/regclient/types/descriptor"
+	"github.com/regclient/regclient/types/errs"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/mediatype"
+	v1 "github.com/regclient/regclient/types/oci/v1"
 	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
@@ -55,18 +71,311 @@ func WithBuildArgRm(arg string, value *regexp.Regexp) Opts {
 	}
 }
 
-// WithConfigCmd sets the command in the config.
+// WithCmd sets the command in the config, see [WithConfigCmd].
+func WithCmd(cmd []string) Opts {
+	return WithConfigCmd(cmd)
+}
+
+// buildPlatformArgs are the platform build args automatically defined by BuildKit.
+var buildPlatformArgs = map[string]bool{
+	"BUILDPLATFORM":  true,
+	"BUILDOS":        true,
+	"BUILDARCH":      true,
+	"BUILDVARIANT":   true,
+	"TARGETPLATFORM": true,
+	"TARGETOS":       true,
+	"TARGETARCH":     true,
+	"TARGETVARIANT":  true,
+}
+
+var buildRunArgsRe = regexp.MustCompile(`(?s)^RUN \|([0-9]+) (.*)$`)
+
+// WithConfigBuildPlatformScrub removes the BuildKit platform build args from the config env and history.
+// This includes BUILDPLATFORM, TARGETPLATFORM, and the OS, ARCH, and VARIANT args for each.
+// Env entries are deleted, and the args are removed from the list of build args on history RUN steps.
+// If report is not nil, it is called with a description of each scrubbed value.
+func WithConfigBuildPlatformScrub(report func(string)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			changed := false
+			oc := doc.oc.GetConfig()
+			for i := len(oc.Config.Env) - 1; i >= 0; i-- {
+				key, _, _ := strings.Cut(oc.Config.Env[i], "=")
+				if !buildPlatformArgs[key] {
+					continue
+				}
+				if report != nil {
+					report(fmt.Sprintf("env %s", oc.Config.Env[i]))
+				}
+				oc.Config.Env = append(oc.Config.Env[:i], oc.Config.Env[i+1:]...)
+				changed = true
+			}
+			for i := range oc.History {
+				match := buildRunArgsRe.FindStringSubmatch(oc.History[i].CreatedBy)
+				if len(match) != 3 {
+					continue
+				}
+				count, err := strconv.Atoi(match[1])
+				if err != nil {
+					return fmt.Errorf("failed parsing history \"%s\": %w", oc.History[i].CreatedBy, err)
+				}
+				fields := strings.SplitN(match[2], " ", count+1)
+				if len(fields) != count+1 {
+					continue
+				}
+				keep := []string{}
+				for _, arg := range fields[:count] {
+					key, _, _ := strings.Cut(arg, "=")
+					if !buildPlatformArgs[key] {
+						keep = append(keep, arg)
+						continue
+					}
+					if report != nil {
+						report(fmt.Sprintf("history %d %s", i, arg))
+					}
+				}
+				if len(keep) == count {
+					continue
+				}
+				if len(keep) == 0 {
+					oc.History[i].CreatedBy = fmt.Sprintf("RUN %s", fields[count])
+				} else {
+					oc.History[i].CreatedBy = fmt.Sprintf("RUN |%d %s %s", len(keep), strings.Join(keep, " "), fields[count])
+				}
+				changed = true
+			}
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.modified = true
+				doc.newDesc = doc.oc.GetDescriptor()
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigCmd sets the command in the config and adds an empty layer history entry recording the change, similar to a Dockerfile CMD.
 // For running a shell command, the `cmd` value should be `[]string{"/bin/sh", "-c", command}`.
+// A nil cmd removes the field, while an empty non-nil cmd sets the field to an empty array.
 func WithConfigCmd(cmd []string) Opts {
+	return configCmdSet("Cmd", cmd)
+}
+
+// WithConfigCmdToEntrypoint moves the cmd to the end of the entrypoint in the config and clears the cmd.
+// The default command run by the image is unchanged, but arguments passed when running the image are now appended to the command rather than replacing it.
+// This prepares an image for wrapping, e.g. prepending an init process to the entrypoint with arguments left for the user.
+// There is no change when the cmd is empty.
+func WithConfigCmdToEntrypoint() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if len(oc.Config.Cmd) == 0 {
+				return nil
+			}
+			entrypoint := make([]string, 0, len(oc.Config.Entrypoint)+len(oc.Config.Cmd))
+			entrypoint = append(entrypoint, oc.Config.Entrypoint...)
+			oc.Config.Entrypoint = append(entrypoint, oc.Config.Cmd...)
+			oc.Config.Cmd = nil
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigCmdValidate checks for a cmd that repeats the entrypoint binary, which usually indicates a misconfiguration.
+// A problem is found when the first cmd value is an absolute path with the same binary as the first entrypoint value.
+// Each problem is passed to warn when it is not nil, and an error is returned when strict is true.
+// This check runs after other config changes.
+func WithConfigCmdValidate(warn func(string), strict bool) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			problems := []string{}
+			err := dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+					return dm, nil
+				}
+				oc := dm.config.oc.GetConfig()
+				if len(oc.Config.Entrypoint) == 0 || len(oc.Config.Cmd) == 0 || !strings.HasPrefix(oc.Config.Cmd[0], "/") {
+					return dm, nil
+				}
+				if oc.Config.Cmd[0] != oc.Config.Entrypoint[0] && path.Base(oc.Config.Cmd[0]) != path.Base(oc.Config.Entrypoint[0]) {
+					return dm, nil
+				}
+				problem := fmt.Sprintf("cmd %s repeats entrypoint %s on %s", oc.Config.Cmd[0], oc.Config.Entrypoint[0], path.Join(oc.OS, oc.Architecture, oc.Variant))
+				if warn != nil {
+					warn(problem)
+				}
+				problems = append(problems, problem)
+				return dm, nil
+			})
+			if err != nil {
+				return err
+			}
+			if strict && len(problems) > 0 {
+				return fmt.Errorf("config cmd is invalid: %s%.0w", strings.Join(problems, ", "), errs.ErrUnsupported)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigCreatedFromEnv sets the created time in the config from an environment variable, e.g. a commit timestamp exported by CI.
+// The value may be Unix seconds or RFC3339, and is read when the option is applied.
+// An error is returned if the variable is not set or cannot be parsed.
+// Use [WithConfigTimestamp] to also modify the history timestamps.
+func WithConfigCreatedFromEnv(envVar string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
+		value, ok := os.LookupEnv(envVar)
+		if !ok || value == "" {
+			return fmt.Errorf("environment variable %s is not set%.0w", envVar, errs.ErrNotFound)
+		}
+		created, err := timeParse(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", envVar, err)
+		}
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
 			oc := doc.oc.GetConfig()
-			if eqStrSlice(cmd, oc.Config.Cmd) {
+			if oc.Created != nil && oc.Created.Equal(created) {
 				return nil
 			}
-			oc.Config.Cmd = cmd
+			oc.Created = &created
 			doc.oc.SetConfig(oc)
 			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigDiffIDsPrune removes entries from the config rootfs diff_ids that do not have a matching layer.
+// When there are more diff_ids than layers, each layer's uncompressed digest is matched in order to the diff_ids,
+// and only the unmatched entries are removed.
+// An error is returned if the layers cannot be matched to the diff_ids without reordering.
+func WithConfigDiffIDsPrune() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+				return nil
+			}
+			oc := dm.config.oc.GetConfig()
+			layers := []*dagLayer{}
+			for _, dl := range dm.layers {
+				if dl.mod != added {
+					layers = append(layers, dl)
+				}
+			}
+			if len(oc.RootFS.DiffIDs) == len(layers) {
+				return nil
+			}
+			if len(oc.RootFS.DiffIDs) < len(layers) {
+				return fmt.Errorf("config has fewer diff_ids (%d) than layers (%d)%.0w", len(oc.RootFS.DiffIDs), len(layers), errs.ErrMismatch)
+			}
+			diffIDs := []digest.Digest{}
+			iDiff := 0
+			for i, dl := range layers {
+				ucDig := dl.ucDigest
+				if ucDig == "" {
+					rGet := rSrc
+					if dl.rSrc.IsSet() {
+						rGet = dl.rSrc
+					}
+					var err error
+					ucDig, err = layerGetUCDigest(ctx, rc, rGet, dl.desc)
+					if err != nil {
+						return fmt.Errorf("failed to get uncompressed digest for layer %d: %w", i, err)
+					}
+				}
+				for iDiff < len(oc.RootFS.DiffIDs) && oc.RootFS.DiffIDs[iDiff] != ucDig {
+					iDiff++
+				}
+				if iDiff >= len(oc.RootFS.DiffIDs) {
+					return fmt.Errorf("layer %d with uncompressed digest %s not found in diff_ids%.0w", i, ucDig.String(), errs.ErrMismatch)
+				}
+				diffIDs = append(diffIDs, oc.RootFS.DiffIDs[iDiff])
+				iDiff++
+			}
+			oc.RootFS.DiffIDs = diffIDs
+			dm.config.oc.SetConfig(oc)
+			dm.config.newDesc = dm.config.oc.GetDescriptor()
+			dm.config.modified = true
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// layerGetUCDigest computes the digest of the uncompressed layer content.
+func layerGetUCDigest(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d descriptor.Descriptor) (digest.Digest, error) {
+	rdr, err := rc.BlobGet(ctx, r, d)
+	if err != nil {
+		return "", err
+	}
+	defer rdr.Close()
+	ucRdr, err := archive.Decompress(rdr)
+	if err != nil {
+		return "", err
+	}
+	digUC := d.DigestAlgo().Digester()
+	_, err = io.Copy(digUC.Hash(), ucRdr)
+	if err != nil {
+		return "", err
+	}
+	return digUC.Digest(), nil
+}
+
+// WithVerifyDiffIDs verifies the uncompressed digest of each layer matches the corresponding config diff_id.
+// Every layer is pulled and decompressed, and an error listing all mismatches is returned when any diff_id is wrong.
+// This only validates the image, see [WithConfigDiffIDsPrune] to remove extra diff_ids.
+// Layers added by other options are skipped.
+func WithVerifyDiffIDs() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		// layers shared between platforms are only checked once
+		ucDigests := map[digest.Digest]digest.Digest{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+				return nil
+			}
+			oc := dm.config.oc.GetConfig()
+			mismatches := []string{}
+			i := 0
+			for _, dl := range dm.layers {
+				if dl.mod == added {
+					continue
+				}
+				ucDig, ok := ucDigests[dl.desc.Digest]
+				if !ok {
+					rGet := rSrc
+					if dl.rSrc.IsSet() {
+						rGet = dl.rSrc
+					}
+					var err error
+					ucDig, err = layerGetUCDigest(ctx, rc, rGet, dl.desc)
+					if err != nil {
+						return fmt.Errorf("failed to get uncompressed digest for layer %d: %w", i, err)
+					}
+					ucDigests[dl.desc.Digest] = ucDig
+				}
+				if i >= len(oc.RootFS.DiffIDs) {
+					mismatches = append(mismatches, fmt.Sprintf("layer %d has uncompressed digest %s and no diff_id", i, ucDig.String()))
+				} else if oc.RootFS.DiffIDs[i] != ucDig {
+					mismatches = append(mismatches, fmt.Sprintf("layer %d has uncompressed digest %s and diff_id %s", i, ucDig.String(), oc.RootFS.DiffIDs[i].String()))
+				}
+				i++
+			}
+			if i < len(oc.RootFS.DiffIDs) {
+				mismatches = append(mismatches, fmt.Sprintf("config has %d diff_ids for %d layers", len(oc.RootFS.DiffIDs), i))
+			}
+			if len(mismatches) > 0 {
+				return fmt.Errorf("diff_ids do not match the layers in %s: %s%.0w", dm.m.GetDescriptor().Digest.String(), strings.Join(mismatches, ", "), errs.ErrMismatch)
+			}
 			return nil
 		})
 		return nil
@@ -106,176 +415,1583 @@ func WithConfigDigestAlgo(algo digest.Algorithm) Opts {
 	}
 }
 
-// WithConfigEntrypoint sets the entrypoint in the config.
+// WithConfigEntrypoint sets the entrypoint in the config and adds an empty layer history entry recording the change, similar to a Dockerfile ENTRYPOINT.
 // For running a shell command, the `entrypoint` value should be `[]string{"/bin/sh", "-c", command}`.
+// A nil entrypoint removes the field, while an empty non-nil entrypoint sets the field to an empty array.
 func WithConfigEntrypoint(entrypoint []string) Opts {
+	return configCmdSet("Entrypoint", entrypoint)
+}
+
+// envEntropyMinLen is the minimum length of an env value checked by [WithConfigEnvEntropyCheck].
+const envEntropyMinLen = 16
+
+// WithConfigEnvDedup removes duplicate env entries from the config, keeping the last value for each key.
+// The remaining entries keep their relative order.
+func WithConfigEnvDedup() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
 			oc := doc.oc.GetConfig()
-			if eqStrSlice(entrypoint, oc.Config.Entrypoint) {
+			seen := map[string]bool{}
+			env := make([]string, 0, len(oc.Config.Env))
+			for i := len(oc.Config.Env) - 1; i >= 0; i-- {
+				key, _, _ := strings.Cut(oc.Config.Env[i], "=")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				env = append(env, oc.Config.Env[i])
+			}
+			if len(env) == len(oc.Config.Env) {
 				return nil
 			}
-			oc.Config.Entrypoint = entrypoint
+			// entries were added in reverse
+			for i, j := 0, len(env)-1; i < j; i, j = i+1, j-1 {
+				env[i], env[j] = env[j], env[i]
+			}
+			oc.Config.Env = env
 			doc.oc.SetConfig(oc)
 			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
 			return nil
 		})
 		return nil
 	}
 }
 
-// WithConfigPlatform sets the platform in the config.
-func WithConfigPlatform(p platform.Platform) Opts {
+// WithConfigEnvEntropyCheck returns an error when the config has env values with a high entropy, which may be secrets.
+// The threshold is the Shannon entropy in bits per character, where random base64 strings are near 6, and paths and words are typically below 4.
+// Values shorter than 16 characters are not checked.
+// The returned error wraps [errs.ErrUnsupported] and lists the keys of the flagged values.
+// This is a heuristic and will not detect short or low entropy secrets, and may flag long random values that are not secrets, like checksums.
+func WithConfigEnvEntropyCheck(threshold float64) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
 			oc := doc.oc.GetConfig()
-			if platform.Match(oc.Platform, p) {
+			keys := []string{}
+			for _, env := range oc.Config.Env {
+				key, value, _ := strings.Cut(env, "=")
+				if len(value) < envEntropyMinLen {
+					continue
+				}
+				if entropyShannon(value) >= threshold {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) > 0 {
+				return fmt.Errorf("config env may contain secrets: %s%.0w", strings.Join(keys, ", "), errs.ErrUnsupported)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// entropyShannon returns the Shannon entropy of a string in bits per character.
+func entropyShannon(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// WithConfigEnvRmEmpty removes env entries with an empty value, e.g. "FOO=" or "FOO".
+// Entries for variables in the keep list are not removed, since an empty value may be intentional.
+func WithConfigEnvRmEmpty(keep []string) Opts {
+	keepMap := map[string]bool{}
+	for _, k := range keep {
+		keepMap[k] = true
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			env := make([]string, 0, len(oc.Config.Env))
+			for _, e := range oc.Config.Env {
+				key, value, _ := strings.Cut(e, "=")
+				if value == "" && !keepMap[key] {
+					continue
+				}
+				env = append(env, e)
+			}
+			if len(env) == len(oc.Config.Env) {
 				return nil
 			}
-			oc.Platform = p
+			oc.Config.Env = env
 			doc.oc.SetConfig(oc)
 			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
 			return nil
 		})
 		return nil
 	}
 }
 
-// WithConfigTimestamp sets the timestamp on the config entries based on options.
-func WithConfigTimestamp(optTime OptTime) Opts {
+// WithConfigEntrypointValidate verifies the first entry of the config entrypoint exists as a file in the image layers.
+// Relative commands are searched for in each directory of the PATH env, and symlinks in the path are followed.
+// This check runs after the layers are modified, and returns ErrFileNotFound listing the missing entrypoint.
+func WithConfigEntrypointValidate() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
-		if optTime.Set.IsZero() && optTime.FromLabel == "" {
-			return fmt.Errorf("WithConfigTimestamp requires a time to set")
-		}
-		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
-			oc := doc.oc.GetConfig()
-			// lookup start time from label
-			if optTime.FromLabel != "" {
-				tl, ok := oc.Config.Labels[optTime.FromLabel]
-				if !ok {
-					return fmt.Errorf("label not found: %s", optTime.FromLabel)
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			return dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+					return dm, nil
 				}
-				tNew, err := time.Parse(time.RFC3339, tl)
-				if err != nil {
-					// TODO: add fallbacks
-					return fmt.Errorf("could not parse time %s from %s: %w", tl, optTime.FromLabel, err)
+				oc := dm.config.oc.GetConfig()
+				if len(oc.Config.Entrypoint) == 0 || oc.Config.Entrypoint[0] == "" {
+					return dm, nil
 				}
-				if !optTime.Set.IsZero() && !optTime.Set.Equal(tNew) {
-					return fmt.Errorf("conflicting time labels found %s and %s", optTime.Set.String(), tNew.String())
+				cmd := oc.Config.Entrypoint[0]
+				candidates := []string{}
+				if strings.Contains(cmd, "/") {
+					candidates = append(candidates, path.Join("/", cmd))
+				} else {
+					for _, env := range oc.Config.Env {
+						if value, ok := strings.CutPrefix(env, "PATH="); ok {
+							for _, dir := range strings.Split(value, ":") {
+								if strings.HasPrefix(dir, "/") {
+									candidates = append(candidates, path.Join(dir, cmd))
+								}
+							}
+						}
+					}
 				}
-				optTime.Set = tNew
-			}
-			startHistory := 0
-			// offset startHistory by base layer count
-			if optTime.BaseLayers > 0 {
-				layersCount := 0
-				for i, history := range oc.History {
-					if !history.EmptyLayer {
-						layersCount++
+				files := map[string]*tar.Header{}
+				err := layerTarWalk(ctx, rc, rSrc, rTgt, dm, func(dl *dagLayer, th *tar.Header, tr io.Reader) error {
+					name := path.Clean("/" + th.Name)
+					base := path.Base(name)
+					if base == ".wh..wh..opq" {
+						dir := path.Dir(name)
+						for f := range files {
+							if strings.HasPrefix(f, dir+"/") {
+								delete(files, f)
+							}
+						}
+						return nil
 					}
-					if layersCount == optTime.BaseLayers {
-						startHistory = i + 1
-						break
+					if strings.HasPrefix(base, ".wh.") {
+						wh := path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh."))
+						for f := range files {
+							if f == wh || strings.HasPrefix(f, wh+"/") {
+								delete(files, f)
+							}
+						}
+						return nil
 					}
+					files[name] = th
+					return nil
+				})
+				if err != nil {
+					return nil, err
 				}
-				if startHistory == 0 {
-					startHistory = len(oc.History)
+				for _, c := range candidates {
+					if layerFileExists(files, c) {
+						return dm, nil
+					}
 				}
+				return nil, fmt.Errorf("entrypoint not found: %s%.0w", cmd, errs.ErrFileNotFound)
+			})
+		})
+		return nil
+	}
+}
+
+// layerFileExists checks if a filename exists as a non-directory in the list of files, following symlinks.
+func layerFileExists(files map[string]*tar.Header, filename string) bool {
+	// limit the number of symlinks followed to avoid loops
+	for hops := 0; hops < 40; hops++ {
+		resolved := "/"
+		remain := strings.Split(strings.TrimPrefix(path.Clean(filename), "/"), "/")
+		restart := false
+		for i, comp := range remain {
+			cur := path.Join(resolved, comp)
+			th, ok := files[cur]
+			if !ok && i == len(remain)-1 {
+				return false
 			}
-			// offset startHistory from base image history
-			if !optTime.BaseRef.IsZero() {
-				baseConfig, err := rc.ImageConfig(c, optTime.BaseRef, regclient.ImageWithPlatform(oc.Platform.String()))
+			// parent directories may not have an entry in the tar
+			if ok && th.Typeflag == tar.TypeSymlink {
+				target := th.Linkname
+				if !strings.HasPrefix(target, "/") {
+					target = path.Join(resolved, target)
+				}
+				filename = path.Join(append([]string{target}, remain[i+1:]...)...)
+				restart = true
+				break
+			}
+			if i == len(remain)-1 {
+				return th.Typeflag != tar.TypeDir
+			}
+			resolved = cur
+		}
+		if !restart {
+			return false
+		}
+	}
+	return false
+}
+
+// WithConfigExposeFromLabel adds exposed ports to the image config from a comma separated list in a label.
+// Each entry is a port number with an optional protocol, e.g. "8080, 53/udp".
+// The protocol defaults to tcp, or the protocol from [WithExposeDefaultProtocol], and the config is unchanged when the label is not defined.
+func WithConfigExposeFromLabel(label string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			value, ok := oc.Config.Labels[label]
+			if !ok {
+				return nil
+			}
+			changed := false
+			for _, entry := range strings.Split(value, ",") {
+				entry = strings.TrimSpace(entry)
+				if entry == "" {
+					continue
+				}
+				port, err := exposeParse(entry, dc.exposeProto)
 				if err != nil {
-					return fmt.Errorf("failed to get base image config: %w", err)
+					return fmt.Errorf("failed to parse port from label %s: %w", label, err)
 				}
-				// exclude matching history lines from base image
-				for i, history := range baseConfig.GetConfig().History {
-					if len(oc.History) <= i ||
-						oc.History[i].Author != history.Author ||
-						oc.History[i].Comment != history.Comment ||
-						!oc.History[i].Created.Equal(*history.Created) ||
-						oc.History[i].CreatedBy != history.CreatedBy ||
-						oc.History[i].EmptyLayer != history.EmptyLayer {
-						break
-					}
-					startHistory = i + 1
+				if oc.Config.ExposedPorts == nil {
+					oc.Config.ExposedPorts = map[string]struct{}{}
+				}
+				if _, ok := oc.Config.ExposedPorts[port]; !ok {
+					oc.Config.ExposedPorts[port] = struct{}{}
+					changed = true
 				}
 			}
-			var changed, cCur bool
-			// adjust created time on created and history fields
-			if oc.Created != nil {
-				*oc.Created, changed = timeModOpt(*oc.Created, optTime)
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.modified = true
+				doc.newDesc = doc.oc.GetDescriptor()
 			}
-			for i := startHistory; i < len(oc.History); i++ {
-				*oc.History[i].Created, cCur = timeModOpt(*oc.History[i].Created, optTime)
-				changed = changed || cCur
+			return nil
+		})
+		return nil
+	}
+}
+
+// exposeParse validates a port and returns it in the "<port>/<protocol>" format used in the config.
+func exposeParse(entry, defProto string) (string, error) {
+	portStr, proto, _ := strings.Cut(entry, "/")
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto == "" {
+		proto = defProto
+	}
+	if proto == "" {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", fmt.Errorf("unsupported protocol %s%.0w", proto, errs.ErrParsingFailed)
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(portStr))
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %s%.0w", portStr, errs.ErrParsingFailed)
+	}
+	return fmt.Sprintf("%d/%s", port, proto), nil
+}
+
+// WithConfigHealthcheckNone disables the healthcheck in the config by setting the test to ["NONE"], the same as a Dockerfile "HEALTHCHECK NONE".
+// This disables any healthcheck in the image, including one inherited from a base image when the image is used in a later build.
+// This differs from [WithConfigHealthcheckRm], which removes the field so the runtime default applies.
+func WithConfigHealthcheckNone() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.Healthcheck != nil && eqStrSlice(oc.Config.Healthcheck.Test, []string{"NONE"}) &&
+				oc.Config.Healthcheck.Interval == 0 && oc.Config.Healthcheck.Timeout == 0 &&
+				oc.Config.Healthcheck.StartPeriod == 0 && oc.Config.Healthcheck.Retries == 0 {
+				return nil
+			}
+			oc.Config.Healthcheck = &v1.HealthConfig{Test: []string{"NONE"}}
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigHealthcheckRm removes the healthcheck from the config.
+// Without the field, no healthcheck runs from this image, but a later build using this image as a base may add one.
+// See [WithConfigHealthcheckNone] to explicitly disable the healthcheck.
+func WithConfigHealthcheckRm() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.Healthcheck == nil {
+				return nil
+			}
+			oc.Config.Healthcheck = nil
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigLabelFromAnnotation copies an annotation from the top level manifest to a label in the image config.
+// An error is returned if the annotation is not found.
+func WithConfigLabelFromAnnotation(labelKey, annotationKey string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		value := ""
+		found := false
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if !dm.top {
+				return nil
+			}
+			ma, ok := dm.m.(manifest.Annotator)
+			if !ok {
+				return fmt.Errorf("manifest does not support annotations: %s%.0w", dm.m.GetDescriptor().MediaType, errs.ErrUnsupportedMediaType)
+			}
+			annotations, err := ma.GetAnnotations()
+			if err != nil {
+				return err
+			}
+			value, found = annotations[annotationKey]
+			if !found {
+				return fmt.Errorf("annotation not found: %s%.0w", annotationKey, errs.ErrMissingAnnotation)
+			}
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			if !found {
+				return nil
+			}
+			oc := doc.oc.GetConfig()
+			if cur, ok := oc.Config.Labels[labelKey]; ok && cur == value {
+				return nil
+			}
+			if oc.Config.Labels == nil {
+				oc.Config.Labels = map[string]string{}
+			}
+			oc.Config.Labels[labelKey] = value
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigLabelRmEmpty removes any labels with an empty value from the image config.
+func WithConfigLabelRmEmpty() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			changed := false
+			oc := doc.oc.GetConfig()
+			for name, value := range oc.Config.Labels {
+				if value == "" {
+					delete(oc.Config.Labels, name)
+					changed = true
+				}
+			}
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.modified = true
+				doc.newDesc = doc.oc.GetDescriptor()
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// legacyV1ConfigKeys are fields from schema1 era configs that are not part of the OCI or schema2 image config.
+var legacyV1ConfigKeys = []string{"container", "container_config", "docker_version", "id", "parent", "parent_id", "Size"}
+
+// legacyV1ContainerKeys are fields from the docker container config that were copied into the image config.
+var legacyV1ContainerKeys = []string{"AttachStderr", "AttachStdin", "AttachStdout", "Domainname", "Hostname", "Image", "MacAddress", "NetworkDisabled", "OpenStdin", "StdinOnce", "Tty"}
+
+// WithConfigLegacyV1Strip removes fields carried over from schema1 images, e.g. "container_config", "docker_version", and "parent".
+// History entries are rewritten without legacy fields like "throwaway", and an empty rootfs type is set to "layers".
+// The diff_ids are preserved, and ErrUnsupported is returned if the result has a rootfs type other than "layers",
+// or the number of history entries creating a layer does not match the number of diff_ids.
+func WithConfigLegacyV1Strip() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			raw, err := doc.oc.RawBody()
+			if err != nil {
+				return err
+			}
+			legacy, err := configLegacyV1Found(raw)
+			if err != nil {
+				return err
+			}
+			oc := doc.oc.GetConfig()
+			if oc.RootFS.Type == "" {
+				oc.RootFS.Type = "layers"
+				legacy = true
+			}
+			if oc.RootFS.Type != "layers" {
+				return fmt.Errorf("unexpected rootfs type %s%.0w", oc.RootFS.Type, errs.ErrUnsupported)
+			}
+			if len(oc.History) > 0 {
+				layerCount := 0
+				for _, h := range oc.History {
+					if !h.EmptyLayer {
+						layerCount++
+					}
+				}
+				if layerCount != len(oc.RootFS.DiffIDs) {
+					return fmt.Errorf("history has %d layers, rootfs has %d diff_ids%.0w", layerCount, len(oc.RootFS.DiffIDs), errs.ErrUnsupported)
+				}
+			}
+			if !legacy {
+				return nil
+			}
+			// the config is rewritten from the parsed struct, dropping any fields outside of the image spec
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// configLegacyV1Found returns true if the raw config contains schema1 era fields in the config or history.
+func configLegacyV1Found(raw []byte) (bool, error) {
+	top := map[string]json.RawMessage{}
+	err := json.Unmarshal(raw, &top)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse config: %w", err)
+	}
+	for _, k := range legacyV1ConfigKeys {
+		if _, ok := top[k]; ok {
+			return true, nil
+		}
+	}
+	if len(top["config"]) > 0 {
+		conf := map[string]json.RawMessage{}
+		err = json.Unmarshal(top["config"], &conf)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse config: %w", err)
+		}
+		for _, k := range legacyV1ContainerKeys {
+			if _, ok := conf[k]; ok {
+				return true, nil
+			}
+		}
+	}
+	if len(top["history"]) > 0 {
+		history := []map[string]json.RawMessage{}
+		err = json.Unmarshal(top["history"], &history)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse history: %w", err)
+		}
+		for _, h := range history {
+			for k := range h {
+				switch k {
+				case "created", "created_by", "author", "comment", "empty_layer":
+				default:
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// WithConfigMediaTypeNormalize sets the config descriptor media type to match the manifest, e.g. an OCI manifest with a Docker config media type.
+// The config content is not changed.
+// Configs with other media types, like artifacts, are not modified.
+func WithConfigMediaTypeNormalize() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+				return nil
+			}
+			var mtConfig string
+			switch dm.m.GetDescriptor().MediaType {
+			case mediatype.OCI1Manifest:
+				mtConfig = mediatype.OCI1ImageConfig
+			case mediatype.Docker2Manifest:
+				mtConfig = mediatype.Docker2ImageConfig
+			default:
+				return nil
+			}
+			mi, ok := dm.m.(manifest.Imager)
+			if !ok {
+				return nil
+			}
+			cd, err := mi.GetConfig()
+			if err != nil {
+				return err
+			}
+			if cd.MediaType == mtConfig || (cd.MediaType != mediatype.OCI1ImageConfig && cd.MediaType != mediatype.Docker2ImageConfig) {
+				return nil
+			}
+			body, err := dm.config.oc.RawBody()
+			if err != nil {
+				return fmt.Errorf("failed to get config body: %w", err)
+			}
+			desc := dm.config.oc.GetDescriptor()
+			desc.MediaType = mtConfig
+			dm.config.oc = blob.NewOCIConfig(
+				blob.WithDesc(desc),
+				blob.WithRawBody(body),
+			)
+			dm.config.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigNormalizeNewlines converts CRLF line endings to LF in the config history and label values.
+func WithConfigNormalizeNewlines() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			changed := false
+			oc := doc.oc.GetConfig()
+			normalize := func(s *string) {
+				if strings.Contains(*s, "\r\n") {
+					*s = strings.ReplaceAll(*s, "\r\n", "\n")
+					changed = true
+				}
+			}
+			for i := range oc.History {
+				normalize(&oc.History[i].CreatedBy)
+				normalize(&oc.History[i].Comment)
+				normalize(&oc.History[i].Author)
+			}
+			for name, value := range oc.Config.Labels {
+				normalize(&value)
+				oc.Config.Labels[name] = value
+			}
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.modified = true
+				doc.newDesc = doc.oc.GetDescriptor()
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigPathAppend adds a directory to the end of the PATH env variable.
+// If the directory is already in PATH, it is moved to the end, and PATH is created if it is not set.
+func WithConfigPathAppend(dir string) Opts {
+	return configPathAdd(dir, false)
+}
+
+// WithConfigPathPrepend adds a directory to the beginning of the PATH env variable.
+// If the directory is already in PATH, it is moved to the beginning, and PATH is created if it is not set.
+func WithConfigPathPrepend(dir string) Opts {
+	return configPathAdd(dir, true)
+}
+
+// configPathAdd updates the last PATH entry in the env, matching the value used by the runtime.
+func configPathAdd(dir string, prepend bool) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if dir == "" || strings.Contains(dir, ":") {
+			return fmt.Errorf("invalid PATH directory: %q%.0w", dir, errs.ErrUnsupported)
+		}
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			index := -1
+			value := ""
+			for i, env := range oc.Config.Env {
+				if key, v, _ := strings.Cut(env, "="); key == "PATH" {
+					index = i
+					value = v
+				}
+			}
+			dirs := []string{}
+			if prepend {
+				dirs = append(dirs, dir)
+			}
+			if value != "" {
+				for _, d := range strings.Split(value, ":") {
+					if d != dir {
+						dirs = append(dirs, d)
+					}
+				}
+			}
+			if !prepend {
+				dirs = append(dirs, dir)
+			}
+			newValue := strings.Join(dirs, ":")
+			if index >= 0 && newValue == value {
+				return nil
+			}
+			if index >= 0 {
+				oc.Config.Env[index] = "PATH=" + newValue
+			} else {
+				oc.Config.Env = append(oc.Config.Env, "PATH="+newValue)
+			}
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigPlatform sets the platform in the config.
+func WithConfigPlatform(p platform.Platform) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if platform.Match(oc.Platform, p) {
+				return nil
+			}
+			oc.Platform = p
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigPlatformValidate verifies the variant in the config platform is valid for the architecture.
+// The amd64 variant must be empty or v1 to v4, arm64 must be empty or v8 and v9 with an optional minor version, arm must be v5 to v8, and 386 must be empty.
+// Other architectures are not checked.
+// This check runs after other config changes, and the error lists each inconsistent platform.
+func WithConfigPlatformValidate() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			problems := []string{}
+			err := dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+					return dm, nil
+				}
+				p := dm.config.oc.GetConfig().Platform
+				if reason := platformVariantCheck(p.Architecture, p.Variant); reason != "" {
+					// platform.String normalizes the variant, so the original values are output
+					problems = append(problems, fmt.Sprintf("%s (%s)", path.Join(p.OS, p.Architecture, p.Variant), reason))
+				}
+				return dm, nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("config platform is inconsistent: %s%.0w", strings.Join(problems, ", "), errs.ErrUnsupported)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+var platformVariantArm64 = regexp.MustCompile(`^v(8|9)(\.[0-9]+)?$`)
+
+// platformVariantCheck returns a description of the problem when the variant is not valid for the architecture.
+func platformVariantCheck(arch, variant string) string {
+	switch arch {
+	case "amd64":
+		switch variant {
+		case "", "v1", "v2", "v3", "v4":
+			return ""
+		}
+		return "amd64 variant must be empty or v1 to v4"
+	case "arm64":
+		if variant == "" || platformVariantArm64.MatchString(variant) {
+			return ""
+		}
+		return "arm64 variant must be empty, v8, or v9"
+	case "arm":
+		switch variant {
+		case "v5", "v6", "v7", "v8":
+			return ""
+		}
+		return "arm variant must be v5 to v8"
+	case "386":
+		if variant == "" {
+			return ""
+		}
+		return "386 does not have a variant"
+	}
+	return ""
+}
+
+// WithConfigTimestamp sets the timestamp on the config entries based on options.
+func WithConfigTimestamp(optTime OptTime) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if optTime.Set.IsZero() && optTime.FromLabel == "" && optTime.Clamp.IsZero() {
+			return fmt.Errorf("WithConfigTimestamp requires a time to set")
+		}
+		dc.timeClampSet(optTime.Clamp)
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			// lookup start time from label
+			if optTime.FromLabel != "" {
+				tl, ok := oc.Config.Labels[optTime.FromLabel]
+				if !ok {
+					return fmt.Errorf("label not found: %s", optTime.FromLabel)
+				}
+				tNew, err := time.Parse(time.RFC3339, tl)
+				if err != nil {
+					// TODO: add fallbacks
+					return fmt.Errorf("could not parse time %s from %s: %w", tl, optTime.FromLabel, err)
+				}
+				if !optTime.Set.IsZero() && !optTime.Set.Equal(tNew) {
+					return fmt.Errorf("conflicting time labels found %s and %s", optTime.Set.String(), tNew.String())
+				}
+				optTime.Set = tNew
+			}
+			if dc.timeSet.IsZero() {
+				dc.timeSet = optTime.Set
+			}
+			startHistory := 0
+			// offset startHistory by base layer count
+			if optTime.BaseLayers > 0 {
+				layersCount := 0
+				for i, history := range oc.History {
+					if !history.EmptyLayer {
+						layersCount++
+					}
+					if layersCount == optTime.BaseLayers {
+						startHistory = i + 1
+						break
+					}
+				}
+				if startHistory == 0 {
+					startHistory = len(oc.History)
+				}
+			}
+			// offset startHistory from base image history
+			if !optTime.BaseRef.IsZero() {
+				baseConfig, err := rc.ImageConfig(c, optTime.BaseRef, regclient.ImageWithPlatform(oc.Platform.String()))
+				if err != nil {
+					return fmt.Errorf("failed to get base image config: %w", err)
+				}
+				// exclude matching history lines from base image
+				for i, history := range baseConfig.GetConfig().History {
+					if len(oc.History) <= i ||
+						oc.History[i].Author != history.Author ||
+						oc.History[i].Comment != history.Comment ||
+						!oc.History[i].Created.Equal(*history.Created) ||
+						oc.History[i].CreatedBy != history.CreatedBy ||
+						oc.History[i].EmptyLayer != history.EmptyLayer {
+						break
+					}
+					startHistory = i + 1
+				}
+			}
+			var changed, cCur bool
+			// adjust created time on created and history fields
+			if oc.Created != nil {
+				*oc.Created, changed = timeModOpt(*oc.Created, optTime)
+			}
+			for i := startHistory; i < len(oc.History); i++ {
+				*oc.History[i].Created, cCur = timeModOpt(*oc.History[i].Created, optTime)
+				changed = changed || cCur
+			}
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.newDesc = doc.oc.GetDescriptor()
+				doc.modified = true
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigTimestampFromLabel sets the max timestamp in the config to match a label value.
+//
+// Deprecated: replace with [WithConfigTimestamp].
+func WithConfigTimestampFromLabel(label string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			var err error
+			changed := false
+			oc := doc.oc.GetConfig()
+			tl, ok := oc.Config.Labels[label]
+			if !ok {
+				return fmt.Errorf("label not found: %s", label)
+			}
+			t, err := time.Parse(time.RFC3339, tl)
+			if err != nil {
+				// TODO: add fallbacks
+				return fmt.Errorf("could not parse time %s from %s: %w", tl, label, err)
+			}
+			if dc.timeSet.IsZero() {
+				dc.timeSet = t
+			}
+			if oc.Created != nil && t.Before(*oc.Created) {
+				*oc.Created = t
+				changed = true
+			}
+			if oc.History != nil {
+				for i, h := range oc.History {
+					if h.Created != nil && t.Before(*h.Created) {
+						*oc.History[i].Created = t
+						changed = true
+					}
+				}
+			}
+			if changed {
+				doc.oc.SetConfig(oc)
+				doc.newDesc = doc.oc.GetDescriptor()
+				doc.modified = true
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigTimestampMax sets the max timestamp on any config objects.
+//
+// Deprecated: replace with [WithConfigTimestamp].
+func WithConfigTimestampMax(t time.Time) Opts {
+	return WithConfigTimestamp(OptTime{
+		Set:   t,
+		After: t,
+	})
+}
+
+// WithConfigUserByName sets the config user to the uid and gid of a user defined in the image /etc/passwd.
+// The primary group must also exist in /etc/group when that file is included in the image.
+// An error is returned if the user is not found.
+func WithConfigUserByName(name string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		users := map[*dagOCIConfig]string{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil {
+				return nil
+			}
+			passwd, err := layerFileRead(ctx, rc, rSrc, rTgt, dm, "/etc/passwd")
+			if err != nil {
+				return fmt.Errorf("failed to read passwd: %w", err)
+			}
+			uid, gid := "", ""
+			for _, line := range strings.Split(string(passwd), "\n") {
+				fields := strings.Split(line, ":")
+				if len(fields) >= 4 && fields[0] == name {
+					uid, gid = fields[2], fields[3]
+					break
+				}
+			}
+			if uid == "" || gid == "" {
+				return fmt.Errorf("user not found: %s%.0w", name, errs.ErrNotFound)
+			}
+			group, err := layerFileRead(ctx, rc, rSrc, rTgt, dm, "/etc/group")
+			if err != nil && !errors.Is(err, errs.ErrFileNotFound) {
+				return fmt.Errorf("failed to read group: %w", err)
+			} else if err == nil {
+				found := false
+				for _, line := range strings.Split(string(group), "\n") {
+					fields := strings.Split(line, ":")
+					if len(fields) >= 3 && fields[2] == gid {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("group %s for user %s not found%.0w", gid, name, errs.ErrNotFound)
+				}
+			}
+			users[dm.config] = uid + ":" + gid
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			user, ok := users[doc]
+			if !ok {
+				return nil
+			}
+			oc := doc.oc.GetConfig()
+			if oc.Config.User == user {
+				return nil
+			}
+			oc.Config.User = user
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigUserEnsure sets the config user to name, adding the user to /etc/passwd and the group to /etc/group when missing.
+// New entries use a home directory of "/" and a shell of "/sbin/nologin", and the group is named after the user.
+// The updated files are added to the top layer with a mode of 0644 and root ownership.
+// A file is not modified when the user name, or group id, already exists.
+func WithConfigUserEnsure(name string, uid, gid int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if name == "" || strings.ContainsAny(name, ":\n") || uid < 0 || gid < 0 {
+			return fmt.Errorf("invalid user %q, uid %d, gid %d%.0w", name, uid, gid, errs.ErrUnsupported)
+		}
+		add := map[*dagLayer][]layerEntry{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil {
+				return nil
+			}
+			entries := []layerEntry{}
+			for _, f := range []struct {
+				filename string
+				field    int
+				match    string
+				line     string
+			}{
+				{"etc/passwd", 0, name, fmt.Sprintf("%s:x:%d:%d::/:/sbin/nologin\n", name, uid, gid)},
+				{"etc/group", 2, strconv.Itoa(gid), fmt.Sprintf("%s:x:%d:\n", name, gid)},
+			} {
+				content, err := layerFileRead(ctx, rc, rSrc, rTgt, dm, f.filename)
+				if err != nil && !errors.Is(err, errs.ErrFileNotFound) {
+					return fmt.Errorf("failed to read %s: %w", f.filename, err)
+				}
+				found := false
+				for _, line := range strings.Split(string(content), "\n") {
+					fields := strings.Split(line, ":")
+					if len(fields) > f.field && fields[f.field] == f.match {
+						found = true
+						break
+					}
+				}
+				if found {
+					continue
+				}
+				if len(content) > 0 && content[len(content)-1] != '\n' {
+					content = append(content, '\n')
+				}
+				content = append(content, []byte(f.line)...)
+				entries = append(entries, layerEntry{
+					th: &tar.Header{
+						Typeflag: tar.TypeReg,
+						Name:     f.filename,
+						Mode:     0644,
+						Size:     int64(len(content)),
+						ModTime:  time.Unix(0, 0),
+						Format:   tar.FormatPAX,
+					},
+					content: content,
+				})
+			}
+			if len(entries) == 0 {
+				return nil
+			}
+			var top *dagLayer
+			for _, dl := range dm.layers {
+				if dl.mod != deleted {
+					top = dl
+				}
+			}
+			if top == nil || !inListStr(top.desc.MediaType, mtKnownTar) {
+				return fmt.Errorf("unable to add user %s, top layer is not a known tar media type", name)
+			}
+			add[top] = entries
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.User == name {
+				return nil
+			}
+			oc.Config.User = name
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		dc.stepsLayer = append(dc.stepsLayer, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, rdr io.ReadCloser) (io.ReadCloser, error) {
+			entries, ok := add[dl]
+			if !ok || dl.mod == deleted {
+				return rdr, nil
+			}
+			return dc.layerAppend(dl, rdr, entries), nil
+		})
+		return nil
+	}
+}
+
+// WithConfigWorkingDirEnsure sets the working directory in the config and adds the directory to the top layer when it is missing.
+// Any missing parent directories are also created, with a mode of 0755, root ownership, and a zero unix timestamp.
+// The layers are not modified when the directory exists and is not removed by a whiteout in a later layer.
+func WithConfigWorkingDirEnsure(dir string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dir = path.Clean("/" + filepath.ToSlash(dir))
+		if dir == "/" {
+			return fmt.Errorf("working dir must not be the root directory%.0w", errs.ErrUnsupported)
+		}
+		// list of the directory and parents to create, parents first
+		dirs := []string{}
+		for cur := strings.TrimPrefix(dir, "/"); cur != "."; cur = path.Dir(cur) {
+			dirs = append([]string{cur}, dirs...)
+		}
+		missing := map[*dagLayer][]string{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil {
+				return nil
+			}
+			// track the layer where each directory was found, whiteouts only remove entries from lower layers
+			found := map[string]*dagLayer{}
+			var top *dagLayer
+			for _, dl := range dm.layers {
+				if dl.mod != deleted {
+					top = dl
+				}
+			}
+			err := layerTarWalk(ctx, rc, rSrc, rTgt, dm, func(dl *dagLayer, th *tar.Header, tr io.Reader) error {
+				name := tarNameClean(th.Name)
+				base := path.Base(name)
+				if base == ".wh..wh..opq" {
+					// opaque whiteout removes everything below the directory, but not the directory itself
+					opq := path.Dir(name)
+					for _, dir := range dirs {
+						if (opq == "." || strings.HasPrefix(dir, opq+"/")) && found[dir] != dl {
+							delete(found, dir)
+						}
+					}
+					return nil
+				}
+				if strings.HasPrefix(base, ".wh.") {
+					// whiteout of a directory in the list, or any parent, removes it
+					wh := path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh."))
+					for _, dir := range dirs {
+						if (dir == wh || strings.HasPrefix(dir, wh+"/")) && found[dir] != dl {
+							delete(found, dir)
+						}
+					}
+					return nil
+				}
+				for _, dir := range dirs {
+					if name == dir || strings.HasPrefix(name, dir+"/") {
+						found[dir] = dl
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			missingDirs := []string{}
+			for _, d := range dirs {
+				if found[d] == nil {
+					missingDirs = append(missingDirs, d)
+				}
+			}
+			if len(missingDirs) == 0 {
+				return nil
+			}
+			if top == nil || !inListStr(top.desc.MediaType, mtKnownTar) {
+				return fmt.Errorf("unable to add working dir %s, top layer is not a known tar media type", dir)
+			}
+			missing[top] = missingDirs
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.WorkingDir == dir {
+				return nil
+			}
+			oc.Config.WorkingDir = dir
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			return nil
+		})
+		dc.stepsLayer = append(dc.stepsLayer, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, rdr io.ReadCloser) (io.ReadCloser, error) {
+			missingDirs, ok := missing[dl]
+			if !ok || dl.mod == deleted {
+				return rdr, nil
+			}
+			entries := make([]layerEntry, 0, len(missingDirs))
+			for _, d := range missingDirs {
+				entries = append(entries, layerEntry{th: &tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     d + "/",
+					Mode:     0755,
+					ModTime:  time.Unix(0, 0),
+					Format:   tar.FormatPAX,
+				}})
+			}
+			return dc.layerAppend(dl, rdr, entries), nil
+		})
+		return nil
+	}
+}
+
+// layerTarWalk calls fn for each entry in the tar layers of an image, in the order they are applied.
+// Deleted, external, and non-tar layers are skipped.
+func layerTarWalk(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest, fn func(*dagLayer, *tar.Header, io.Reader) error) error {
+	for _, dl := range dm.layers {
+		if dl.mod == deleted || len(dl.desc.URLs) > 0 || !inListStr(dl.desc.MediaType, mtKnownTar) {
+			continue
+		}
+		r := rSrc
+		d := dl.desc
+		if dl.rSrc.IsSet() {
+			r = dl.rSrc
+		} else if dl.mod == added {
+			r = rTgt
+		}
+		// layers already replaced in the layer walk are read from the target
+		if dl.mod == replaced && dl.newDesc.Digest != "" {
+			r = rTgt
+			d = dl.newDesc
+		}
+		err := func() error {
+			br, err := rc.BlobGet(ctx, r, d)
+			if err != nil {
+				return err
+			}
+			defer br.Close()
+			dr, err := archive.Decompress(br)
+			if err != nil {
+				return err
+			}
+			tr := tar.NewReader(dr)
+			for {
+				th, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read layer %s: %w", d.Digest.String(), err)
+				}
+				err = fn(dl, th, tr)
+				if err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerFileRead returns the content of a regular file in the image layers, handling whiteouts in later layers.
+// ErrFileNotFound is returned if the file does not exist.
+func layerFileRead(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest, filename string) ([]byte, error) {
+	filename = tarNameClean(filename)
+	var content []byte
+	found := false
+	err := layerTarWalk(ctx, rc, rSrc, rTgt, dm, func(dl *dagLayer, th *tar.Header, tr io.Reader) error {
+		name := tarNameClean(th.Name)
+		base := path.Base(name)
+		if base == ".wh..wh..opq" {
+			dir := path.Dir(name)
+			if dir == "." || strings.HasPrefix(filename, dir+"/") {
+				found, content = false, nil
+			}
+			return nil
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			wh := path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh."))
+			if filename == wh || strings.HasPrefix(filename, wh+"/") {
+				found, content = false, nil
+			}
+			return nil
+		}
+		if name != filename {
+			return nil
+		}
+		if th.Typeflag != tar.TypeReg {
+			found, content = false, nil
+			return nil
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		found, content = true, b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("file not found: %s%.0w", filename, errs.ErrFileNotFound)
+	}
+	return content, nil
+}
+
+// layerEntry is a tar entry added to a layer.
+type layerEntry struct {
+	th      *tar.Header
+	content []byte
+}
+
+// layerAppend returns a reader for the layer with entries appended, updating the layer descriptor when the reader is closed.
+func (dc *dagConfig) layerAppend(dl *dagLayer, rdr io.ReadCloser, entries []layerEntry) io.ReadCloser {
+	if dl.newDesc.MediaType == "" {
+		dl.newDesc = dl.desc
+	}
+	var comp archive.CompressType
+	switch dl.newDesc.MediaType {
+	case mediatype.OCI1LayerGzip, mediatype.Docker2LayerGzip:
+		comp = archive.CompressGzip
+	case mediatype.OCI1LayerZstd, mediatype.Docker2LayerZstd:
+		comp = archive.CompressZstd
+	default:
+		comp = archive.CompressNone
+	}
+	dl.newDesc.Digest = ""
+	dl.newDesc.Size = 0
+	if dl.mod == unchanged {
+		dl.mod = replaced
+	}
+	digUC := dl.newDesc.DigestAlgo().Digester()
+	pr, pw := io.Pipe()
+	go func() {
+		err := dc.layerEntriesAppend(rdr, pw, comp, digUC.Hash(), entries)
+		_ = pw.CloseWithError(err)
+	}()
+	return readCloserFn{
+		Reader: pr,
+		closeFn: func() error {
+			_ = pr.Close()
+			err := rdr.Close()
+			if err != nil {
+				return err
+			}
+			dl.ucDigest = digUC.Digest()
+			return nil
+		}}
+}
+
+// layerEntriesAppend copies a layer, appending the entries.
+// Existing entries with the same name as an appended entry are not copied.
+func (dc *dagConfig) layerEntriesAppend(rdr io.Reader, w io.Writer, comp archive.CompressType, ucw io.Writer, entries []layerEntry) error {
+	dr, err := archive.Decompress(rdr)
+	if err != nil {
+		return err
+	}
+	var cw io.WriteCloser
+	switch comp {
+	case archive.CompressGzip:
+		cw = dc.gzipWriter(w)
+	case archive.CompressZstd:
+		cw, err = zstd.NewWriter(w, dc.zstdEncoderOpts()...)
+		if err != nil {
+			return err
+		}
+	}
+	var tw *tar.Writer
+	if cw != nil {
+		tw = tar.NewWriter(io.MultiWriter(cw, ucw))
+	} else {
+		tw = tar.NewWriter(io.MultiWriter(w, ucw))
+	}
+	replace := map[string]bool{}
+	for _, e := range entries {
+		replace[tarNameClean(e.th.Name)] = true
+	}
+	tr := tar.NewReader(dr)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if replace[tarNameClean(th.Name)] {
+			continue
+		}
+		err = tw.WriteHeader(th)
+		if err != nil {
+			return err
+		}
+		if th.Typeflag == tar.TypeReg && th.Size > 0 {
+			_, err = io.CopyN(tw, tr, th.Size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range entries {
+		err = tw.WriteHeader(e.th)
+		if err != nil {
+			return err
+		}
+		if len(e.content) > 0 {
+			_, err = tw.Write(e.content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	if cw != nil {
+		err = cw.Close()
+		if gw, ok := cw.(*gzip.Writer); ok && err == nil {
+			gzipWriterPool.Put(gw)
+		}
+		return err
+	}
+	return nil
+}
+
+// WithDefaultPlatform sets the platform on images that do not define an os or architecture.
+// Platforms already defined in the config are not changed.
+// When an index descriptor includes a platform, that platform is used for the config instead of the default.
+// Index descriptors without a platform are set to the default when the config is also missing a platform.
+func WithDefaultPlatform(p platform.Platform) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if p.OS == "" || p.Architecture == "" {
+			return fmt.Errorf("default platform requires an os and architecture")
+		}
+		descPlat := map[*dagOCIConfig]platform.Platform{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || !dm.m.IsList() {
+				return nil
+			}
+			mi, ok := dm.m.(manifest.Indexer)
+			if !ok {
+				return nil
+			}
+			ml, err := mi.GetManifestList()
+			if err != nil {
+				return fmt.Errorf("failed to get manifest list: %w", err)
+			}
+			changed := false
+			mlI := 0
+			for _, child := range dm.manifests {
+				if child.mod == added {
+					continue
+				}
+				if mlI >= len(ml) {
+					return fmt.Errorf("could not find descriptor, index=%d, digest=%s", mlI, dm.origDesc.Digest.String())
+				}
+				d := &ml[mlI]
+				mlI++
+				if child.mod == deleted || child.config == nil || child.config.oc == nil {
+					continue
+				}
+				oc := child.config.oc.GetConfig()
+				if oc.OS != "" || oc.Architecture != "" {
+					continue
+				}
+				if d.Platform != nil && (d.Platform.OS != "" || d.Platform.Architecture != "") {
+					descPlat[child.config] = *d.Platform
+					continue
+				}
+				pDesc := p
+				d.Platform = &pDesc
+				changed = true
+			}
+			if !changed {
+				return nil
+			}
+			err = mi.SetManifestList(ml)
+			if err != nil {
+				return err
+			}
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			dm.newDesc = dm.m.GetDescriptor()
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.OS != "" || oc.Architecture != "" {
+				return nil
 			}
-			if changed {
-				doc.oc.SetConfig(oc)
-				doc.newDesc = doc.oc.GetDescriptor()
-				doc.modified = true
+			if pDesc, ok := descPlat[doc]; ok {
+				oc.Platform = pDesc
+			} else {
+				oc.Platform = p
 			}
+			doc.oc.SetConfig(oc)
+			doc.modified = true
 			return nil
 		})
 		return nil
 	}
 }
 
-// WithConfigTimestampFromLabel sets the max timestamp in the config to match a label value.
-//
-// Deprecated: replace with [WithConfigTimestamp].
-func WithConfigTimestampFromLabel(label string) Opts {
+// WithEntrypoint sets the entrypoint in the config, see [WithConfigEntrypoint].
+func WithEntrypoint(entrypoint []string) Opts {
+	return WithConfigEntrypoint(entrypoint)
+}
+
+// configCmdSet sets the Cmd or Entrypoint field in the config with a history entry.
+// The history entry uses the config created time to keep the output reproducible.
+func configCmdSet(field string, value []string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
-		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
-			var err error
-			changed := false
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
 			oc := doc.oc.GetConfig()
-			tl, ok := oc.Config.Labels[label]
-			if !ok {
-				return fmt.Errorf("label not found: %s", label)
+			cur := &oc.Config.Cmd
+			if field == "Entrypoint" {
+				cur = &oc.Config.Entrypoint
 			}
-			t, err := time.Parse(time.RFC3339, tl)
-			if err != nil {
-				// TODO: add fallbacks
-				return fmt.Errorf("could not parse time %s from %s: %w", tl, label, err)
+			if (*cur == nil) == (value == nil) && eqStrSlice(*cur, value) {
+				return nil
 			}
-			if oc.Created != nil && t.Before(*oc.Created) {
-				*oc.Created = t
-				changed = true
+			*cur = value
+			valueJSON := []byte("[]")
+			if len(value) > 0 {
+				var err error
+				valueJSON, err = json.Marshal(value)
+				if err != nil {
+					return err
+				}
 			}
-			if oc.History != nil {
-				for i, h := range oc.History {
-					if h.Created != nil && t.Before(*h.Created) {
-						*oc.History[i].Created = t
-						changed = true
-					}
+			// history is only extended when it has an entry for every layer, an entry added to a missing or short history would be matched to a layer
+			histLayers := 0
+			for _, h := range oc.History {
+				if !h.EmptyLayer {
+					histLayers++
 				}
 			}
-			if changed {
-				doc.oc.SetConfig(oc)
-				doc.newDesc = doc.oc.GetDescriptor()
-				doc.modified = true
+			if len(oc.History) > 0 && histLayers == len(oc.RootFS.DiffIDs) {
+				oc.History = append(oc.History, v1.History{
+					Created:    oc.Created,
+					CreatedBy:  strings.ToUpper(field) + " " + string(valueJSON),
+					EmptyLayer: true,
+				})
 			}
+			doc.oc.SetConfig(oc)
+			// omitempty drops the empty array, so it is restored by dagPut after the config is last marshaled
+			if doc.emptyFields == nil {
+				doc.emptyFields = map[string]bool{}
+			}
+			doc.emptyFields[field] = value != nil && len(value) == 0
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
 			return nil
 		})
 		return nil
 	}
 }
 
-// WithConfigTimestampMax sets the max timestamp on any config objects.
-//
-// Deprecated: replace with [WithConfigTimestamp].
-func WithConfigTimestampMax(t time.Time) Opts {
-	return WithConfigTimestamp(OptTime{
-		Set:   t,
-		After: t,
+// emptyFieldsRestore sets the fields from emptyFields that are still empty to empty arrays in the raw config.
+// This must run after the last call to SetConfig since marshaling the config drops empty arrays.
+func (doc *dagOCIConfig) emptyFieldsRestore() error {
+	if len(doc.emptyFields) == 0 {
+		return nil
+	}
+	oc := doc.oc.GetConfig()
+	raw, err := doc.oc.RawBody()
+	if err != nil {
+		return err
+	}
+	top := map[string]json.RawMessage{}
+	err = json.Unmarshal(raw, &top)
+	if err != nil {
+		return err
+	}
+	conf := map[string]json.RawMessage{}
+	if len(top["config"]) > 0 {
+		err = json.Unmarshal(top["config"], &conf)
+		if err != nil {
+			return err
+		}
+	}
+	changed := false
+	for _, field := range []string{"Cmd", "Entrypoint"} {
+		value := oc.Config.Cmd
+		if field == "Entrypoint" {
+			value = oc.Config.Entrypoint
+		}
+		if !doc.emptyFields[field] || len(value) > 0 {
+			continue
+		}
+		if _, ok := conf[field]; ok {
+			continue
+		}
+		conf[field] = json.RawMessage("[]")
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	top["config"], err = json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	raw, err = json.Marshal(top)
+	if err != nil {
+		return err
+	}
+	err = doc.oc.UnmarshalJSON(raw)
+	if err != nil {
+		return err
+	}
+	doc.newDesc = doc.oc.GetDescriptor()
+	return nil
+}
+
+// WithEnvDelete removes the env entries for key from the image config.
+// Entries that are not in the form "KEY=VALUE" are not modified.
+func WithEnvDelete(key string) Opts {
+	return envEdit(key, func(env []string) ([]string, bool) {
+		result := make([]string, 0, len(env))
+		for _, e := range env {
+			if k, _, ok := strings.Cut(e, "="); ok && k == key {
+				continue
+			}
+			result = append(result, e)
+		}
+		return result, len(result) != len(env)
+	})
+}
+
+// WithEnvSet sets the value of key in the image config env.
+// An existing entry is replaced in its current position, otherwise a new entry is appended.
+// Entries that are not in the form "KEY=VALUE" are not modified.
+func WithEnvSet(key, value string) Opts {
+	entry := key + "=" + value
+	return envEdit(key, func(env []string) ([]string, bool) {
+		env = append([]string{}, env...)
+		found, changed := false, false
+		for i, e := range env {
+			if k, _, ok := strings.Cut(e, "="); ok && k == key {
+				found = true
+				if e != entry {
+					env[i] = entry
+					changed = true
+				}
+			}
+		}
+		if !found {
+			env = append(env, entry)
+			changed = true
+		}
+		return env, changed
 	})
 }
 
+// envEdit runs edit on the env of each image config, edit returns the new env and true when it was changed.
+func envEdit(key string, edit func([]string) ([]string, bool)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid env key %q%.0w", key, errs.ErrUnsupported)
+		}
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			env, changed := edit(oc.Config.Env)
+			if !changed {
+				return nil
+			}
+			oc.Config.Env = env
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithExposeAdd defines an exposed port in the image config.
+// A port without a protocol is added as is, unless [WithExposeDefaultProtocol] is used.
 func WithExposeAdd(port string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			port := dc.exposePort(port)
 			changed := false
 			oc := doc.oc.GetConfig()
 			if oc.Config.ExposedPorts == nil {
@@ -296,10 +2012,82 @@ func WithExposeAdd(port string) Opts {
 	}
 }
 
+// WithExposeDefaultProtocol sets the protocol added to ports without a protocol, e.g. "8080" becomes "8080/udp".
+// This applies to [WithExposeAdd], [WithExposeRm], and [WithConfigExposeFromLabel], regardless of the order of the options.
+// The protocol must be tcp or udp.
+func WithExposeDefaultProtocol(proto string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		proto = strings.ToLower(proto)
+		if proto != "tcp" && proto != "udp" {
+			return fmt.Errorf("unsupported default protocol %s%.0w", proto, errs.ErrUnsupported)
+		}
+		dc.exposeProto = proto
+		return nil
+	}
+}
+
+// exposePort adds the default protocol to a port without a protocol.
+func (dc *dagConfig) exposePort(port string) string {
+	if dc.exposeProto == "" || strings.Contains(port, "/") {
+		return port
+	}
+	return port + "/" + dc.exposeProto
+}
+
+// WithExposedPortAdd defines an exposed port in the image config using the canonical "port/protocol" form.
+// The protocol defaults to tcp when omitted, e.g. "80" is added as "80/tcp".
+func WithExposedPortAdd(port string) Opts {
+	canonical, err := exposePortCanonical(port)
+	if err != nil {
+		return func(dc *dagConfig, dm *dagManifest) error {
+			return err
+		}
+	}
+	return WithExposeAdd(canonical)
+}
+
+// WithExposedPortRm deletes an exposed port from the image config using the canonical "port/protocol" form.
+// The protocol defaults to tcp when omitted, and removing a port that is not exposed does not change the image.
+func WithExposedPortRm(port string) Opts {
+	canonical, err := exposePortCanonical(port)
+	if err != nil {
+		return func(dc *dagConfig, dm *dagManifest) error {
+			return err
+		}
+	}
+	return WithExposeRm(canonical)
+}
+
+// exposePortCanonical validates a port or port range with an optional protocol, returning the "port/protocol" form.
+func exposePortCanonical(port string) (string, error) {
+	num, proto, _ := strings.Cut(strings.TrimSpace(port), "/")
+	proto = strings.ToLower(proto)
+	if proto == "" {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", fmt.Errorf("unsupported protocol in port %s%.0w", port, errs.ErrUnsupported)
+	}
+	start, end, isRange := strings.Cut(num, "-")
+	nums := []string{start}
+	if isRange {
+		nums = append(nums, end)
+	}
+	for _, p := range nums {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port %s%.0w", port, errs.ErrUnsupported)
+		}
+	}
+	return num + "/" + proto, nil
+}
+
 // WithExposeRm deletes an exposed from the image config.
+// A port without a protocol is removed as is, unless [WithExposeDefaultProtocol] is used.
 func WithExposeRm(port string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			port := dc.exposePort(port)
 			changed := false
 			oc := doc.oc.GetConfig()
 			if oc.Config.ExposedPorts == nil {
@@ -321,12 +2109,55 @@ func WithExposeRm(port string) Opts {
 }
 
 // WithLabel sets or deletes a label from the image config.
+// Name may be prefixed with a list of platforms "[p1,p2,...]name" to only modify the matching images, e.g. "[linux/amd64]com.example.field".
+// Use [WithLabelSet] to store an empty value.
 func WithLabel(name, value string) Opts {
+	return labelEdit(name, func(labels map[string]string, name string) bool {
+		cur, ok := labels[name]
+		if value == "" && ok {
+			delete(labels, name)
+			return true
+		} else if value != "" && value != cur {
+			labels[name] = value
+			return true
+		}
+		return false
+	})
+}
+
+// WithLabelDelete removes a label from the image config, a missing label is not an error.
+// The name supports the same platform selectors as [WithLabel].
+func WithLabelDelete(name string) Opts {
+	return labelEdit(name, func(labels map[string]string, name string) bool {
+		if _, ok := labels[name]; !ok {
+			return false
+		}
+		delete(labels, name)
+		return true
+	})
+}
+
+// WithLabelSet sets a label in the image config.
+// The name supports the same platform selectors as [WithLabel].
+// Unlike [WithLabel], an empty value is stored rather than deleting the label, use [WithLabelDelete] to remove it.
+func WithLabelSet(name, value string) Opts {
+	return labelEdit(name, func(labels map[string]string, name string) bool {
+		if cur, ok := labels[name]; ok && cur == value {
+			return false
+		}
+		labels[name] = value
+		return true
+	})
+}
+
+// labelEdit runs edit on the labels of each image config selected by name, see [WithLabel].
+// Edit is called with the name stripped of any platform selector and returns true when the map was changed.
+func labelEdit(name string, edit func(labels map[string]string, name string) bool) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		// extract the list for platforms to update from the name
 		name = strings.TrimSpace(name)
 		platforms := []platform.Platform{}
-		if name[0] == '[' && strings.Index(name, "]") > 0 {
+		if strings.HasPrefix(name, "[") && strings.Index(name, "]") > 0 {
 			end := strings.Index(name, "]")
 			list := strings.Split(name[1:end], ",")
 			for _, entry := range list {
@@ -342,6 +2173,9 @@ func WithLabel(name, value string) Opts {
 			}
 			name = name[end+1:]
 		}
+		if name == "" {
+			return fmt.Errorf("label name must not be empty%.0w", errs.ErrUnsupported)
+		}
 		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
 			// if platforms are listed, skip non-matching platforms
 			if len(platforms) > 0 {
@@ -357,16 +2191,42 @@ func WithLabel(name, value string) Opts {
 					return nil
 				}
 			}
-			changed := false
 			oc := doc.oc.GetConfig()
 			if oc.Config.Labels == nil {
 				oc.Config.Labels = map[string]string{}
 			}
-			cur, ok := oc.Config.Labels[name]
-			if value == "" && ok {
-				delete(oc.Config.Labels, name)
-				changed = true
-			} else if value != "" && value != cur {
+			if !edit(oc.Config.Labels, name) {
+				return nil
+			}
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithLabelsMergeFromRef copies the labels from the config of a base image into the image config.
+// Labels already in the image are preserved unless overwrite is true.
+// When the base image is a manifest list, the config for the matching platform is used.
+func WithLabelsMergeFromRef(baseRef ref.Ref, overwrite bool) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		base := baseConfigCache{r: baseRef}
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			ocBase, err := base.get(ctx, rc, oc.Platform)
+			if err != nil {
+				return err
+			}
+			changed := false
+			for name, value := range ocBase.Config.Labels {
+				if cur, ok := oc.Config.Labels[name]; ok && (!overwrite || cur == value) {
+					continue
+				}
+				if oc.Config.Labels == nil {
+					oc.Config.Labels = map[string]string{}
+				}
 				oc.Config.Labels[name] = value
 				changed = true
 			}
@@ -381,6 +2241,179 @@ func WithLabel(name, value string) Opts {
 	}
 }
 
+// WithEnvMergeFromRef copies the env from the config of a base image into the image config, e.g. to inherit an updated PATH after a rebase.
+// Variables already in the image are preserved unless overwrite is true, and new variables are appended in the order of the base image.
+// Entries that are not in the form "KEY=VALUE" are not modified.
+// When the base image is a manifest list, the config for the matching platform is used.
+func WithEnvMergeFromRef(baseRef ref.Ref, overwrite bool) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		base := baseConfigCache{r: baseRef}
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			ocBase, err := base.get(ctx, rc, oc.Platform)
+			if err != nil {
+				return err
+			}
+			env := append([]string{}, oc.Config.Env...)
+			changed := false
+			for _, entry := range ocBase.Config.Env {
+				key, _, ok := strings.Cut(entry, "=")
+				if !ok {
+					continue
+				}
+				found := false
+				for i, e := range env {
+					if k, _, ok := strings.Cut(e, "="); ok && k == key {
+						found = true
+						if overwrite && e != entry {
+							env[i] = entry
+							changed = true
+						}
+					}
+				}
+				if !found {
+					env = append(env, entry)
+					changed = true
+				}
+			}
+			if changed {
+				oc.Config.Env = env
+				doc.oc.SetConfig(oc)
+				doc.modified = true
+				doc.newDesc = doc.oc.GetDescriptor()
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// baseConfigCache retrieves the config of a base image for each platform, caching the results.
+type baseConfigCache struct {
+	r       ref.Ref
+	m       manifest.Manifest
+	configs map[digest.Digest]v1.Image
+}
+
+func (bc *baseConfigCache) get(ctx context.Context, rc *regclient.RegClient, p platform.Platform) (v1.Image, error) {
+	var err error
+	if bc.m == nil {
+		bc.m, err = rc.ManifestGet(ctx, bc.r)
+		if err != nil {
+			return v1.Image{}, fmt.Errorf("failed to get base image %s: %w", bc.r.CommonName(), err)
+		}
+		bc.configs = map[digest.Digest]v1.Image{}
+	}
+	mBase := bc.m
+	if mBase.IsList() {
+		d, err := manifest.GetPlatformDesc(mBase, &p)
+		if err != nil {
+			return v1.Image{}, fmt.Errorf("failed to find platform %s in base image %s: %w", p.String(), bc.r.CommonName(), err)
+		}
+		mBase, err = rc.ManifestGet(ctx, bc.r.SetDigest(d.Digest.String()))
+		if err != nil {
+			return v1.Image{}, err
+		}
+	}
+	mi, ok := mBase.(manifest.Imager)
+	if !ok {
+		return v1.Image{}, fmt.Errorf("base image is not an image: %s", bc.r.CommonName())
+	}
+	cd, err := mi.GetConfig()
+	if err != nil {
+		return v1.Image{}, err
+	}
+	if oc, ok := bc.configs[cd.Digest]; ok {
+		return oc, nil
+	}
+	confBase, err := rc.BlobGetOCIConfig(ctx, bc.r, cd)
+	if err != nil {
+		return v1.Image{}, err
+	}
+	oc := confBase.GetConfig()
+	bc.configs[cd.Digest] = oc
+	return oc, nil
+}
+
+// WithRequireNonRootUser returns an error when the config user is root.
+// The user is root when it is empty, or the uid is "0" or "root".
+// Other user names are resolved with the image /etc/passwd when that file exists.
+// If fallback is not empty, the user is changed to fallback instead of returning an error.
+func WithRequireNonRootUser(fallback string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		configManifest := map[*dagOCIConfig]*dagManifest{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil {
+				return nil
+			}
+			configManifest[dm.config] = dm
+			return nil
+		})
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			root, err := configUserIsRoot(ctx, rc, rSrc, rTgt, configManifest[doc], oc.Config.User)
+			if err != nil {
+				return err
+			}
+			if !root {
+				return nil
+			}
+			if fallback == "" {
+				return fmt.Errorf("config user is root: %q%.0w", oc.Config.User, errs.ErrUnsupported)
+			}
+			oc.Config.User = fallback
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// configUserIsRoot reports if the config user runs as uid 0.
+func configUserIsRoot(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest, user string) (bool, error) {
+	uid, _, _ := strings.Cut(user, ":")
+	if uid == "" || uid == "0" || uid == "root" {
+		return true, nil
+	}
+	if _, err := strconv.Atoi(uid); err == nil || dm == nil {
+		return false, nil
+	}
+	passwd, err := layerFileRead(ctx, rc, rSrc, rTgt, dm, "/etc/passwd")
+	if errors.Is(err, errs.ErrFileNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read passwd: %w", err)
+	}
+	for _, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 3 && fields[0] == uid {
+			return fields[2] == "0", nil
+		}
+	}
+	return false, nil
+}
+
+// WithUser sets the user in the image config, e.g. "1000", "1000:1000", or "name:group".
+// The value is not validated, and an empty string clears the user.
+func WithUser(user string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.User == user {
+				return nil
+			}
+			oc.Config.User = user
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithVolumeAdd defines a volume in the image config.
 func WithVolumeAdd(volume string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -428,3 +2461,40 @@ func WithVolumeRm(volume string) Opts {
 		return nil
 	}
 }
+
+// WithWorkingDir sets the working directory in the image config, an empty string clears the working directory.
+// Use [WithConfigWorkingDirEnsure] to also create the directory in the layers.
+func WithWorkingDir(dir string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.WorkingDir == dir {
+				return nil
+			}
+			oc.Config.WorkingDir = dir
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithConfigWorkingDirTrim removes the working directory from the image config when it is set to the default "/".
+func WithConfigWorkingDirTrim() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			if oc.Config.WorkingDir != "/" {
+				return nil
+			}
+			oc.Config.WorkingDir = ""
+			doc.oc.SetConfig(oc)
+			doc.modified = true
+			doc.newDesc = doc.oc.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
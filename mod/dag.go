@@ -7,6 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 
@@ -28,14 +31,60 @@ const (
 	deleted
 )
 
+func (c changes) String() string {
+	switch c {
+	case unchanged:
+		return "unchanged"
+	case added:
+		return "added"
+	case replaced:
+		return "replaced"
+	case deleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
 type dagConfig struct {
-	stepsManifest  []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error
-	stepsOCIConfig []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagOCIConfig) error
-	stepsLayer     []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, io.ReadCloser) (io.ReadCloser, error)
-	stepsLayerFile []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, *tar.Header, io.Reader) (*tar.Header, io.Reader, changes, error)
-	maxDataSize    int64
-	rTgt           ref.Ref
-	forceLayerWalk bool
+	stepsManifest       []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error
+	stepsOCIConfig      []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagOCIConfig) error
+	stepsLayer          []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, io.ReadCloser) (io.ReadCloser, error)
+	stepsLayerFile      []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, *tar.Header, io.Reader) (*tar.Header, io.Reader, changes, error)
+	stepsLayerFileFinal []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, *tar.Header, io.Reader) (io.Reader, error) // run on each entry kept after stepsLayerFile, may only wrap the reader
+	stepsFinal          []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error                                   // run after layers are processed, before pushing manifests
+	stepsConfigFinal    []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error                                   // run on each image after the config is rebuilt, before the config is pushed
+	stepsPushed         []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error                                   // run after manifests are pushed, rTgt includes the digest
+	maxDataSize         int64
+	maxDataConfig       *int64 // overrides maxDataSize for the config descriptor
+	maxDataLayer        *int64 // overrides maxDataSize for layer descriptors
+	rTgt                ref.Ref
+	forceLayerWalk      bool
+	blobChunkSize       int
+	readBufferSize      int
+	timeSet             time.Time    // time from the first OptTime, used by WithAnnotationCreatedAuto
+	timeClamp           time.Time    // earliest OptTime clamp, used by WithAnnotationCreatedAuto
+	httpClient          *http.Client // used to fetch external layers from their URLs
+
+	layerCompressionReport *LayerCompressionReport
+	discardPush            *discardPush
+	manifestIndent         *string
+	exposeProto            string
+	zstdLevel              int
+	gzipOS                 byte
+	keepSetuid             bool
+	preserveMetadata       bool
+	expectedDigest         digest.Digest
+	dryRun                 func(DryRunReport)
+	concurrency            int
+	muSteps                *sync.Mutex // serializes layer steps when concurrency is above 1
+	muReport               *sync.Mutex // guards reports updated while reading layers
+	progress               func(ProgressEvent)
+	tempDir                string
+	memoryLimit            int64
+	retryAttempts          int
+	retryDelay             time.Duration
+	muProgress             *sync.Mutex // serializes progress callbacks
 }
 
 type dagManifest struct {
@@ -51,17 +100,20 @@ type dagManifest struct {
 }
 
 type dagOCIConfig struct {
-	modified bool
-	newDesc  descriptor.Descriptor
-	oc       blob.OCIConfig
+	modified    bool
+	newDesc     descriptor.Descriptor
+	oc          blob.OCIConfig
+	emptyFields map[string]bool // fields set to an explicit empty array, see emptyFieldsRestore
 }
 
 type dagLayer struct {
-	mod      changes
-	newDesc  descriptor.Descriptor
-	ucDigest digest.Digest // uncompressed descriptor
-	desc     descriptor.Descriptor
-	rSrc     ref.Ref
+	mod       changes
+	newDesc   descriptor.Descriptor
+	ucDigest  digest.Digest // uncompressed descriptor
+	desc      descriptor.Descriptor
+	rSrc      ref.Ref
+	created   time.Time // history time for added layers
+	createdBy string    // history created_by for added layers
 }
 
 func dagGet(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, d descriptor.Descriptor) (*dagManifest, error) {
@@ -214,6 +266,13 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 		if err != nil {
 			return err
 		}
+		maxDataConfig, maxDataLayer := mc.maxDataSize, mc.maxDataSize
+		if mc.maxDataConfig != nil {
+			maxDataConfig = *mc.maxDataConfig
+		}
+		if mc.maxDataLayer != nil {
+			maxDataLayer = *mc.maxDataLayer
+		}
 		oc := v1.Image{}
 		iConfig := -1
 		if dm.config != nil {
@@ -246,7 +305,7 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 			if layer.mod != unchanged && layer.newDesc.Digest != "" {
 				d = layer.newDesc
 			}
-			if d.Size <= mc.maxDataSize || (mc.maxDataSize < 0 && len(d.Data) > 0) {
+			if d.Size <= maxDataLayer || (maxDataLayer < 0 && len(d.Data) > 0) {
 				// if data field should be set
 				// retrieve the body
 				br, err := rc.BlobGet(ctx, rTgt, d)
@@ -260,7 +319,7 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 				}
 				// set data field
 				d.Data = bBytes
-			} else if mc.maxDataSize >= 0 && d.Size > mc.maxDataSize && len(d.Data) > 0 {
+			} else if maxDataLayer >= 0 && d.Size > maxDataLayer && len(d.Data) > 0 {
 				// strip data fields if above max size
 				d.Data = []byte{}
 			}
@@ -278,9 +337,14 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 						oc.RootFS.DiffIDs[i] = layer.ucDigest
 					}
 				}
+				created := timeStart
+				if !layer.created.IsZero() {
+					created = layer.created
+				}
 				newHistory := v1.History{
-					Created: &timeStart,
-					Comment: "regclient",
+					Created:   &created,
+					CreatedBy: layer.createdBy,
+					Comment:   "regclient",
 				}
 				if iConfig < 0 {
 					// noop
@@ -331,6 +395,16 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 		}
 		var cBytes []byte
 		if dm.config != nil {
+			err = dm.config.emptyFieldsRestore()
+			if err != nil {
+				return err
+			}
+			for _, fn := range mc.stepsConfigFinal {
+				err = fn(ctx, rc, rSrc, rTgt, dm)
+				if err != nil {
+					return err
+				}
+			}
 			dm.config.newDesc = dm.config.oc.GetDescriptor()
 			cBytes, err = dm.config.oc.RawBody()
 			if err != nil {
@@ -338,7 +412,7 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 			}
 			if dm.config.modified {
 				cRdr := bytes.NewReader(cBytes)
-				_, err = rc.BlobPut(ctx, rTgt, dm.config.newDesc, cRdr)
+				_, err = mc.blobPut(ctx, rc, rTgt, dm.config.newDesc, cRdr)
 				if err != nil {
 					return err
 				}
@@ -347,20 +421,20 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 				ociM.Config.Size = dm.config.newDesc.Size
 				changed = true
 			} else if !ref.EqualRepository(rSrc, rTgt) {
-				err = rc.BlobCopy(ctx, rSrc, rTgt, dm.config.oc.GetDescriptor())
+				err = mc.blobCopy(ctx, rc, rSrc, rTgt, dm.config.oc.GetDescriptor())
 				if err != nil {
 					return err
 				}
 			}
 		}
 		if dm.config == nil && ociM.Config.Digest != "" && !ref.EqualRepository(rSrc, rTgt) {
-			err = rc.BlobCopy(ctx, rSrc, rTgt, ociM.Config)
+			err = mc.blobCopy(ctx, rc, rSrc, rTgt, ociM.Config)
 			if err != nil {
 				return err
 			}
 		}
 		// handle config data field
-		if ociM.Config.Size <= mc.maxDataSize || (mc.maxDataSize < 0 && len(ociM.Config.Data) > 0) {
+		if ociM.Config.Size <= maxDataConfig || (maxDataConfig < 0 && len(ociM.Config.Data) > 0) {
 			// if config was not loaded into memory (e.g. artifact), load it now
 			if cBytes == nil {
 				cRdr, err := rc.BlobGet(ctx, rTgt, ociM.Config)
@@ -377,7 +451,7 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 				ociM.Config.Data = cBytes
 				changed = true
 			}
-		} else if mc.maxDataSize >= 0 && ociM.Config.Size > mc.maxDataSize && len(ociM.Config.Data) > 0 {
+		} else if maxDataConfig >= 0 && ociM.Config.Size > maxDataConfig && len(ociM.Config.Data) > 0 {
 			// strip data fields if above max size
 			ociM.Config.Data = []byte{}
 			changed = true
@@ -397,6 +471,18 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 			return err
 		}
 	}
+	if mc.manifestIndent != nil && dm.mod != deleted {
+		mFmt, fmtChanged, err := manifestFormat(dm.m, *mc.manifestIndent)
+		if err != nil {
+			return err
+		}
+		if fmtChanged {
+			dm.m = mFmt
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+		}
+	}
 	// update descriptor and update subject descriptor on all referrers
 	if dm.mod == replaced || dm.mod == added {
 		dm.newDesc = dm.m.GetDescriptor()
@@ -429,6 +515,10 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 			}
 		}
 	}
+	// verify the top manifest digest before it is pushed
+	if dm.top && mc.expectedDigest != "" && dm.m.GetDescriptor().Digest != mc.expectedDigest {
+		return fmt.Errorf("manifest digest mismatch, expected %s, computed %s%.0w", mc.expectedDigest.String(), dm.m.GetDescriptor().Digest.String(), errs.ErrDigestMismatch)
+	}
 	// push manifest
 	if dm.mod == replaced || dm.mod == added || (dm.mod == unchanged && !ref.EqualRepository(rSrc, rTgt)) {
 		mpOpts := []regclient.ManifestOpts{}
@@ -448,7 +538,7 @@ func dagPut(ctx context.Context, rc *regclient.RegClient, mc dagConfig, rSrc, rT
 			// push by tag
 			rPut.Digest = ""
 		}
-		err = rc.ManifestPut(ctx, rPut, dm.m, mpOpts...)
+		err = mc.manifestPut(ctx, rc, rPut, dm.m, mpOpts...)
 		if err != nil {
 			return err
 		}
@@ -492,6 +582,64 @@ func dagWalkOCIConfig(dm *dagManifest, fn func(*dagOCIConfig) (*dagOCIConfig, er
 	return nil
 }
 
+// dagWalkLayersConcurrent runs fn on each layer in the same order as dagWalkLayers, with up to n calls running at once.
+// The first error cancels the context passed to the other calls, and is returned after all running calls complete.
+func dagWalkLayersConcurrent(ctx context.Context, dm *dagManifest, n int, fn func(context.Context, *dagLayer) (*dagLayer, error)) error {
+	type layerEntry struct {
+		dm *dagManifest
+		i  int
+	}
+	entries := []layerEntry{}
+	var list func(dm *dagManifest)
+	list = func(dm *dagManifest) {
+		for _, child := range dm.manifests {
+			list(child)
+		}
+		for i, layer := range dm.layers {
+			if layer.mod != deleted {
+				entries = append(entries, layerEntry{dm: dm, i: i})
+			}
+		}
+	}
+	list(dm)
+
+	ctxWalk, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var errWalk error
+	sem := make(chan struct{}, n)
+	for _, e := range entries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctxWalk.Done():
+		}
+		if ctxWalk.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(e layerEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dl, err := fn(ctxWalk, e.dm.layers[e.i])
+			if err != nil {
+				errOnce.Do(func() {
+					errWalk = err
+					cancel()
+				})
+				return
+			}
+			// each entry updates a different index, so the slices are not shared between goroutines
+			e.dm.layers[e.i] = dl
+		}(e)
+	}
+	wg.Wait()
+	if errWalk != nil {
+		return errWalk
+	}
+	return ctx.Err()
+}
+
 func dagWalkLayers(dm *dagManifest, fn func(*dagLayer) (*dagLayer, error)) error {
 	var err error
 	if dm.manifests != nil {
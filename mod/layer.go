@@ -2,16 +2,24 @@ package mod
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 
 	"github.com/regclient/regclient"
@@ -20,14 +28,267 @@ import (
 	"github.com/regclient/regclient/types/errs"
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
+	v1 "github.com/regclient/regclient/types/oci/v1"
 	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
 
+// WithCanonicalRepack rewrites every layer as a gzip compressed PAX tar with normalized headers.
+// Names are made relative, user and group names, access and change times, and PAX records other than xattrs are removed,
+// and modification times are truncated to the second.
+// Equivalent layers produced by different tools will have the same digest, but the order of entries is not changed.
+// Combine with [WithLayerTimestamp] or [WithFileTimestampFlatten] to also normalize the modification times.
+func WithCanonicalRepack() Opts {
+	compressOpt := WithLayerCompression(archive.CompressGzip)
+	return func(dc *dagConfig, dm *dagManifest) error {
+		err := compressOpt(dc, dm)
+		if err != nil {
+			return err
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			name := strings.TrimLeft(strings.TrimPrefix(th.Name, "./"), "/")
+			if name == "" {
+				// drop the entry for the root directory
+				return th, tr, deleted, nil
+			}
+			if th.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+				name += "/"
+			}
+			thNew := &tar.Header{
+				Typeflag: th.Typeflag,
+				Name:     name,
+				Linkname: th.Linkname,
+				Size:     th.Size,
+				Mode:     th.Mode,
+				Uid:      th.Uid,
+				Gid:      th.Gid,
+				ModTime:  th.ModTime.Truncate(time.Second),
+				Format:   tar.FormatPAX,
+			}
+			if th.Typeflag == tar.TypeLink {
+				thNew.Linkname = strings.TrimLeft(strings.TrimPrefix(th.Linkname, "./"), "/")
+			}
+			if th.Typeflag == tar.TypeChar || th.Typeflag == tar.TypeBlock {
+				thNew.Devmajor = th.Devmajor
+				thNew.Devminor = th.Devminor
+			}
+			for k, v := range th.PAXRecords {
+				if strings.HasPrefix(k, "SCHILY.xattr.") {
+					if thNew.PAXRecords == nil {
+						thNew.PAXRecords = map[string]string{}
+					}
+					thNew.PAXRecords[k] = v
+				}
+			}
+			// always return replaced to rewrite every layer
+			return thNew, tr, replaced, nil
+		})
+		return nil
+	}
+}
+
+// WithInjectCACert adds a new layer with a PEM encoded CA certificate to every image.
+// When destPath is empty or ends with a slash, the file is created in that directory, defaulting to "/etc/ssl/certs/",
+// with the name "ca-<hash>.crt", where hash is the start of the sha256 digest of the certificate.
+// The file has a mode of 0644, root ownership, and a zero unix timestamp, and parent directories are included with a mode of 0755.
+// If bundlePath is not empty, the certificate is also appended to that bundle file when it exists in any layer,
+// e.g. "/etc/ssl/certs/ca-certificates.crt".
+// Tools like update-ca-certificates are not run, so any hashed links or other trust stores in the image are not updated.
+func WithInjectCACert(certPEM []byte, destPath, bundlePath string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		block, _ := pem.Decode(certPEM)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("CA certificate is not a PEM encoded certificate%.0w", errs.ErrParsingFailed)
+		}
+		if !bytes.HasSuffix(certPEM, []byte("\n")) {
+			certPEM = append(append([]byte{}, certPEM...), '\n')
+		}
+		if destPath == "" {
+			destPath = "/etc/ssl/certs/"
+		}
+		destPath = filepath.ToSlash(destPath)
+		if strings.HasSuffix(destPath, "/") {
+			destPath = path.Join(destPath, fmt.Sprintf("ca-%s.crt", digest.SHA256.FromBytes(certPEM).Encoded()[:12]))
+		}
+		destPath = tarNameClean(destPath)
+		if destPath == "" {
+			return fmt.Errorf("CA certificate path must not be the root directory")
+		}
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		dirs := []string{}
+		for cur := path.Dir(destPath); cur != "."; cur = path.Dir(cur) {
+			dirs = append([]string{cur}, dirs...)
+		}
+		for _, dir := range dirs {
+			err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  time.Unix(0, 0),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     destPath,
+			Size:     int64(len(certPEM)),
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(certPEM); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if bundlePath != "" {
+			bundleOpt := fileContentEdit(bundlePath, false, func(orig []byte) []byte {
+				buf := make([]byte, 0, len(orig)+len(certPEM)+1)
+				buf = append(buf, orig...)
+				if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+					buf = append(buf, '\n')
+				}
+				return append(buf, certPEM...)
+			})
+			if err := bundleOpt(dc, dm); err != nil {
+				return err
+			}
+		}
+		return WithLayerAddTar(buf, "", nil)(dc, dm)
+	}
+}
+
+// WithLayerAddArchive appends a new layer to every image from a tar file that may be uncompressed, gzip, or zstd compressed.
+// The file is pushed without recompressing, and the media type is selected from the detected compression.
+// The file must contain a valid tar after decompression.
+func WithLayerAddArchive(filename string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		var ucDig digest.Digest
+		var comp archive.CompressType
+		desc := descriptor.Descriptor{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
+				return nil
+			}
+			// push the layer once, then save descriptor for other manifests
+			if ucDig == "" {
+				fh, err := os.Open(filename)
+				if err != nil {
+					return fmt.Errorf("failed to open %s: %w", filename, err)
+				}
+				defer fh.Close()
+				head := make([]byte, 10)
+				n, err := io.ReadFull(fh, head)
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return fmt.Errorf("failed to read %s: %w", filename, err)
+				}
+				comp = archive.DetectCompression(head[:n])
+				switch comp {
+				case archive.CompressNone, archive.CompressGzip, archive.CompressZstd:
+				default:
+					return fmt.Errorf("unsupported compression %s for %s%.0w", comp.String(), filename, errs.ErrUnsupportedMediaType)
+				}
+				err = desc.DigestAlgoPrefer(dm.m.GetDescriptor().DigestAlgo())
+				if err != nil {
+					return fmt.Errorf("failed to configure digest algorithm for new layer: %w", err)
+				}
+				// validate the tar and compute the uncompressed digest
+				_, err = fh.Seek(0, io.SeekStart)
+				if err != nil {
+					return err
+				}
+				dr, err := archive.Decompress(fh)
+				if err != nil {
+					return fmt.Errorf("failed to decompress %s: %w", filename, err)
+				}
+				digUC := desc.DigestAlgo().Digester()
+				tr := tar.NewReader(io.TeeReader(dr, digUC.Hash()))
+				for {
+					_, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						return fmt.Errorf("failed to read tar from %s: %w", filename, err)
+					}
+				}
+				// include any trailing padding in the digest
+				_, err = io.Copy(digUC.Hash(), dr)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", filename, err)
+				}
+				// push the file as is
+				_, err = fh.Seek(0, io.SeekStart)
+				if err != nil {
+					return err
+				}
+				descPut, err := dc.blobPut(ctx, rc, rTgt, desc, fh)
+				if err != nil {
+					return fmt.Errorf("failed to push layer to %s: %w", rTgt.CommonName(), err)
+				}
+				ucDig = digUC.Digest()
+				desc.Digest = descPut.Digest
+				desc.Size = descPut.Size
+			}
+			// set the media type based on the manifest
+			descLayer := desc
+			docker := false
+			switch dm.m.GetDescriptor().MediaType {
+			case mediatype.Docker2Manifest, mediatype.Docker2ManifestList:
+				docker = true
+			}
+			switch comp {
+			case archive.CompressGzip:
+				descLayer.MediaType = mediatype.OCI1LayerGzip
+				if docker {
+					descLayer.MediaType = mediatype.Docker2LayerGzip
+				}
+			case archive.CompressZstd:
+				descLayer.MediaType = mediatype.OCI1LayerZstd
+				if docker {
+					descLayer.MediaType = mediatype.Docker2LayerZstd
+				}
+			default:
+				descLayer.MediaType = mediatype.OCI1Layer
+				if docker {
+					descLayer.MediaType = mediatype.Docker2Layer
+				}
+			}
+			// add the layer to the dag
+			dm.layers = append(dm.layers, &dagLayer{
+				mod:      added,
+				desc:     descLayer,
+				ucDigest: ucDig,
+				rSrc:     rTgt,
+			})
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithLayerAddTar appends a new layer to the image based on a tar input stream.
 // If media type (mt) is not defined, it will default to Gzip and match Docker or OCI based on the manifest media type.
 // If the platform slice is empty, the layer is added to all platforms.
 func WithLayerAddTar(rdr io.Reader, mt string, platforms []platform.Platform) Opts {
+	return layerAddTar(rdr, mt, platforms, "", nil)
+}
+
+// WithLayerAddTarCreatedBy appends a new layer to every platform from a tar input stream.
+// The config history entry for the layer is set with the createdBy value.
+// Media type (mt) defaults the same as [WithLayerAddTar].
+func WithLayerAddTarCreatedBy(rdr io.Reader, mt string, createdBy string) Opts {
+	return layerAddTar(rdr, mt, nil, createdBy, nil)
+}
+
+// layerAddTar appends a layer to each image matching the platforms, and the match func when it is not nil.
+func layerAddTar(rdr io.Reader, mt string, platforms []platform.Platform, createdBy string, match func(*dagManifest) bool) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		if mt == "" {
 			switch dm.m.GetDescriptor().MediaType {
@@ -70,6 +331,9 @@ func WithLayerAddTar(rdr io.Reader, mt string, platforms []platform.Platform) Op
 					return nil
 				}
 			}
+			if match != nil && !match(dm) {
+				return nil
+			}
 			// push the layer once, then save descriptor for other manifests
 			if ucDig == "" {
 				err := desc.DigestAlgoPrefer(dm.m.GetDescriptor().DigestAlgo())
@@ -78,11 +342,11 @@ func WithLayerAddTar(rdr io.Reader, mt string, platforms []platform.Platform) Op
 				}
 				digUC := desc.DigestAlgo().Digester() // uncompressed digest
 				ucDigRdr := io.TeeReader(rdr, digUC.Hash())
-				cRdr, err := archive.Compress(ucDigRdr, comp)
+				cRdr, err := dc.compress(ucDigRdr, comp)
 				if err != nil {
 					return fmt.Errorf("failed to compress layer with %s: %w", comp.String(), err)
 				}
-				descPut, err := rc.BlobPut(ctx, rTgt, desc, cRdr)
+				descPut, err := dc.blobPut(ctx, rc, rTgt, desc, cRdr)
 				_ = cRdr.Close()
 				if err != nil {
 					return fmt.Errorf("failed to push layer to %s: %w", rTgt.CommonName(), err)
@@ -93,9 +357,11 @@ func WithLayerAddTar(rdr io.Reader, mt string, platforms []platform.Platform) Op
 			}
 			// add the layer to the dag
 			dm.layers = append(dm.layers, &dagLayer{
-				mod:      added,
-				desc:     desc,
-				ucDigest: ucDig,
+				mod:       added,
+				desc:      desc,
+				ucDigest:  ucDig,
+				rSrc:      rTgt,
+				createdBy: createdBy,
 			})
 			return nil
 		})
@@ -119,6 +385,7 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 			if dl.newDesc.MediaType != "" {
 				desc = dl.newDesc
 			}
+			origDesc := desc
 			desc.Size = 0
 			err := desc.DigestAlgoPrefer(desc.DigestAlgo())
 			if err != nil {
@@ -146,13 +413,15 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 					_ = rdr.Close()
 					return nil, err
 				}
-				ucDigRdr := io.TeeReader(ucRdr, digUC.Hash())
-				cRdr, err := archive.Compress(ucDigRdr, algo)
+				ucCount := &countWriter{}
+				ucDigRdr := io.TeeReader(ucRdr, io.MultiWriter(digUC.Hash(), ucCount))
+				cRdr, err := dc.gzipCompress(ucDigRdr)
 				if err != nil {
 					_ = rdr.Close()
 					return nil, err
 				}
-				digRdr := io.TeeReader(cRdr, digRaw.Hash())
+				cCount := &countWriter{}
+				digRdr := io.TeeReader(cRdr, io.MultiWriter(digRaw.Hash(), cCount))
 				return readCloserFn{
 					Reader: digRdr,
 					closeFn: func() error {
@@ -163,6 +432,7 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 						_ = cRdr.Close()
 						dl.newDesc.Digest = digRaw.Digest()
 						dl.ucDigest = digUC.Digest()
+						dc.layerCompressionReportAdd(origDesc, dl.newDesc, cCount.n, ucCount.n)
 						return nil
 					}}, nil
 
@@ -186,13 +456,15 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 					_ = rdr.Close()
 					return nil, err
 				}
-				ucDigRdr := io.TeeReader(ucRdr, digUC.Hash())
-				cRdr, err := archive.Compress(ucDigRdr, algo)
+				ucCount := &countWriter{}
+				ucDigRdr := io.TeeReader(ucRdr, io.MultiWriter(digUC.Hash(), ucCount))
+				cRdr, err := dc.zstdCompress(ucDigRdr)
 				if err != nil {
 					_ = rdr.Close()
 					return nil, err
 				}
-				digRdr := io.TeeReader(cRdr, digRaw.Hash())
+				cCount := &countWriter{}
+				digRdr := io.TeeReader(cRdr, io.MultiWriter(digRaw.Hash(), cCount))
 				return readCloserFn{
 					Reader: digRdr,
 					closeFn: func() error {
@@ -203,6 +475,7 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 						_ = cRdr.Close()
 						dl.newDesc.Digest = digRaw.Digest()
 						dl.ucDigest = digUC.Digest()
+						dc.layerCompressionReportAdd(origDesc, dl.newDesc, cCount.n, ucCount.n)
 						return nil
 					}}, nil
 
@@ -225,7 +498,8 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 					_ = rdr.Close()
 					return nil, err
 				}
-				digRdr := io.TeeReader(ucRdr, dig.Hash())
+				ucCount := &countWriter{}
+				digRdr := io.TeeReader(ucRdr, io.MultiWriter(dig.Hash(), ucCount))
 				return readCloserFn{
 					Reader: digRdr,
 					closeFn: func() error {
@@ -235,6 +509,7 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 						}
 						dl.newDesc.Digest = dig.Digest()
 						dl.ucDigest = dig.Digest()
+						dc.layerCompressionReportAdd(origDesc, dl.newDesc, ucCount.n, ucCount.n)
 						return nil
 					}}, nil
 
@@ -246,6 +521,52 @@ func WithLayerCompression(algo archive.CompressType) Opts {
 	}
 }
 
+// LayerCompressionReport summarizes the layers changed by [WithLayerCompression].
+type LayerCompressionReport struct {
+	Layers           []LayerCompressionEntry // list of changed layers
+	Size             int64                   // total compressed size of the changed layers before the change
+	NewSize          int64                   // total compressed size of the changed layers after the change
+	UncompressedSize int64                   // total uncompressed size of the changed layers
+}
+
+// LayerCompressionEntry describes a single layer changed by [WithLayerCompression].
+type LayerCompressionEntry struct {
+	Desc             descriptor.Descriptor // original layer descriptor
+	NewDesc          descriptor.Descriptor // layer descriptor after the change
+	UncompressedSize int64                 // size of the uncompressed layer
+}
+
+// WithLayerCompressionReport calls fn with a summary of the layers changed by [WithLayerCompression].
+// The report is generated after all layers have been processed, before the manifests are pushed.
+func WithLayerCompressionReport(fn func(LayerCompressionReport)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.layerCompressionReport = &LayerCompressionReport{
+			Layers: []LayerCompressionEntry{},
+		}
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			fn(*dc.layerCompressionReport)
+			return nil
+		})
+		return nil
+	}
+}
+
+func (dc *dagConfig) layerCompressionReportAdd(desc, newDesc descriptor.Descriptor, size, ucSize int64) {
+	if dc.layerCompressionReport == nil {
+		return
+	}
+	defer dc.lock(dc.muReport)()
+	newDesc.Size = size
+	dc.layerCompressionReport.Layers = append(dc.layerCompressionReport.Layers, LayerCompressionEntry{
+		Desc:             desc,
+		NewDesc:          newDesc,
+		UncompressedSize: ucSize,
+	})
+	dc.layerCompressionReport.Size += desc.Size
+	dc.layerCompressionReport.NewSize += size
+	dc.layerCompressionReport.UncompressedSize += ucSize
+}
+
 // WithLayerDigestAlgo changes the digester algorithm.
 func WithLayerDigestAlgo(algo digest.Algorithm) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -317,8 +638,100 @@ func WithLayerDigestAlgo(algo digest.Algorithm) Opts {
 	}
 }
 
+// WithLayerDoubleCompressionRepair fixes gzip layers that were compressed twice.
+// A layer is repaired when the decompressed content starts with the gzip magic bytes,
+// and the inner gzip stream is kept as the layer, with the digest and diff_id recomputed.
+// Other layers are not changed.
+func WithLayerDoubleCompressionRepair() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayer = append(dc.stepsLayer, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, rdr io.ReadCloser) (io.ReadCloser, error) {
+			if dl.mod == deleted {
+				return rdr, nil
+			}
+			desc := dl.desc
+			if dl.newDesc.MediaType != "" {
+				desc = dl.newDesc
+			}
+			if desc.MediaType != mediatype.OCI1LayerGzip && desc.MediaType != mediatype.Docker2LayerGzip {
+				return rdr, nil
+			}
+			// record the raw content read while checking for the magic bytes, to restore the original stream
+			pw := &peekWriter{}
+			orig := readCloserFn{Reader: io.MultiReader(&pw.buf, rdr), closeFn: rdr.Close}
+			gr, err := gzip.NewReader(io.TeeReader(rdr, pw))
+			if err != nil {
+				pw.stop = true
+				return orig, nil
+			}
+			magic := make([]byte, 2)
+			_, err = io.ReadFull(gr, magic)
+			pw.stop = true
+			if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+				return orig, nil
+			}
+			pw.buf.Reset()
+			if dl.mod == unchanged {
+				dl.mod = replaced
+			}
+			desc.Digest = ""
+			desc.Size = 0
+			err = desc.DigestAlgoPrefer(desc.DigestAlgo())
+			if err != nil {
+				_ = rdr.Close()
+				return nil, fmt.Errorf("failed to configure digest algorithm for repairing layer: %w", err)
+			}
+			dl.newDesc = desc
+			digRaw := desc.DigestAlgo().Digester() // raw/compressed digest
+			digUC := desc.DigestAlgo().Digester()  // uncompressed digest
+			// the uncompressed digest is computed from a copy of the inner gzip stream
+			ucR, ucW := io.Pipe()
+			ucDone := make(chan error, 1)
+			go func() {
+				ucRdr, err := gzip.NewReader(ucR)
+				if err == nil {
+					_, err = io.Copy(digUC.Hash(), ucRdr)
+				}
+				// drain the pipe so the writer is never blocked
+				_, _ = io.Copy(io.Discard, ucR)
+				// closing the channel allows the reader to be closed more than once
+				ucDone <- err
+				close(ucDone)
+			}()
+			innerRdr := io.MultiReader(bytes.NewReader(magic), gr)
+			return readCloserFn{
+				Reader: io.TeeReader(innerRdr, io.MultiWriter(digRaw.Hash(), ucW)),
+				closeFn: func() error {
+					_ = ucW.Close()
+					errUC := <-ucDone
+					err := rdr.Close()
+					if err != nil {
+						return err
+					}
+					if errUC != nil {
+						return fmt.Errorf("failed to decompress repaired layer: %w", errUC)
+					}
+					dl.newDesc.Digest = digRaw.Digest()
+					dl.ucDigest = digUC.Digest()
+					return nil
+				}}, nil
+		})
+		return nil
+	}
+}
+
+// reproducibleXattrs are extended attributes that vary by build host and are removed by [WithLayerReproducible].
+var reproducibleXattrs = []string{
+	"com.apple.lastuseddate#PS",
+	"com.apple.provenance",
+	"com.apple.quarantine",
+	"security.selinux",
+}
+
 // WithLayerReproducible modifies the layer with reproducible options.
-// This currently configures users and groups with numeric ids.
+// This clears the user and group names leaving the numeric ids, zeros the access and change times,
+// zeros the device numbers on entries other than character and block devices,
+// and removes host specific extended attributes (macOS quarantine and provenance, and SELinux labels).
+// Modification times are not changed, combine this with [WithLayerTimestamp] or [WithFileTimestampFlatten] for that.
 func WithLayerReproducible() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsLayerFile = append(dc.stepsLayerFile,
@@ -332,6 +745,30 @@ func WithLayerReproducible() Opts {
 					th.Gname = ""
 					changed = true
 				}
+				if !th.AccessTime.IsZero() || !th.ChangeTime.IsZero() {
+					th.AccessTime = time.Time{}
+					th.ChangeTime = time.Time{}
+					delete(th.PAXRecords, "atime")
+					delete(th.PAXRecords, "ctime")
+					changed = true
+				}
+				if th.Typeflag != tar.TypeChar && th.Typeflag != tar.TypeBlock && (th.Devmajor != 0 || th.Devminor != 0) {
+					th.Devmajor = 0
+					th.Devminor = 0
+					changed = true
+				}
+				//lint:ignore SA1019 the tar reader populates the deprecated Xattrs field and the writer includes it
+				xattrs := th.Xattrs
+				for _, x := range reproducibleXattrs {
+					if _, ok := xattrs[x]; ok {
+						delete(xattrs, x)
+						changed = true
+					}
+					if _, ok := th.PAXRecords["SCHILY.xattr."+x]; ok {
+						delete(th.PAXRecords, "SCHILY.xattr."+x)
+						changed = true
+					}
+				}
 				if changed {
 					return th, tr, replaced, nil
 				}
@@ -343,6 +780,8 @@ func WithLayerReproducible() Opts {
 
 // WithLayerRmCreatedBy deletes a layer based on a regex of the created by field
 // in the config history for that layer.
+// The layer, diff_id, and history entry are removed together,
+// and ErrMismatch is returned if the history does not align with the layers.
 func WithLayerRmCreatedBy(re regexp.Regexp) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsManifest = append(dc.stepsManifest, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
@@ -364,6 +803,16 @@ func WithLayerRmCreatedBy(re regexp.Regexp) Opts {
 				}
 				i++
 			}
+			// verify the history can be aligned with the layers
+			origLayers := 0
+			for _, dl := range dm.layers {
+				if dl.mod != added {
+					origLayers++
+				}
+			}
+			if i != origLayers || (oc.RootFS.DiffIDs != nil && i != len(oc.RootFS.DiffIDs)) {
+				return fmt.Errorf("config history has %d layers, manifest has %d layers, and config has %d diff_ids%.0w", i, origLayers, len(oc.RootFS.DiffIDs), errs.ErrMismatch)
+			}
 			if len(delLayers) == 0 {
 				return fmt.Errorf("no layers match expression: %s", re.String())
 			}
@@ -425,65 +874,617 @@ func WithLayerRmIndex(index int) Opts {
 	}
 }
 
-// WithLayerStripFile removes a file from within the layer tar.
-func WithLayerStripFile(file string) Opts {
-	file = strings.Trim(filepath.ToSlash(file), "/")
-	fileRE := regexp.MustCompile("^/?" + regexp.QuoteMeta(file) + "(/.*)?$")
+// WithLayerSplitBySize splits each layer with a compressed size above maxBytes into multiple layers that are each within the limit.
+// Layers are split between tar entries so every new layer is a valid tar,
+// and ErrSizeLimitExceeded is returned when a single entry does not fit within the limit.
+// The new layers keep the media type, and each has a copy of the created time and created by from the original history entry.
+// The size is checked before other changes to the layers.
+func WithLayerSplitBySize(maxBytes int64) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
-		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
-			if fileRE.MatchString(th.Name) {
-				return th, tr, deleted, nil
+		if maxBytes <= 0 {
+			return fmt.Errorf("layer size limit %d must be positive%.0w", maxBytes, errs.ErrUnsupported)
+		}
+		// layers shared between platforms are only split once
+		splits := map[digest.Digest][]*dagLayer{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
+				return nil
 			}
-			return th, tr, unchanged, nil
+			history := []v1.History{}
+			if dm.config != nil && dm.config.oc != nil {
+				for _, h := range dm.config.oc.GetConfig().History {
+					if !h.EmptyLayer {
+						history = append(history, h)
+					}
+				}
+			}
+			newLayers := make([]*dagLayer, 0, len(dm.layers))
+			iOrig := -1
+			for _, dl := range dm.layers {
+				if dl.mod != added {
+					iOrig++
+				}
+				if dl.mod == added || dl.mod == deleted || dl.desc.Size <= maxBytes || len(dl.desc.URLs) > 0 {
+					newLayers = append(newLayers, dl)
+					continue
+				}
+				if !inListStr(dl.desc.MediaType, mtKnownTar) {
+					return fmt.Errorf("unable to split layer %s with media type %s%.0w", dl.desc.Digest.String(), dl.desc.MediaType, errs.ErrUnsupportedMediaType)
+				}
+				chunks, ok := splits[dl.desc.Digest]
+				if !ok {
+					var err error
+					chunks, err = dc.layerSplit(ctx, rc, rSrc, rTgt, dl, maxBytes)
+					if err != nil {
+						return err
+					}
+					splits[dl.desc.Digest] = chunks
+				}
+				// the new layers are added before the deleted original to keep the history aligned
+				for _, chunk := range chunks {
+					dlChunk := &dagLayer{
+						mod:      added,
+						desc:     chunk.desc,
+						ucDigest: chunk.ucDigest,
+						rSrc:     rTgt,
+					}
+					if iOrig < len(history) {
+						if history[iOrig].Created != nil {
+							dlChunk.created = *history[iOrig].Created
+						}
+						dlChunk.createdBy = history[iOrig].CreatedBy
+					}
+					newLayers = append(newLayers, dlChunk)
+				}
+				dl.mod = deleted
+				newLayers = append(newLayers, dl)
+			}
+			dm.layers = newLayers
+			return nil
 		})
 		return nil
 	}
 }
 
-// WithLayerTimestamp sets the timestamp on files in the layers based on options.
-func WithLayerTimestamp(optTime OptTime) Opts {
-	return func(dc *dagConfig, dm *dagManifest) error {
-		if optTime.Set.IsZero() && optTime.FromLabel == "" {
-			return fmt.Errorf("WithLayerTimestamp requires a time to set")
+// layerSplit divides a layer into new layers that are pushed to rTgt, each with a compressed size no larger than maxBytes.
+// The uncompressed tar is saved with the offset of each entry, and entries are added to a chunk until the compressed size exceeds the limit.
+func (dc *dagConfig) layerSplit(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, maxBytes int64) ([]*dagLayer, error) {
+	r := rSrc
+	if dl.rSrc.IsSet() {
+		r = dl.rSrc
+	}
+	br, err := rc.BlobGet(ctx, r, dl.desc)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	dr, err := archive.Decompress(br)
+	if err != nil {
+		return nil, err
+	}
+	ucBuf := dc.spillBuffer()
+	defer ucBuf.Close()
+	type splitEntry struct {
+		name       string
+		start, end int64
+	}
+	entries := []splitEntry{}
+	tr := tar.NewReader(io.TeeReader(dr, ucBuf))
+	var start int64
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
 		}
-		baseProcessed := false
-		baseDigests := map[digest.Digest]bool{}
-		// add base layers by count
-		if optTime.BaseLayers > 0 {
-			dl, err := layerGetBaseCount(optTime.BaseLayers, dm)
-			if err != nil {
-				return fmt.Errorf("failed to get base layers: %w", err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", dl.desc.Digest.String(), err)
+		}
+		_, err = io.Copy(io.Discard, tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", dl.desc.Digest.String(), err)
+		}
+		// entries are padded to the tar block size
+		end := (ucBuf.Size() + 511) / 512 * 512
+		entries = append(entries, splitEntry{name: th.Name, start: start, end: end})
+		start = end
+	}
+	ra := ucBuf.ReaderAt()
+	// find the chunks by compressing each entry, starting a new chunk when the limit is exceeded
+	comp := layerCompressType(dl.desc.MediaType)
+	type splitChunk struct {
+		start, end int64
+	}
+	chunks := []splitChunk{}
+	var cw *countWriter
+	var w io.Writer
+	var flush func() error
+	var closeFn func()
+	measureStart := func() error {
+		cw = &countWriter{}
+		switch comp {
+		case archive.CompressGzip:
+			gw := dc.gzipWriter(cw)
+			w, flush = gw, gw.Flush
+			closeFn = func() {
+				_ = gw.Close()
+				gzipWriterPool.Put(gw)
 			}
-			for _, d := range dl {
-				baseDigests[d] = true
+		case archive.CompressZstd:
+			zw, err := zstd.NewWriter(cw, dc.zstdEncoderOpts()...)
+			if err != nil {
+				return err
 			}
+			w, flush = zw, zw.Flush
+			closeFn = func() { _ = zw.Close() }
+		default:
+			w = cw
+			flush = func() error { return nil }
+			closeFn = func() {}
 		}
-		if optTime.FromLabel != "" {
-			dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
-				oc := doc.oc.GetConfig()
-				tl, ok := oc.Config.Labels[optTime.FromLabel]
-				if !ok {
-					return fmt.Errorf("label not found: %s", optTime.FromLabel)
-				}
-				tNew, err := time.Parse(time.RFC3339, tl)
-				if err != nil {
-					// TODO: add fallbacks
-					return fmt.Errorf("could not parse time %s from %s: %w", tl, optTime.FromLabel, err)
-				}
-				if !optTime.Set.IsZero() && !optTime.Set.Equal(tNew) {
-					return fmt.Errorf("conflicting time labels found %s and %s", optTime.Set.String(), tNew.String())
-				}
-				optTime.Set = tNew
-				return nil
-			})
+		return nil
+	}
+	err = measureStart()
+	if err != nil {
+		return nil, err
+	}
+	cur := splitChunk{}
+	for i := 0; i < len(entries); {
+		e := entries[i]
+		_, err = io.Copy(w, io.NewSectionReader(ra, e.start, e.end-e.start))
+		if err == nil {
+			err = flush()
 		}
-		dc.stepsLayerFile = append(dc.stepsLayerFile,
-			func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
-				if optTime.Set.IsZero() {
-					return nil, nil, unchanged, fmt.Errorf("timestamp not available")
-				}
-				// for base ref, lookup all digests from base image to exclude
-				if !baseProcessed {
+		if err != nil {
+			closeFn()
+			return nil, err
+		}
+		if cw.n > maxBytes {
+			closeFn()
+			if cur.end == cur.start {
+				return nil, fmt.Errorf("entry %s in layer %s does not fit within the size limit %d%.0w", e.name, dl.desc.Digest.String(), maxBytes, errs.ErrSizeLimitExceeded)
+			}
+			// retry the entry in a new chunk
+			chunks = append(chunks, cur)
+			cur = splitChunk{start: e.start, end: e.start}
+			err = measureStart()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cur.end = e.end
+		i++
+	}
+	closeFn()
+	chunks = append(chunks, cur)
+	// push each chunk as a new layer
+	layers := make([]*dagLayer, 0, len(chunks))
+	for _, chunk := range chunks {
+		desc := descriptor.Descriptor{MediaType: dl.desc.MediaType}
+		err = desc.DigestAlgoPrefer(dl.desc.DigestAlgo())
+		if err != nil {
+			return nil, err
+		}
+		digUC := desc.DigestAlgo().Digester()
+		// each chunk ends with the two empty blocks that mark the end of a tar
+		ucRdr := io.TeeReader(io.MultiReader(
+			io.NewSectionReader(ra, chunk.start, chunk.end-chunk.start),
+			bytes.NewReader(make([]byte, 1024)),
+		), digUC.Hash())
+		cRdr, err := dc.compress(ucRdr, comp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress layer with %s: %w", comp.String(), err)
+		}
+		descPut, err := dc.blobPut(ctx, rc, rTgt, desc, cRdr)
+		_ = cRdr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to push layer to %s: %w", rTgt.CommonName(), err)
+		}
+		if descPut.Size > maxBytes {
+			return nil, fmt.Errorf("split layer %s has size %d above the limit %d%.0w", descPut.Digest.String(), descPut.Size, maxBytes, errs.ErrSizeLimitExceeded)
+		}
+		desc.Digest = descPut.Digest
+		desc.Size = descPut.Size
+		layers = append(layers, &dagLayer{
+			mod:      added,
+			desc:     desc,
+			ucDigest: digUC.Digest(),
+			rSrc:     rTgt,
+		})
+	}
+	return layers, nil
+}
+
+// WithLayerSquash merges a contiguous range of layers into a single layer. The index starts at 0.
+// Layers from index from through index to are merged, and a negative to merges through the last layer.
+// Later layers override earlier layers and whiteouts are applied, so the merged layer has the same filesystem as the stacked layers.
+// Whiteouts that hide content below the range are kept, and are dropped when the range starts with the first layer.
+// The diff_ids and history entries of the range are replaced by a single entry for the new layer.
+// Layers added by other options are not included in the index.
+func WithLayerSquash(from, to int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if from < 0 || (to >= 0 && to < from) {
+			return fmt.Errorf("invalid layer range %d to %d%.0w", from, to, errs.ErrUnsupported)
+		}
+		// layers shared between platforms are only squashed once
+		squashed := map[string]*dagLayer{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
+				return nil
+			}
+			origIdx := []int{}
+			for i, dl := range dm.layers {
+				if dl.mod != added {
+					origIdx = append(origIdx, i)
+				}
+			}
+			last := to
+			if last < 0 {
+				last = len(origIdx) - 1
+			}
+			if last >= len(origIdx) {
+				return fmt.Errorf("layer %d not found, image has %d layers%.0w", last, len(origIdx), errs.ErrNotFound)
+			}
+			if from >= last {
+				return nil
+			}
+			layers := []*dagLayer{}
+			key := ""
+			for _, i := range origIdx[from : last+1] {
+				dl := dm.layers[i]
+				if dl.mod == deleted {
+					continue
+				}
+				if len(dl.desc.URLs) > 0 || !inListStr(dl.desc.MediaType, mtKnownTar) {
+					return fmt.Errorf("unable to squash layer %s with media type %s%.0w", dl.desc.Digest.String(), dl.desc.MediaType, errs.ErrUnsupportedMediaType)
+				}
+				layers = append(layers, dl)
+				key += dl.desc.Digest.String() + ","
+			}
+			if len(layers) < 2 {
+				return nil
+			}
+			squash, ok := squashed[key]
+			if !ok {
+				var err error
+				squash, err = dc.layerSquash(ctx, rc, rSrc, rTgt, layers, from > 0)
+				if err != nil {
+					return err
+				}
+				squashed[key] = squash
+			}
+			for _, dl := range layers {
+				dl.mod = deleted
+			}
+			// insert the squashed layer before the range
+			pos := origIdx[from]
+			newLayers := make([]*dagLayer, 0, len(dm.layers)+1)
+			newLayers = append(newLayers, dm.layers[:pos]...)
+			newLayers = append(newLayers, &dagLayer{
+				mod:      added,
+				desc:     squash.desc,
+				ucDigest: squash.ucDigest,
+				rSrc:     rTgt,
+			})
+			dm.layers = append(newLayers, dm.layers[pos:]...)
+			return nil
+		})
+		return nil
+	}
+}
+
+// layerSquash merges the content of layers into a new layer that is pushed to rTgt.
+// The first pass finds the last entry for each path that is not removed by a later whiteout,
+// and the second pass copies those entries into the new layer.
+// With keepWhiteouts, whiteouts and opaque directories that apply to lower layers are added to the new layer.
+func (dc *dagConfig) layerSquash(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, layers []*dagLayer, keepWhiteouts bool) (*dagLayer, error) {
+	type squashEntry struct {
+		layer int
+		ord   int
+		dir   bool
+	}
+	entries := map[string]squashEntry{}
+	whiteouts := map[string]bool{}
+	opaque := map[string]bool{}
+	parentName := func(name string) string {
+		parent := path.Dir(name)
+		if parent == "." {
+			return ""
+		}
+		return parent
+	}
+	rmUnder := func(dir string) {
+		for _, m := range []map[string]bool{whiteouts, opaque} {
+			for name := range m {
+				if (dir == "" && name != "") || strings.HasPrefix(name, dir+"/") {
+					delete(m, name)
+				}
+			}
+		}
+		for name := range entries {
+			if (dir == "" && name != "") || strings.HasPrefix(name, dir+"/") {
+				delete(entries, name)
+			}
+		}
+	}
+	layerRead := func(dl *dagLayer, fn func(ord int, th *tar.Header, tr io.Reader) error) error {
+		r := rSrc
+		if dl.rSrc.IsSet() {
+			r = dl.rSrc
+		}
+		br, err := rc.BlobGet(ctx, r, dl.desc)
+		if err != nil {
+			return err
+		}
+		defer br.Close()
+		dr, err := archive.Decompress(br)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(dr)
+		for ord := 0; ; ord++ {
+			th, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = fn(ord, th, tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// first pass, apply each layer to the entries
+	for i, dl := range layers {
+		headers := []*tar.Header{}
+		err := layerRead(dl, func(ord int, th *tar.Header, tr io.Reader) error {
+			headers = append(headers, th)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", dl.desc.Digest.String(), err)
+		}
+		// whiteouts only apply to lower layers
+		for _, th := range headers {
+			name := tarNameClean(th.Name)
+			base := path.Base(name)
+			if base == ".wh..wh..opq" {
+				dir := parentName(name)
+				rmUnder(dir)
+				if keepWhiteouts {
+					opaque[dir] = true
+				}
+			} else if strings.HasPrefix(base, ".wh.") {
+				target := path.Join(parentName(name), strings.TrimPrefix(base, ".wh."))
+				delete(entries, target)
+				delete(opaque, target)
+				rmUnder(target)
+				if keepWhiteouts {
+					whiteouts[target] = true
+				}
+			}
+		}
+		for ord, th := range headers {
+			name := tarNameClean(th.Name)
+			if strings.HasPrefix(path.Base(name), ".wh.") {
+				continue
+			}
+			isDir := th.Typeflag == tar.TypeDir
+			// a file replacing a directory hides the directory contents
+			if prev, ok := entries[name]; ok && prev.dir && !isDir {
+				rmUnder(name)
+			}
+			entries[name] = squashEntry{layer: i, ord: ord, dir: isDir}
+			if whiteouts[name] {
+				// a recreated directory must still hide the content below the range
+				delete(whiteouts, name)
+				if isDir {
+					opaque[name] = true
+				}
+			}
+		}
+	}
+	// second pass, copy the remaining entries to the new layer
+	desc := descriptor.Descriptor{MediaType: layers[0].desc.MediaType}
+	err := desc.DigestAlgoPrefer(layers[0].desc.DigestAlgo())
+	if err != nil {
+		return nil, err
+	}
+	fh := dc.spillBuffer()
+	defer fh.Close()
+	digUC := desc.DigestAlgo().Digester()
+	tw := tar.NewWriter(io.MultiWriter(fh, digUC.Hash()))
+	for i, dl := range layers {
+		err := layerRead(dl, func(ord int, th *tar.Header, tr io.Reader) error {
+			e, ok := entries[tarNameClean(th.Name)]
+			if !ok || e.layer != i || e.ord != ord {
+				return nil
+			}
+			err := tw.WriteHeader(th)
+			if err != nil {
+				return err
+			}
+			if th.Typeflag == tar.TypeReg && th.Size > 0 {
+				_, err = io.CopyN(tw, tr, th.Size)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to squash layer %s: %w", dl.desc.Digest.String(), err)
+		}
+	}
+	whNames := []string{}
+	for name := range whiteouts {
+		whNames = append(whNames, path.Join(parentName(name), ".wh."+path.Base(name)))
+	}
+	for name := range opaque {
+		whNames = append(whNames, path.Join(name, ".wh..wh..opq"))
+	}
+	sort.Strings(whNames)
+	for _, name := range whNames {
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	// compress and push the new layer
+	comp := layerCompressType(desc.MediaType)
+	fhRdr, err := fh.Reader()
+	if err != nil {
+		return nil, err
+	}
+	cRdr, err := dc.compress(fhRdr, comp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress layer with %s: %w", comp.String(), err)
+	}
+	descPut, err := dc.blobPut(ctx, rc, rTgt, desc, cRdr)
+	_ = cRdr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to push layer to %s: %w", rTgt.CommonName(), err)
+	}
+	desc.Digest = descPut.Digest
+	desc.Size = descPut.Size
+	return &dagLayer{
+		mod:      added,
+		desc:     desc,
+		ucDigest: digUC.Digest(),
+		rSrc:     rTgt,
+	}, nil
+}
+
+// WithSquashValidate verifies the config of each image after all layers are squashed with [WithLayerSquash].
+// The config must have exactly one diff_id matching the uncompressed digest of the only layer, and one history entry that is not an empty layer.
+// The check runs before the config and manifest are pushed, returning an error if the config is invalid.
+// Referrers are not squashed and are not checked.
+func WithSquashValidate() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		// track the images visited by the manifest steps, excluding referrers
+		images := map[*dagManifest]bool{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			images[dm] = true
+			return nil
+		})
+		dc.stepsConfigFinal = append(dc.stepsConfigFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if !images[dm] || dm.mod == deleted || dm.m.IsList() || dm.config == nil {
+				return nil
+			}
+			layers := []*dagLayer{}
+			for _, dl := range dm.layers {
+				if dl.mod != deleted {
+					layers = append(layers, dl)
+				}
+			}
+			oc := dm.config.oc.GetConfig()
+			histLayers := 0
+			for _, h := range oc.History {
+				if !h.EmptyLayer {
+					histLayers++
+				}
+			}
+			if len(layers) != 1 || len(oc.RootFS.DiffIDs) != 1 || histLayers != 1 {
+				return fmt.Errorf("squashed image %s must have one layer, diff_id, and history entry, found %d layers, %d diff_ids, %d history entries%.0w",
+					dm.m.GetDescriptor().Digest.String(), len(layers), len(oc.RootFS.DiffIDs), histLayers, errs.ErrMismatch)
+			}
+			dl := layers[0]
+			ucDigest := dl.ucDigest
+			if ucDigest == "" {
+				r := rSrc
+				if dl.rSrc.IsSet() {
+					r = dl.rSrc
+				}
+				var err error
+				ucDigest, err = layerGetUCDigest(ctx, rc, r, dl.desc)
+				if err != nil {
+					return fmt.Errorf("failed to get uncompressed digest of layer %s: %w", dl.desc.Digest.String(), err)
+				}
+			}
+			if oc.RootFS.DiffIDs[0] != ucDigest {
+				return fmt.Errorf("squashed image diff_id %s does not match layer %s, uncompressed digest %s%.0w",
+					oc.RootFS.DiffIDs[0].String(), dl.desc.Digest.String(), ucDigest.String(), errs.ErrDigestMismatch)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithLayerStripFile removes a file from within the layer tar.
+func WithLayerStripFile(file string) Opts {
+	file = strings.Trim(filepath.ToSlash(file), "/")
+	fileRE := regexp.MustCompile("^/?" + regexp.QuoteMeta(file) + "(/.*)?$")
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if fileRE.MatchString(th.Name) {
+				return th, tr, deleted, nil
+			}
+			return th, tr, unchanged, nil
+		})
+		return nil
+	}
+}
+
+// WithLayerTimestamp sets the timestamp on files in the layers based on options.
+func WithLayerTimestamp(optTime OptTime) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if optTime.Set.IsZero() && optTime.FromLabel == "" && optTime.Clamp.IsZero() {
+			return fmt.Errorf("WithLayerTimestamp requires a time to set")
+		}
+		dc.timeClampSet(optTime.Clamp)
+		baseProcessed := false
+		baseDigests := map[digest.Digest]bool{}
+		// add base layers by count
+		if optTime.BaseLayers > 0 {
+			dl, err := layerGetBaseCount(optTime.BaseLayers, dm)
+			if err != nil {
+				return fmt.Errorf("failed to get base layers: %w", err)
+			}
+			for _, d := range dl {
+				baseDigests[d] = true
+			}
+		}
+		if optTime.FromLabel != "" {
+			dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+				oc := doc.oc.GetConfig()
+				tl, ok := oc.Config.Labels[optTime.FromLabel]
+				if !ok {
+					return fmt.Errorf("label not found: %s", optTime.FromLabel)
+				}
+				tNew, err := time.Parse(time.RFC3339, tl)
+				if err != nil {
+					// TODO: add fallbacks
+					return fmt.Errorf("could not parse time %s from %s: %w", tl, optTime.FromLabel, err)
+				}
+				if !optTime.Set.IsZero() && !optTime.Set.Equal(tNew) {
+					return fmt.Errorf("conflicting time labels found %s and %s", optTime.Set.String(), tNew.String())
+				}
+				optTime.Set = tNew
+				if dc.timeSet.IsZero() {
+					dc.timeSet = tNew
+				}
+				return nil
+			})
+		} else if dc.timeSet.IsZero() {
+			dc.timeSet = optTime.Set
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile,
+			func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+				if optTime.Set.IsZero() && optTime.Clamp.IsZero() {
+					return nil, nil, unchanged, fmt.Errorf("timestamp not available")
+				}
+				// for base ref, lookup all digests from base image to exclude
+				if !baseProcessed {
 					if !optTime.BaseRef.IsZero() {
 						m, err := rc.ManifestGet(c, optTime.BaseRef)
 						if err != nil {
@@ -517,6 +1518,10 @@ func WithLayerTimestamp(optTime OptTime) Opts {
 				if !th.ModTime.IsZero() {
 					th.ModTime, cm = timeModOpt(th.ModTime, optTime)
 				}
+				// set the history time for added layers
+				if dl.mod == added {
+					dl.created, _ = timeModOpt(timeStart, optTime)
+				}
 				if ca || cc || cm {
 					return th, tr, replaced, nil
 				}
@@ -551,99 +1556,1075 @@ func layerGetBaseRef(c context.Context, rc *regclient.RegClient, r ref.Ref, m ma
 		if err != nil {
 			return dl, err
 		}
-		for _, d := range ml {
-			mChild, err := rc.ManifestGet(c, r, regclient.WithManifestDesc(d))
-			if err != nil {
-				return dl, err
+		for _, d := range ml {
+			mChild, err := rc.ManifestGet(c, r, regclient.WithManifestDesc(d))
+			if err != nil {
+				return dl, err
+			}
+			dlChild, err := layerGetBaseRef(c, rc, r, mChild)
+			if err != nil {
+				return dl, err
+			}
+			dl = append(dl, dlChild...)
+		}
+	}
+	if mi, ok := m.(manifest.Imager); ok {
+		layers, err := mi.GetLayers()
+		if err != nil {
+			return dl, err
+		}
+		for _, l := range layers {
+			dl = append(dl, l.Digest)
+		}
+	}
+	return dl, nil
+}
+
+// WithLayerTimestampFromLabel sets the max layer timestamp based on a label in the image.
+//
+// Deprecated: replace with [WithLayerTimestamp].
+func WithLayerTimestampFromLabel(label string) Opts {
+	t := time.Time{}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
+			oc := doc.oc.GetConfig()
+			tl, ok := oc.Config.Labels[label]
+			if !ok {
+				return fmt.Errorf("label not found: %s", label)
+			}
+			tNew, err := time.Parse(time.RFC3339, tl)
+			if err != nil {
+				// TODO: add fallbacks
+				return fmt.Errorf("could not parse time %s from %s: %w", tl, label, err)
+			}
+			if !t.IsZero() && !t.Equal(tNew) {
+				return fmt.Errorf("conflicting time labels found %s and %s", t.String(), tNew.String())
+			}
+			t = tNew
+			if dc.timeSet.IsZero() {
+				dc.timeSet = tNew
+			}
+			return nil
+		})
+		dc.stepsLayerFile = append(dc.stepsLayerFile,
+			func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+				if t.IsZero() {
+					return nil, nil, unchanged, fmt.Errorf("timestamp not available")
+				}
+				changed := false
+				if th == nil || tr == nil {
+					return nil, nil, unchanged, fmt.Errorf("missing header or reader")
+				}
+				if t.Before(th.AccessTime) {
+					th.AccessTime = t
+					changed = true
+				}
+				if t.Before(th.ChangeTime) {
+					th.ChangeTime = t
+					changed = true
+				}
+				if t.Before(th.ModTime) {
+					th.ModTime = t
+					changed = true
+				}
+				if changed {
+					return th, tr, replaced, nil
+				}
+				return th, tr, unchanged, nil
+			},
+		)
+		return nil
+	}
+}
+
+// WithLayerTimestampMax ensures no file timestamps are after specified time.
+//
+// Deprecated: replace with [WithLayerTimestamp].
+func WithLayerTimestampMax(t time.Time) Opts {
+	return WithLayerTimestamp(OptTime{
+		Set:   t,
+		After: t,
+	})
+}
+
+// FileInventoryEntry describes a regular file in a layer, output as JSON by [WithFileInventory].
+type FileInventoryEntry struct {
+	Layer  digest.Digest `json:"layer"`
+	Path   string        `json:"path"`
+	Size   int64         `json:"size"`
+	Digest digest.Digest `json:"digest"`
+	Mode   int64         `json:"mode"`
+}
+
+// WithLayerZstd recompresses the layers with zstd, updating the media type to the zstd layer type.
+// This is the same as [WithLayerCompression] with [archive.CompressZstd], and layers already compressed with zstd are not changed.
+// An optional level may be provided, see [WithZstdLevel].
+func WithLayerZstd(level ...int) Opts {
+	compressOpt := WithLayerCompression(archive.CompressZstd)
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if len(level) > 1 {
+			return fmt.Errorf("only one zstd level may be provided%.0w", errs.ErrUnsupported)
+		}
+		if len(level) == 1 {
+			err := WithZstdLevel(level[0])(dc, dm)
+			if err != nil {
+				return err
+			}
+		}
+		return compressOpt(dc, dm)
+	}
+}
+
+// WithDedupAgainstBase removes files from the layers above the base image that are identical to the file provided by the lower layers.
+// A regular file is removed when the path, content, mode, and owner match, so the resulting filesystem is unchanged.
+// The modification time is not compared.
+// The image must start with the layers of the base image, and the base platform is selected to match each image.
+// If report is not nil, it is called with the original layer descriptor, the name, and the size of each removed file.
+func WithDedupAgainstBase(baseRef ref.Ref, report func(descriptor.Descriptor, string, int64)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		removals := map[*dagLayer]map[string]bool{}
+		// the base filesystem is indexed once for each base manifest
+		baseFiles := map[digest.Digest]map[string]dedupFile{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
+				return nil
+			}
+			mBase, err := rc.ManifestGet(ctx, baseRef)
+			if err != nil {
+				return fmt.Errorf("failed to get base image %s: %w", baseRef.CommonName(), err)
+			}
+			if mBase.IsList() {
+				if dm.config == nil || dm.config.oc == nil {
+					return fmt.Errorf("platform not found for base image %s%.0w", baseRef.CommonName(), errs.ErrNotFound)
+				}
+				p := dm.config.oc.GetConfig().Platform
+				d, err := manifest.GetPlatformDesc(mBase, &p)
+				if err != nil {
+					return fmt.Errorf("failed to find platform %s in base image %s: %w", p.String(), baseRef.CommonName(), err)
+				}
+				mBase, err = rc.ManifestGet(ctx, baseRef.SetDigest(d.Digest.String()))
+				if err != nil {
+					return err
+				}
+			}
+			mi, ok := mBase.(manifest.Imager)
+			if !ok {
+				return fmt.Errorf("base image is not an image: %s%.0w", baseRef.CommonName(), errs.ErrUnsupportedMediaType)
+			}
+			layersBase, err := mi.GetLayers()
+			if err != nil {
+				return err
+			}
+			// find the layers above the base image
+			appStart := -1
+			iBase := 0
+			for i, dl := range dm.layers {
+				if dl.mod == added {
+					continue
+				}
+				if iBase == len(layersBase) {
+					appStart = i
+					break
+				}
+				if dl.desc.Digest != layersBase[iBase].Digest {
+					break
+				}
+				iBase++
+			}
+			if iBase < len(layersBase) {
+				return fmt.Errorf("image is not based on %s%.0w", baseRef.CommonName(), errs.ErrMismatch)
+			}
+			if appStart < 0 {
+				return nil
+			}
+			files, ok := baseFiles[mBase.GetDescriptor().Digest]
+			if !ok {
+				files = map[string]dedupFile{}
+				dmBase := &dagManifest{m: mBase}
+				for _, l := range layersBase {
+					dmBase.layers = append(dmBase.layers, &dagLayer{desc: l})
+				}
+				err = layerTarWalk(ctx, rc, baseRef, baseRef, dmBase, func(dl *dagLayer, th *tar.Header, rdr io.Reader) error {
+					_, err := dedupApply(files, dl, th, rdr)
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("failed to index base image %s: %w", baseRef.CommonName(), err)
+				}
+				baseFiles[mBase.GetDescriptor().Digest] = files
+			}
+			// walk the layers above the base, tracking files that match the lower layers
+			state := make(map[string]dedupFile, len(files))
+			for k, v := range files {
+				state[k] = v
+			}
+			dmApp := &dagManifest{m: dm.m, layers: dm.layers[appStart:]}
+			return layerTarWalk(ctx, rc, rSrc, rTgt, dmApp, func(dl *dagLayer, th *tar.Header, rdr io.Reader) error {
+				// a hardlink keeps the target in the layer
+				if th.Typeflag == tar.TypeLink && removals[dl] != nil {
+					for name := range removals[dl] {
+						if tarNameClean(name) == tarNameClean(th.Linkname) {
+							delete(removals[dl], name)
+						}
+					}
+				}
+				dup, err := dedupApply(state, dl, th, rdr)
+				if err != nil || !dup {
+					return err
+				}
+				if removals[dl] == nil {
+					removals[dl] = map[string]bool{}
+				}
+				removals[dl][th.Name] = true
+				return nil
+			})
+		})
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if !removals[dl][th.Name] {
+				return th, tr, unchanged, nil
+			}
+			if report != nil {
+				report(dl.desc, th.Name, th.Size)
+			}
+			return th, tr, deleted, nil
+		})
+		return nil
+	}
+}
+
+// dedupFile describes an entry in the filesystem for [WithDedupAgainstBase].
+type dedupFile struct {
+	dl       *dagLayer
+	typeflag byte
+	mode     int64
+	uid, gid int
+	linkname string
+	digest   digest.Digest
+}
+
+// dedupApply updates files with an entry from layer dl, applying whiteouts to the lower layers.
+// When the entry is a regular file identical to the current file, files is unchanged and true is returned.
+func dedupApply(files map[string]dedupFile, dl *dagLayer, th *tar.Header, rdr io.Reader) (bool, error) {
+	name := tarNameClean(th.Name)
+	dir, base := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	rmLower := func(prefix string, self bool) {
+		for k, f := range files {
+			if f.dl != dl && ((self && k == prefix) || prefix == "" || strings.HasPrefix(k, prefix+"/")) {
+				delete(files, k)
+			}
+		}
+	}
+	if base == ".wh..wh..opq" {
+		rmLower(dir, false)
+		return false, nil
+	}
+	if strings.HasPrefix(base, ".wh.") {
+		rmLower(path.Join(dir, strings.TrimPrefix(base, ".wh.")), true)
+		return false, nil
+	}
+	f := dedupFile{
+		dl:       dl,
+		typeflag: th.Typeflag,
+		mode:     th.Mode,
+		uid:      th.Uid,
+		gid:      th.Gid,
+		linkname: th.Linkname,
+	}
+	if th.Typeflag == tar.TypeReg {
+		dig, err := digest.Canonical.FromReader(rdr)
+		if err != nil {
+			return false, err
+		}
+		f.digest = dig
+	}
+	cur, ok := files[name]
+	if ok && th.Typeflag == tar.TypeReg && cur.dl != dl &&
+		cur.typeflag == f.typeflag && cur.mode == f.mode && cur.uid == f.uid && cur.gid == f.gid && cur.digest == f.digest {
+		return true, nil
+	}
+	// a file replacing a directory hides the directory contents
+	if ok && cur.typeflag == tar.TypeDir && th.Typeflag != tar.TypeDir {
+		rmLower(name, false)
+	}
+	files[name] = f
+	return false, nil
+}
+
+// WithFileDelete removes entries from the layers with a name matching pattern.
+// The pattern uses the syntax of [path.Match], anchored at the root of the layer without a leading slash.
+// Matching a directory also removes its contents, e.g. "root/.cache/*" removes everything under that directory.
+// Only entries physically present in a layer are removed, a file added in a lower layer remains visible if the match is in an upper layer.
+// Use [WithWhiteoutAdd] to hide files from lower layers.
+// Layers that become empty are removed.
+func WithFileDelete(pattern string) Opts {
+	pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		return fileDelete(func(name string) bool {
+			return fileMatchParents(name, func(cur string) bool {
+				match, _ := path.Match(pattern, cur)
+				return match
+			})
+		}, nil)(dc, dm)
+	}
+}
+
+// fileDelete removes entries from the layers when match returns true for the cleaned name.
+// If report is not nil, it is called with the original layer descriptor, the name, and the size of each removed entry.
+func fileDelete(match func(name string) bool, report func(descriptor.Descriptor, string, int64)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if !match(tarNameClean(th.Name)) {
+				return th, tr, unchanged, nil
+			}
+			if report != nil {
+				report(dl.desc, th.Name, th.Size)
+			}
+			return th, tr, deleted, nil
+		})
+		return nil
+	}
+}
+
+// fileMatchParents returns true if fn returns true for the name or any of its parent directories.
+func fileMatchParents(name string, fn func(string) bool) bool {
+	for cur := name; cur != "." && cur != ""; cur = path.Dir(cur) {
+		if fn(cur) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithWhiteoutAdd adds overlay whiteout entries to the top layer of each image, hiding the paths from lower layers.
+// Paths already whited out in the top layer are skipped.
+func WithWhiteoutAdd(paths []string) Opts {
+	whiteouts := make([]string, 0, len(paths))
+	for _, p := range paths {
+		p = tarNameClean(filepath.ToSlash(p))
+		whiteouts = append(whiteouts, path.Join(path.Dir(p), ".wh."+path.Base(p)))
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		for i, p := range paths {
+			if path.Base(whiteouts[i]) == ".wh." || path.Base(whiteouts[i]) == ".wh.." {
+				return fmt.Errorf("invalid whiteout path %s%.0w", p, errs.ErrUnsupported)
+			}
+		}
+		tops := map[*dagLayer]bool{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || len(whiteouts) == 0 {
+				return nil
+			}
+			var top *dagLayer
+			for _, dl := range dm.layers {
+				if dl.mod != deleted {
+					top = dl
+				}
+			}
+			if top == nil || !inListStr(top.desc.MediaType, mtKnownTar) {
+				return fmt.Errorf("unable to add whiteouts, top layer is not a known tar media type%.0w", errs.ErrUnsupportedMediaType)
+			}
+			tops[top] = true
+			return nil
+		})
+		dc.stepsLayer = append(dc.stepsLayer, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, rdr io.ReadCloser) (io.ReadCloser, error) {
+			if !tops[dl] || dl.mod == deleted {
+				return rdr, nil
+			}
+			entries := make([]layerEntry, 0, len(whiteouts))
+			for _, wh := range whiteouts {
+				entries = append(entries, layerEntry{th: &tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     wh,
+					Mode:     0644,
+					ModTime:  time.Unix(0, 0),
+					Format:   tar.FormatPAX,
+				}})
+			}
+			return dc.layerAppend(dl, rdr, entries), nil
+		})
+		return nil
+	}
+}
+
+// WithFileInventory writes a JSON line to w for every regular file in the layers of the image.
+// The inventory is collected during the layer walk from the final layers after other changes, and each layer is only included once.
+// Whiteout files are not included.
+// This does not modify the image.
+func WithFileInventory(w io.Writer) Opts {
+	type inventoryEntry struct {
+		entry    FileInventoryEntry
+		digester digest.Digester
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		layerEntries := map[*dagLayer][]inventoryEntry{}
+		dc.stepsLayerFileFinal = append(dc.stepsLayerFileFinal, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (io.Reader, error) {
+			if th.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(th.Name), ".wh.") {
+				return tr, nil
+			}
+			// the digest is computed as the entry is copied into the layer
+			digester := digest.Canonical.Digester()
+			layerEntries[dl] = append(layerEntries[dl], inventoryEntry{
+				entry: FileInventoryEntry{
+					Path: th.Name,
+					Size: th.Size,
+					Mode: th.Mode,
+				},
+				digester: digester,
+			})
+			return io.TeeReader(tr, digester.Hash()), nil
+		})
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			enc := json.NewEncoder(w)
+			return layerInventoryWalk(dm, func(dl *dagLayer) error {
+				for _, ie := range layerEntries[dl] {
+					entry := ie.entry
+					entry.Layer = layerInventoryDigest(dl)
+					entry.Digest = ie.digester.Digest()
+					err := enc.Encode(entry)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		return nil
+	}
+}
+
+// FileSizeHistogram is the distribution of regular file sizes reported by [WithFileSizeHistogram].
+type FileSizeHistogram struct {
+	Buckets  map[int64]int // count of files by the smallest bucket greater than or equal to the file size
+	Overflow int           // count of files larger than every bucket
+	Files    int           // total number of files
+	Bytes    int64         // total size of the files
+}
+
+// WithFileSizeHistogram calls fn with the distribution of regular file sizes in the layers of the image.
+// Each bucket is an upper bound, inclusive, and every bucket is included in the result even when the count is zero.
+// Like [WithFileInventory], the sizes are collected during the layer walk from the final layers and each layer is only included once.
+// The counts in [FileSizeHistogram.Buckets] are the map of bucket to file count, the struct adds the overflow, file count, and byte total.
+// This does not modify the image.
+func WithFileSizeHistogram(buckets []int64, fn func(FileSizeHistogram)) Opts {
+	bucketsSorted := make([]int64, len(buckets))
+	copy(bucketsSorted, buckets)
+	sort.Slice(bucketsSorted, func(i, j int) bool { return bucketsSorted[i] < bucketsSorted[j] })
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if len(bucketsSorted) == 0 || bucketsSorted[0] < 0 {
+			return fmt.Errorf("histogram buckets must be non-negative and at least one bucket is required%.0w", errs.ErrUnsupported)
+		}
+		layerSizes := map[*dagLayer][]int64{}
+		dc.stepsLayerFileFinal = append(dc.stepsLayerFileFinal, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (io.Reader, error) {
+			if th.Typeflag == tar.TypeReg && !strings.HasPrefix(path.Base(th.Name), ".wh.") {
+				layerSizes[dl] = append(layerSizes[dl], th.Size)
+			}
+			return tr, nil
+		})
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			hist := FileSizeHistogram{
+				Buckets: map[int64]int{},
+			}
+			for _, b := range bucketsSorted {
+				hist.Buckets[b] = 0
+			}
+			err := layerInventoryWalk(dm, func(dl *dagLayer) error {
+				for _, size := range layerSizes[dl] {
+					hist.Files++
+					hist.Bytes += size
+					i := sort.Search(len(bucketsSorted), func(i int) bool { return bucketsSorted[i] >= size })
+					if i < len(bucketsSorted) {
+						hist.Buckets[bucketsSorted[i]]++
+					} else {
+						hist.Overflow++
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fn(hist)
+			return nil
+		})
+		return nil
+	}
+}
+
+// layerInventoryWalk calls fn for each layer in the images that is not deleted, skipping layers with a digest already seen.
+func layerInventoryWalk(dm *dagManifest, fn func(*dagLayer) error) error {
+	seen := map[digest.Digest]bool{}
+	return dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+		if dm.mod == deleted || dm.m.IsList() {
+			return dm, nil
+		}
+		for _, dl := range dm.layers {
+			if dl.mod == deleted {
+				continue
+			}
+			d := layerInventoryDigest(dl)
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			err := fn(dl)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dm, nil
+	})
+}
+
+// layerInventoryDigest returns the digest of the layer after any changes.
+func layerInventoryDigest(dl *dagLayer) digest.Digest {
+	if dl.mod != unchanged && dl.newDesc.Digest != "" {
+		return dl.newDesc.Digest
+	}
+	return dl.desc.Digest
+}
+
+// WithFileAppend adds content to the end of each regular file matching pathPattern, e.g. to add a trailing newline.
+// The pattern uses the syntax of [path.Match] and is compared to the file name without a leading slash.
+// Each matching file is read into memory to compute the new size.
+func WithFileAppend(pathPattern string, content []byte) Opts {
+	return fileContentEdit(pathPattern, len(content) == 0, func(orig []byte) []byte {
+		return append(orig, content...)
+	})
+}
+
+// WithFileChmod sets the mode of specific entries in the layers, e.g. to make "/entrypoint.sh" executable.
+// Each key is an exact path, compared without a leading slash or "./" prefix, and the value replaces the permission, setuid, setgid, and sticky bits.
+// Entries not in the map and symlinks are not modified.
+func WithFileChmod(modes map[string]os.FileMode) Opts {
+	tarModes := map[string]int64{}
+	for name, mode := range modes {
+		tarModes[tarNameClean(filepath.ToSlash(name))] = tarModeBits(mode)
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if len(tarModes) == 0 {
+			return nil
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if th.Typeflag == tar.TypeSymlink {
+				return th, tr, unchanged, nil
+			}
+			tarMode, ok := tarModes[tarNameClean(th.Name)]
+			if !ok {
+				return th, tr, unchanged, nil
+			}
+			mode := (th.Mode &^ 0o7777) | tarMode
+			if mode == th.Mode {
+				return th, tr, unchanged, nil
+			}
+			th.Mode = mode
+			return th, tr, replaced, nil
+		})
+		return nil
+	}
+}
+
+// WithFilePathRewrite relocates entries in the layers under the from directory to the to directory, e.g. "/app" to "/opt/app".
+// Directory entries, whiteouts, and hardlinks are renamed with the same prefix replacement, and each entry is rewritten once, so to may be under from.
+// Absolute symlink targets within from are rewritten, and relative symlink targets are recomputed when the link or its target is moved.
+func WithFilePathRewrite(from, to string) Opts {
+	from = tarNameClean(filepath.ToSlash(from))
+	to = tarNameClean(filepath.ToSlash(to))
+	// rewrite returns the new name for a clean name without a leading slash
+	rewrite := func(name string) (string, bool) {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			return to + strings.TrimPrefix(name, from), true
+		}
+		// a whiteout of from becomes a whiteout of to
+		dir, base := path.Dir(name), path.Base(name)
+		if strings.HasPrefix(base, ".wh.") && base != ".wh..wh..opq" {
+			orig := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+			if orig == from {
+				return path.Join(path.Dir(to), ".wh."+path.Base(to)), true
+			}
+		}
+		return name, false
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if from == "" || to == "" {
+			return fmt.Errorf("path rewrite does not support the root directory, from %s, to %s%.0w", from, to, errs.ErrUnsupported)
+		}
+		if from == to {
+			return nil
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			changed := false
+			name := tarNameClean(th.Name)
+			newName, moved := rewrite(name)
+			if moved {
+				if strings.HasSuffix(th.Name, "/") {
+					newName += "/"
+				}
+				th.Name = newName
+				changed = true
+			}
+			switch th.Typeflag {
+			case tar.TypeLink:
+				// hardlinks are relative to the root of the layer
+				if target, ok := rewrite(tarNameClean(th.Linkname)); ok {
+					th.Linkname = target
+					changed = true
+				}
+			case tar.TypeSymlink:
+				if path.IsAbs(th.Linkname) {
+					if target, ok := rewrite(strings.Trim(path.Clean(th.Linkname), "/")); ok {
+						th.Linkname = "/" + target
+						changed = true
+					}
+					break
+				}
+				// relative links only change when one of the link and target is moved
+				target := strings.Trim(path.Clean(path.Join("/", path.Dir(name), th.Linkname)), "/")
+				newTarget, targetMoved := rewrite(target)
+				if moved != targetMoved {
+					linkDir := path.Dir(name)
+					if moved {
+						linkDir = path.Dir(strings.TrimSuffix(newName, "/"))
+					}
+					th.Linkname = pathRel(linkDir, newTarget)
+					changed = true
+				}
+			}
+			if !changed {
+				return th, tr, unchanged, nil
+			}
+			// remove records that would override the new names
+			delete(th.PAXRecords, "path")
+			delete(th.PAXRecords, "linkpath")
+			return th, tr, replaced, nil
+		})
+		return nil
+	}
+}
+
+// pathRel returns a relative path from the base directory to the target, both slash separated and relative to the same root.
+func pathRel(base, target string) string {
+	split := func(p string) []string {
+		p = tarNameClean(p)
+		if p == "" {
+			return []string{}
+		}
+		return strings.Split(p, "/")
+	}
+	baseList, targetList := split(base), split(target)
+	i := 0
+	for i < len(baseList) && i < len(targetList) && baseList[i] == targetList[i] {
+		i++
+	}
+	rel := []string{}
+	for range baseList[i:] {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, targetList[i:]...)
+	if len(rel) == 0 {
+		return "."
+	}
+	return strings.Join(rel, "/")
+}
+
+// WithFileMode sets the permission bits on every regular file to fileMode and every directory to dirMode.
+// A mode of 0 leaves entries of that type unchanged, symlinks and other special files are never modified.
+// The sticky bit is preserved, while setuid and setgid bits are cleared unless [WithKeepSetuid] is also used.
+func WithFileMode(fileMode, dirMode os.FileMode) Opts {
+	fileBits := int64(fileMode.Perm())
+	dirBits := int64(dirMode.Perm())
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			var bits int64
+			switch {
+			case th.Typeflag == tar.TypeReg && fileMode != 0:
+				bits = fileBits
+			case th.Typeflag == tar.TypeDir && dirMode != 0:
+				bits = dirBits
+			default:
+				return th, tr, unchanged, nil
+			}
+			keep := int64(0o1000) // sticky
+			if dc.keepSetuid {
+				keep |= 0o6000
+			}
+			mode := (th.Mode &^ 0o7777) | (th.Mode & keep) | bits
+			if mode == th.Mode {
+				return th, tr, unchanged, nil
+			}
+			th.Mode = mode
+			return th, tr, replaced, nil
+		})
+		return nil
+	}
+}
+
+// WithKeepSetuid preserves the setuid and setgid bits on entries modified by [WithFileMode].
+func WithKeepSetuid() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.keepSetuid = true
+		return nil
+	}
+}
+
+// WithFileOwnership sets the uid and gid of every entry in the layers.
+// A value of -1 leaves that id unchanged.
+// The user or group name is cleared when the matching id is set, along with the PAX records for the id and name.
+func WithFileOwnership(uid, gid int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if uid < -1 || gid < -1 {
+			return fmt.Errorf("invalid ownership %d:%d%.0w", uid, gid, errs.ErrUnsupported)
+		}
+		if uid == -1 && gid == -1 {
+			return nil
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			changed := false
+			if uid >= 0 {
+				if th.Uid != uid || th.Uname != "" {
+					th.Uid = uid
+					th.Uname = ""
+					changed = true
+				}
+				for _, k := range []string{"uid", "uname"} {
+					if _, ok := th.PAXRecords[k]; ok {
+						delete(th.PAXRecords, k)
+						changed = true
+					}
+				}
+			}
+			if gid >= 0 {
+				if th.Gid != gid || th.Gname != "" {
+					th.Gid = gid
+					th.Gname = ""
+					changed = true
+				}
+				for _, k := range []string{"gid", "gname"} {
+					if _, ok := th.PAXRecords[k]; ok {
+						delete(th.PAXRecords, k)
+						changed = true
+					}
+				}
+			}
+			if changed {
+				return th, tr, replaced, nil
+			}
+			return th, tr, unchanged, nil
+		})
+		return nil
+	}
+}
+
+// WithFilePrepend adds content to the beginning of each regular file matching pathPattern, e.g. to inject a license header.
+// The pattern uses the syntax of [path.Match] and is compared to the file name without a leading slash.
+// Each matching file is read into memory to compute the new size.
+func WithFilePrepend(pathPattern string, content []byte) Opts {
+	return fileContentEdit(pathPattern, len(content) == 0, func(orig []byte) []byte {
+		buf := make([]byte, 0, len(content)+len(orig))
+		buf = append(buf, content...)
+		return append(buf, orig...)
+	})
+}
+
+// fileContentEdit replaces the content of each regular file matching pathPattern with the output of edit.
+func fileContentEdit(pathPattern string, noop bool, edit func([]byte) []byte) Opts {
+	pathPattern = tarNameClean(filepath.ToSlash(pathPattern))
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if _, err := path.Match(pathPattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pathPattern, err)
+		}
+		if noop {
+			return nil
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if th.Typeflag != tar.TypeReg {
+				return th, tr, unchanged, nil
 			}
-			dlChild, err := layerGetBaseRef(c, rc, r, mChild)
+			if match, _ := path.Match(pathPattern, tarNameClean(th.Name)); !match {
+				return th, tr, unchanged, nil
+			}
+			orig, err := io.ReadAll(io.LimitReader(tr, th.Size))
 			if err != nil {
-				return dl, err
+				return nil, nil, unchanged, fmt.Errorf("failed to read %s: %w", th.Name, err)
 			}
-			dl = append(dl, dlChild...)
+			buf := edit(orig)
+			if bytes.Equal(buf, orig) {
+				return th, bytes.NewReader(orig), unchanged, nil
+			}
+			th.Size = int64(len(buf))
+			return th, bytes.NewReader(buf), replaced, nil
+		})
+		return nil
+	}
+}
+
+// WithFileLineEndingConvert rewrites the line endings of each regular file matching pathPattern.
+// The to value is either "lf" or "crlf".
+// The pattern uses the syntax of [path.Match] and is compared to the file name without a leading slash.
+// Files containing a null byte are treated as binary and skipped.
+func WithFileLineEndingConvert(pathPattern string, to string) Opts {
+	var toBytes []byte
+	switch strings.ToLower(to) {
+	case "lf":
+		toBytes = []byte("\n")
+	case "crlf":
+		toBytes = []byte("\r\n")
+	default:
+		return func(dc *dagConfig, dm *dagManifest) error {
+			return fmt.Errorf("unsupported line ending %s%.0w", to, errs.ErrUnsupported)
 		}
 	}
-	if mi, ok := m.(manifest.Imager); ok {
-		layers, err := mi.GetLayers()
-		if err != nil {
-			return dl, err
+	return fileContentEdit(pathPattern, false, func(orig []byte) []byte {
+		if bytes.IndexByte(orig, 0) >= 0 {
+			return orig
 		}
-		for _, l := range layers {
-			dl = append(dl, l.Digest)
+		buf := bytes.ReplaceAll(orig, []byte("\r\n"), []byte("\n"))
+		if len(toBytes) > 1 {
+			buf = bytes.ReplaceAll(buf, []byte("\n"), toBytes)
 		}
-	}
-	return dl, nil
+		return buf
+	})
 }
 
-// WithLayerTimestampFromLabel sets the max layer timestamp based on a label in the image.
-//
-// Deprecated: replace with [WithLayerTimestamp].
-func WithLayerTimestampFromLabel(label string) Opts {
-	t := time.Time{}
+// OptFileReplace defines optional settings for [WithFileReplaceOpt].
+type OptFileReplace struct {
+	Mode       *os.FileMode // permission, setuid, setgid, and sticky bits to set on the file, the existing mode is preserved when nil
+	AddMissing bool         // add the file in a new layer to images without it, rather than returning an error
+}
+
+// WithFileReplace replaces the content of a file within the layers with the content of a local file.
+// The header of the file in the image, including the mode and ownership, is preserved.
+// An error is returned if the file is not found in an image.
+func WithFileReplace(pathInImage, localPath string) Opts {
+	return WithFileReplaceOpt(pathInImage, localPath, OptFileReplace{})
+}
+
+// WithFileReplaceOpt replaces the content of a file within the layers with the content of a local file.
+// The header of the file in the image, including the ownership, is preserved, and the mode is changed when opt.Mode is set.
+// The layers of each image are read before any changes are pushed to verify the file exists.
+// When the file is missing, an error is returned unless opt.AddMissing is set,
+// which adds a layer with the file, root ownership, a zero unix timestamp, a mode of 0644 unless opt.Mode is set,
+// and parent directories with a mode of 0755.
+func WithFileReplaceOpt(pathInImage, localPath string, opt OptFileReplace) Opts {
+	pathInImage = tarNameClean(filepath.ToSlash(pathInImage))
 	return func(dc *dagConfig, dm *dagManifest) error {
-		dc.stepsOCIConfig = append(dc.stepsOCIConfig, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, doc *dagOCIConfig) error {
-			oc := doc.oc.GetConfig()
-			tl, ok := oc.Config.Labels[label]
-			if !ok {
-				return fmt.Errorf("label not found: %s", label)
+		if pathInImage == "" {
+			return fmt.Errorf("file replace path must not be the root directory%.0w", errs.ErrUnsupported)
+		}
+		//#nosec G304 file is provided by the caller
+		content, err := os.ReadFile(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", localPath, err)
+		}
+		tarMode := int64(-1)
+		if opt.Mode != nil {
+			tarMode = tarModeBits(*opt.Mode)
+		}
+		// verify the file exists in each image before the layer walk pushes any changes
+		missing := map[*dagManifest]bool{}
+		errFound := errors.New("file found")
+		dc.stepsManifest = append(dc.stepsManifest, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
+				return nil
+			}
+			hasTar := false
+			for _, dl := range dm.layers {
+				if dl.mod != deleted && inListStr(dl.desc.MediaType, mtKnownTar) {
+					hasTar = true
+					break
+				}
+			}
+			if !hasTar {
+				return nil
+			}
+			err := layerTarWalk(c, rc, rSrc, rTgt, dm, func(dl *dagLayer, th *tar.Header, tr io.Reader) error {
+				if th.Typeflag == tar.TypeReg && tarNameClean(th.Name) == pathInImage {
+					return errFound
+				}
+				return nil
+			})
+			if errors.Is(err, errFound) {
+				return nil
 			}
-			tNew, err := time.Parse(time.RFC3339, tl)
 			if err != nil {
-				// TODO: add fallbacks
-				return fmt.Errorf("could not parse time %s from %s: %w", tl, label, err)
+				return err
 			}
-			if !t.IsZero() && !t.Equal(tNew) {
-				return fmt.Errorf("conflicting time labels found %s and %s", t.String(), tNew.String())
+			if !opt.AddMissing {
+				return fmt.Errorf("failed to replace %s in %s%.0w", pathInImage, dm.m.GetDescriptor().Digest.String(), errs.ErrFileNotFound)
 			}
-			t = tNew
+			missing[dm] = true
 			return nil
 		})
-		dc.stepsLayerFile = append(dc.stepsLayerFile,
-			func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
-				if t.IsZero() {
-					return nil, nil, unchanged, fmt.Errorf("timestamp not available")
-				}
-				changed := false
-				if th == nil || tr == nil {
-					return nil, nil, unchanged, fmt.Errorf("missing header or reader")
+		if opt.AddMissing {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			dirs := []string{}
+			for cur := path.Dir(pathInImage); cur != "."; cur = path.Dir(cur) {
+				dirs = append([]string{cur}, dirs...)
+			}
+			for _, dir := range dirs {
+				err := tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     dir + "/",
+					Mode:     0755,
+					ModTime:  time.Unix(0, 0),
+				})
+				if err != nil {
+					return err
 				}
-				if t.Before(th.AccessTime) {
-					th.AccessTime = t
-					changed = true
+			}
+			mode := int64(0644)
+			if tarMode >= 0 {
+				mode = tarMode
+			}
+			err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     pathInImage,
+				Size:     int64(len(content)),
+				Mode:     mode,
+				ModTime:  time.Unix(0, 0),
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write(content); err != nil {
+				return err
+			}
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			err = layerAddTar(buf, "", nil, "", func(dm *dagManifest) bool { return missing[dm] })(dc, dm)
+			if err != nil {
+				return err
+			}
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if th.Typeflag != tar.TypeReg || tarNameClean(th.Name) != pathInImage {
+				return th, tr, unchanged, nil
+			}
+			th.Size = int64(len(content))
+			if tarMode >= 0 {
+				th.Mode = (th.Mode &^ 0o7777) | tarMode
+			}
+			return th, bytes.NewReader(content), replaced, nil
+		})
+		return nil
+	}
+}
+
+// PythonCachePatterns are the default patterns removed by [WithStripPythonCache].
+var PythonCachePatterns = []string{"__pycache__", "*.pyc", "*.pyo"}
+
+// WithStripPythonCache removes Python bytecode caches from the layers.
+// Patterns are matched with [path.Match] against each element of the path, so matching a directory also removes its contents.
+// When patterns is empty, [PythonCachePatterns] is used.
+// If report is not nil, it is called with the original layer descriptor, the name, and the size of each removed entry.
+func WithStripPythonCache(patterns []string, report func(descriptor.Descriptor, string, int64)) Opts {
+	if len(patterns) == 0 {
+		patterns = PythonCachePatterns
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %s: %w", p, err)
+			}
+		}
+		return fileDelete(func(name string) bool {
+			return fileMatchParents(name, func(cur string) bool {
+				for _, p := range patterns {
+					if match, _ := path.Match(p, path.Base(cur)); match {
+						return true
+					}
 				}
-				if t.Before(th.ChangeTime) {
-					th.ChangeTime = t
-					changed = true
+				return false
+			})
+		}, report)(dc, dm)
+	}
+}
+
+// StripDocsPaths are the default paths removed by [WithStripDocs].
+var StripDocsPaths = []string{"usr/share/man", "usr/share/doc", "usr/share/info"}
+
+// StripDocsLocalePath is the locale directory, include it in the paths of [WithStripDocs] to remove locale data.
+const StripDocsLocalePath = "usr/share/locale"
+
+// WithStripDocs removes documentation from the layers, including man pages, docs, and info pages.
+// Paths use the syntax of [path.Match], anchored at the root of the layer, and matching a directory also removes its contents.
+// When paths is empty, [StripDocsPaths] is used.
+// When [StripDocsLocalePath] is included in paths, locales matching an entry of localeKeep (e.g. "en*") are not removed.
+// If report is not nil, it is called with the original layer descriptor, the name, and the size of each removed entry.
+func WithStripDocs(paths []string, localeKeep []string, report func(descriptor.Descriptor, string, int64)) Opts {
+	if len(paths) == 0 {
+		paths = StripDocsPaths
+	}
+	cleanPaths := make([]string, len(paths))
+	for i, p := range paths {
+		cleanPaths[i] = strings.Trim(filepath.ToSlash(p), "/")
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		for _, p := range append(cleanPaths, localeKeep...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %s: %w", p, err)
+			}
+		}
+		return fileDelete(func(name string) bool {
+			if len(localeKeep) > 0 && (name == StripDocsLocalePath || strings.HasPrefix(name, StripDocsLocalePath+"/")) {
+				// keep the locale directory and any locale in the keep list
+				locale, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(name, StripDocsLocalePath), "/"), "/")
+				if locale == "" {
+					return false
 				}
-				if t.Before(th.ModTime) {
-					th.ModTime = t
-					changed = true
+				for _, k := range localeKeep {
+					if match, _ := path.Match(k, locale); match {
+						return false
+					}
 				}
-				if changed {
-					return th, tr, replaced, nil
+			}
+			return fileMatchParents(name, func(cur string) bool {
+				for _, p := range cleanPaths {
+					if match, _ := path.Match(p, cur); match {
+						return true
+					}
 				}
-				return th, tr, unchanged, nil
-			},
-		)
-		return nil
+				return false
+			})
+		}, report)(dc, dm)
 	}
 }
 
-// WithLayerTimestampMax ensures no file timestamps are after specified time.
-//
-// Deprecated: replace with [WithLayerTimestamp].
-func WithLayerTimestampMax(t time.Time) Opts {
-	return WithLayerTimestamp(OptTime{
-		Set:   t,
-		After: t,
-	})
+// WithFileStripSpecial removes character devices, block devices, and fifos from the layers.
+// Paths in the allow list are not removed, e.g. "/dev/null".
+// If report is not nil, it is called with the original layer descriptor and the name of each removed entry.
+func WithFileStripSpecial(allow []string, report func(descriptor.Descriptor, string)) Opts {
+	allowMap := map[string]bool{}
+	for _, a := range allow {
+		allowMap[tarNameClean(filepath.ToSlash(a))] = true
+	}
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if th.Typeflag != tar.TypeChar && th.Typeflag != tar.TypeBlock && th.Typeflag != tar.TypeFifo {
+				return th, tr, unchanged, nil
+			}
+			if allowMap[tarNameClean(th.Name)] {
+				return th, tr, unchanged, nil
+			}
+			if report != nil {
+				report(dl.desc, th.Name)
+			}
+			return th, tr, deleted, nil
+		})
+		return nil
+	}
 }
 
 // WithFileTarTime processes a tar file within a layer and adjusts the timestamps according to optTime.
 func WithFileTarTime(name string, optTime OptTime) Opts {
 	name = strings.TrimPrefix(name, "/")
 	return func(dc *dagConfig, dm *dagManifest) error {
-		if optTime.Set.IsZero() && optTime.FromLabel == "" {
+		if optTime.Set.IsZero() && optTime.FromLabel == "" && optTime.Clamp.IsZero() {
 			return fmt.Errorf("WithFileTarTime requires a time to set")
 		}
 		baseProcessed := false
@@ -678,7 +2659,7 @@ func WithFileTarTime(name string, optTime OptTime) Opts {
 			})
 		}
 		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
-			if optTime.Set.IsZero() {
+			if optTime.Set.IsZero() && optTime.Clamp.IsZero() {
 				return nil, nil, unchanged, fmt.Errorf("timestamp not available")
 			}
 			// for base ref, lookup all digests from base image to exclude
@@ -710,7 +2691,7 @@ func WithFileTarTime(name string, optTime OptTime) Opts {
 				return th, tr, unchanged, nil
 			}
 			// read contents into a temporary file, adjusting included timestamps, track if any timestamps are changed
-			tmpFile, err := os.CreateTemp("", "regclient.*")
+			tmpFile, err := os.CreateTemp(dc.tempDir, "regclient.*")
 			if err != nil {
 				return th, tr, unchanged, err
 			}
@@ -790,6 +2771,264 @@ func WithFileTarTimeMax(name string, t time.Time) Opts {
 	})
 }
 
+// WithFileTimestampFlatten sets the timestamp of every file in every layer to t.
+// Unlike [WithLayerTimestamp] with [OptTime], there is no base image or After time to preserve,
+// so base layers are also modified, and their digests will no longer match the base image.
+func WithFileTimestampFlatten(t time.Time) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if t.IsZero() {
+			return fmt.Errorf("WithFileTimestampFlatten requires a time to set")
+		}
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			changed := false
+			if !th.ModTime.Equal(t) {
+				th.ModTime = t
+				changed = true
+			}
+			// do not set times that are currently zero, the tar format may not support them
+			if !th.AccessTime.IsZero() && !th.AccessTime.Equal(t) {
+				th.AccessTime = t
+				changed = true
+			}
+			if !th.ChangeTime.IsZero() && !th.ChangeTime.Equal(t) {
+				th.ChangeTime = t
+				changed = true
+			}
+			if changed {
+				return th, tr, replaced, nil
+			}
+			return th, tr, unchanged, nil
+		})
+		return nil
+	}
+}
+
+// WithFileTimestampFromConfigCreated sets the timestamps of every file in the layers to the created time of the image config.
+// An error is returned if the config does not have a created time.
+// Access and change times are only modified if they are already set.
+func WithFileTimestampFromConfigCreated() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		layerConfig := map[*dagLayer]*dagOCIConfig{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+				return nil
+			}
+			for _, dl := range dm.layers {
+				layerConfig[dl] = dm.config
+			}
+			return nil
+		})
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			doc, ok := layerConfig[dl]
+			if !ok {
+				return th, tr, unchanged, nil
+			}
+			// the created time is read from the config after any config changes have been applied
+			created := doc.oc.GetConfig().Created
+			if created == nil || created.IsZero() {
+				return nil, nil, unchanged, fmt.Errorf("config created time is not set%.0w", errs.ErrNotFound)
+			}
+			changed := false
+			if !th.ModTime.Equal(*created) {
+				th.ModTime = *created
+				changed = true
+			}
+			if !th.AccessTime.IsZero() && !th.AccessTime.Equal(*created) {
+				th.AccessTime = *created
+				changed = true
+			}
+			if !th.ChangeTime.IsZero() && !th.ChangeTime.Equal(*created) {
+				th.ChangeTime = *created
+				changed = true
+			}
+			if changed {
+				return th, tr, replaced, nil
+			}
+			return th, tr, unchanged, nil
+		})
+		return nil
+	}
+}
+
+// WithFileUmask clears the permission bits in mask from every entry in the layers, e.g. 0022 removes group and other write.
+// The file type and setuid, setgid, and sticky bits are not modified.
+// Options that set an explicit mode should be applied after this option to avoid the mask being applied to their result.
+func WithFileUmask(mask os.FileMode) Opts {
+	maskBits := int64(mask.Perm())
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsLayerFile = append(dc.stepsLayerFile, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dl *dagLayer, th *tar.Header, tr io.Reader) (*tar.Header, io.Reader, changes, error) {
+			if th.Mode&maskBits == 0 {
+				return th, tr, unchanged, nil
+			}
+			th.Mode = th.Mode &^ maskBits
+			return th, tr, replaced, nil
+		})
+		return nil
+	}
+}
+
+// WithGzipOS sets the OS byte in the header of gzip compressed layers written by this package.
+// The default is 255 (unknown), so layers compressed on different platforms have the same digest.
+// Layers that are not recompressed keep their existing header.
+func WithGzipOS(b byte) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.gzipOS = b
+		return nil
+	}
+}
+
+// WithZstdLevel sets the zstd compression level used when layers are compressed with zstd, e.g. with [WithLayerCompression].
+// The level uses the zstd command line range of 1 to 22, and is mapped to one of four encoder speeds:
+// 1-2 is the fastest with the lowest ratio, 3-5 is the default, 6-9 is better compression, and 10 or above is the best compression and the slowest.
+// The compressed output is deterministic for a given encoder speed and library version, so changing the level changes the layer digests.
+func WithZstdLevel(level int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if level < 1 || level > 22 {
+			return fmt.Errorf("zstd level %d must be between 1 and 22%.0w", level, errs.ErrUnsupported)
+		}
+		dc.zstdLevel = level
+		return nil
+	}
+}
+
+// compress returns a reader with the content of rdr compressed using comp.
+func (dc *dagConfig) compress(rdr io.Reader, comp archive.CompressType) (io.ReadCloser, error) {
+	switch comp {
+	case archive.CompressGzip:
+		return dc.gzipCompress(rdr)
+	case archive.CompressZstd:
+		return dc.zstdCompress(rdr)
+	default:
+		return archive.Compress(rdr, comp)
+	}
+}
+
+// layerCompressType returns the compression of a tar layer media type.
+func layerCompressType(mt string) archive.CompressType {
+	switch mt {
+	case mediatype.OCI1LayerGzip, mediatype.Docker2LayerGzip:
+		return archive.CompressGzip
+	case mediatype.OCI1LayerZstd, mediatype.Docker2LayerZstd:
+		return archive.CompressZstd
+	}
+	return archive.CompressNone
+}
+
+// gzipWriterPool reuses gzip writers across layers, each writer allocates large compression tables.
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// copyBufPool reuses the buffers for copying file content within the layers.
+var copyBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// gzipWriter returns a gzip writer from the pool with the configured OS byte in the header.
+// The writer should be returned to gzipWriterPool after it is closed.
+func (dc *dagConfig) gzipWriter(w io.Writer) *gzip.Writer {
+	gw := gzipWriterPool.Get().(*gzip.Writer)
+	gw.Reset(w)
+	gw.Header.OS = dc.gzipOS
+	return gw
+}
+
+// gzipCompress returns a reader with the gzip compressed content of rdr.
+func (dc *dagConfig) gzipCompress(rdr io.Reader) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	gw := dc.gzipWriter(pw)
+	go func() {
+		defer gzipWriterPool.Put(gw)
+		_, err := io.Copy(gw, rdr)
+		if err != nil {
+			_ = gw.Close()
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(gw.Close())
+	}()
+	return pr, nil
+}
+
+// zstdEncoderOpts returns the options for creating a zstd writer.
+func (dc *dagConfig) zstdEncoderOpts() []zstd.EOption {
+	if dc.zstdLevel == 0 {
+		return nil
+	}
+	return []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(dc.zstdLevel))}
+}
+
+// zstdCompress returns a reader with the zstd compressed content of rdr.
+func (dc *dagConfig) zstdCompress(rdr io.Reader) (io.ReadCloser, error) {
+	if dc.zstdLevel == 0 {
+		return archive.Compress(rdr, archive.CompressZstd)
+	}
+	pr, pw := io.Pipe()
+	zw, err := zstd.NewWriter(pw, dc.zstdEncoderOpts()...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(zw, rdr)
+		if err != nil {
+			_ = zw.Close()
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(zw.Close())
+	}()
+	return pr, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+// Write for countWriter tracks the number of bytes written.
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// peekWriter records written data until stop is set.
+type peekWriter struct {
+	buf  bytes.Buffer
+	stop bool
+}
+
+// Write for peekWriter saves the data when not stopped.
+func (pw *peekWriter) Write(p []byte) (int, error) {
+	if pw.stop {
+		return len(p), nil
+	}
+	return pw.buf.Write(p)
+}
+
+// tarNameClean returns a file name from a tar header without the leading "/" or "./" and any trailing slash, the root directory is returned as "".
+func tarNameClean(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// tarModeBits converts the permission, setuid, setgid, and sticky bits of a file mode to a tar header mode.
+func tarModeBits(mode os.FileMode) int64 {
+	tarMode := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		tarMode |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		tarMode |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		tarMode |= 0o1000
+	}
+	return tarMode
+}
+
 type readCloserFn struct {
 	io.Reader
 	closeFn func() error
@@ -1,18 +1,29 @@
 package mod
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/blob"
+	"github.com/regclient/regclient/types/descriptor"
 	"github.com/regclient/regclient/types/docker/schema2"
 	"github.com/regclient/regclient/types/errs"
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
+	v1 "github.com/regclient/regclient/types/oci/v1"
 	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
@@ -21,51 +32,15 @@ import (
 // If name is not prefixed with a platform selector, this only applies to the top level manifest.
 // Name may be prefixed with a list of platforms "[p1,p2,...]name", e.g. "[linux/amd64]com.example.field".
 // The platform selector may also be "[*]" to apply to all manifests, including the top level manifest list.
+// Use [WithAnnotationSet] to store an empty value.
 func WithAnnotation(name, value string) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
-		// extract the list for platforms to update from the name
-		name = strings.TrimSpace(name)
-		platforms := []platform.Platform{}
-		allPlatforms := false
-		if name[0] == '[' && strings.Index(name, "]") > 0 {
-			end := strings.Index(name, "]")
-			list := strings.Split(name[1:end], ",")
-			for _, entry := range list {
-				entry = strings.TrimSpace(entry)
-				if entry == "*" {
-					allPlatforms = true
-					continue
-				}
-				p, err := platform.Parse(entry)
-				if err != nil {
-					return fmt.Errorf("failed to parse annotation platform %s: %w", entry, err)
-				}
-				platforms = append(platforms, p)
-			}
-			name = name[end+1:]
+		name, match, err := annotationSelect(name)
+		if err != nil {
+			return err
 		}
 		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
-			// skip deleted manifest, those not in the platform list, or the non-top manifest if no platform list provided
-			if dm.mod == deleted {
-				return nil
-			}
-			if len(platforms) > 0 && !allPlatforms {
-				if dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
-					return nil
-				}
-				p := dm.config.oc.GetConfig().Platform
-				found := false
-				for _, pe := range platforms {
-					if platform.Match(p, pe) {
-						found = true
-						break
-					}
-				}
-				if !found {
-					return nil
-				}
-			}
-			if len(platforms) == 0 && !allPlatforms && !dm.top {
+			if dm.mod == deleted || !match(dm) {
 				return nil
 			}
 			// check if annotation is already set to the correct value
@@ -96,6 +71,209 @@ func WithAnnotation(name, value string) Opts {
 	}
 }
 
+// WithAnnotationDelete removes an annotation from an OCI manifest or index, a missing annotation is not an error.
+// The name supports the same platform selectors as [WithAnnotation].
+// An error is returned for Docker manifests.
+func WithAnnotationDelete(name string) Opts {
+	return annotationEdit(name, func(annotations map[string]string, key string) bool {
+		if _, ok := annotations[key]; !ok {
+			return false
+		}
+		delete(annotations, key)
+		return true
+	})
+}
+
+// WithAnnotationSet sets an annotation on an OCI manifest or index.
+// The name supports the same platform selectors as [WithAnnotation].
+// Unlike [WithAnnotation], an empty value is stored rather than deleting the annotation, use [WithAnnotationDelete] to remove it.
+// An error is returned for Docker manifests.
+func WithAnnotationSet(name, value string) Opts {
+	return annotationEdit(name, func(annotations map[string]string, key string) bool {
+		if cur, ok := annotations[key]; ok && cur == value {
+			return false
+		}
+		annotations[key] = value
+		return true
+	})
+}
+
+// annotationSelect parses the platform selector from the name of an annotation, see [WithAnnotation].
+// The returned match function reports if the annotation applies to a manifest.
+func annotationSelect(name string) (string, func(*dagManifest) bool, error) {
+	// extract the list for platforms to update from the name
+	name = strings.TrimSpace(name)
+	platforms := []platform.Platform{}
+	allPlatforms := false
+	if strings.HasPrefix(name, "[") && strings.Index(name, "]") > 0 {
+		end := strings.Index(name, "]")
+		list := strings.Split(name[1:end], ",")
+		for _, entry := range list {
+			entry = strings.TrimSpace(entry)
+			if entry == "*" {
+				allPlatforms = true
+				continue
+			}
+			p, err := platform.Parse(entry)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to parse annotation platform %s: %w", entry, err)
+			}
+			platforms = append(platforms, p)
+		}
+		name = name[end+1:]
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("annotation key must not be empty%.0w", errs.ErrUnsupported)
+	}
+	match := func(dm *dagManifest) bool {
+		if len(platforms) > 0 && !allPlatforms {
+			if dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+				return false
+			}
+			p := dm.config.oc.GetConfig().Platform
+			for _, pe := range platforms {
+				if platform.Match(p, pe) {
+					return true
+				}
+			}
+			return false
+		}
+		return allPlatforms || dm.top
+	}
+	return name, match, nil
+}
+
+// revisionRE matches a git commit SHA or ref name.
+var revisionRE = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+
+// WithAnnotationRevision sets the "org.opencontainers.image.revision" annotation on the top level OCI manifest or index.
+// The rev must look like a git commit SHA or ref, e.g. "1a2b3c4" or "refs/tags/v1.0.0".
+// An existing revision is only replaced when force is true.
+// An error is returned for Docker manifests.
+func WithAnnotationRevision(rev string, force bool) Opts {
+	if !revisionRE.MatchString(rev) || strings.Contains(rev, "..") || strings.Contains(rev, "//") ||
+		strings.HasSuffix(rev, "/") || strings.HasSuffix(rev, ".") || strings.HasSuffix(rev, ".lock") {
+		return func(dc *dagConfig, dm *dagManifest) error {
+			return fmt.Errorf("invalid git revision %q%.0w", rev, errs.ErrParsingFailed)
+		}
+	}
+	return annotationEdit(types.AnnotationRevision, func(annotations map[string]string, key string) bool {
+		if cur, ok := annotations[key]; cur == rev || (ok && !force) {
+			return false
+		}
+		annotations[key] = rev
+		return true
+	})
+}
+
+// annotationEdit runs edit on the annotations of each OCI manifest selected by name, see [WithAnnotation].
+// Edit is called with the key stripped of any platform selector and returns true when the map was changed.
+func annotationEdit(name string, edit func(annotations map[string]string, key string) bool) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		key, match, err := annotationSelect(name)
+		if err != nil {
+			return err
+		}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || !match(dm) {
+				return nil
+			}
+			om := dm.m.GetOrig()
+			changed := false
+			switch mt := dm.m.GetDescriptor().MediaType; mt {
+			case mediatype.OCI1ManifestList:
+				ociI, err := manifest.OCIIndexFromAny(om)
+				if err != nil {
+					return err
+				}
+				if ociI.Annotations == nil {
+					ociI.Annotations = map[string]string{}
+				}
+				changed = edit(ociI.Annotations, key)
+				if len(ociI.Annotations) == 0 {
+					ociI.Annotations = nil
+				}
+				err = manifest.OCIIndexToAny(ociI, &om)
+				if err != nil {
+					return err
+				}
+			case mediatype.OCI1Manifest:
+				ociM, err := manifest.OCIManifestFromAny(om)
+				if err != nil {
+					return err
+				}
+				if ociM.Annotations == nil {
+					ociM.Annotations = map[string]string{}
+				}
+				changed = edit(ociM.Annotations, key)
+				if len(ociM.Annotations) == 0 {
+					ociM.Annotations = nil
+				}
+				err = manifest.OCIManifestToAny(ociM, &om)
+				if err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("annotations are not supported on media type %s, convert to OCI first%.0w", mt, errs.ErrUnsupportedMediaType)
+			}
+			if !changed {
+				return nil
+			}
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			err := dm.m.SetOrig(om)
+			if err != nil {
+				return err
+			}
+			dm.newDesc = dm.m.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithAnnotationCreatedAuto sets the created annotation on the top level manifest to the time of the modification.
+// When [WithConfigTimestamp] or [WithLayerTimestamp] is used, the time from that [OptTime] is used instead,
+// including a time read from a label, and otherwise the SOURCE_DATE_EPOC environment variable is used when defined.
+// The result is limited by the earliest Clamp from those options.
+// An existing created annotation, including one set by [WithAnnotation], is not changed.
+func WithAnnotationCreatedAuto() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted {
+				return nil
+			}
+			ma, ok := dm.m.(manifest.Annotator)
+			if !ok {
+				return fmt.Errorf("manifest does not support annotations: %s%.0w", dm.m.GetDescriptor().MediaType, errs.ErrUnsupportedMediaType)
+			}
+			annotations, err := ma.GetAnnotations()
+			if err != nil {
+				return err
+			}
+			if annotations[types.AnnotationCreated] != "" {
+				return nil
+			}
+			t := dc.timeSet
+			if t.IsZero() {
+				t = timeNow()
+			}
+			t, _ = timeModOpt(t, OptTime{Clamp: dc.timeClamp})
+			err = ma.SetAnnotation(types.AnnotationCreated, t.UTC().Format(time.RFC3339))
+			if err != nil {
+				return err
+			}
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			dm.newDesc = dm.m.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithAnnotationOCIBase adds annotations for the base image.
 func WithAnnotationOCIBase(rBase ref.Ref, dBase digest.Digest) Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -235,6 +413,53 @@ func WithAnnotationPromoteCommon() Opts {
 	}
 }
 
+// WithAttachReferrer pushes an artifact with content as the only layer, and the modified image as the subject.
+// The artifact is pushed after the modified image, using the referrers API or the fallback tag when the registry does not support it.
+func WithAttachReferrer(artifactType, mediaType string, content io.Reader) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if artifactType == "" || mediaType == "" {
+			return fmt.Errorf("artifact type and media type are required to attach a referrer%.0w", errs.ErrUnsupportedMediaType)
+		}
+		if content == nil {
+			return fmt.Errorf("content is required to attach a referrer")
+		}
+		dc.stepsPushed = append(dc.stepsPushed, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			dSubject := dm.m.GetDescriptor()
+			dConfig, err := dc.blobPut(ctx, rc, rTgt, descriptor.Descriptor{
+				MediaType: mediatype.OCI1Empty,
+				Digest:    descriptor.EmptyDigest,
+				Size:      int64(len(descriptor.EmptyData)),
+			}, bytes.NewReader(descriptor.EmptyData))
+			if err != nil {
+				return fmt.Errorf("failed to push referrer config: %w", err)
+			}
+			dConfig.MediaType = mediatype.OCI1Empty
+			dLayer, err := dc.blobPut(ctx, rc, rTgt, descriptor.Descriptor{MediaType: mediaType}, content)
+			if err != nil {
+				return fmt.Errorf("failed to push referrer content: %w", err)
+			}
+			dLayer.MediaType = mediaType
+			m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+				Versioned:    v1.ManifestSchemaVersion,
+				MediaType:    mediatype.OCI1Manifest,
+				ArtifactType: artifactType,
+				Config:       dConfig,
+				Layers:       []descriptor.Descriptor{dLayer},
+				Subject: &descriptor.Descriptor{
+					MediaType: dSubject.MediaType,
+					Digest:    dSubject.Digest,
+					Size:      dSubject.Size,
+				},
+			}))
+			if err != nil {
+				return err
+			}
+			return dc.manifestPut(ctx, rc, rTgt.SetDigest(m.GetDescriptor().Digest.String()), m, regclient.WithManifestChild())
+		})
+		return nil
+	}
+}
+
 // WithLabelToAnnotation copies image config labels to manifest annotations.
 func WithLabelToAnnotation() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -330,7 +555,102 @@ func WithManifestDigestAlgo(algo digest.Algorithm) Opts {
 	}
 }
 
+// WithManifestIndent sets the JSON formatting of every pushed manifest.
+// An empty indent outputs compact JSON, which matches the default formatting of modified manifests.
+// Since the digest is computed over the exact bytes, changing the formatting changes the digest of each manifest.
+// Docker schema1 signed manifests are not reformatted.
+func WithManifestIndent(indent string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if strings.Trim(indent, " \t") != "" {
+			return fmt.Errorf("manifest indent may only contain spaces and tabs: %q%.0w", indent, errs.ErrUnsupported)
+		}
+		dc.manifestIndent = &indent
+		return nil
+	}
+}
+
+// manifestFormat returns the manifest with the body reformatted, and true if the body was changed.
+func manifestFormat(m manifest.Manifest, indent string) (manifest.Manifest, bool, error) {
+	desc := m.GetDescriptor()
+	if desc.MediaType == mediatype.Docker1ManifestSigned {
+		return m, false, nil
+	}
+	raw, err := m.RawBody()
+	if err != nil {
+		return m, false, err
+	}
+	buf := &bytes.Buffer{}
+	if indent == "" {
+		err = json.Compact(buf, raw)
+	} else {
+		err = json.Indent(buf, raw, "", indent)
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("failed to format manifest: %w", err)
+	}
+	if bytes.Equal(raw, buf.Bytes()) {
+		return m, false, nil
+	}
+	algo := desc.DigestAlgo()
+	desc.Digest = ""
+	desc.Size = 0
+	err = desc.DigestAlgoPrefer(algo)
+	if err != nil {
+		return m, false, err
+	}
+	mFmt, err := manifest.New(
+		manifest.WithDesc(desc),
+		manifest.WithRaw(buf.Bytes()),
+	)
+	if err != nil {
+		return m, false, err
+	}
+	return mFmt, true, nil
+}
+
+// WithManifestSignatureStrip removes the signatures field from manifests, e.g. from legacy tooling that embedded a JWS.
+// The manifest is regenerated from the known fields of the media type.
+// Docker schema1 manifests are not supported and return an error.
+func WithManifestSignatureStrip() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsManifest = append(dc.stepsManifest, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted {
+				return nil
+			}
+			raw, err := dm.m.RawBody()
+			if err != nil {
+				return err
+			}
+			fields := map[string]json.RawMessage{}
+			err = json.Unmarshal(raw, &fields)
+			if err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+			if _, ok := fields["signatures"]; !ok {
+				return nil
+			}
+			switch dm.m.GetDescriptor().MediaType {
+			case mediatype.Docker1Manifest, mediatype.Docker1ManifestSigned:
+				return fmt.Errorf("unable to strip signatures from schema1 manifest%.0w", errs.ErrUnsupportedMediaType)
+			}
+			newM, err := manifest.New(manifest.WithOrig(dm.m.GetOrig()))
+			if err != nil {
+				return err
+			}
+			dm.m = newM
+			dm.newDesc = dm.m.GetDescriptor()
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithManifestToDocker converts the manifest to Docker schema2 media types.
+// Manifest lists are converted along with each child manifest, and the config and layer media types are changed to match.
+// Zstd layers use the Docker zstd layer media type, see [mediatype.Docker2LayerZstd].
 func WithManifestToDocker() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsManifest = append(dc.stepsManifest, func(c context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
@@ -440,6 +760,16 @@ func WithManifestToOCI() Opts {
 					ociM.Config.MediaType = mediatype.OCI1ImageConfig
 					changed = true
 				}
+				if dc.preserveMetadata && dm.m.GetDescriptor().MediaType == mediatype.Docker2Manifest && dm.config != nil && dm.config.oc != nil {
+					for k, v := range ociAnnotationsFromConfig(dm.config.oc.GetConfig()) {
+						if ociM.Annotations == nil {
+							ociM.Annotations = map[string]string{}
+						}
+						if _, ok := ociM.Annotations[k]; !ok {
+							ociM.Annotations[k] = v
+						}
+					}
+				}
 				for i, l := range ociM.Layers {
 					switch l.MediaType {
 					case mediatype.Docker2Layer:
@@ -451,6 +781,10 @@ func WithManifestToOCI() Opts {
 					case mediatype.Docker2ForeignLayer:
 						ociM.Layers[i].MediaType = mediatype.OCI1ForeignLayerGzip
 					default:
+						// reject docker media types that do not have an OCI equivalent
+						if strings.HasPrefix(l.MediaType, "application/vnd.docker.") {
+							return fmt.Errorf("unable to convert layer media type to OCI, mt=%s%.0w", l.MediaType, errs.ErrUnsupportedMediaType)
+						}
 						continue
 					}
 					changed = true
@@ -477,6 +811,57 @@ func WithManifestToOCI() Opts {
 	}
 }
 
+// labelSchemaToOCI maps the deprecated label-schema.org labels to the OCI annotation keys.
+var labelSchemaToOCI = map[string]string{
+	"org.label-schema.build-date":  types.AnnotationCreated,
+	"org.label-schema.description": types.AnnotationDescription,
+	"org.label-schema.name":        types.AnnotationTitle,
+	"org.label-schema.url":         types.AnnotationURL,
+	"org.label-schema.vcs-ref":     types.AnnotationRevision,
+	"org.label-schema.vcs-url":     types.AnnotationSource,
+	"org.label-schema.vendor":      types.AnnotationVendor,
+	"org.label-schema.version":     types.AnnotationVersion,
+}
+
+// ociAnnotationsFromConfig returns the OCI annotations for metadata found in an image config.
+// Labels with the "org.opencontainers.image." prefix take precedence over label-schema labels, which take precedence over the created and author fields.
+func ociAnnotationsFromConfig(oc v1.Image) map[string]string {
+	annotations := map[string]string{}
+	if oc.Created != nil {
+		annotations[types.AnnotationCreated] = oc.Created.UTC().Format(time.RFC3339)
+	}
+	if oc.Author != "" {
+		annotations[types.AnnotationAuthors] = oc.Author
+	}
+	for k, v := range oc.Config.Labels {
+		if ociK, ok := labelSchemaToOCI[k]; ok && v != "" {
+			annotations[ociK] = v
+		}
+	}
+	for k, v := range oc.Config.Labels {
+		if strings.HasPrefix(k, "org.opencontainers.image.") && v != "" {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// WithPreserveMetadata maps image config metadata to manifest annotations when [WithManifestToOCI] converts a Docker manifest.
+// The mapped fields are:
+//   - config "created" to "org.opencontainers.image.created"
+//   - config "author" to "org.opencontainers.image.authors"
+//   - labels prefixed with "org.opencontainers.image." to the annotation with the same key
+//   - label-schema.org labels (build-date, description, name, url, vcs-ref, vcs-url, vendor, version) to the equivalent OCI annotation
+//
+// Existing manifest annotations are not overwritten.
+// Layer and config descriptors, including urls, platform, and annotations, are already carried over by the conversion.
+func WithPreserveMetadata() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.preserveMetadata = true
+		return nil
+	}
+}
+
 const (
 	dockerReferenceType   = "vnd.docker.reference.type"
 	dockerReferenceDigest = "vnd.docker.reference.digest"
@@ -559,75 +944,194 @@ func WithManifestToOCIReferrers() Opts {
 	}
 }
 
+// WithMaxLayers returns an error when any image has more than n layers, e.g. 127 for overlayfs.
+// Each platform of a manifest list is checked separately, and the error lists each platform with the layer count.
+// This runs after other changes, so layers removed by options like [WithLayerRmIndex] are not counted.
+func WithMaxLayers(n int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if n < 1 {
+			return fmt.Errorf("max layers must be positive: %d%.0w", n, errs.ErrUnsupported)
+		}
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			problems := []string{}
+			err := dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted || dm.m.IsList() {
+					return dm, nil
+				}
+				count := 0
+				for _, dl := range dm.layers {
+					if dl.mod != deleted {
+						count++
+					}
+				}
+				if count <= n {
+					return dm, nil
+				}
+				name := dm.m.GetDescriptor().Digest.String()
+				if dm.config != nil && dm.config.oc != nil {
+					oc := dm.config.oc.GetConfig()
+					name = path.Join(oc.OS, oc.Architecture, oc.Variant)
+				}
+				problems = append(problems, fmt.Sprintf("%s (%d layers)", name, count))
+				return dm, nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("image exceeds %d layers, squash or remove layers: %s%.0w", n, strings.Join(problems, ", "), errs.ErrUnsupported)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
 // WithExternalURLsRm strips external URLs from descriptors and adjusts media type to match.
 func WithExternalURLsRm() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
 		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
-			if dm.mod == deleted {
+			if dm.mod == deleted || dm.m.IsList() {
 				return nil
 			}
-			changed := false
-			if dm.m.IsList() {
+			return externalURLsRm(dm)
+		})
+		return nil
+	}
+}
+
+// externalURLsRm strips external URLs from the layers of an image manifest.
+func externalURLsRm(dm *dagManifest) error {
+	changed := false
+	om := dm.m.GetOrig()
+	ociOM, err := manifest.OCIManifestFromAny(om)
+	if err != nil {
+		return err
+	}
+	// strip layers from image
+	for i := range ociOM.Layers {
+		if len(ociOM.Layers[i].URLs) > 0 {
+			ociOM.Layers[i].URLs = []string{}
+			mt := ociOM.Layers[i].MediaType
+			switch mt {
+			case mediatype.Docker2ForeignLayer:
+				mt = mediatype.Docker2LayerGzip
+			case mediatype.OCI1ForeignLayer:
+				mt = mediatype.OCI1Layer
+			case mediatype.OCI1ForeignLayerGzip:
+				mt = mediatype.OCI1LayerGzip
+			case mediatype.OCI1ForeignLayerZstd:
+				mt = mediatype.OCI1LayerZstd
+			}
+			ociOM.Layers[i].MediaType = mt
+			changed = true
+		}
+	}
+	// also strip from dag so other steps don't skip the external layer
+	for i, dl := range dm.layers {
+		if dl.mod == deleted {
+			continue
+		}
+		if dl.newDesc.Digest == "" && len(dl.desc.URLs) > 0 {
+			dl.newDesc = dl.desc
+		}
+		if len(dl.newDesc.URLs) > 0 {
+			dl.newDesc.URLs = []string{}
+			dm.layers[i] = dl
+		}
+	}
+	if !changed {
+		return nil
+	}
+	err = manifest.OCIManifestToAny(ociOM, &om)
+	if err != nil {
+		return err
+	}
+	err = dm.m.SetOrig(om)
+	if err != nil {
+		return err
+	}
+	dm.newDesc = dm.m.GetDescriptor()
+	if dm.mod == unchanged {
+		dm.mod = replaced
+	}
+	return nil
+}
+
+// WithExternalLayerInline pushes external layers to the target repository and strips the external URLs, making the image self-contained.
+// Each layer is pulled from the source repository, falling back to the layer URLs, and the digest is verified before the push.
+// The URLs are fetched with [http.DefaultClient] unless a client is set with [WithHTTPClient].
+// An error is returned when the layer cannot be retrieved or the content does not match the digest.
+func WithExternalLayerInline() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		pushed := map[digest.Digest]bool{}
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted || dm.m.IsList() {
 				return nil
 			}
-			om := dm.m.GetOrig()
-			ociOM, err := manifest.OCIManifestFromAny(om)
-			if err != nil {
-				return err
-			}
-			// strip layers from image
-			for i := range ociOM.Layers {
-				if len(ociOM.Layers[i].URLs) > 0 {
-					ociOM.Layers[i].URLs = []string{}
-					mt := ociOM.Layers[i].MediaType
-					switch mt {
-					case mediatype.Docker2ForeignLayer:
-						mt = mediatype.Docker2LayerGzip
-					case mediatype.OCI1ForeignLayer:
-						mt = mediatype.OCI1Layer
-					case mediatype.OCI1ForeignLayerGzip:
-						mt = mediatype.OCI1LayerGzip
-					case mediatype.OCI1ForeignLayerZstd:
-						mt = mediatype.OCI1LayerZstd
-					}
-					ociOM.Layers[i].MediaType = mt
-					changed = true
-				}
-			}
-			// also strip from dag so other steps don't skip the external layer
-			for i, dl := range dm.layers {
-				if dl.mod == deleted {
+			for _, dl := range dm.layers {
+				if dl.mod == deleted || len(dl.desc.URLs) == 0 || pushed[dl.desc.Digest] {
 					continue
 				}
-				if dl.newDesc.Digest == "" && len(dl.desc.URLs) > 0 {
-					dl.newDesc = dl.desc
+				rdr, err := externalLayerGet(ctx, rc, dc.httpClient, rSrc, dl.desc)
+				if err != nil {
+					return err
 				}
-				if len(dl.newDesc.URLs) > 0 {
-					dl.newDesc.URLs = []string{}
-					dm.layers[i] = dl
+				d := dl.desc
+				d.URLs = []string{}
+				_, err = dc.blobPut(ctx, rc, rTgt, d, rdr)
+				_ = rdr.Close()
+				if err != nil {
+					return fmt.Errorf("failed to push external layer %s: %w", d.Digest.String(), err)
 				}
+				pushed[dl.desc.Digest] = true
 			}
-			if !changed {
-				return nil
-			}
-			err = manifest.OCIManifestToAny(ociOM, &om)
-			if err != nil {
-				return err
-			}
-			err = dm.m.SetOrig(om)
-			if err != nil {
-				return err
-			}
-			dm.newDesc = dm.m.GetDescriptor()
-			if dm.mod == unchanged {
-				dm.mod = replaced
-			}
-			return nil
+			return externalURLsRm(dm)
 		})
 		return nil
 	}
 }
 
+// WithHTTPClient sets the client used to fetch external layers from their URLs, e.g. to configure a proxy, TLS, or timeouts.
+// Requests to the source and target registries continue to use the regclient configuration.
+func WithHTTPClient(hc *http.Client) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.httpClient = hc
+		return nil
+	}
+}
+
+// externalLayerGet returns a reader for an external layer, verifying the digest and size as the content is read.
+// The URLs are fetched with hc, or [http.DefaultClient] when hc is nil.
+func externalLayerGet(ctx context.Context, rc *regclient.RegClient, hc *http.Client, r ref.Ref, d descriptor.Descriptor) (io.ReadCloser, error) {
+	br, err := rc.BlobGet(ctx, r, d)
+	if err == nil {
+		return br, nil
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	for _, u := range d.URLs {
+		req, errReq := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if errReq != nil {
+			err = errReq
+			continue
+		}
+		resp, errResp := hc.Do(req)
+		if errResp != nil {
+			err = errResp
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("unexpected status %d from %s%.0w", resp.StatusCode, u, errs.ErrHTTPStatus)
+			continue
+		}
+		return blob.NewReader(blob.WithDesc(d), blob.WithResp(resp)), nil
+	}
+	return nil, fmt.Errorf("failed to get external layer %s from %s: %w%.0w", d.Digest.String(), strings.Join(d.URLs, ", "), err, errs.ErrNotFound)
+}
+
 // WithRebase attempts to rebase the image using OCI annotations identifying the base image.
 func WithRebase() Opts {
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -663,6 +1167,10 @@ func WithRebase() Opts {
 }
 
 // WithRebaseRefs swaps the base image layers from the old to the new reference.
+// The lower layers, diff_ids, and history entries of the image must match the old base exactly, otherwise ErrMismatch is returned.
+// Those entries are replaced with the layers, diff_ids, and history of the new base, and the layers above the base are kept.
+// For a manifest list, the base platform is selected to match each image.
+// See [WithRebase] to detect the base image from annotations.
 func WithRebaseRefs(rOld, rNew ref.Ref) Opts {
 	// cache old and new manifests, variable is nil until first pulled
 	return func(dc *dagConfig, dm *dagManifest) error {
@@ -879,3 +1387,86 @@ func rebaseAddStep(dc *dagConfig, rBaseOld, rBaseNew ref.Ref) error {
 	})
 	return nil
 }
+
+// WithRequireEmptyConfig returns an error if any image manifest has a Docker or OCI image config, e.g. to enforce a policy when publishing artifacts.
+// Artifacts with an empty config or a custom config media type pass this check.
+// The check runs after other changes, and the error lists the digest of each violating manifest with the config media type and size.
+func WithRequireEmptyConfig() Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			violations := []string{}
+			err := dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted || dm.m.IsList() || dm.config == nil || dm.config.oc == nil {
+					return dm, nil
+				}
+				cd := dm.config.oc.GetDescriptor()
+				violations = append(violations, fmt.Sprintf("%s (config %s, %d bytes)", dm.origDesc.Digest.String(), cd.MediaType, cd.Size))
+				return dm, nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(violations) > 0 {
+				return fmt.Errorf("manifests have an image config: %s%.0w", strings.Join(violations, ", "), errs.ErrUnsupportedMediaType)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithSubjectValidate verifies the subject of each manifest exists in the target repository.
+// Subjects within the image being modified are not checked since they are pushed with the image.
+// A missing subject returns ErrNotFound with the dangling digest, or when remove is true, the subject field is deleted.
+// The report function, if not nil, is called with each dangling subject descriptor.
+func WithSubjectValidate(remove bool, report func(descriptor.Descriptor)) Opts {
+	return func(dc *dagConfig, dmTop *dagManifest) error {
+		dc.stepsManifest = append(dc.stepsManifest, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			if dm.mod == deleted {
+				return nil
+			}
+			sm, ok := dm.m.(manifest.Subjecter)
+			if !ok {
+				return nil
+			}
+			subject, err := sm.GetSubject()
+			if err != nil || subject == nil || subject.Digest == "" {
+				return nil
+			}
+			// skip subjects included in the image
+			found := false
+			_ = dagWalkManifests(dmTop, func(dmCur *dagManifest) (*dagManifest, error) {
+				if dmCur.mod != deleted && (dmCur.m.GetDescriptor().Digest == subject.Digest || dmCur.origDesc.Digest == subject.Digest) {
+					found = true
+				}
+				return dmCur, nil
+			})
+			if found {
+				return nil
+			}
+			_, err = rc.ManifestHead(ctx, rTgt.SetDigest(subject.Digest.String()))
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, errs.ErrNotFound) {
+				return fmt.Errorf("failed to check subject %s: %w", subject.Digest.String(), err)
+			}
+			if report != nil {
+				report(*subject)
+			}
+			if !remove {
+				return fmt.Errorf("subject not found: %s%.0w", subject.Digest.String(), errs.ErrNotFound)
+			}
+			err = sm.SetSubject(nil)
+			if err != nil {
+				return err
+			}
+			if dm.mod == unchanged {
+				dm.mod = replaced
+			}
+			dm.newDesc = dm.m.GetDescriptor()
+			return nil
+		})
+		return nil
+	}
+}
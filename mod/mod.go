@@ -3,11 +3,18 @@ package mod
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -16,7 +23,10 @@ import (
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/pkg/archive"
 	"github.com/regclient/regclient/types/descriptor"
+	"github.com/regclient/regclient/types/errs"
+	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
+	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
 
@@ -24,10 +34,15 @@ import (
 type Opts func(*dagConfig, *dagManifest) error
 
 // OptTime defines time settings for [WithConfigTimestamp] and [WithLayerTimestamp].
+// Set is applied first, to every time after the After value, or to all times when After is zero.
+// Clamp is then applied to the result, reducing any time after Clamp down to Clamp while earlier times are preserved.
+// After only filters the Set value, and has no effect on Clamp.
+// Times in the base layers from BaseRef or BaseLayers are not changed by either Set or Clamp.
 type OptTime struct {
-	Set        time.Time // time to set, this or FromLabel are required
+	Set        time.Time // time to set, one of Set, FromLabel, or Clamp is required
 	FromLabel  string    // label from which to extract set time
 	After      time.Time // only change times that are after this
+	Clamp      time.Time // reduce any time after this to this value, after Set is applied
 	BaseRef    ref.Ref   // define base image, do not alter timestamps from base layers
 	BaseLayers int       // define a number of layers to not modify (count of the layers in a base image)
 }
@@ -74,7 +89,12 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 		stepsOCIConfig: []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagOCIConfig) error{},
 		stepsLayer:     []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, io.ReadCloser) (io.ReadCloser, error){},
 		stepsLayerFile: []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagLayer, *tar.Header, io.Reader) (*tar.Header, io.Reader, changes, error){},
-		maxDataSize:    -1, // unchanged, if a data field exists, preserve it
+		stepsFinal:     []func(context.Context, *regclient.RegClient, ref.Ref, ref.Ref, *dagManifest) error{},
+		maxDataSize:    -1,  // unchanged, if a data field exists, preserve it
+		gzipOS:         255, // unknown, the compress/gzip default
+		muSteps:        &sync.Mutex{},
+		muReport:       &sync.Mutex{},
+		muProgress:     &sync.Mutex{},
 		rTgt:           rTgt,
 	}
 	for _, opt := range opts {
@@ -113,8 +133,16 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 			return rTgt, err
 		}
 	}
-	if len(dc.stepsLayer) > 0 || len(dc.stepsLayerFile) > 0 || !ref.EqualRepository(rSrc, rTgt) || dc.forceLayerWalk {
-		err = dagWalkLayers(dm, func(dl *dagLayer) (*dagLayer, error) {
+	if len(dc.stepsLayer) > 0 || len(dc.stepsLayerFile) > 0 || len(dc.stepsLayerFileFinal) > 0 || !ref.EqualRepository(rSrc, rTgt) || dc.forceLayerWalk {
+		layerFn := func(ctx context.Context, dl *dagLayer) (*dagLayer, error) {
+			var copyBuf []byte
+			if dc.blobChunkSize > 0 {
+				copyBuf = make([]byte, dc.blobChunkSize)
+			} else {
+				bufP := copyBufPool.Get().(*[]byte)
+				defer copyBufPool.Put(bufP)
+				copyBuf = *bufP
+			}
 			var rdr io.ReadCloser
 			defer func() {
 				if rdr != nil {
@@ -131,31 +159,32 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 				return dl, nil
 			}
 			if len(dc.stepsLayer) > 0 {
-				bRdr, err := rc.BlobGet(ctx, rSrc, dl.desc)
+				rdr, err = dc.layerGet(ctx, rc, rSrc, dl.desc)
 				if err != nil {
 					return nil, err
 				}
-				rdr = bRdr
 				for _, sl := range dc.stepsLayer {
+					unlock := dc.lock(dc.muSteps)
 					rdrNext, err := sl(ctx, rc, rSrc, rTgt, dl, rdr)
+					unlock()
 					if err != nil {
 						return nil, err
 					}
 					rdr = rdrNext
 				}
 			}
-			if len(dc.stepsLayerFile) > 0 && inListStr(dl.desc.MediaType, mtKnownTar) {
+			if (len(dc.stepsLayerFile) > 0 || len(dc.stepsLayerFileFinal) > 0) && inListStr(dl.desc.MediaType, mtKnownTar) {
 				if dl.mod == deleted {
 					return dl, nil
 				}
 				if rdr == nil {
-					bRdr, err := rc.BlobGet(ctx, rSrc, dl.desc)
+					rdr, err = dc.layerGet(ctx, rc, rSrc, dl.desc)
 					if err != nil {
 						return nil, err
 					}
-					rdr = bRdr
 				}
-				changed := false
+				// layers modified by the earlier steps must be written from the tar since the reader is consumed
+				changed := dl.mod == replaced || dl.mod == added
 				empty := true
 				desc := dl.desc
 				if dl.newDesc.MediaType != "" {
@@ -172,40 +201,36 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 				}
 				// setup tar reader to process layer
 				tr := tar.NewReader(rdr)
-				// create temp file and setup tar writer
-				fh, err := os.CreateTemp("", "regclient-mod-")
-				if err != nil {
-					_ = rdr.Close()
-					return nil, err
-				}
-				defer func() {
-					_ = fh.Close()
-					_ = os.Remove(fh.Name())
-				}()
+				// create temp buffer and setup tar writer
+				fh := dc.spillBuffer()
+				defer fh.Close()
 				var tw *tar.Writer
 				var gw *gzip.Writer
 				var zw *zstd.Encoder
 				digRaw := desc.DigestAlgo().Digester() // raw/compressed digest
 				digUC := desc.DigestAlgo().Digester()  // uncompressed digest
-				if dl.desc.MediaType == mediatype.Docker2LayerGzip || dl.desc.MediaType == mediatype.OCI1LayerGzip {
+				if desc.MediaType == mediatype.Docker2LayerGzip || desc.MediaType == mediatype.OCI1LayerGzip {
 					cw := io.MultiWriter(fh, digRaw.Hash())
-					gw = gzip.NewWriter(cw)
-					defer gw.Close()
+					gw = dc.gzipWriter(cw)
+					defer func() {
+						_ = gw.Close()
+						gzipWriterPool.Put(gw)
+					}()
 					ucw := io.MultiWriter(gw, digUC.Hash())
-					tw = tar.NewWriter(ucw)
-				} else if dl.desc.MediaType == mediatype.Docker2LayerZstd || dl.desc.MediaType == mediatype.OCI1LayerZstd {
+					tw = tar.NewWriter(dc.progressWriter(ucw, dl.desc.Digest, ProgressRewrite))
+				} else if desc.MediaType == mediatype.Docker2LayerZstd || desc.MediaType == mediatype.OCI1LayerZstd {
 					cw := io.MultiWriter(fh, digRaw.Hash())
-					zw, err = zstd.NewWriter(cw)
+					zw, err = zstd.NewWriter(cw, dc.zstdEncoderOpts()...)
 					if err != nil {
 						_ = rdr.Close()
 						return nil, err
 					}
 					defer zw.Close()
 					ucw := io.MultiWriter(zw, digUC.Hash())
-					tw = tar.NewWriter(ucw)
+					tw = tar.NewWriter(dc.progressWriter(ucw, dl.desc.Digest, ProgressRewrite))
 				} else {
 					dw := io.MultiWriter(fh, digRaw.Hash(), digUC.Hash())
-					tw = tar.NewWriter(dw)
+					tw = tar.NewWriter(dc.progressWriter(dw, dl.desc.Digest, ProgressRewrite))
 				}
 				// iterate over files in the layer
 				for {
@@ -221,7 +246,9 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 					fileRdr = tr
 					for _, slf := range dc.stepsLayerFile {
 						var changeCur changes
+						unlock := dc.lock(dc.muSteps)
 						th, fileRdr, changeCur, err = slf(ctx, rc, rSrc, rTgt, dl, th, fileRdr)
+						unlock()
 						if err != nil {
 							_ = rdr.Close()
 							return nil, err
@@ -236,6 +263,15 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 					}
 					// copy th and tr to temp tar writer file
 					if changeFile != deleted {
+						for _, slf := range dc.stepsLayerFileFinal {
+							unlock := dc.lock(dc.muSteps)
+							fileRdr, err = slf(ctx, rc, rSrc, rTgt, dl, th, fileRdr)
+							unlock()
+							if err != nil {
+								_ = rdr.Close()
+								return nil, err
+							}
+						}
 						empty = false
 						err = tw.WriteHeader(th)
 						if err != nil {
@@ -243,7 +279,11 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 							return nil, err
 						}
 						if th.Typeflag == tar.TypeReg && th.Size > 0 {
-							_, err := io.CopyN(tw, fileRdr, th.Size)
+							var n int64
+							n, err = io.CopyBuffer(tw, io.LimitReader(fileRdr, th.Size), copyBuf)
+							if err == nil && n < th.Size {
+								err = io.ErrUnexpectedEOF
+							}
 							if err != nil {
 								_ = rdr.Close()
 								return nil, err
@@ -281,17 +321,13 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 						return nil, fmt.Errorf("failed to close layer reader: %w", err)
 					}
 					// replace the current reader and save the digests
-					l, err := fh.Seek(0, 1)
+					fhRdr, err := fh.Reader()
 					if err != nil {
 						return nil, err
 					}
-					_, err = fh.Seek(0, 0)
-					if err != nil {
-						return nil, err
-					}
-					rdr = fh
+					rdr = readCloserFn{Reader: fhRdr, closeFn: fh.Close}
 					desc.Digest = digRaw.Digest()
-					desc.Size = l
+					desc.Size = fh.Size()
 					dl.newDesc = desc
 					dl.ucDigest = digUC.Digest()
 					if dl.mod == unchanged {
@@ -302,7 +338,14 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 			// if added or replaced, and reader not nil, push blob
 			if (dl.mod == added || dl.mod == replaced) && rdr != nil {
 				// push the blob and verify the results
-				dNew, err := rc.BlobPut(ctx, rTgt, dl.newDesc, rdr)
+				// retries seek the underlying temp file rather than the closing wrapper
+				var srcRdr io.Reader = rdr
+				if rcf, ok := rdr.(readCloserFn); ok {
+					srcRdr = rcf.Reader
+				}
+				dNew, err := dc.blobPutRetry(ctx, rc, rTgt, dl.newDesc, srcRdr, func(srcRdr io.Reader) io.Reader {
+					return dc.blobChunkWrap(dc.progressReader(srcRdr, dl.desc.Digest, ProgressPush, dl.newDesc.Size))
+				})
 				if err != nil {
 					return nil, err
 				}
@@ -322,13 +365,27 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 				}
 			}
 			if dl.mod == unchanged && !ref.EqualRepository(rSrc, rTgt) {
-				err = rc.BlobCopy(ctx, rSrc, rTgt, dl.desc)
+				err = dc.blobCopy(ctx, rc, rSrc, rTgt, dl.desc)
 				if err != nil {
 					return nil, err
 				}
 			}
 			return dl, nil
-		})
+		}
+		if dc.concurrency > 1 {
+			err = dagWalkLayersConcurrent(ctx, dm, dc.concurrency, layerFn)
+		} else {
+			err = dagWalkLayers(dm, func(dl *dagLayer) (*dagLayer, error) {
+				return layerFn(ctx, dl)
+			})
+		}
+		if err != nil {
+			return rTgt, err
+		}
+	}
+
+	for _, fn := range dc.stepsFinal {
+		err = fn(ctx, rc, rSrc, rTgt, dm)
 		if err != nil {
 			return rTgt, err
 		}
@@ -341,9 +398,241 @@ func Apply(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...O
 	if rTgt.Tag == "" {
 		rTgt.Digest = dm.m.GetDescriptor().Digest.String()
 	}
+	if len(dc.stepsPushed) > 0 {
+		rPushed := rTgt.SetDigest(dm.m.GetDescriptor().Digest.String())
+		for _, fn := range dc.stepsPushed {
+			err = fn(ctx, rc, rSrc, rPushed, dm)
+			if err != nil {
+				return rTgt, err
+			}
+		}
+	}
+	if dc.discardPush != nil && dc.discardPush.fn != nil {
+		dc.discardPush.report.Duration = time.Since(dc.discardPush.start)
+		dc.discardPush.fn(dc.discardPush.report)
+	}
+	if dc.dryRun != nil {
+		dc.dryRun(dryRunReport(rTgt.SetDigest(dm.m.GetDescriptor().Digest.String()), dm))
+	}
 	return rTgt, nil
 }
 
+// GetFile returns the content of a file from the layers of an image without modifying the image.
+// Later layers override earlier ones, and ErrFileNotFound is returned when the file does not exist or was removed with a whiteout.
+// When r is a manifest list, the image for the local platform is used.
+func GetFile(ctx context.Context, rc *regclient.RegClient, r ref.Ref, filename string) ([]byte, error) {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if m.IsList() {
+		p := platform.Local()
+		d, err := manifest.GetPlatformDesc(m, &p)
+		if err != nil {
+			return nil, err
+		}
+		m, err = rc.ManifestGet(ctx, r.SetDigest(d.Digest.String()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, fmt.Errorf("manifest is not an image: %s%.0w", m.GetDescriptor().MediaType, errs.ErrUnsupportedMediaType)
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	dm := &dagManifest{m: m}
+	for _, l := range layers {
+		dm.layers = append(dm.layers, &dagLayer{desc: l})
+	}
+	return layerFileRead(ctx, rc, r, r, dm, filename)
+}
+
+// CompressionReport lists the compression of the layers for each image in a reference, see [InspectCompression].
+type CompressionReport struct {
+	Images []CompressionImage           // list of images, one per platform when the reference is an index
+	Counts map[archive.CompressType]int // number of tar layers using each compression
+	Other  int                          // number of layers that are not a known tar media type
+}
+
+// CompressionImage describes the layer compression of a single image manifest.
+type CompressionImage struct {
+	Desc     descriptor.Descriptor // image manifest descriptor
+	Platform *platform.Platform    // platform from the index, nil when the reference is an image
+	Layers   []CompressionLayer    // list of layers in the image
+}
+
+// CompressionLayer describes the compression of a single layer.
+type CompressionLayer struct {
+	Desc        descriptor.Descriptor // layer descriptor
+	Tar         bool                  // true when the media type is a known tar layer
+	Compression archive.CompressType  // compression based on the media type, only valid for tar layers
+}
+
+// InspectCompression reports the compression of each layer for every image in r without modifying the image.
+// The compression is determined by the media type of each layer descriptor, and blob content is not downloaded.
+func InspectCompression(ctx context.Context, rc *regclient.RegClient, r ref.Ref) (CompressionReport, error) {
+	report := CompressionReport{
+		Images: []CompressionImage{},
+		Counts: map[archive.CompressType]int{},
+	}
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return report, err
+	}
+	type entry struct {
+		m manifest.Manifest
+		p *platform.Platform
+	}
+	entries := []entry{}
+	if mi, ok := m.(manifest.Indexer); ok {
+		dl, err := mi.GetManifestList()
+		if err != nil {
+			return report, err
+		}
+		for _, d := range dl {
+			mc, err := rc.ManifestGet(ctx, r.SetDigest(d.Digest.String()), regclient.WithManifestDesc(d))
+			if err != nil {
+				return report, fmt.Errorf("failed to get manifest %s: %w", d.Digest.String(), err)
+			}
+			entries = append(entries, entry{m: mc, p: d.Platform})
+		}
+	} else {
+		entries = append(entries, entry{m: m})
+	}
+	for _, e := range entries {
+		mi, ok := e.m.(manifest.Imager)
+		if !ok {
+			continue
+		}
+		layers, err := mi.GetLayers()
+		if err != nil {
+			return report, err
+		}
+		ci := CompressionImage{
+			Desc:     e.m.GetDescriptor(),
+			Platform: e.p,
+			Layers:   make([]CompressionLayer, 0, len(layers)),
+		}
+		for _, l := range layers {
+			cl := CompressionLayer{
+				Desc: l,
+				Tar:  inListStr(l.MediaType, mtKnownTar),
+			}
+			switch l.MediaType {
+			case mediatype.OCI1LayerGzip, mediatype.Docker2LayerGzip:
+				cl.Compression = archive.CompressGzip
+			case mediatype.OCI1LayerZstd, mediatype.Docker2LayerZstd:
+				cl.Compression = archive.CompressZstd
+			default:
+				cl.Compression = archive.CompressNone
+			}
+			if cl.Tar {
+				report.Counts[cl.Compression]++
+			} else {
+				report.Other++
+			}
+			ci.Layers = append(ci.Layers, cl)
+		}
+		report.Images = append(report.Images, ci)
+	}
+	return report, nil
+}
+
+// Verify recomputes the digests of an image and compares them to the expected values without modifying the image.
+// Keys in expected are "manifest", "config", and "layer/<n>", where layers are compared by their uncompressed digest (diff_id).
+// Images in an index are prefixed by their platform, e.g. "linux/amd64/config", or by their digest when the platform is missing or repeated.
+// Digests that are not listed in expected are not checked, and an error wrapping ErrMismatch lists every mismatched or missing key.
+func Verify(ctx context.Context, rc *regclient.RegClient, r ref.Ref, expected map[string]digest.Digest) error {
+	dm, err := dagGet(ctx, rc, r, descriptor.Descriptor{})
+	if err != nil {
+		return err
+	}
+	computed := map[string]digest.Digest{}
+	// layers shared between platforms are only pulled once
+	ucDigests := map[digest.Digest]digest.Digest{}
+	err = verifyWalk(ctx, rc, r, dm, "", computed, ucDigests)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mismatches := []string{}
+	for _, k := range keys {
+		dig, ok := computed[k]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s not found", k))
+		} else if dig != expected[k] {
+			mismatches = append(mismatches, fmt.Sprintf("%s has digest %s, expected %s", k, dig.String(), expected[k].String()))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("image %s does not match the expected digests: %s%.0w", r.CommonName(), strings.Join(mismatches, ", "), errs.ErrMismatch)
+	}
+	return nil
+}
+
+// verifyWalk adds the recomputed digests of a manifest and its children to computed, using prefix for the keys.
+func verifyWalk(ctx context.Context, rc *regclient.RegClient, r ref.Ref, dm *dagManifest, prefix string, computed map[string]digest.Digest, ucDigests map[digest.Digest]digest.Digest) error {
+	raw, err := dm.m.RawBody()
+	if err != nil {
+		return err
+	}
+	computed[prefix+"manifest"] = dm.origDesc.DigestAlgo().FromBytes(raw)
+	if dm.m.IsList() {
+		ociI, err := manifest.OCIIndexFromAny(dm.m.GetOrig())
+		if err != nil {
+			return err
+		}
+		used := map[string]bool{}
+		for i, child := range dm.manifests {
+			name := child.origDesc.Digest.String()
+			if i < len(ociI.Manifests) && ociI.Manifests[i].Platform != nil && !used[ociI.Manifests[i].Platform.String()] {
+				name = ociI.Manifests[i].Platform.String()
+			}
+			used[name] = true
+			err = verifyWalk(ctx, rc, r.SetDigest(child.origDesc.Digest.String()), child, prefix+name+"/", computed, ucDigests)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	mi, ok := dm.m.(manifest.Imager)
+	if !ok {
+		return nil
+	}
+	if dm.config != nil && dm.config.oc != nil {
+		cd, err := mi.GetConfig()
+		if err != nil {
+			return err
+		}
+		raw, err := dm.config.oc.RawBody()
+		if err != nil {
+			return err
+		}
+		computed[prefix+"config"] = cd.DigestAlgo().FromBytes(raw)
+	}
+	for i, dl := range dm.layers {
+		ucDig, ok := ucDigests[dl.desc.Digest]
+		if !ok {
+			ucDig, err = layerGetUCDigest(ctx, rc, r, dl.desc)
+			if err != nil {
+				return fmt.Errorf("failed to get uncompressed digest for layer %d: %w", i, err)
+			}
+			ucDigests[dl.desc.Digest] = ucDig
+		}
+		computed[fmt.Sprintf("%slayer/%d", prefix, i)] = ucDig
+	}
+	return nil
+}
+
 // WithRefTgt sets the target manifest.
 // Apply will default to pushing to the same name by digest.
 func WithRefTgt(rTgt ref.Ref) Opts {
@@ -362,6 +651,483 @@ func WithData(maxDataSize int64) Opts {
 	}
 }
 
+// WithDataConfig sets the descriptor data field max size for the config, overriding [WithData].
+func WithDataConfig(maxDataSize int64) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.maxDataConfig = &maxDataSize
+		return nil
+	}
+}
+
+// WithDataLayer sets the descriptor data field max size for layers, overriding [WithData].
+func WithDataLayer(maxDataSize int64) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.maxDataLayer = &maxDataSize
+		return nil
+	}
+}
+
+// WithExpectedDigest verifies the digest of the resulting top level manifest matches d, e.g. to detect a non-deterministic change in a reproducible pipeline.
+// When the digest does not match, ErrDigestMismatch is returned with both digests before the top level manifest is pushed.
+func WithExpectedDigest(d digest.Digest) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		err := d.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid expected digest %s: %w", d.String(), err)
+		}
+		dc.expectedDigest = d
+		return nil
+	}
+}
+
+// DiscardPushReport summarizes the content that would have been pushed with [WithDiscardPush].
+type DiscardPushReport struct {
+	Blobs     int           // number of blobs processed
+	Manifests int           // number of manifests processed
+	Bytes     int64         // total size of the blobs and manifests
+	Duration  time.Duration // time from processing the options until Apply completes
+}
+
+type discardPush struct {
+	report DiscardPushReport
+	start  time.Time
+	fn     func(DiscardPushReport)
+}
+
+// WithDiscardPush processes all modifications, but discards the blobs and manifests instead of pushing them.
+// Digests are still computed, allowing the cost of modifications to be measured without the network.
+// If fn is not nil, it is called with a summary when Apply completes.
+// Options that read modified content back from the target, like [WithData] or validating added layers, will fail.
+func WithDiscardPush(fn func(DiscardPushReport)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.discardPush = &discardPush{
+			start: time.Now(),
+			fn:    fn,
+		}
+		return nil
+	}
+}
+
+// DryRunReport describes the changes Apply would make with [WithDryRun].
+type DryRunReport struct {
+	Ref       ref.Ref          // target reference, including the digest of the top level manifest
+	Manifests []DryRunManifest // list of manifests, children are listed before their parent, and referrers before their subject
+}
+
+// DryRunManifest describes the change to a single manifest.
+type DryRunManifest struct {
+	Change        string                // one of "unchanged", "added", "replaced", or "deleted"
+	Desc          descriptor.Descriptor // original manifest descriptor, empty for added manifests
+	NewDesc       descriptor.Descriptor // manifest descriptor after the change, empty for deleted manifests
+	ConfigChanged bool                  // true when the config was modified
+	ConfigDesc    descriptor.Descriptor // config descriptor after the change, empty for manifest lists
+	Layers        []DryRunLayer         // list of layers in the image
+}
+
+// DryRunLayer describes the change to a single layer.
+type DryRunLayer struct {
+	Change  string                // one of "unchanged", "added", "replaced", or "deleted"
+	Desc    descriptor.Descriptor // original layer descriptor, empty for added layers
+	NewDesc descriptor.Descriptor // layer descriptor after the change, empty for deleted layers
+}
+
+// WithDryRun processes all modifications without pushing any blobs or manifests, calling fn with the changes when Apply completes.
+// The digests in the report match those of an Apply without this option.
+// The report is passed to a callback, like [WithDiscardPush], rather than changing the return values of Apply, see [ApplyDryRun] to return it directly.
+// Like [WithDiscardPush], options that read modified content back from the target will fail.
+func WithDryRun(fn func(DryRunReport)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if dc.discardPush == nil {
+			dc.discardPush = &discardPush{
+				start: time.Now(),
+			}
+		}
+		dc.dryRun = fn
+		return nil
+	}
+}
+
+// ApplyDryRun runs [Apply] with [WithDryRun], returning the report alongside the target reference.
+// Nothing is pushed to the registry, and the digests in the report match those of an Apply with the same options.
+// Apply keeps its signature, so existing callers are unaffected, and this is a shortcut for collecting the report from the [WithDryRun] callback.
+func ApplyDryRun(ctx context.Context, rc *regclient.RegClient, rSrc ref.Ref, opts ...Opts) (ref.Ref, DryRunReport, error) {
+	var report DryRunReport
+	optsDryRun := make([]Opts, 0, len(opts)+1)
+	optsDryRun = append(optsDryRun, opts...)
+	optsDryRun = append(optsDryRun, WithDryRun(func(r DryRunReport) {
+		report = r
+	}))
+	rTgt, err := Apply(ctx, rc, rSrc, optsDryRun...)
+	return rTgt, report, err
+}
+
+// dryRunReport generates the report for [WithDryRun] after the manifests are processed.
+func dryRunReport(rTgt ref.Ref, dm *dagManifest) DryRunReport {
+	report := DryRunReport{
+		Ref:       rTgt,
+		Manifests: []DryRunManifest{},
+	}
+	var walk func(dm *dagManifest)
+	walk = func(dm *dagManifest) {
+		for _, child := range dm.manifests {
+			walk(child)
+		}
+		for _, child := range dm.referrers {
+			walk(child)
+		}
+		entry := DryRunManifest{
+			Change: dm.mod.String(),
+			Layers: []DryRunLayer{},
+		}
+		if dm.mod != added {
+			entry.Desc = dm.origDesc
+		}
+		if dm.mod != deleted {
+			entry.NewDesc = dm.m.GetDescriptor()
+			if dm.config != nil {
+				entry.ConfigChanged = dm.config.modified
+				entry.ConfigDesc = dm.config.newDesc
+			}
+		}
+		for _, dl := range dm.layers {
+			le := DryRunLayer{
+				Change: dl.mod.String(),
+			}
+			switch dl.mod {
+			case unchanged:
+				le.Desc = dl.desc
+				le.NewDesc = dl.desc
+			case added:
+				le.NewDesc = dl.desc
+				if dl.newDesc.Digest != "" {
+					le.NewDesc = dl.newDesc
+				}
+			case replaced:
+				le.Desc = dl.desc
+				le.NewDesc = dl.newDesc
+			case deleted:
+				le.Desc = dl.desc
+			}
+			entry.Layers = append(entry.Layers, le)
+		}
+		report.Manifests = append(report.Manifests, entry)
+	}
+	walk(dm)
+	return report
+}
+
+// blobPut pushes a blob, or computes the digest when pushes are discarded.
+func (dc *dagConfig) blobPut(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d descriptor.Descriptor, rdr io.Reader) (descriptor.Descriptor, error) {
+	if dc.discardPush == nil {
+		return rc.BlobPut(ctx, r, d, rdr)
+	}
+	algo := digest.Canonical
+	if d.Digest != "" {
+		algo = d.Digest.Algorithm()
+	}
+	if !algo.Available() {
+		return descriptor.Descriptor{}, fmt.Errorf("digest algorithm is not available: %s%.0w", algo, errs.ErrUnsupported)
+	}
+	digester := algo.Digester()
+	n, err := io.Copy(digester.Hash(), rdr)
+	if err != nil {
+		return descriptor.Descriptor{}, err
+	}
+	if d.Digest != "" && d.Digest != digester.Digest() {
+		return descriptor.Descriptor{}, fmt.Errorf("blob digest mismatch, expected %s, computed %s%.0w", d.Digest, digester.Digest(), errs.ErrDigestMismatch)
+	}
+	if d.Size > 0 && d.Size != n {
+		return descriptor.Descriptor{}, fmt.Errorf("blob size mismatch, expected %d, read %d%.0w", d.Size, n, errs.ErrMismatch)
+	}
+	unlock := dc.lock(dc.muReport)
+	dc.discardPush.report.Blobs++
+	dc.discardPush.report.Bytes += n
+	unlock()
+	return descriptor.Descriptor{
+		MediaType: d.MediaType,
+		Digest:    digester.Digest(),
+		Size:      n,
+	}, nil
+}
+
+// blobPutRetry pushes a blob with [dagConfig.blobPut], retrying failures when configured by [WithRetry].
+// The wrap function is applied to rdr on each attempt, and rdr is seeked back to its starting offset between attempts.
+func (dc *dagConfig) blobPutRetry(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d descriptor.Descriptor, rdr io.Reader, wrap func(io.Reader) io.Reader) (descriptor.Descriptor, error) {
+	if wrap == nil {
+		wrap = func(rdr io.Reader) io.Reader { return rdr }
+	}
+	attempts := dc.retryAttempts
+	var offset int64
+	rdrSeek, ok := rdr.(io.Seeker)
+	if ok {
+		var err error
+		offset, err = rdrSeek.Seek(0, io.SeekCurrent)
+		if err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		attempts = 0
+	}
+	delay := dc.retryDelay
+	for i := 0; ; i++ {
+		dNew, err := dc.blobPut(ctx, rc, r, d, wrap(rdr))
+		if err == nil || i >= attempts || !blobPutRetryable(err) {
+			return dNew, err
+		}
+		if _, errS := rdrSeek.Seek(offset, io.SeekStart); errS != nil {
+			return dNew, err
+		}
+		select {
+		case <-ctx.Done():
+			return dNew, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// blobPutRetryable returns true for push errors that may succeed when sent again.
+func blobPutRetryable(err error) bool {
+	if errors.Is(err, errs.ErrDigestMismatch) || errors.Is(err, errs.ErrMismatch) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var errStatus *errs.HTTPStatusError
+	return errors.As(err, &errStatus) && errStatus.StatusCode >= 500 && errStatus.StatusCode <= 599
+}
+
+// blobCopy copies a blob between repositories, or skips the copy when pushes are discarded.
+func (dc *dagConfig) blobCopy(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, d descriptor.Descriptor) error {
+	if dc.discardPush != nil {
+		return nil
+	}
+	// the registry copy is used within a registry to support blob mounts
+	if dc.blobChunkSize <= 0 || ref.EqualRegistry(rSrc, rTgt) {
+		return rc.BlobCopy(ctx, rSrc, rTgt, d)
+	}
+	d.URLs = []string{}
+	if _, err := rc.BlobHead(ctx, rTgt, d); err == nil {
+		return nil
+	}
+	br, err := rc.BlobGet(ctx, rSrc, d)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	_, err = rc.BlobPut(ctx, rTgt, d, dc.blobChunkWrap(br))
+	return err
+}
+
+// manifestPut pushes a manifest, or counts the manifest when pushes are discarded.
+func (dc *dagConfig) manifestPut(ctx context.Context, rc *regclient.RegClient, r ref.Ref, m manifest.Manifest, opts ...regclient.ManifestOpts) error {
+	if dc.discardPush == nil {
+		return rc.ManifestPut(ctx, r, m, opts...)
+	}
+	raw, err := m.RawBody()
+	if err != nil {
+		return err
+	}
+	dc.discardPush.report.Manifests++
+	dc.discardPush.report.Bytes += int64(len(raw))
+	return nil
+}
+
+// WithBlobDigestAlgo sets the digest algorithm for the config and layer blobs.
+// The config diff_ids are computed with the same algorithm as the layers.
+// Combine with [WithManifestDigestAlgo] to use a different algorithm for the manifests.
+func WithBlobDigestAlgo(algo digest.Algorithm) Opts {
+	layerOpt := WithLayerDigestAlgo(algo)
+	configOpt := WithConfigDigestAlgo(algo)
+	return func(dc *dagConfig, dm *dagManifest) error {
+		err := layerOpt(dc, dm)
+		if err != nil {
+			return err
+		}
+		err = configOpt(dc, dm)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+const (
+	bufSizeMin = 4 * 1024
+	bufSizeMax = 256 * 1024 * 1024
+)
+
+// WithBlobChunkSize sets the size of the I/O buffer used when streaming blobs in the layer walk and copy paths.
+// This buffers the file content copied into modified layers, the layers pushed after a change,
+// and the layers copied to a different registry. Larger buffers reduce the number of reads on large layers.
+// The size must be between 4KiB and 256MiB.
+// The chunk size used for uploads to a registry is configured separately with BlobChunk in the registry host config.
+func WithBlobChunkSize(bytes int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if bytes < bufSizeMin || bytes > bufSizeMax {
+			return fmt.Errorf("blob chunk size %d must be between %d and %d%.0w", bytes, bufSizeMin, bufSizeMax, errs.ErrUnsupported)
+		}
+		dc.blobChunkSize = bytes
+		return nil
+	}
+}
+
+// blobChunkWrap buffers reads from rdr with the size from [WithBlobChunkSize].
+// Seeking is preserved so a failed upload can be retried.
+func (dc *dagConfig) blobChunkWrap(rdr io.Reader) io.Reader {
+	if dc.blobChunkSize <= 0 {
+		return rdr
+	}
+	if rs, ok := rdr.(io.ReadSeeker); ok {
+		return &bufReadSeeker{Reader: bufio.NewReaderSize(rs, dc.blobChunkSize), rs: rs}
+	}
+	return bufio.NewReaderSize(rdr, dc.blobChunkSize)
+}
+
+// bufReadSeeker is a buffered reader that discards the buffer when seeking.
+type bufReadSeeker struct {
+	*bufio.Reader
+	rs io.ReadSeeker
+}
+
+func (brs *bufReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		// adjust for the data read from rs that is still in the buffer
+		offset -= int64(brs.Buffered())
+	}
+	n, err := brs.rs.Seek(offset, whence)
+	brs.Reset(brs.rs)
+	return n, err
+}
+
+// WithRetry retries a failed layer push up to attempts times, waiting baseDelay and doubling the delay after each failure.
+// Only server errors (http 5xx) and dropped connections are retried, a digest or size mismatch fails immediately.
+// Layers that cannot be read again from the start, e.g. unmodified layers streamed from the source, are only pushed once.
+func WithRetry(attempts int, baseDelay time.Duration) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if attempts < 1 {
+			return fmt.Errorf("retry attempts %d must be at least 1%.0w", attempts, errs.ErrUnsupported)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("retry delay %s must not be negative%.0w", baseDelay, errs.ErrUnsupported)
+		}
+		dc.retryAttempts = attempts
+		dc.retryDelay = baseDelay
+		return nil
+	}
+}
+
+// WithConcurrency processes up to n layers at the same time.
+// Manifests are pushed after all layers complete, and the first error cancels the remaining layers.
+// Options that process layers are run one at a time, while pulling, compressing, and pushing the layers run concurrently.
+func WithConcurrency(n int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if n < 1 {
+			return fmt.Errorf("concurrency %d must be at least 1%.0w", n, errs.ErrUnsupported)
+		}
+		dc.concurrency = n
+		return nil
+	}
+}
+
+// ProgressPhase is the stage of processing a layer reported by [WithProgress].
+type ProgressPhase int
+
+const (
+	ProgressPull    ProgressPhase = iota // reading the layer from the source
+	ProgressRewrite                      // writing the uncompressed content of a modified layer
+	ProgressPush                         // pushing the layer to the target
+)
+
+// String returns the name of the phase.
+func (p ProgressPhase) String() string {
+	switch p {
+	case ProgressPull:
+		return "pulling"
+	case ProgressRewrite:
+		return "rewriting"
+	case ProgressPush:
+		return "pushing"
+	}
+	return "unknown"
+}
+
+// ProgressEvent reports the bytes processed for a layer from [WithProgress].
+type ProgressEvent struct {
+	Digest digest.Digest // digest of the original layer, empty for some added layers
+	Phase  ProgressPhase // current phase of processing the layer
+	Bytes  int64         // bytes processed so far in the phase
+	Total  int64         // expected bytes for the phase, or 0 when unknown
+}
+
+// WithProgress calls fn as layers are pulled, rewritten, and pushed.
+// Events are sent while the content is streamed, not only when a layer completes.
+// Calls to fn are serialized, even with [WithConcurrency], so fn does not need to be safe for concurrent use.
+// The fn is called inline with the processing of the layer, a slow fn slows the apply.
+func WithProgress(fn func(ProgressEvent)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.progress = fn
+		return nil
+	}
+}
+
+// progressReader wraps rdr to send progress events for each read, returning rdr when progress is not configured.
+func (dc *dagConfig) progressReader(rdr io.Reader, d digest.Digest, phase ProgressPhase, total int64) io.Reader {
+	if dc.progress == nil {
+		return rdr
+	}
+	return &progressRW{dc: dc, rdr: rdr, ev: ProgressEvent{Digest: d, Phase: phase, Total: total}}
+}
+
+// progressWriter wraps w to send progress events for each write, returning w when progress is not configured.
+func (dc *dagConfig) progressWriter(w io.Writer, d digest.Digest, phase ProgressPhase) io.Writer {
+	if dc.progress == nil {
+		return w
+	}
+	return &progressRW{dc: dc, w: w, ev: ProgressEvent{Digest: d, Phase: phase}}
+}
+
+type progressRW struct {
+	dc  *dagConfig
+	rdr io.Reader
+	w   io.Writer
+	ev  ProgressEvent
+}
+
+func (prw *progressRW) Read(p []byte) (int, error) {
+	n, err := prw.rdr.Read(p)
+	prw.send(n)
+	return n, err
+}
+
+func (prw *progressRW) Write(p []byte) (int, error) {
+	n, err := prw.w.Write(p)
+	prw.send(n)
+	return n, err
+}
+
+func (prw *progressRW) send(n int) {
+	if n <= 0 {
+		return
+	}
+	prw.ev.Bytes += int64(n)
+	unlock := prw.dc.lock(prw.dc.muProgress)
+	prw.dc.progress(prw.ev)
+	unlock()
+}
+
+// lock acquires mu when layers are processed concurrently.
+// The returned function releases the lock.
+func (dc *dagConfig) lock(mu *sync.Mutex) func() {
+	if dc.concurrency <= 1 || mu == nil {
+		return func() {}
+	}
+	mu.Lock()
+	return mu.Unlock
+}
+
 // WithDigestAlgo sets the digest algorithm for both manifests and layers.
 func WithDigestAlgo(algo digest.Algorithm) Opts {
 	layerOpt := WithLayerDigestAlgo(algo)
@@ -384,6 +1150,234 @@ func WithDigestAlgo(algo digest.Algorithm) Opts {
 	}
 }
 
+// WithReadBuffer adds a read-ahead buffer to the blob reader when processing layers.
+// This reduces the number of small reads from the registry when parsing a layer tar.
+// The size must be between 4KiB and 256MiB.
+func WithReadBuffer(size int) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if size < bufSizeMin || size > bufSizeMax {
+			return fmt.Errorf("read buffer size %d must be between %d and %d%.0w", size, bufSizeMin, bufSizeMax, errs.ErrUnsupported)
+		}
+		dc.readBufferSize = size
+		return nil
+	}
+}
+
+// readBufferWrap adds the read-ahead buffer to a reader if configured.
+func (dc *dagConfig) readBufferWrap(rdr io.ReadCloser) io.ReadCloser {
+	if dc.readBufferSize <= 0 {
+		return rdr
+	}
+	return readCloserFn{
+		Reader:  bufio.NewReaderSize(rdr, dc.readBufferSize),
+		closeFn: rdr.Close,
+	}
+}
+
+// SizeReport summarizes the change in the compressed size of the layers from [WithSizeReport].
+type SizeReport struct {
+	Layers  []SizeReportLayer // list of layers, including unchanged, added, and deleted layers
+	Size    int64             // total compressed size of the layers before the change
+	NewSize int64             // total compressed size of the layers after the change
+}
+
+// SizeReportLayer describes the change in size of a single layer.
+type SizeReportLayer struct {
+	Desc    descriptor.Descriptor // original layer descriptor, empty for added layers
+	NewDesc descriptor.Descriptor // layer descriptor after the change, empty for deleted layers
+	Delta   int64                 // change in the compressed size
+}
+
+// layerGet returns a reader for a layer being modified.
+// When layers are processed concurrently, the blob is first copied to a temporary file.
+// Each worker then holds a single registry connection at a time, avoiding a deadlock on the per host connection limit
+// when every connection is used for a pull while waiting to push.
+func (dc *dagConfig) layerGet(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d descriptor.Descriptor) (io.ReadCloser, error) {
+	br, err := rc.BlobGet(ctx, r, d)
+	if err != nil {
+		return nil, err
+	}
+	pr := dc.progressReader(br, d.Digest, ProgressPull, d.Size)
+	if dc.concurrency <= 1 {
+		return dc.readBufferWrap(readCloserFn{Reader: pr, closeFn: br.Close}), nil
+	}
+	fh := dc.spillBuffer()
+	_, err = io.Copy(fh, pr)
+	_ = br.Close()
+	var fhRdr io.Reader
+	if err == nil {
+		fhRdr, err = fh.Reader()
+	}
+	if err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+	return dc.readBufferWrap(readCloserFn{Reader: fhRdr, closeFn: fh.Close}), nil
+}
+
+// WithTempDir sets the directory for temporary files created when layers are modified.
+// The default is the directory from [os.TempDir].
+func WithTempDir(dir string) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("failed to access temp dir %s: %w", dir, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("temp dir %s is not a directory%.0w", dir, errs.ErrUnsupported)
+		}
+		dc.tempDir = dir
+		return nil
+	}
+}
+
+// WithMemoryLimit sets the size of a modified layer that is held in memory before it is moved to a temporary file.
+// This avoids the disk for images with many small layers.
+// With [WithConcurrency], each layer being processed may use up to the limit.
+// The default is 0, all modified layers are written to a temporary file.
+func WithMemoryLimit(size int64) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		if size < 0 {
+			return fmt.Errorf("memory limit %d must not be negative%.0w", size, errs.ErrUnsupported)
+		}
+		dc.memoryLimit = size
+		return nil
+	}
+}
+
+// spillBuffer returns a buffer for a layer being modified, using the configured temp dir and memory limit.
+func (dc *dagConfig) spillBuffer() *spillBuffer {
+	return &spillBuffer{dir: dc.tempDir, limit: dc.memoryLimit}
+}
+
+// spillBuffer holds content in memory up to a limit, moving the content to a temporary file when the limit is exceeded.
+type spillBuffer struct {
+	dir    string
+	limit  int64
+	buf    bytes.Buffer
+	fh     *os.File
+	size   int64
+	closed bool
+}
+
+func (sb *spillBuffer) Write(p []byte) (int, error) {
+	if sb.fh == nil && sb.size+int64(len(p)) > sb.limit {
+		fh, err := os.CreateTemp(sb.dir, "regclient-mod-")
+		if err != nil {
+			return 0, err
+		}
+		sb.fh = fh
+		_, err = fh.Write(sb.buf.Bytes())
+		sb.buf = bytes.Buffer{}
+		if err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if sb.fh != nil {
+		n, err = sb.fh.Write(p)
+	} else {
+		n, err = sb.buf.Write(p)
+	}
+	sb.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written.
+func (sb *spillBuffer) Size() int64 {
+	return sb.size
+}
+
+// Reader returns a reader for the content written to the buffer.
+func (sb *spillBuffer) Reader() (io.Reader, error) {
+	if sb.fh == nil {
+		return bytes.NewReader(sb.buf.Bytes()), nil
+	}
+	_, err := sb.fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return sb.fh, nil
+}
+
+// ReaderAt returns a reader for random access to the content written to the buffer.
+func (sb *spillBuffer) ReaderAt() io.ReaderAt {
+	if sb.fh == nil {
+		return bytes.NewReader(sb.buf.Bytes())
+	}
+	return sb.fh
+}
+
+// Close releases the memory and removes any temporary file.
+// Like an [os.File], calling Close more than once returns an error.
+func (sb *spillBuffer) Close() error {
+	if sb.closed {
+		return os.ErrClosed
+	}
+	sb.closed = true
+	sb.buf = bytes.Buffer{}
+	if sb.fh == nil {
+		return nil
+	}
+	err := sb.fh.Close()
+	_ = os.Remove(sb.fh.Name())
+	return err
+}
+
+// WithSizeReport calls fn with the compressed size of each layer before and after the modifications.
+// The report is generated after all layers have been processed, before the manifests are pushed.
+// Layers shared between multiple platforms are only included once.
+func WithSizeReport(fn func(SizeReport)) Opts {
+	return func(dc *dagConfig, dm *dagManifest) error {
+		dc.stepsFinal = append(dc.stepsFinal, func(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, dm *dagManifest) error {
+			report := SizeReport{
+				Layers: []SizeReportLayer{},
+			}
+			seen := map[[2]digest.Digest]bool{}
+			err := dagWalkManifests(dm, func(dm *dagManifest) (*dagManifest, error) {
+				if dm.mod == deleted {
+					return dm, nil
+				}
+				for _, dl := range dm.layers {
+					entry := SizeReportLayer{}
+					switch dl.mod {
+					case unchanged:
+						entry.Desc = dl.desc
+						entry.NewDesc = dl.desc
+					case added:
+						entry.NewDesc = dl.desc
+						if dl.newDesc.Digest != "" {
+							entry.NewDesc = dl.newDesc
+						}
+					case replaced:
+						entry.Desc = dl.desc
+						entry.NewDesc = dl.newDesc
+					case deleted:
+						entry.Desc = dl.desc
+					}
+					key := [2]digest.Digest{entry.Desc.Digest, entry.NewDesc.Digest}
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+					entry.Delta = entry.NewDesc.Size - entry.Desc.Size
+					report.Layers = append(report.Layers, entry)
+					report.Size += entry.Desc.Size
+					report.NewSize += entry.NewDesc.Size
+				}
+				return dm, nil
+			})
+			if err != nil {
+				return err
+			}
+			fn(report)
+			return nil
+		})
+		return nil
+	}
+}
+
 func inListStr(str string, list []string) bool {
 	for _, s := range list {
 		if str == s {
@@ -1,15 +1,26 @@
 package mod
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,20 +33,20 @@ import (
 	"github.com/regclient/regclient/internal/copyfs"
 	"github.com/regclient/regclient/pkg/archive"
 	"github.com/regclient/regclient/scheme/reg"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/descriptor"
 	"github.com/regclient/regclient/types/errs"
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
+	v1 "github.com/regclient/regclient/types/oci/v1"
 	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
 
 func TestMod(t *testing.T) {
 	t.Parallel()
-	ctx := context.Background()
-	baseTime, err := time.Parse(time.RFC3339, "2020-01-01T00:00:00Z")
-	if err != nil {
-		t.Fatalf("failed to parse test time: %v", err)
-	}
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, tempDir, baseTime, r3, r3amd := env.ctx, env.rc, env.tTgtHost, env.tempDir, env.baseTime, env.r3, env.r3amd
 	oldTime, err := time.Parse(time.RFC3339, "1999-01-01T00:00:00Z")
 	if err != nil {
 		t.Fatalf("failed to parse test time: %v", err)
@@ -49,63 +60,6 @@ func TestMod(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to read testdata/layer.tar: %v", err)
 	}
-	bTrue := true
-	regSrc := olareg.New(oConfig.Config{
-		Storage: oConfig.ConfigStorage{
-			StoreType: oConfig.StoreMem,
-			RootDir:   "../testdata",
-			ReadOnly:  &bTrue,
-		},
-	})
-	tSrc := httptest.NewServer(regSrc)
-	tSrcURL, _ := url.Parse(tSrc.URL)
-	tSrcHost := tSrcURL.Host
-	regTgt := olareg.New(oConfig.Config{
-		Storage: oConfig.ConfigStorage{
-			StoreType: oConfig.StoreMem,
-			RootDir:   "../testdata",
-		},
-	})
-	tTgt := httptest.NewServer(regTgt)
-	tTgtURL, _ := url.Parse(tTgt.URL)
-	tTgtHost := tTgtURL.Host
-	t.Cleanup(func() {
-		tSrc.Close()
-		_ = regSrc.Close()
-		tTgt.Close()
-		_ = regTgt.Close()
-	})
-	tempDir := t.TempDir()
-	err = copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
-	if err != nil {
-		t.Fatalf("failed to setup tempDir: %v", err)
-	}
-
-	// create regclient
-	rcHosts := []config.Host{
-		{
-			Name:     tSrcHost,
-			Hostname: tSrcHost,
-			TLS:      config.TLSDisabled,
-		},
-		{
-			Name:     tTgtHost,
-			Hostname: tTgtHost,
-			TLS:      config.TLSDisabled,
-		},
-		{
-			Name:     "registry.example.org",
-			Hostname: tSrcHost,
-			TLS:      config.TLSDisabled,
-		},
-	}
-	delayInit, _ := time.ParseDuration("0.05s")
-	delayMax, _ := time.ParseDuration("0.10s")
-	rc := regclient.New(
-		regclient.WithConfigHost(rcHosts...),
-		regclient.WithRegOpts(reg.WithDelay(delayInit, delayMax)),
-	)
-
 	rTgt1, err := ref.New(tTgtHost + "/tgtrepo1:v1")
 	if err != nil {
 		t.Fatalf("failed to parse ref: %v", err)
@@ -138,39 +92,17 @@ func TestMod(t *testing.T) {
 	// if err != nil {
 	// 	t.Fatalf("failed to parse ref: %v", err)
 	// }
-	r3, err := ref.New(tTgtHost + "/testrepo:v3")
-	if err != nil {
-		t.Fatalf("failed to parse ref: %v", err)
-	}
-	m3, err := rc.ManifestGet(ctx, r3)
-	if err != nil {
-		t.Fatalf("failed to retrieve v3 ref: %v", err)
-	}
 	pAMD, err := platform.Parse("linux/amd64")
 	if err != nil {
 		t.Fatalf("failed to parse platform: %v", err)
 	}
-	m3DescAmd, err := manifest.GetPlatformDesc(m3, &pAMD)
-	if err != nil {
-		t.Fatalf("failed to get amd64 descriptor: %v", err)
-	}
-	r3amd, err := ref.New(fmt.Sprintf("%s/testrepo@%s", tTgtHost, m3DescAmd.Digest.String()))
-	if err != nil {
-		t.Fatalf("failed to parse platform specific descriptor: %v", err)
-	}
 	plat, err := platform.Parse("linux/amd64/v3")
 	if err != nil {
 		t.Fatalf("failed to parse the platform: %v", err)
 	}
 
 	// define tests
-	tests := []struct {
-		name     string
-		opts     []Opts
-		ref      string
-		wantErr  error
-		wantSame bool // if the resulting image should be unchanged
-	}{
+	tests := []testModCase{
 		{
 			name: "To OCI",
 			opts: []Opts{
@@ -188,6 +120,51 @@ func TestMod(t *testing.T) {
 			ref:      tTgtHost + "/testrepo:v1",
 			wantSame: true,
 		},
+		{
+			name: "To Docker Index Layers",
+			opts: []Opts{
+				WithManifestToDocker(),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.GetDescriptor().MediaType != mediatype.Docker2ManifestList {
+					t.Fatalf("unexpected media type: %s", m.GetDescriptor().MediaType)
+				}
+				dl, err := m.(manifest.Indexer).GetManifestList()
+				if err != nil {
+					t.Fatalf("failed to get manifest list: %v", err)
+				}
+				for _, d := range dl {
+					mc, err := rc.ManifestGet(ctx, rMod.SetDigest(d.Digest.String()))
+					if err != nil {
+						t.Fatalf("failed to get manifest: %v", err)
+					}
+					if d.MediaType != mediatype.Docker2Manifest || mc.GetDescriptor().MediaType != mediatype.Docker2Manifest {
+						t.Errorf("unexpected child media type: %s", mc.GetDescriptor().MediaType)
+					}
+					cd, err := mc.(manifest.Imager).GetConfig()
+					if err != nil {
+						t.Fatalf("failed to get config: %v", err)
+					}
+					if cd.MediaType != mediatype.Docker2ImageConfig {
+						t.Errorf("unexpected config media type: %s", cd.MediaType)
+					}
+					layers, err := mc.(manifest.Imager).GetLayers()
+					if err != nil {
+						t.Fatalf("failed to get layers: %v", err)
+					}
+					for _, l := range layers {
+						if l.MediaType != mediatype.Docker2LayerGzip {
+							t.Errorf("unexpected layer media type: %s", l.MediaType)
+						}
+					}
+				}
+			},
+		},
 		{
 			name: "To Docker Copy",
 			opts: []Opts{
@@ -202,6 +179,44 @@ func TestMod(t *testing.T) {
 				WithManifestToOCI(),
 			},
 			ref: rTgt1.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.GetDescriptor().MediaType != mediatype.OCI1ManifestList {
+					t.Errorf("unexpected media type: %s", m.GetDescriptor().MediaType)
+				}
+				dl, err := m.(manifest.Indexer).GetManifestList()
+				if err != nil {
+					t.Fatalf("failed to get manifest list: %v", err)
+				}
+				gzipFound := false
+				for _, d := range dl {
+					mc, err := rc.ManifestGet(ctx, rMod.SetDigest(d.Digest.String()))
+					if err != nil {
+						t.Fatalf("failed to get manifest: %v", err)
+					}
+					if mc.GetDescriptor().MediaType != mediatype.OCI1Manifest {
+						t.Errorf("unexpected media type: %s", mc.GetDescriptor().MediaType)
+					}
+					layers, err := mc.(manifest.Imager).GetLayers()
+					if err != nil {
+						t.Fatalf("failed to get layers: %v", err)
+					}
+					for _, l := range layers {
+						if strings.HasPrefix(l.MediaType, "application/vnd.docker.") {
+							t.Errorf("unexpected layer media type: %s", l.MediaType)
+						}
+						if l.MediaType == mediatype.OCI1LayerGzip {
+							gzipFound = true
+						}
+					}
+				}
+				if !gzipFound {
+					t.Errorf("no gzip layers found")
+				}
+			},
 		},
 		{
 			name: "To OCI Referrers",
@@ -210,6 +225,30 @@ func TestMod(t *testing.T) {
 			},
 			ref: tTgtHost + "/testrepo:v1",
 		},
+		{
+			name: "Max Layers",
+			opts: []Opts{
+				WithMaxLayers(4),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: fmt.Errorf("image exceeds 4 layers, squash or remove layers: linux/amd64 (5 layers), linux/arm64 (5 layers), linux/arm/v7 (5 layers), linux/arm/v6 (5 layers)"),
+		},
+		{
+			name: "Max Layers After Remove",
+			opts: []Opts{
+				WithLayerRmIndex(4),
+				WithMaxLayers(4),
+			},
+			ref: r3amd.CommonName(),
+		},
+		{
+			name: "Max Layers Unchanged",
+			opts: []Opts{
+				WithMaxLayers(127),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
 		{
 			name: "Add Annotation",
 			opts: []Opts{
@@ -262,6 +301,182 @@ func TestMod(t *testing.T) {
 			ref:      tTgtHost + "/testrepo:v1",
 			wantSame: true,
 		},
+		{
+			name: "Annotation Set",
+			opts: []Opts{
+				WithAnnotationSet("org.example.empty", ""),
+				WithAnnotationSet("org.example.set", "hello"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if v, ok := annotations["org.example.empty"]; !ok || v != "" {
+					t.Errorf("empty annotation not set: %v", annotations)
+				}
+				if annotations["org.example.set"] != "hello" {
+					t.Errorf("annotation not set: %v", annotations)
+				}
+			},
+		},
+		{
+			name: "Annotation Set Platform",
+			opts: []Opts{
+				WithAnnotationSet("[linux/amd64]org.example.empty", ""),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				for _, ps := range []string{"linux/amd64", "linux/arm64"} {
+					p, err := platform.Parse(ps)
+					if err != nil {
+						t.Fatalf("failed to parse platform %s: %v", ps, err)
+					}
+					m, err := rc.ManifestGet(ctx, rMod, regclient.WithManifestPlatform(p))
+					if err != nil {
+						t.Fatalf("failed to get manifest for %s: %v", ps, err)
+					}
+					annotations, err := m.(manifest.Annotator).GetAnnotations()
+					if err != nil {
+						t.Fatalf("failed to get annotations: %v", err)
+					}
+					if v, ok := annotations["org.example.empty"]; ok != (ps == "linux/amd64") || v != "" {
+						t.Errorf("unexpected annotations on %s: %v", ps, annotations)
+					}
+				}
+			},
+		},
+		{
+			name: "Annotation Delete",
+			opts: []Opts{
+				WithAnnotationDelete("org.example.version"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if _, ok := annotations["org.example.version"]; ok {
+					t.Errorf("annotation not deleted: %v", annotations)
+				}
+			},
+		},
+		{
+			name: "Annotation Delete Missing",
+			opts: []Opts{
+				WithAnnotationDelete("org.example.missing"),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+		},
+		{
+			name: "Annotation Set Docker",
+			opts: []Opts{
+				WithManifestToDocker(),
+				WithAnnotationSet("org.example.set", "hello"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupportedMediaType,
+		},
+		{
+			name: "Annotation Set Empty Key",
+			opts: []Opts{
+				WithAnnotationSet("", "hello"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Annotation Revision",
+			opts: []Opts{
+				WithAnnotationRevision("0123456789abcdef0123456789abcdef01234567", false),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if !m.IsList() {
+					t.Fatalf("manifest is not an index: %s", m.GetDescriptor().MediaType)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if annotations[types.AnnotationRevision] != "0123456789abcdef0123456789abcdef01234567" {
+					t.Errorf("revision not set on index: %v", annotations)
+				}
+			},
+		},
+		{
+			name: "Annotation Revision Existing",
+			opts: []Opts{
+				WithAnnotationSet(types.AnnotationRevision, "refs/tags/v1.0.0"),
+				WithAnnotationRevision("main", false),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if annotations[types.AnnotationRevision] != "refs/tags/v1.0.0" {
+					t.Errorf("existing revision replaced: %v", annotations)
+				}
+			},
+		},
+		{
+			name: "Annotation Revision Force",
+			opts: []Opts{
+				WithAnnotationSet(types.AnnotationRevision, "refs/tags/v1.0.0"),
+				WithAnnotationRevision("main", true),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if annotations[types.AnnotationRevision] != "main" {
+					t.Errorf("revision not replaced: %v", annotations)
+				}
+			},
+		},
+		{
+			name: "Annotation Revision Invalid",
+			opts: []Opts{
+				WithAnnotationRevision("bad revision", false),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrParsingFailed,
+		},
+		{
+			name: "Annotation Revision Invalid Ref",
+			opts: []Opts{
+				WithAnnotationRevision("refs/heads/../main", false),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrParsingFailed,
+		},
 		{
 			name: "Add Base Annotations",
 			opts: []Opts{
@@ -306,6 +521,85 @@ func TestMod(t *testing.T) {
 			ref:     tTgtHost + "/testrepo:v1",
 			wantErr: fmt.Errorf("failed to parse label platform linux/invalid.arch!: invalid platform component invalid.arch! in linux/invalid.arch!"),
 		},
+		{
+			name: "Label Set",
+			opts: []Opts{
+				WithLabelSet("org.opencontainers.image.revision", "abc123"),
+				WithLabelSet("org.example.empty", ""),
+				WithLabelSet("a.first", "1"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				labels := conf.GetConfig().Config.Labels
+				if labels["org.opencontainers.image.revision"] != "abc123" || labels["a.first"] != "1" {
+					t.Errorf("labels not set: %v", labels)
+				}
+				if v, ok := labels["org.example.empty"]; !ok || v != "" {
+					t.Errorf("empty label not set: %v", labels)
+				}
+				// re-serializing the config and setting the same labels again must not change the digest
+				raw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				conf.SetConfig(conf.GetConfig())
+				reRaw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				if !bytes.Equal(raw, reRaw) {
+					t.Errorf("config changed when re-serialized:\n%s\n%s", string(raw), string(reRaw))
+				}
+				rAgain, err := Apply(ctx, rc, rMod,
+					WithLabelSet("a.first", "1"),
+					WithLabelSet("org.opencontainers.image.revision", "abc123"),
+				)
+				if err != nil {
+					t.Fatalf("failed to set labels again: %v", err)
+				}
+				if rAgain.Digest != rMod.Digest {
+					t.Errorf("digest changed when setting the same labels, expected %s, received %s", rMod.Digest, rAgain.Digest)
+				}
+			},
+		},
+		{
+			name: "Label Set Platform",
+			opts: []Opts{
+				WithLabelSet("[linux/arm64]org.example.empty", ""),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				for _, p := range []string{"linux/amd64", "linux/arm64"} {
+					conf, err := rc.ImageConfig(ctx, rMod, regclient.ImageWithPlatform(p))
+					if err != nil {
+						t.Fatalf("failed to get config for %s: %v", p, err)
+					}
+					labels := conf.GetConfig().Config.Labels
+					if v, ok := labels["org.example.empty"]; ok != (p == "linux/arm64") || v != "" {
+						t.Errorf("unexpected labels on %s: %v", p, labels)
+					}
+				}
+			},
+		},
+		{
+			name: "Label Delete",
+			opts: []Opts{
+				WithLabelDelete("version"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+		},
+		{
+			name: "Label Delete Missing",
+			opts: []Opts{
+				WithLabelDelete("org.example.missing"),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+		},
 		{
 			name: "Delete Label",
 			opts: []Opts{
@@ -321,6 +615,44 @@ func TestMod(t *testing.T) {
 			ref:      tTgtHost + "/testrepo:v1",
 			wantSame: true,
 		},
+		{
+			name: "Label from Annotation",
+			opts: []Opts{
+				WithConfigLabelFromAnnotation("version", "org.example.version"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				version, ok := annotations["org.example.version"]
+				if !ok {
+					t.Fatalf("annotation org.example.version missing: %v", annotations)
+				}
+				for _, p := range []string{"linux/amd64", "linux/arm64"} {
+					conf, err := rc.ImageConfig(ctx, rMod, regclient.ImageWithPlatform(p))
+					if err != nil {
+						t.Fatalf("failed to get config for %s: %v", p, err)
+					}
+					if label := conf.GetConfig().Config.Labels["version"]; label != version {
+						t.Errorf("label version for %s, expected %s, received %s", p, version, label)
+					}
+				}
+			},
+		},
+		{
+			name: "Label from Annotation Missing",
+			opts: []Opts{
+				WithConfigLabelFromAnnotation("version", "missing"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrMissingAnnotation,
+		},
 		{
 			name: "Label to Annotation",
 			opts: []Opts{
@@ -411,6 +743,39 @@ func TestMod(t *testing.T) {
 			},
 			ref: tTgtHost + "/testrepo:v3",
 		},
+		{
+			name: "Config Time Clamp",
+			opts: []Opts{
+				WithConfigTimestamp(OptTime{
+					Clamp: baseTime,
+				}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				confOrig, err := rc.ImageConfig(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				confMod, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				histOrig := confOrig.GetConfig().History
+				histMod := confMod.GetConfig().History
+				if len(histOrig) != len(histMod) {
+					t.Fatalf("history length changed from %d to %d", len(histOrig), len(histMod))
+				}
+				for i := range histMod {
+					expect := *histOrig[i].Created
+					if expect.After(baseTime) {
+						expect = baseTime
+					}
+					if !histMod[i].Created.Equal(expect) {
+						t.Errorf("history %d created %s, expected %s", i, histMod[i].Created.String(), expect.String())
+					}
+				}
+			},
+		},
 		{
 			name: "Config Time Label Missing",
 			opts: []Opts{
@@ -443,12 +808,280 @@ func TestMod(t *testing.T) {
 			wantSame: true,
 		},
 		{
-			name: "Config Platform",
+			name: "Entrypoint and Cmd",
 			opts: []Opts{
-				WithConfigPlatform(plat),
+				WithEntrypoint([]string{"/app", "--serve"}),
+				WithCmd([]string{"--port", "8080"}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				confOrig, err := rc.ImageConfig(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				if !eqStrSlice(oc.Config.Entrypoint, []string{"/app", "--serve"}) || !eqStrSlice(oc.Config.Cmd, []string{"--port", "8080"}) {
+					t.Errorf("unexpected entrypoint %v, cmd %v", oc.Config.Entrypoint, oc.Config.Cmd)
+				}
+				hist := oc.History
+				if len(hist) != len(confOrig.GetConfig().History)+2 {
+					t.Fatalf("unexpected history length %d", len(hist))
+				}
+				if hist[len(hist)-2].CreatedBy != `ENTRYPOINT ["/app","--serve"]` || !hist[len(hist)-2].EmptyLayer {
+					t.Errorf("unexpected entrypoint history: %v", hist[len(hist)-2])
+				}
+				if hist[len(hist)-1].CreatedBy != `CMD ["--port","8080"]` || !hist[len(hist)-1].EmptyLayer {
+					t.Errorf("unexpected cmd history: %v", hist[len(hist)-1])
+				}
+				// setting the same value does not change the image
+				rSame, err := Apply(ctx, rc, rMod, WithEntrypoint([]string{"/app", "--serve"}))
+				if err != nil {
+					t.Fatalf("failed to set entrypoint: %v", err)
+				}
+				if rSame.Digest != rMod.Digest {
+					t.Errorf("digest changed when setting the same entrypoint")
+				}
+				// an empty array is distinct from a nil value that clears the field
+				rEmpty, err := Apply(ctx, rc, rMod, WithEntrypoint([]string{}), WithRefTgt(rMod.SetTag("entrypoint-empty")))
+				if err != nil {
+					t.Fatalf("failed to set empty entrypoint: %v", err)
+				}
+				confEmpty, err := rc.ImageConfig(ctx, rEmpty)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err := confEmpty.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				if !bytes.Contains(raw, []byte(`"Entrypoint":[]`)) || confEmpty.GetConfig().Config.Entrypoint == nil {
+					t.Errorf("empty entrypoint not set: %s", string(raw))
+				}
+				rNil, err := Apply(ctx, rc, rEmpty, WithEntrypoint(nil), WithRefTgt(rMod.SetTag("entrypoint-nil")))
+				if err != nil {
+					t.Fatalf("failed to clear entrypoint: %v", err)
+				}
+				confNil, err := rc.ImageConfig(ctx, rNil)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err = confNil.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				if bytes.Contains(raw, []byte(`"Entrypoint"`)) {
+					t.Errorf("entrypoint not cleared: %s", string(raw))
+				}
+				if len(confNil.GetConfig().History) != len(hist)+2 {
+					t.Errorf("unexpected history length %d", len(confNil.GetConfig().History))
+				}
+			},
+		},
+		{
+			name: "Cmd Empty With Layer Change",
+			opts: []Opts{
+				WithCmd([]string{}),
+				WithEnvSet("AFTER_CMD", "1"),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				if !bytes.Contains(raw, []byte(`"Cmd":[]`)) || conf.GetConfig().Config.Cmd == nil {
+					t.Errorf("empty cmd not preserved: %s", string(raw))
+				}
+				if conf.GetDescriptor().Digest != digest.FromBytes(raw) {
+					t.Errorf("config digest does not match the body")
+				}
+			},
+		},
+		{
+			name: "Config Cmd To Entrypoint",
+			opts: []Opts{
+				WithConfigEntrypoint(nil),
+				WithConfigCmd([]string{"/usr/bin/app", "--serve"}),
+				WithConfigCmdToEntrypoint(),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				c := conf.GetConfig().Config
+				if !eqStrSlice(c.Entrypoint, []string{"/usr/bin/app", "--serve"}) || len(c.Cmd) != 0 {
+					t.Errorf("unexpected entrypoint %v, cmd %v", c.Entrypoint, c.Cmd)
+				}
+			},
+		},
+		{
+			name: "Config Cmd To Entrypoint Append",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/sbin/tini", "--"}),
+				WithConfigCmd([]string{"/usr/bin/app"}),
+				WithConfigCmdToEntrypoint(),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				c := conf.GetConfig().Config
+				if !eqStrSlice(c.Entrypoint, []string{"/sbin/tini", "--", "/usr/bin/app"}) || len(c.Cmd) != 0 {
+					t.Errorf("unexpected entrypoint %v, cmd %v", c.Entrypoint, c.Cmd)
+				}
+			},
+		},
+		{
+			name: "Config Platform",
+			opts: []Opts{
+				WithConfigPlatform(plat),
 			},
 			ref: tTgtHost + "/testrepo:v1",
 		},
+		{
+			name: "Config Platform Validate",
+			opts: []Opts{
+				WithConfigPlatformValidate(),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config Platform Validate amd64 v7",
+			opts: []Opts{
+				WithConfigPlatform(platform.Platform{OS: "linux", Architecture: "amd64", Variant: "v7"}),
+				WithConfigPlatformValidate(),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: fmt.Errorf("config platform is inconsistent: linux/amd64/v7 (amd64 variant must be empty or v1 to v4)"),
+		},
+		{
+			name: "Config Platform Validate arm64 v7",
+			opts: []Opts{
+				WithConfigPlatform(platform.Platform{OS: "linux", Architecture: "arm64", Variant: "v7"}),
+				WithConfigPlatformValidate(),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: fmt.Errorf("config platform is inconsistent: linux/arm64/v7 (arm64 variant must be empty, v8, or v9)"),
+		},
+		{
+			name: "Config Platform Validate arm Missing",
+			opts: []Opts{
+				WithConfigPlatform(platform.Platform{OS: "linux", Architecture: "arm"}),
+				WithConfigPlatformValidate(),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: fmt.Errorf("config platform is inconsistent: linux/arm (arm variant must be v5 to v8)"),
+		},
+		{
+			name: "Config Platform Validate 386 Variant",
+			opts: []Opts{
+				WithConfigPlatform(platform.Platform{OS: "linux", Architecture: "386", Variant: "v2"}),
+				WithConfigPlatformValidate(),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: fmt.Errorf("config platform is inconsistent: linux/386/v2 (386 does not have a variant)"),
+		},
+		{
+			name: "Blob Digest sha512 ocidir",
+			opts: []Opts{
+				WithBlobDigestAlgo(digest.SHA512),
+			},
+			ref: "ocidir://" + tempDir + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.GetDescriptor().Digest.Algorithm() != digest.SHA256 {
+					t.Errorf("unexpected manifest digest algorithm: %s", m.GetDescriptor().Digest.String())
+				}
+				dAmd, err := manifest.GetPlatformDesc(m, &pAMD)
+				if err != nil {
+					t.Fatalf("failed to get amd64 descriptor: %v", err)
+				}
+				rAmd := rMod.SetDigest(dAmd.Digest.String())
+				mAmd, err := rc.ManifestGet(ctx, rAmd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if mAmd.GetDescriptor().Digest.Algorithm() != digest.SHA256 {
+					t.Errorf("unexpected platform manifest digest algorithm: %s", mAmd.GetDescriptor().Digest.String())
+				}
+				confDesc, err := mAmd.(manifest.Imager).GetConfig()
+				if err != nil {
+					t.Fatalf("failed to get config descriptor: %v", err)
+				}
+				if confDesc.Digest.Algorithm() != digest.SHA512 {
+					t.Errorf("unexpected config digest algorithm: %s", confDesc.Digest.String())
+				}
+				layers, err := mAmd.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for _, l := range layers {
+					if l.Digest.Algorithm() != digest.SHA512 {
+						t.Errorf("unexpected layer digest algorithm: %s", l.Digest.String())
+					}
+				}
+				conf, err := rc.ImageConfig(ctx, rAmd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				for _, d := range conf.GetConfig().RootFS.DiffIDs {
+					if d.Algorithm() != digest.SHA512 {
+						t.Errorf("unexpected diff_id digest algorithm: %s", d.String())
+					}
+				}
+			},
+		},
+		{
+			name: "Read Buffer",
+			opts: []Opts{
+				WithReadBuffer(1024 * 1024),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+				WithLayerCompression(archive.CompressZstd),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				content, err := testLayerFile(ctx, rc, rMod, 2, "layer2")
+				if err != nil {
+					t.Fatalf("failed to read layer2: %v", err)
+				}
+				if string(content) != "3\n" {
+					t.Errorf("unexpected content, received %q", string(content))
+				}
+				// the buffer must not change the output
+				rUnbuf, err := Apply(ctx, rc, r3amd, WithFileReplace("/layer2", "../testdata/layer3.txt"), WithLayerCompression(archive.CompressZstd))
+				if err != nil {
+					t.Fatalf("failed to apply without a read buffer: %v", err)
+				}
+				if rUnbuf.Digest == "" || rUnbuf.Digest != rMod.Digest {
+					t.Errorf("digest mismatch, expected %s, received %s", rUnbuf.Digest, rMod.Digest)
+				}
+			},
+		},
+		{
+			name: "Read Buffer Invalid",
+			opts: []Opts{
+				WithReadBuffer(-1),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
 		{
 			name: "Digest sha256",
 			opts: []Opts{
@@ -471,6 +1104,87 @@ func TestMod(t *testing.T) {
 			},
 			ref: tTgtHost + "/testrepo:v1",
 		},
+		{
+			name: "Expose Port Default udp",
+			opts: []Opts{
+				WithExposeDefaultProtocol("udp"),
+				WithExposeAdd("8080"),
+				WithExposeAdd("9090/tcp"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				ports := conf.GetConfig().Config.ExposedPorts
+				for _, p := range []string{"8080/udp", "9090/tcp"} {
+					if _, ok := ports[p]; !ok {
+						t.Errorf("missing exposed port %s: %v", p, ports)
+					}
+				}
+				if _, ok := ports["8080"]; ok {
+					t.Errorf("port added without protocol: %v", ports)
+				}
+			},
+		},
+		{
+			name: "Expose Port Default Invalid",
+			opts: []Opts{
+				WithExposeDefaultProtocol("sctp"),
+				WithExposeAdd("8080"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Exposed Port Canonical",
+			opts: []Opts{
+				WithExposedPortAdd("8080"),
+				WithExposedPortAdd("53/UDP"),
+				WithExposedPortAdd("9000-9002"),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				ports := conf.GetConfig().Config.ExposedPorts
+				for _, p := range []string{"8080/tcp", "53/udp", "9000-9002/tcp"} {
+					if _, ok := ports[p]; !ok {
+						t.Errorf("port %s not found: %v", p, ports)
+					}
+				}
+				if _, ok := ports["8080"]; ok {
+					t.Errorf("port added without protocol: %v", ports)
+				}
+			},
+		},
+		{
+			name: "Exposed Port Invalid",
+			opts: []Opts{
+				WithExposedPortAdd("70000/tcp"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Exposed Port Invalid Protocol",
+			opts: []Opts{
+				WithExposedPortRm("80/icmp"),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Exposed Port Delete Missing",
+			opts: []Opts{
+				WithExposedPortRm("8080"),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+		},
 		{
 			name: "Expose Port Delete Unchanged",
 			opts: []Opts{
@@ -524,6 +1238,176 @@ func TestMod(t *testing.T) {
 			},
 			ref: tTgtHost + "/testrepo:v1",
 		},
+		{
+			name: "Layer Compressed zstd With File Change",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressZstd),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, r ref.Ref) {
+				// every layer is recompressed, including layers without a file change
+				m, err := rc.ManifestGet(ctx, r)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.IsList() {
+					p := platform.Platform{OS: "linux", Architecture: "amd64"}
+					d, err := manifest.GetPlatformDesc(m, &p)
+					if err != nil {
+						t.Fatalf("failed to get platform: %v", err)
+					}
+					m, err = rc.ManifestGet(ctx, r.SetDigest(d.Digest.String()))
+					if err != nil {
+						t.Fatalf("failed to get manifest: %v", err)
+					}
+				}
+				mi, ok := m.(manifest.Imager)
+				if !ok {
+					t.Fatalf("manifest is not an image")
+				}
+				layers, err := mi.GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for i, l := range layers {
+					if l.MediaType != mediatype.OCI1LayerZstd {
+						t.Errorf("layer %d unexpected media type: %s", i, l.MediaType)
+						continue
+					}
+					blob, err := rc.BlobGet(ctx, r, l)
+					if err != nil {
+						t.Fatalf("failed to get layer %d: %v", i, err)
+					}
+					b, err := io.ReadAll(blob)
+					_ = blob.Close()
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					if comp := archive.DetectCompression(b); comp != archive.CompressZstd {
+						t.Errorf("layer %d compressed with %s", i, comp.String())
+					}
+				}
+			},
+		},
+		{
+			name: "Layer Compressed zstd Level",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressZstd),
+				WithZstdLevel(19),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				rSrc, err := ref.New(tTgtHost + "/testrepo:v3")
+				if err != nil {
+					t.Fatalf("failed to parse ref: %v", err)
+				}
+				rRepeat, err := Apply(ctx, rc, rSrc, WithLayerCompression(archive.CompressZstd), WithZstdLevel(19))
+				if err != nil {
+					t.Fatalf("failed to repeat apply: %v", err)
+				}
+				if rRepeat.Digest != rMod.Digest {
+					t.Errorf("digest is not reproducible, expected %s, received %s", rMod.Digest, rRepeat.Digest)
+				}
+				rDefault, err := Apply(ctx, rc, rSrc, WithLayerCompression(archive.CompressZstd))
+				if err != nil {
+					t.Fatalf("failed to apply default level: %v", err)
+				}
+				if rDefault.Digest == rMod.Digest {
+					t.Errorf("digest did not change with the zstd level")
+				}
+			},
+		},
+		{
+			name: "Layer Compressed zstd Level Invalid",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressZstd),
+				WithZstdLevel(23),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "File Timestamp Flatten",
+			opts: []Opts{
+				WithFileTimestampFlatten(time.Unix(1700000000, 0).UTC()),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				mMod, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				layersMod, err := mMod.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(layersOrig) != len(layersMod) {
+					t.Fatalf("layer count changed")
+				}
+				for i := range layersMod {
+					if layersOrig[i].Digest == layersMod[i].Digest {
+						t.Errorf("layer %d digest did not change", i)
+					}
+					headers, err := testLayerHeaders(ctx, rc, rMod, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					for _, th := range headers {
+						if th.ModTime.Unix() != 1700000000 {
+							t.Errorf("unexpected mod time in layer %d on %s: %s", i, th.Name, th.ModTime.String())
+						}
+					}
+				}
+			},
+		},
+		{
+			name: "File Timestamp Flatten Missing Time",
+			opts: []Opts{
+				WithFileTimestampFlatten(time.Time{}),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: fmt.Errorf("WithFileTimestampFlatten requires a time to set"),
+		},
+		{
+			name: "File Umask",
+			opts: []Opts{
+				WithFileUmask(0044),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				for i := 0; i < 5; i++ {
+					headers, err := testLayerHeaders(ctx, rc, rMod, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					for _, th := range headers {
+						if th.Mode&0044 != 0 {
+							t.Errorf("mask not applied to %s: %o", th.Name, th.Mode)
+						}
+						if th.Typeflag == tar.TypeDir && th.Mode&0700 != 0700 {
+							t.Errorf("unexpected mode on %s: %o", th.Name, th.Mode)
+						}
+					}
+				}
+			},
+		},
+		{
+			name: "File Umask Unchanged",
+			opts: []Opts{
+				WithFileUmask(0),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
 		{
 			name: "Layer Digest sha256",
 			opts: []Opts{
@@ -601,65 +1485,242 @@ func TestMod(t *testing.T) {
 			ref: tTgtHost + "/testrepo:v3",
 		},
 		{
-			name: "Layer Timestamp Set Missing",
+			name: "Layer File Replace",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{}),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
 			},
-			ref:     tTgtHost + "/testrepo:v1",
-			wantErr: fmt.Errorf("WithLayerTimestamp requires a time to set"),
+			ref: tTgtHost + "/testrepo:v3",
 		},
 		{
-			name: "Layer Timestamp Missing Label",
+			name: "Layer File Append",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{
-					FromLabel: "missing",
-				}),
+				WithFileAppend("layer[12]", []byte("# footer\n")),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				for i := 1; i <= 3; i++ {
+					name := fmt.Sprintf("layer%d", i)
+					orig, err := testLayerFile(ctx, rc, r3amd, i, name)
+					if err != nil {
+						t.Fatalf("failed to read %s: %v", name, err)
+					}
+					content, err := testLayerFile(ctx, rc, rMod, i, name)
+					if err != nil {
+						t.Fatalf("failed to read %s: %v", name, err)
+					}
+					expect := string(orig) + "# footer\n"
+					if i == 3 {
+						expect = string(orig)
+					}
+					if string(content) != expect {
+						t.Errorf("unexpected content in %s: %s", name, string(content))
+					}
+				}
 			},
-			ref:     tTgtHost + "/testrepo:v1",
-			wantErr: fmt.Errorf("label not found: missing"),
 		},
 		{
-			name: "Layer Timestamp",
+			name: "Layer File Append Invalid",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{
-					Set: baseTime,
-				}),
+				WithFileAppend("layer[", []byte("# footer\n")),
 			},
-			ref: tTgtHost + "/testrepo:v1",
+			ref:     r3amd.CommonName(),
+			wantErr: path.ErrBadPattern,
 		},
 		{
-			name: "Layer Timestamp After Unchanged",
+			name: "Layer File Prepend",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{
-					Set:   baseTime,
-					After: time.Now(),
-				}),
+				WithFilePrepend("/layer*", []byte("# header\n")),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				for i := 1; i <= 3; i++ {
+					name := fmt.Sprintf("layer%d", i)
+					orig, err := testLayerFile(ctx, rc, r3amd, i, name)
+					if err != nil {
+						t.Fatalf("failed to read %s: %v", name, err)
+					}
+					content, err := testLayerFile(ctx, rc, rMod, i, name)
+					if err != nil {
+						t.Fatalf("failed to read %s: %v", name, err)
+					}
+					if string(content) != "# header\n"+string(orig) {
+						t.Errorf("unexpected content in %s: %s", name, string(content))
+					}
+				}
+				content, err := testLayerFile(ctx, rc, rMod, 0, "base.txt")
+				if err != nil {
+					t.Fatalf("failed to read base.txt: %v", err)
+				}
+				if strings.HasPrefix(string(content), "# header") {
+					t.Errorf("unmatched file was modified: %s", string(content))
+				}
 			},
-			ref:      tTgtHost + "/testrepo:v1",
-			wantSame: true,
 		},
 		{
-			name: "Layer Timestamp Base Ref",
+			name: "Layer File Prepend Invalid",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{
-					Set:     baseTime,
-					BaseRef: rb1,
-				}),
+				WithFilePrepend("layer[", []byte("# header\n")),
 			},
-			ref: tTgtHost + "/testrepo:v3",
+			ref:     r3amd.CommonName(),
+			wantErr: path.ErrBadPattern,
 		},
 		{
-			name: "Layer Timestamp Base Ref Same",
+			name: "Layer File Delete",
 			opts: []Opts{
-				WithLayerTimestamp(OptTime{
-					Set:     baseTime,
-					BaseRef: r3,
-				}),
+				WithFileDelete("/layer2"),
 			},
-			ref:      tTgtHost + "/testrepo:v3",
-			wantSame: true,
-		},
-		{
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				found := []string{}
+				for i := range layers {
+					headers, err := testLayerHeaders(ctx, rc, rMod, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					for _, th := range headers {
+						found = append(found, strings.TrimPrefix(th.Name, "/"))
+					}
+				}
+				for _, name := range found {
+					if name == "layer2" {
+						t.Errorf("file was not deleted: %s", name)
+					}
+				}
+				if _, err := testLayerFile(ctx, rc, rMod, 1, "layer1"); err != nil {
+					t.Errorf("failed to read layer1: %v", err)
+				}
+			},
+		},
+		{
+			name: "Layer File Delete Unchanged",
+			opts: []Opts{
+				WithFileDelete("missing/*"),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer File Delete Bad Pattern",
+			opts: []Opts{
+				WithFileDelete("layer["),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: path.ErrBadPattern,
+		},
+		{
+			name: "Layer Whiteout Add",
+			opts: []Opts{
+				WithWhiteoutAdd([]string{"/layer1", "dir/sub/"}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				found := map[string]bool{}
+				for _, th := range headers {
+					found[th.Name] = true
+				}
+				for _, name := range []string{".wh.layer1", "dir/.wh.sub"} {
+					if !found[name] {
+						t.Errorf("whiteout %s not found", name)
+					}
+				}
+			},
+		},
+		{
+			name: "Layer Whiteout Add Root",
+			opts: []Opts{
+				WithWhiteoutAdd([]string{"/"}),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Layer File Replace Missing",
+			opts: []Opts{
+				WithFileReplace("/missing", "../testdata/layer3.txt"),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrFileNotFound,
+		},
+		{
+			name: "Layer File Replace Missing Local",
+			opts: []Opts{
+				WithFileReplace("/layer2", "../testdata/missing.txt"),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: os.ErrNotExist,
+		},
+		{
+			name: "Layer Timestamp Set Missing",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{}),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: fmt.Errorf("WithLayerTimestamp requires a time to set"),
+		},
+		{
+			name: "Layer Timestamp Missing Label",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					FromLabel: "missing",
+				}),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: fmt.Errorf("label not found: missing"),
+		},
+		{
+			name: "Layer Timestamp",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Set: baseTime,
+				}),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+		},
+		{
+			name: "Layer Timestamp After Unchanged",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Set:   baseTime,
+					After: time.Now(),
+				}),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+		},
+		{
+			name: "Layer Timestamp Base Ref",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Set:     baseTime,
+					BaseRef: rb1,
+				}),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+		},
+		{
+			name: "Layer Timestamp Base Ref Same",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Set:     baseTime,
+					BaseRef: r3,
+				}),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
 			name: "Layer Timestamp Base Count Same",
 			opts: []Opts{
 				WithLayerTimestamp(OptTime{
@@ -691,6 +1752,71 @@ func TestMod(t *testing.T) {
 			ref:      tTgtHost + "/testrepo:a1",
 			wantSame: true,
 		},
+		{
+			name: "Layer Timestamp Clamp",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Clamp: time.Unix(1590969600, 0),
+				}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				testLayerModTimes(ctx, t, rc, r3amd, rMod, func(i int, orig time.Time) time.Time {
+					if orig.Unix() > 1590969600 {
+						return time.Unix(1590969600, 0)
+					}
+					return orig
+				})
+			},
+		},
+		{
+			name: "Layer Timestamp Clamp After Set",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Set:   time.Unix(1640995200, 0),
+					After: time.Unix(1590969600, 0),
+					Clamp: time.Unix(1622505600, 0),
+				}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				// times after the After value are set, and then clamped, earlier times are preserved
+				testLayerModTimes(ctx, t, rc, r3amd, rMod, func(i int, orig time.Time) time.Time {
+					if orig.Unix() > 1590969600 {
+						return time.Unix(1622505600, 0)
+					}
+					return orig
+				})
+			},
+		},
+		{
+			name: "Layer Timestamp Clamp Base Count",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Clamp:      time.Unix(1546300800, 0),
+					BaseLayers: 1,
+				}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				testLayerModTimes(ctx, t, rc, r3amd, rMod, func(i int, orig time.Time) time.Time {
+					if i < 1 {
+						return orig
+					}
+					return time.Unix(1546300800, 0)
+				})
+			},
+		},
+		{
+			name: "Layer Timestamp Clamp Unchanged",
+			opts: []Opts{
+				WithLayerTimestamp(OptTime{
+					Clamp: time.Now(),
+				}),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
 		{
 			name: "Layer File Tar Time Max",
 			opts: []Opts{
@@ -775,6 +1901,98 @@ func TestMod(t *testing.T) {
 			ref:      tTgtHost + "/testrepo:v1",
 			wantSame: true,
 		},
+		{
+			name: "Manifest Indent",
+			opts: []Opts{
+				WithManifestIndent("  "),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				mi, ok := m.(manifest.Indexer)
+				if !ok {
+					t.Fatalf("manifest is not an index")
+				}
+				dl, err := mi.GetManifestList()
+				if err != nil {
+					t.Fatalf("failed to get manifest list: %v", err)
+				}
+				raws := [][]byte{}
+				raw, err := m.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get manifest body: %v", err)
+				}
+				raws = append(raws, raw)
+				for _, d := range dl {
+					mc, err := rc.ManifestGet(ctx, rMod.SetDigest(d.Digest.String()))
+					if err != nil {
+						t.Fatalf("failed to get child manifest: %v", err)
+					}
+					raw, err := mc.RawBody()
+					if err != nil {
+						t.Fatalf("failed to get manifest body: %v", err)
+					}
+					raws = append(raws, raw)
+				}
+				for _, raw := range raws {
+					buf := &bytes.Buffer{}
+					err = json.Indent(buf, raw, "", "  ")
+					if err != nil {
+						t.Fatalf("failed to indent: %v", err)
+					}
+					if !bytes.Equal(raw, buf.Bytes()) || !bytes.Contains(raw, []byte("\n  \"")) {
+						t.Errorf("manifest is not indented: %s", string(raw))
+					}
+				}
+				// round trip back to compact
+				rCompact, err := Apply(ctx, rc, rMod, WithManifestIndent(""))
+				if err != nil {
+					t.Fatalf("failed to compact: %v", err)
+				}
+				mOrig, err := rc.ManifestHead(ctx, r3, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				if rCompact.Digest != mOrig.GetDescriptor().Digest.String() {
+					t.Errorf("compact digest mismatch, expected %s, received %s", mOrig.GetDescriptor().Digest.String(), rCompact.Digest)
+				}
+			},
+		},
+		{
+			name: "Manifest Indent Compact",
+			opts: []Opts{
+				WithManifestIndent(""),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Manifest Indent Invalid",
+			opts: []Opts{
+				WithManifestIndent("x"),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Require Empty Config",
+			opts: []Opts{
+				WithRequireEmptyConfig(),
+			},
+			ref:      tTgtHost + "/testrepo:a1",
+			wantSame: true,
+		},
+		{
+			name: "Require Empty Config Image",
+			opts: []Opts{
+				WithRequireEmptyConfig(),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupportedMediaType,
+		},
 		{
 			name: "Manifest Digest sha512 ocidir",
 			opts: []Opts{
@@ -858,7 +2076,7 @@ func TestMod(t *testing.T) {
 		{
 			name: "Remove Entrypoint",
 			opts: []Opts{
-				WithConfigEntrypoint([]string{}),
+				WithConfigEntrypoint(nil),
 			},
 			ref:      tTgtHost + "/testrepo:v1",
 			wantSame: true,
@@ -923,6 +2141,53 @@ func TestMod(t *testing.T) {
 				WithRefTgt(rTgt2),
 			},
 			ref: tTgtHost + "/testrepo:v2",
+			check: func(t *testing.T, rMod ref.Ref) {
+				// the lower layers and diff_ids of each platform must match the new base
+				getImage := func(r ref.Ref) ([]descriptor.Descriptor, []digest.Digest) {
+					m, err := rc.ManifestGet(ctx, r)
+					if err != nil {
+						t.Fatalf("failed to get manifest %s: %v", r.CommonName(), err)
+					}
+					if m.IsList() {
+						d, err := manifest.GetPlatformDesc(m, &pAMD)
+						if err != nil {
+							t.Fatalf("failed to get platform: %v", err)
+						}
+						m, err = rc.ManifestGet(ctx, r.SetDigest(d.Digest.String()))
+						if err != nil {
+							t.Fatalf("failed to get manifest %s: %v", r.CommonName(), err)
+						}
+					}
+					layers, err := m.(manifest.Imager).GetLayers()
+					if err != nil {
+						t.Fatalf("failed to get layers: %v", err)
+					}
+					cd, err := m.(manifest.Imager).GetConfig()
+					if err != nil {
+						t.Fatalf("failed to get config descriptor: %v", err)
+					}
+					conf, err := rc.BlobGetOCIConfig(ctx, r, cd)
+					if err != nil {
+						t.Fatalf("failed to get config: %v", err)
+					}
+					return layers, conf.GetConfig().RootFS.DiffIDs
+				}
+				layersBase, diffIDsBase := getImage(rb2)
+				layers, diffIDs := getImage(rMod)
+				if len(layers) < len(layersBase) || len(diffIDs) < len(diffIDsBase) {
+					t.Fatalf("image has fewer layers than the base")
+				}
+				for i := range layersBase {
+					if layers[i].Digest != layersBase[i].Digest {
+						t.Errorf("layer %d does not match the new base, expected %s, received %s", i, layersBase[i].Digest, layers[i].Digest)
+					}
+				}
+				for i := range diffIDsBase {
+					if diffIDs[i] != diffIDsBase[i] {
+						t.Errorf("diff_id %d does not match the new base, expected %s, received %s", i, diffIDsBase[i], diffIDs[i])
+					}
+				}
+			},
 		},
 		{
 			name: "Rebase mismatch",
@@ -982,58 +2247,6894 @@ func TestMod(t *testing.T) {
 		},
 	}
 
-	// run tests
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			rSrc, err := ref.New(tt.ref)
-			if err != nil {
-				t.Fatalf("failed creating ref: %v", err)
-			}
-			// run mod with opts
-			rMod, err := Apply(ctx, rc, rSrc, tt.opts...)
-			if tt.wantErr != nil {
-				if err == nil {
-					t.Errorf("ModImage did not fail")
-				} else if !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
-					t.Errorf("unexpected error, wanted %v, received %v", tt.wantErr, err)
+	testModRun(t, env, tests)
+}
+
+func TestExpectedDigest(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, r3amd := env.ctx, env.rc, env.r3amd
+	// compute the digest of a deterministic change
+	rExpected, err := Apply(ctx, rc, r3amd, WithLabel("expected", "digest"))
+	if err != nil {
+		t.Fatalf("failed to setup expected digest: %v", err)
+	}
+	expectedDigest := digest.Digest(rExpected.Digest)
+	tests := []testModCase{
+		{
+			name: "Expected Digest",
+			opts: []Opts{
+				WithLabel("expected", "digest"),
+				WithExpectedDigest(expectedDigest),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if rMod.Digest != expectedDigest.String() {
+					t.Errorf("unexpected digest, expected %s, received %s", expectedDigest, rMod.Digest)
 				}
-				return
-			} else if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
+			},
+		},
+		{
+			name: "Expected Digest Mismatch",
+			opts: []Opts{
+				WithLabel("expected", "changed"),
+				WithExpectedDigest(expectedDigest),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrDigestMismatch,
+		},
+		{
+			name: "Expected Digest Invalid",
+			opts: []Opts{
+				WithExpectedDigest(digest.Digest("invalid")),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: digest.ErrDigestInvalidFormat,
+		},
+	}
+	testModRun(t, env, tests)
+}
 
-			mSrc, err := rc.ManifestHead(ctx, rSrc, regclient.WithManifestRequireDigest())
+func TestLayerZstd(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	// setup an image with zstd compressed layers
+	rZstd, err := ref.New(tTgtHost + "/testrepo:zstd")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rZstd), WithLayerCompression(archive.CompressZstd))
+	if err != nil {
+		t.Fatalf("failed to setup zstd image: %v", err)
+	}
+	rZstdCopy, err := ref.New(tTgtHost + "/tgtrepo-zstd:copy")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	zstdCheck := func(t *testing.T, rMod ref.Ref) {
+		t.Helper()
+		mSrc, err := rc.ManifestGet(ctx, rZstd)
+		if err != nil {
+			t.Fatalf("failed to get source manifest: %v", err)
+		}
+		mTgt, err := rc.ManifestGet(ctx, rMod)
+		if err != nil {
+			t.Fatalf("failed to get target manifest: %v", err)
+		}
+		layersSrc, err := mSrc.(manifest.Imager).GetLayers()
+		if err != nil {
+			t.Fatalf("failed to get source layers: %v", err)
+		}
+		layersTgt, err := mTgt.(manifest.Imager).GetLayers()
+		if err != nil {
+			t.Fatalf("failed to get target layers: %v", err)
+		}
+		if len(layersSrc) != len(layersTgt) {
+			t.Fatalf("layer count mismatch, expected %d, received %d", len(layersSrc), len(layersTgt))
+		}
+		for i := range layersSrc {
+			if !layersSrc[i].Equal(layersTgt[i]) || layersTgt[i].MediaType != mediatype.OCI1LayerZstd {
+				t.Errorf("layer %d changed, expected %v, received %v", i, layersSrc[i], layersTgt[i])
+			}
+			_, err = rc.BlobHead(ctx, rMod, layersTgt[i])
 			if err != nil {
-				t.Fatalf("failed to get manifest from src: %v", err)
+				t.Errorf("layer %d missing from target: %v", i, err)
 			}
-			mTgt, err := rc.ManifestHead(ctx, rMod, regclient.WithManifestRequireDigest())
+		}
+	}
+	gzipOSCheck := func(want byte) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			m, err := rc.ManifestGet(ctx, rMod)
 			if err != nil {
-				t.Fatalf("failed to get manifest from mod \"%s\": %v", rMod.CommonName(), err)
+				t.Fatalf("failed to get manifest: %v", err)
 			}
-
-			if tt.wantSame {
-				if mSrc.GetDescriptor().Digest != mTgt.GetDescriptor().Digest {
-					t.Errorf("digest changed")
+			layers, err := m.(manifest.Imager).GetLayers()
+			if err != nil {
+				t.Fatalf("failed to get layers: %v", err)
+			}
+			for i, l := range layers {
+				br, err := rc.BlobGet(ctx, rMod, l)
+				if err != nil {
+					t.Fatalf("failed to get layer %d: %v", i, err)
 				}
-			} else {
-				if mSrc.GetDescriptor().Digest == mTgt.GetDescriptor().Digest {
-					t.Errorf("digest did not change")
+				head := make([]byte, 10)
+				_, err = io.ReadFull(br, head)
+				_ = br.Close()
+				if err != nil {
+					t.Fatalf("failed to read layer %d: %v", i, err)
+				}
+				if head[0] != 0x1f || head[1] != 0x8b {
+					t.Errorf("layer %d is not gzip compressed: %s", i, l.MediaType)
+				} else if head[9] != want {
+					t.Errorf("layer %d gzip OS, expected %d, received %d", i, want, head[9])
 				}
 			}
-		})
-	}
-}
-
-func TestInList(t *testing.T) {
-	t.Parallel()
-	t.Run("match", func(t *testing.T) {
-		if !inListStr(mediatype.Docker2LayerGzip, mtKnownTar) {
-			t.Errorf("did not find docker layer in known tar list")
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "To Docker Zstd Layers",
+			opts: []Opts{
+				WithManifestToDocker(),
+			},
+			ref: rZstd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for _, l := range layers {
+					if l.MediaType != mediatype.Docker2LayerZstd {
+						t.Errorf("unexpected layer media type: %s", l.MediaType)
+					}
+				}
+			},
+		},
+		{
+			name: "Layer Zstd",
+			opts: []Opts{
+				WithLayerZstd(),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for i, l := range layers {
+					if l.MediaType != mediatype.OCI1LayerZstd {
+						t.Errorf("layer %d media type not converted: %s", i, l.MediaType)
+					}
+				}
+				_, err = testLayerHeaders(ctx, rc, rMod, 0)
+				if err != nil {
+					t.Errorf("failed to read converted layer: %v", err)
+				}
+			},
+		},
+		{
+			name: "Layer Zstd Level",
+			opts: []Opts{
+				WithLayerZstd(19),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				rDefault, err := Apply(ctx, rc, r3amd, WithLayerZstd())
+				if err != nil {
+					t.Fatalf("failed to apply default level: %v", err)
+				}
+				if rDefault.Digest == rMod.Digest {
+					t.Errorf("zstd level did not change the digest")
+				}
+			},
+		},
+		{
+			name: "Layer Zstd Unchanged",
+			opts: []Opts{
+				WithLayerZstd(),
+			},
+			ref:      rZstd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer Zstd Invalid Level",
+			opts: []Opts{
+				WithLayerZstd(30),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Copy zstd",
+			opts: []Opts{
+				WithRefTgt(rZstdCopy),
+			},
+			ref:      rZstd.CommonName(),
+			wantSame: true,
+			check:    zstdCheck,
+		},
+		{
+			name: "Copy zstd File Unchanged",
+			opts: []Opts{
+				WithFileUmask(0),
+				WithRefTgt(rZstdCopy),
+			},
+			ref:      rZstd.CommonName(),
+			wantSame: true,
+			check:    zstdCheck,
+		},
+		{
+			name: "Layer Gzip OS Default",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressGzip),
+			},
+			ref: rZstd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				gzipOSCheck(255)(t, rMod)
+				// an explicit unknown OS matches the default on every platform
+				rOther, err := Apply(ctx, rc, rZstd, WithLayerCompression(archive.CompressGzip), WithGzipOS(255))
+				if err != nil {
+					t.Fatalf("failed to recompress: %v", err)
+				}
+				if rOther.Digest != rMod.Digest {
+					t.Errorf("digest mismatch, expected %s, received %s", rMod.Digest, rOther.Digest)
+				}
+			},
+		},
+		{
+			name: "Layer Gzip OS Unix",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressGzip),
+				WithGzipOS(3),
+			},
+			ref:   rZstd.CommonName(),
+			check: gzipOSCheck(3),
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestDockerToOCI(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup a docker image with a layer media type that cannot be converted to OCI
+	rDockerBadLayer, err := ref.New(tTgtHost + "/testrepo:docker-bad-layer")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rDockerBadLayer, err = Apply(ctx, rc, r3amd, WithManifestToDocker(), WithRefTgt(rDockerBadLayer))
+	if err != nil {
+		t.Fatalf("failed to convert to docker: %v", err)
+	}
+	mDockerBadLayer, err := rc.ManifestGet(ctx, rDockerBadLayer)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	dlDockerBadLayer, err := mDockerBadLayer.(manifest.Imager).GetLayers()
+	if err != nil {
+		t.Fatalf("failed to get layers: %v", err)
+	}
+	dlDockerBadLayer[0].MediaType = "application/vnd.docker.image.rootfs.diff.tar.unknown"
+	err = mDockerBadLayer.(manifest.Imager).SetLayers(dlDockerBadLayer)
+	if err != nil {
+		t.Fatalf("failed to set layers: %v", err)
+	}
+	err = rc.ManifestPut(ctx, rDockerBadLayer, mDockerBadLayer)
+	if err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+	// setup a docker image with metadata in the config
+	rDockerMeta, err := ref.New(tTgtHost + "/testrepo:docker-meta")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rDockerMeta, err = Apply(ctx, rc, r3amd, WithRefTgt(rDockerMeta),
+		WithManifestToDocker(),
+		WithLabel("org.opencontainers.image.revision", "abc123"),
+		WithLabel("org.label-schema.vcs-ref", "def456"),
+		WithLabel("org.label-schema.vcs-url", "https://example.com/repo.git"),
+		WithConfigTimestamp(OptTime{Set: baseTime}),
+	)
+	if err != nil {
+		t.Fatalf("failed to setup docker image with metadata: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Docker To OCI Preserve Metadata",
+			opts: []Opts{
+				WithManifestToOCI(),
+				WithPreserveMetadata(),
+			},
+			ref: rDockerMeta.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.GetDescriptor().MediaType != mediatype.OCI1Manifest {
+					t.Errorf("unexpected media type: %s", m.GetDescriptor().MediaType)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				expect := map[string]string{
+					types.AnnotationCreated:  baseTime.UTC().Format(time.RFC3339),
+					types.AnnotationRevision: "abc123",
+					types.AnnotationSource:   "https://example.com/repo.git",
+				}
+				for k, v := range expect {
+					if annotations[k] != v {
+						t.Errorf("annotation %s, expected %s, received %s", k, v, annotations[k])
+					}
+				}
+			},
+		},
+		{
+			name: "Docker To OCI Unsupported Layer",
+			opts: []Opts{
+				WithManifestToOCI(),
+			},
+			ref:     rDockerBadLayer.CommonName(),
+			wantErr: errs.ErrUnsupportedMediaType,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestSubjectValidate(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd, m3DescAmd := env.ctx, env.rc, env.tTgtHost, env.r3amd, env.m3DescAmd
+	// setup an image with a subject that does not exist
+	rDangling, err := ref.New(tTgtHost + "/testrepo:dangling-subject")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	danglingDesc := descriptor.Descriptor{
+		MediaType: mediatype.OCI1Manifest,
+		Digest:    digest.FromString("missing subject"),
+		Size:      1234,
+	}
+	mDangling, err := rc.ManifestGet(ctx, r3amd)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	err = mDangling.(manifest.Subjecter).SetSubject(&danglingDesc)
+	if err != nil {
+		t.Fatalf("failed to set subject: %v", err)
+	}
+	err = rc.ManifestPut(ctx, rDangling, mDangling)
+	if err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+	rSubject, err := ref.New(tTgtHost + "/testrepo:valid-subject")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = mDangling.(manifest.Subjecter).SetSubject(m3DescAmd)
+	if err != nil {
+		t.Fatalf("failed to set subject: %v", err)
+	}
+	err = rc.ManifestPut(ctx, rSubject, mDangling)
+	if err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+	var danglingReport []descriptor.Descriptor
+	danglingCheck := func(wantSubject bool) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			m, err := rc.ManifestGet(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			subject, err := m.(manifest.Subjecter).GetSubject()
+			if err != nil {
+				t.Fatalf("failed to get subject: %v", err)
+			}
+			if wantSubject != (subject != nil) {
+				t.Errorf("unexpected subject, expected %t, received %v", wantSubject, subject)
+			}
+			if len(danglingReport) != 1 || danglingReport[0].Digest != danglingDesc.Digest {
+				t.Errorf("unexpected report, expected %s, received %v", danglingDesc.Digest, danglingReport)
+			}
+			danglingReport = nil
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Subject Validate Remove",
+			opts: []Opts{
+				WithSubjectValidate(true, func(d descriptor.Descriptor) {
+					danglingReport = append(danglingReport, d)
+				}),
+			},
+			ref:   rDangling.CommonName(),
+			check: danglingCheck(false),
+		},
+		{
+			name: "Subject Validate Error",
+			opts: []Opts{
+				WithSubjectValidate(false, nil),
+			},
+			ref:     rDangling.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+		{
+			name: "Subject Validate No Subject",
+			opts: []Opts{
+				WithSubjectValidate(false, nil),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+		},
+		{
+			name: "Subject Validate Existing",
+			opts: []Opts{
+				WithSubjectValidate(false, nil),
+			},
+			ref:      rSubject.CommonName(),
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestAnnotationCreatedAuto(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	rCreatedLabel, err := ref.New(tTgtHost + "/testrepo:created-label")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rCreatedLabel, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"org.opencontainers.image.created": baseTime.Format(time.RFC3339),
 		}
 	})
-	t.Run("mismatch", func(t *testing.T) {
-		if inListStr(mediatype.Docker2LayerGzip, mtKnownConfig) {
-			t.Errorf("found docker layer in known config list")
+	if err != nil {
+		t.Fatalf("failed to setup config with created label: %v", err)
+	}
+	createdAnnotationCheck := func(expect time.Time) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			m, err := rc.ManifestGet(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			annotations, err := m.(manifest.Annotator).GetAnnotations()
+			if err != nil {
+				t.Fatalf("failed to get annotations: %v", err)
+			}
+			if annotations["org.opencontainers.image.created"] != expect.UTC().Format(time.RFC3339) {
+				t.Errorf("unexpected created annotation, expected %s, received %s", expect.UTC().Format(time.RFC3339), annotations["org.opencontainers.image.created"])
+			}
 		}
+	}
+	tests := []testModCase{
+		{
+			name: "Annotation Created Auto",
+			opts: []Opts{
+				WithAnnotationCreatedAuto(),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				created, err := time.Parse(time.RFC3339, annotations["org.opencontainers.image.created"])
+				if err != nil {
+					t.Fatalf("failed to parse created annotation: %v", err)
+				}
+				if created.After(time.Now()) || created.Before(time.Now().Add(-time.Hour)) {
+					t.Errorf("unexpected created annotation: %s", created.String())
+				}
+			},
+		},
+		{
+			name: "Annotation Created Auto Reproducible",
+			opts: []Opts{
+				WithConfigTimestamp(OptTime{
+					Set: baseTime,
+				}),
+				WithAnnotationCreatedAuto(),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if annotations["org.opencontainers.image.created"] != baseTime.Format(time.RFC3339) {
+					t.Errorf("unexpected created annotation: %s", annotations["org.opencontainers.image.created"])
+				}
+			},
+		},
+		{
+			name: "Annotation Created Auto Label",
+			opts: []Opts{
+				WithLayerTimestampFromLabel("org.opencontainers.image.created"),
+				WithAnnotationCreatedAuto(),
+			},
+			ref:   rCreatedLabel.CommonName(),
+			check: createdAnnotationCheck(baseTime),
+		},
+		{
+			name: "Annotation Created Auto OptTime Label",
+			opts: []Opts{
+				WithConfigTimestamp(OptTime{
+					FromLabel: "org.opencontainers.image.created",
+				}),
+				WithAnnotationCreatedAuto(),
+			},
+			ref:   rCreatedLabel.CommonName(),
+			check: createdAnnotationCheck(baseTime),
+		},
+		{
+			name: "Annotation Created Auto Clamp",
+			opts: []Opts{
+				WithConfigTimestamp(OptTime{
+					Clamp: baseTime,
+				}),
+				WithAnnotationCreatedAuto(),
+			},
+			ref:   tTgtHost + "/testrepo:v1",
+			check: createdAnnotationCheck(baseTime),
+		},
+		{
+			name: "Annotation Created Auto Existing",
+			opts: []Opts{
+				WithAnnotation("org.opencontainers.image.created", "2000-01-01T00:00:00Z"),
+				WithAnnotationCreatedAuto(),
+			},
+			ref: tTgtHost + "/testrepo:v1",
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				annotations, err := m.(manifest.Annotator).GetAnnotations()
+				if err != nil {
+					t.Fatalf("failed to get annotations: %v", err)
+				}
+				if annotations["org.opencontainers.image.created"] != "2000-01-01T00:00:00Z" {
+					t.Errorf("created annotation was overwritten: %s", annotations["org.opencontainers.image.created"])
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestAttachReferrer(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost := env.ctx, env.rc, env.tTgtHost
+	rAttach, err := ref.New(tTgtHost + "/tgtrepo-attach:v1")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Attach Referrer",
+			opts: []Opts{
+				WithRefTgt(rAttach),
+				WithAttachReferrer("application/example.sbom", "application/example.sbom.v1+json", bytes.NewReader([]byte(`{"packages":[]}`))),
+			},
+			ref:      tTgtHost + "/testrepo:v1",
+			wantSame: true,
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestHead(ctx, rMod, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				rl, err := rc.ReferrerList(ctx, rMod.SetDigest(m.GetDescriptor().Digest.String()))
+				if err != nil {
+					t.Fatalf("failed to list referrers: %v", err)
+				}
+				if len(rl.Descriptors) != 1 || rl.Descriptors[0].ArtifactType != "application/example.sbom" {
+					t.Fatalf("unexpected referrers: %v", rl.Descriptors)
+				}
+				mArt, err := rc.ManifestGet(ctx, rMod.SetDigest(rl.Descriptors[0].Digest.String()))
+				if err != nil {
+					t.Fatalf("failed to get referrer: %v", err)
+				}
+				layers, err := mArt.(manifest.Imager).GetLayers()
+				if err != nil || len(layers) != 1 || layers[0].MediaType != "application/example.sbom.v1+json" {
+					t.Errorf("unexpected referrer layers: %v, %v", layers, err)
+				}
+			},
+		},
+		{
+			name: "Attach Referrer Missing Type",
+			opts: []Opts{
+				WithAttachReferrer("", "application/example.sbom.v1+json", bytes.NewReader([]byte(`{}`))),
+			},
+			ref:     tTgtHost + "/testrepo:v1",
+			wantErr: errs.ErrUnsupportedMediaType,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigDiffIDs(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rDiffIDExtra, err := ref.New(tTgtHost + "/testrepo:diffid-extra")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rDiffIDExtra, func(oc *v1.Image) {
+		extra := digest.FromString("extra diff_id")
+		oc.RootFS.DiffIDs = append(oc.RootFS.DiffIDs[:2], append([]digest.Digest{extra}, oc.RootFS.DiffIDs[2:]...)...)
+		oc.RootFS.DiffIDs = append(oc.RootFS.DiffIDs, extra)
+	})
+	if err != nil {
+		t.Fatalf("failed to setup diffid-extra: %v", err)
+	}
+	rDiffIDBad, err := ref.New(tTgtHost + "/testrepo:diffid-bad")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rDiffIDBad, func(oc *v1.Image) {
+		oc.RootFS.DiffIDs[1] = digest.FromString("bad diff_id")
+		oc.RootFS.DiffIDs = append(oc.RootFS.DiffIDs, digest.FromString("extra diff_id"))
 	})
+	if err != nil {
+		t.Fatalf("failed to setup diffid-bad: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config DiffIDs Prune",
+			opts: []Opts{
+				WithConfigDiffIDsPrune(),
+			},
+			ref: rDiffIDExtra.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				confOrig, err := rc.ImageConfig(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				confMod, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				diffOrig := confOrig.GetConfig().RootFS.DiffIDs
+				diffMod := confMod.GetConfig().RootFS.DiffIDs
+				if len(diffOrig) != len(diffMod) {
+					t.Fatalf("diff_ids length mismatch, expected %d, received %d", len(diffOrig), len(diffMod))
+				}
+				for i := range diffOrig {
+					if diffOrig[i] != diffMod[i] {
+						t.Errorf("diff_id %d mismatch, expected %s, received %s", i, diffOrig[i], diffMod[i])
+					}
+				}
+			},
+		},
+		{
+			name: "Config DiffIDs Prune Unchanged",
+			opts: []Opts{
+				WithConfigDiffIDsPrune(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Config DiffIDs Prune Mismatch",
+			opts: []Opts{
+				WithConfigDiffIDsPrune(),
+			},
+			ref:     rDiffIDBad.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+		{
+			name: "Verify Diff IDs",
+			opts: []Opts{
+				WithVerifyDiffIDs(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Verify Diff IDs Bad",
+			opts: []Opts{
+				WithVerifyDiffIDs(),
+			},
+			ref:     rDiffIDBad.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+		{
+			name: "Verify Diff IDs Extra",
+			opts: []Opts{
+				WithVerifyDiffIDs(),
+			},
+			ref:     rDiffIDExtra.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+		{
+			name: "Layer Remove By Created By",
+			opts: []Opts{
+				WithLayerRmCreatedBy(*regexp.MustCompile("^COPY layer2.txt /layer2")),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				confOrig, err := rc.ImageConfig(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				ocOrig := confOrig.GetConfig()
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				// find the matching layer in the original image
+				rmIndex, i := -1, 0
+				for _, h := range ocOrig.History {
+					if h.EmptyLayer {
+						continue
+					}
+					if strings.HasPrefix(h.CreatedBy, "COPY layer2.txt /layer2") {
+						rmIndex = i
+					}
+					i++
+				}
+				if rmIndex < 0 {
+					t.Fatalf("matching history entry not found in original image")
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(layers) != len(layersOrig)-1 || len(oc.RootFS.DiffIDs) != len(layers) || len(oc.History) != len(ocOrig.History)-1 {
+					t.Fatalf("unexpected counts, layers %d, diff_ids %d, history %d", len(layers), len(oc.RootFS.DiffIDs), len(oc.History))
+				}
+				for i := range layers {
+					iOrig := i
+					if i >= rmIndex {
+						iOrig++
+					}
+					if layers[i].Digest != layersOrig[iOrig].Digest || oc.RootFS.DiffIDs[i] != ocOrig.RootFS.DiffIDs[iOrig] {
+						t.Errorf("layer %d does not match original layer %d", i, iOrig)
+					}
+				}
+				for _, h := range oc.History {
+					if strings.HasPrefix(h.CreatedBy, "COPY layer2.txt /layer2") {
+						t.Errorf("history entry was not removed: %s", h.CreatedBy)
+					}
+				}
+			},
+		},
+		{
+			name: "Layer Remove By Created By Mismatch",
+			opts: []Opts{
+				WithLayerRmCreatedBy(*regexp.MustCompile("^COPY layer2.txt /layer2")),
+			},
+			ref:     rDiffIDExtra.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigUser(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with users
+	rUsers, err := ref.New(tTgtHost + "/testrepo:users")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	usersBuf := &bytes.Buffer{}
+	usersTW := tar.NewWriter(usersBuf)
+	for _, f := range []struct{ name, content string }{
+		{"etc/passwd", "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001:app:/home/app:/bin/sh\nnogroup:x:1002:1999::/:/bin/false\n"},
+		{"etc/group", "root:x:0:\napp:x:1001:\n"},
+	} {
+		err = usersTW.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime})
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = usersTW.Write([]byte(f.content))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = usersTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rUsers), WithLayerAddTar(usersBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup users layer: %v", err)
+	}
+	rUserNamed, err := ref.New(tTgtHost + "/testrepo:user-named")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, rUsers, rUserNamed, func(oc *v1.Image) {
+		oc.Config.User = "app"
+	})
+	if err != nil {
+		t.Fatalf("failed to setup named user: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Require Non Root User",
+			opts: []Opts{
+				WithRequireNonRootUser(""),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Require Non Root User By Name",
+			opts: []Opts{
+				WithConfigUserByName("root"),
+				WithRequireNonRootUser(""),
+			},
+			ref:     rUsers.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Require Non Root User Fallback",
+			opts: []Opts{
+				WithRequireNonRootUser("1000:1000"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.User != "1000:1000" {
+					t.Errorf("unexpected user: %s", conf.GetConfig().Config.User)
+				}
+			},
+		},
+		{
+			name: "Require Non Root User Named",
+			opts: []Opts{
+				WithRequireNonRootUser(""),
+			},
+			ref:      rUserNamed.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Require Non Root User Set",
+			opts: []Opts{
+				WithConfigUserByName("app"),
+				WithRequireNonRootUser(""),
+			},
+			ref: rUsers.CommonName(),
+		},
+		{
+			name: "Config User By Name",
+			opts: []Opts{
+				WithConfigUserByName("app"),
+			},
+			ref: rUsers.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.User != "1000:1001" {
+					t.Errorf("unexpected user: %s", conf.GetConfig().Config.User)
+				}
+			},
+		},
+		{
+			name: "User and Working Dir",
+			opts: []Opts{
+				WithUser("app:staff"),
+				WithWorkingDir("/srv"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.User != "app:staff" || conf.GetConfig().Config.WorkingDir != "/srv" {
+					t.Errorf("unexpected user %s, working dir %s", conf.GetConfig().Config.User, conf.GetConfig().Config.WorkingDir)
+				}
+				rAgain, err := Apply(ctx, rc, r3amd, WithUser("app:staff"), WithWorkingDir("/srv"))
+				if err != nil {
+					t.Fatalf("failed to apply again: %v", err)
+				}
+				if rAgain.Digest != rMod.Digest {
+					t.Errorf("digest changed on second apply, expected %s, received %s", rMod.Digest, rAgain.Digest)
+				}
+			},
+		},
+		{
+			name: "User Clear",
+			opts: []Opts{
+				WithUser(""),
+			},
+			ref: rUserNamed.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.User != "" {
+					t.Errorf("user not cleared: %s", conf.GetConfig().Config.User)
+				}
+			},
+		},
+		{
+			name: "User Unchanged",
+			opts: []Opts{
+				WithUser("app"),
+			},
+			ref:      rUserNamed.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config User Ensure",
+			opts: []Opts{
+				WithConfigUserEnsure("svc", 2000, 2000),
+			},
+			ref: rUsers.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.User != "svc" {
+					t.Errorf("unexpected user: %s", conf.GetConfig().Config.User)
+				}
+				passwd, err := testLayerFile(ctx, rc, rMod, 5, "etc/passwd")
+				if err != nil {
+					t.Fatalf("failed to read passwd: %v", err)
+				}
+				expect := "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001:app:/home/app:/bin/sh\nnogroup:x:1002:1999::/:/bin/false\nsvc:x:2000:2000::/:/sbin/nologin\n"
+				if string(passwd) != expect {
+					t.Errorf("unexpected passwd, expected %q, received %q", expect, string(passwd))
+				}
+				group, err := testLayerFile(ctx, rc, rMod, 5, "etc/group")
+				if err != nil {
+					t.Fatalf("failed to read group: %v", err)
+				}
+				expect = "root:x:0:\napp:x:1001:\nsvc:x:2000:\n"
+				if string(group) != expect {
+					t.Errorf("unexpected group, expected %q, received %q", expect, string(group))
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, 5)
+				if err != nil {
+					t.Fatalf("failed to read layer: %v", err)
+				}
+				if len(headers) != 2 {
+					t.Errorf("unexpected number of entries: %d", len(headers))
+				}
+				// the new user resolves at runtime
+				_, err = Apply(ctx, rc, rMod, WithConfigUserByName("svc"), WithRefTgt(rMod.SetTag("user-ensure")))
+				if err != nil {
+					t.Errorf("failed to resolve new user: %v", err)
+				}
+			},
+		},
+		{
+			name: "Config User Ensure Existing",
+			opts: []Opts{
+				WithConfigUserEnsure("app", 1000, 1001),
+			},
+			ref:      rUserNamed.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config User Ensure Invalid",
+			opts: []Opts{
+				WithConfigUserEnsure("bad:name", 1000, 1000),
+			},
+			ref:     rUsers.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Config User By Name Missing",
+			opts: []Opts{
+				WithConfigUserByName("missing"),
+			},
+			ref:     rUsers.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+		{
+			name: "Config User By Name Missing Group",
+			opts: []Opts{
+				WithConfigUserByName("nogroup"),
+			},
+			ref:     rUsers.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+		{
+			name: "Config User By Name No Passwd",
+			opts: []Opts{
+				WithConfigUserByName("app"),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrFileNotFound,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigWorkingDir(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	rWorkDirRoot, err := ref.New(tTgtHost + "/testrepo:workdir-root")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rWorkDirRoot, func(oc *v1.Image) {
+		oc.Config.WorkingDir = "/"
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with root working dir: %v", err)
+	}
+	// setup an image with an opaque whiteout hiding a lower directory
+	rWorkDirOpq, err := ref.New(tTgtHost + "/testrepo:workdir-opq")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	workDirOpqOpts := []Opts{WithRefTgt(rWorkDirOpq)}
+	for _, files := range [][]struct{ name, content string }{
+		{{"app/", ""}, {"app/data/", ""}, {"app/data/f", "F"}},
+		{{"app/", ""}, {"app/.wh..wh..opq", ""}},
+	} {
+		opqBuf := &bytes.Buffer{}
+		opqTW := tar.NewWriter(opqBuf)
+		for _, f := range files {
+			th := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime}
+			if strings.HasSuffix(f.name, "/") {
+				th.Typeflag = tar.TypeDir
+				th.Mode = 0755
+			}
+			err = opqTW.WriteHeader(th)
+			if err != nil {
+				t.Fatalf("failed to write tar header: %v", err)
+			}
+			_, err = opqTW.Write([]byte(f.content))
+			if err != nil {
+				t.Fatalf("failed to write tar content: %v", err)
+			}
+		}
+		err = opqTW.Close()
+		if err != nil {
+			t.Fatalf("failed to close tar: %v", err)
+		}
+		workDirOpqOpts = append(workDirOpqOpts, WithLayerAddTar(opqBuf, "", nil))
+	}
+	_, err = Apply(ctx, rc, r3amd, workDirOpqOpts...)
+	if err != nil {
+		t.Fatalf("failed to setup opaque whiteout layers: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config WorkingDir Trim",
+			opts: []Opts{
+				WithConfigWorkingDirTrim(),
+			},
+			ref: rWorkDirRoot.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get raw config: %v", err)
+				}
+				if conf.GetConfig().Config.WorkingDir != "" || bytes.Contains(raw, []byte(`"WorkingDir"`)) {
+					t.Errorf("working dir not removed: %s", string(raw))
+				}
+			},
+		},
+		{
+			name: "Config WorkingDir Trim Unchanged",
+			opts: []Opts{
+				WithConfigWorkingDirTrim(),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config WorkingDir Ensure",
+			opts: []Opts{
+				WithConfigWorkingDirEnsure("/app/data"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.WorkingDir != "/app/data" {
+					t.Errorf("unexpected working dir: %s", conf.GetConfig().Config.WorkingDir)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				if len(headers) < 2 || headers[len(headers)-2].Name != "app/" || headers[len(headers)-1].Name != "app/data/" {
+					t.Errorf("directories not added to the top layer")
+				}
+			},
+		},
+		{
+			name: "Config WorkingDir Ensure Opaque Whiteout",
+			opts: []Opts{
+				WithConfigWorkingDirEnsure("/app/data"),
+			},
+			ref: rWorkDirOpq.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				// the opaque whiteout hides app/data from the lower layer, but app remains
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				if len(headers) != 3 || headers[2].Name != "app/data/" {
+					names := []string{}
+					for _, th := range headers {
+						names = append(names, th.Name)
+					}
+					t.Errorf("unexpected entries in the top layer: %v", names)
+				}
+			},
+		},
+		{
+			name: "Config WorkingDir Ensure Opaque Whiteout Parent",
+			opts: []Opts{
+				WithConfigWorkingDirEnsure("/app"),
+			},
+			ref: rWorkDirOpq.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				if len(headers) != 2 {
+					t.Errorf("unexpected entries added to the top layer: %d", len(headers))
+				}
+			},
+		},
+		{
+			name: "Config WorkingDir Ensure Root",
+			opts: []Opts{
+				WithConfigWorkingDirEnsure("/"),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Config WorkingDir Ensure Existing",
+			opts: []Opts{
+				WithConfigWorkingDirEnsure("/dir"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				mMod, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				lOrig, _ := mOrig.(manifest.Imager).GetLayers()
+				lMod, _ := mMod.(manifest.Imager).GetLayers()
+				if len(lOrig) != len(lMod) {
+					t.Fatalf("layer count mismatch, expected %d, received %d", len(lOrig), len(lMod))
+				}
+				for i := range lOrig {
+					if lOrig[i].Digest != lMod[i].Digest {
+						t.Errorf("layer %d changed", i)
+					}
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigBuildPlatformScrub(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	rBuildPlatform, err := ref.New(tTgtHost + "/testrepo:build-platform")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rBuildPlatform, func(oc *v1.Image) {
+		oc.Config.Env = append(oc.Config.Env, "TARGETPLATFORM=linux/amd64", "APP=1", "BUILDPLATFORM=linux/arm64")
+		oc.History = append(oc.History,
+			v1.History{Created: &baseTime, CreatedBy: "RUN |3 TARGETPLATFORM=linux/amd64 VERSION=1.2 BUILDPLATFORM=linux/arm64 /bin/sh -c make", EmptyLayer: true},
+			v1.History{Created: &baseTime, CreatedBy: "RUN |1 TARGETARCH=amd64 /bin/sh -c echo $TARGETARCH", EmptyLayer: true},
+		)
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with build platform args: %v", err)
+	}
+	buildPlatformScrubbed := []string{}
+	tests := []testModCase{
+		{
+			name: "Config Build Platform Scrub",
+			opts: []Opts{
+				WithConfigBuildPlatformScrub(func(s string) {
+					buildPlatformScrubbed = append(buildPlatformScrubbed, s)
+				}),
+			},
+			ref: rBuildPlatform.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				for _, env := range oc.Config.Env {
+					if strings.HasPrefix(env, "TARGETPLATFORM=") || strings.HasPrefix(env, "BUILDPLATFORM=") {
+						t.Errorf("env not removed: %s", env)
+					}
+				}
+				if len(oc.History) < 2 {
+					t.Fatalf("history missing")
+				}
+				expect := []string{
+					"RUN |1 VERSION=1.2 /bin/sh -c make",
+					"RUN /bin/sh -c echo $TARGETARCH",
+				}
+				for i, e := range expect {
+					h := oc.History[len(oc.History)-len(expect)+i]
+					if h.CreatedBy != e {
+						t.Errorf("unexpected history, expected %s, received %s", e, h.CreatedBy)
+					}
+				}
+				if len(buildPlatformScrubbed) != 5 {
+					t.Errorf("unexpected report: %v", buildPlatformScrubbed)
+				}
+			},
+		},
+		{
+			name: "Config Build Platform Scrub Unchanged",
+			opts: []Opts{
+				WithConfigBuildPlatformScrub(nil),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigEntrypointPath(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with binaries for entrypoint validation
+	rEntry, err := ref.New(tTgtHost + "/testrepo:entrypoint")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	entryBuf := &bytes.Buffer{}
+	entryTW := tar.NewWriter(entryBuf)
+	for _, th := range []*tar.Header{
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", Mode: 0777, ModTime: baseTime},
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, ModTime: baseTime},
+		{Name: "usr/local/bin/tool", Typeflag: tar.TypeReg, Mode: 0755, ModTime: baseTime},
+	} {
+		err = entryTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+	}
+	err = entryTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rEntry), WithLayerAddTar(entryBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup entrypoint layer: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, rEntry, rEntry, func(oc *v1.Image) {
+		oc.Config.Env = append(oc.Config.Env, "PATH=/usr/local/bin:/usr/bin")
+	})
+	if err != nil {
+		t.Fatalf("failed to setup entrypoint env: %v", err)
+	}
+	rNoPath, err := ref.New(tTgtHost + "/testrepo:no-path")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rNoPath, func(oc *v1.Image) {
+		oc.Config.Env = []string{"APP=1"}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config without path: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Entrypoint Validate Symlink",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/bin/app"}),
+				WithConfigEntrypointValidate(),
+			},
+			ref: rEntry.CommonName(),
+		},
+		{
+			name: "Config Entrypoint Validate Path",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"tool", "--help"}),
+				WithConfigEntrypointValidate(),
+			},
+			ref: rEntry.CommonName(),
+		},
+		{
+			name: "Config Entrypoint Validate Missing",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/bin/missing"}),
+				WithConfigEntrypointValidate(),
+			},
+			ref:     rEntry.CommonName(),
+			wantErr: errs.ErrFileNotFound,
+		},
+		{
+			name: "Config Entrypoint Validate Removed",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/bin/app"}),
+				WithLayerStripFile("/usr/bin/app"),
+				WithConfigEntrypointValidate(),
+			},
+			ref:     rEntry.CommonName(),
+			wantErr: errs.ErrFileNotFound,
+		},
+		{
+			name: "Config Path Prepend",
+			opts: []Opts{
+				WithConfigPathPrepend("/opt/bin"),
+			},
+			ref: rEntry.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "PATH=/opt/bin:/usr/local/bin:/usr/bin"}
+				env := conf.GetConfig().Config.Env
+				if strings.Join(env, "\n") != strings.Join(expect, "\n") {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Config Path Append Existing",
+			opts: []Opts{
+				WithConfigPathAppend("/usr/local/bin"),
+			},
+			ref: rEntry.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "PATH=/usr/bin:/usr/local/bin"}
+				env := conf.GetConfig().Config.Env
+				if strings.Join(env, "\n") != strings.Join(expect, "\n") {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Config Path Create",
+			opts: []Opts{
+				WithConfigPathAppend("/opt/bin"),
+			},
+			ref: rNoPath.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"APP=1", "PATH=/opt/bin"}
+				env := conf.GetConfig().Config.Env
+				if strings.Join(env, "\n") != strings.Join(expect, "\n") {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Config Path Prepend Unchanged",
+			opts: []Opts{
+				WithConfigPathPrepend("/usr/local/bin"),
+			},
+			ref:      rEntry.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config Path Invalid",
+			opts: []Opts{
+				WithConfigPathPrepend("/opt/bin:/usr/bin"),
+			},
+			ref:     rEntry.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigEnv(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rEnvSecret, err := ref.New(tTgtHost + "/testrepo:env-secret")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rEnvSecret, func(oc *v1.Image) {
+		oc.Config.Env = append(oc.Config.Env,
+			"LANG=en_US.UTF-8",
+			"DOWNLOAD_URL=https://example.com/some/path/file.tar.gz",
+			"API_KEY=Zx8kQ2vN7pL4mR9tW3yB6cF1hJ5sD0gA",
+		)
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with env secret: %v", err)
+	}
+	rEnvDup, err := ref.New(tTgtHost + "/testrepo:env-dup")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rEnvDup, func(oc *v1.Image) {
+		oc.Config.Env = []string{"PATH=/bin", "A=1", "B=2", "A=3", "C=4", "B=5", "A=6=7"}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with duplicate env: %v", err)
+	}
+	rEnvEmpty, err := ref.New(tTgtHost + "/testrepo:env-empty")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rEnvEmpty, func(oc *v1.Image) {
+		oc.Config.Env = []string{"PATH=/bin", "EMPTY=", "KEEP=", "VALUE=1", "NOEQUAL"}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with empty env: %v", err)
+	}
+	rEnvBase, err := ref.New(tTgtHost + "/testrepo:env-base")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rEnvBase, func(oc *v1.Image) {
+		oc.Config.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "LANG=C.UTF-8", "VALUE=1", "BASEONLY"}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup base config env: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Env Dedup",
+			opts: []Opts{
+				WithConfigEnvDedup(),
+			},
+			ref: rEnvDup.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/bin", "C=4", "B=5", "A=6=7"}
+				env := conf.GetConfig().Config.Env
+				if strings.Join(env, "\n") != strings.Join(expect, "\n") {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Config Env Dedup Unchanged",
+			opts: []Opts{
+				WithConfigEnvDedup(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Env Set",
+			opts: []Opts{
+				WithEnvSet("VALUE", "a=b"),
+				WithEnvSet("NOEQUAL", "x"),
+				WithEnvSet("NEW", "1"),
+			},
+			ref: rEnvEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				env := conf.GetConfig().Config.Env
+				expect := []string{"PATH=/bin", "EMPTY=", "KEEP=", "VALUE=a=b", "NOEQUAL", "NOEQUAL=x", "NEW=1"}
+				if !eqStrSlice(env, expect) {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Env Set Unchanged",
+			opts: []Opts{
+				WithEnvSet("VALUE", "1"),
+			},
+			ref:      rEnvEmpty.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Env Set Invalid Key",
+			opts: []Opts{
+				WithEnvSet("A=B", "1"),
+			},
+			ref:     rEnvEmpty.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Env Delete",
+			opts: []Opts{
+				WithEnvDelete("EMPTY"),
+				WithEnvDelete("NOEQUAL"),
+			},
+			ref: rEnvEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				env := conf.GetConfig().Config.Env
+				expect := []string{"PATH=/bin", "KEEP=", "VALUE=1", "NOEQUAL"}
+				if !eqStrSlice(env, expect) {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Env Delete Missing",
+			opts: []Opts{
+				WithEnvDelete("MISSING"),
+				WithEnvDelete("NOEQUAL"),
+			},
+			ref:      rEnvEmpty.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config Env Rm Empty",
+			opts: []Opts{
+				WithConfigEnvRmEmpty([]string{"KEEP"}),
+			},
+			ref: rEnvEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/bin", "KEEP=", "VALUE=1"}
+				env := conf.GetConfig().Config.Env
+				if strings.Join(env, "\n") != strings.Join(expect, "\n") {
+					t.Errorf("unexpected env, expected %v, received %v", expect, env)
+				}
+			},
+		},
+		{
+			name: "Config Env Rm Empty Unchanged",
+			opts: []Opts{
+				WithConfigEnvRmEmpty(nil),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Config Env Entropy Check",
+			opts: []Opts{
+				WithConfigEnvEntropyCheck(4.5),
+			},
+			ref:     rEnvSecret.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Config Env Entropy Check Pass",
+			opts: []Opts{
+				WithConfigEnvEntropyCheck(4.5),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "Config Env Merge From Ref",
+			opts: []Opts{
+				WithEnvMergeFromRef(rEnvBase, false),
+			},
+			ref: rEnvEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/bin", "EMPTY=", "KEEP=", "VALUE=1", "NOEQUAL", "LANG=C.UTF-8"}
+				if !eqStrSlice(conf.GetConfig().Config.Env, expect) {
+					t.Errorf("unexpected env, expected %v, received %v", expect, conf.GetConfig().Config.Env)
+				}
+			},
+		},
+		{
+			name: "Config Env Merge From Ref Overwrite",
+			opts: []Opts{
+				WithEnvMergeFromRef(rEnvBase, true),
+			},
+			ref: rEnvEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				expect := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "EMPTY=", "KEEP=", "VALUE=1", "NOEQUAL", "LANG=C.UTF-8"}
+				if !eqStrSlice(conf.GetConfig().Config.Env, expect) {
+					t.Errorf("unexpected env, expected %v, received %v", expect, conf.GetConfig().Config.Env)
+				}
+			},
+		},
+		{
+			name: "Config Env Merge From Ref Unchanged",
+			opts: []Opts{
+				WithEnvMergeFromRef(rEnvBase, true),
+			},
+			ref:      rEnvBase.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config Env Merge From Ref Missing",
+			opts: []Opts{
+				WithEnvMergeFromRef(rEnvBase.SetTag("missing"), false),
+			},
+			ref:     rEnvEmpty.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigExposeFromLabel(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rExposeLabel, err := ref.New(tTgtHost + "/testrepo:expose-label")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rExposeLabel, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"ports":     "8080, 53/UDP,",
+			"ports-bad": "8080,http",
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with port labels: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Expose From Label",
+			opts: []Opts{
+				WithConfigExposeFromLabel("ports"),
+			},
+			ref: rExposeLabel.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				ports := conf.GetConfig().Config.ExposedPorts
+				if len(ports) != 2 {
+					t.Errorf("unexpected exposed ports: %v", ports)
+				}
+				for _, p := range []string{"8080/tcp", "53/udp"} {
+					if _, ok := ports[p]; !ok {
+						t.Errorf("missing exposed port %s: %v", p, ports)
+					}
+				}
+			},
+		},
+		{
+			name: "Config Expose From Label Default udp",
+			opts: []Opts{
+				WithConfigExposeFromLabel("ports"),
+				WithExposeDefaultProtocol("udp"),
+			},
+			ref: rExposeLabel.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				ports := conf.GetConfig().Config.ExposedPorts
+				if len(ports) != 2 {
+					t.Errorf("unexpected exposed ports: %v", ports)
+				}
+				for _, p := range []string{"8080/udp", "53/udp"} {
+					if _, ok := ports[p]; !ok {
+						t.Errorf("missing exposed port %s: %v", p, ports)
+					}
+				}
+			},
+		},
+		{
+			name: "Config Expose From Label Invalid",
+			opts: []Opts{
+				WithConfigExposeFromLabel("ports-bad"),
+			},
+			ref:     rExposeLabel.CommonName(),
+			wantErr: errs.ErrParsingFailed,
+		},
+		{
+			name: "Config Expose From Label Missing",
+			opts: []Opts{
+				WithConfigExposeFromLabel("ports"),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigLabels(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rLabelEmpty, err := ref.New(tTgtHost + "/testrepo:label-empty")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rLabelEmpty, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"empty1": "",
+			"keep":   "value",
+			"empty2": "",
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with empty labels: %v", err)
+	}
+	rLabelBase, err := ref.New(tTgtHost + "/testrepo:label-base")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rLabelBase, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"base":   "base",
+			"shared": "base",
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup base config labels: %v", err)
+	}
+	rLabelApp, err := ref.New(tTgtHost + "/testrepo:label-app")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rLabelApp, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"app":    "app",
+			"shared": "app",
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup app config labels: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Labels Merge From Ref",
+			opts: []Opts{
+				WithLabelsMergeFromRef(rLabelBase, false),
+			},
+			ref: rLabelApp.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				labels := conf.GetConfig().Config.Labels
+				expect := map[string]string{"app": "app", "base": "base", "shared": "app"}
+				for k, v := range expect {
+					if labels[k] != v {
+						t.Errorf("label %s, expected %s, received %s", k, v, labels[k])
+					}
+				}
+			},
+		},
+		{
+			name: "Config Labels Merge From Ref Overwrite",
+			opts: []Opts{
+				WithLabelsMergeFromRef(rLabelBase, true),
+			},
+			ref: rLabelApp.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				labels := conf.GetConfig().Config.Labels
+				expect := map[string]string{"app": "app", "base": "base", "shared": "base"}
+				for k, v := range expect {
+					if labels[k] != v {
+						t.Errorf("label %s, expected %s, received %s", k, v, labels[k])
+					}
+				}
+			},
+		},
+		{
+			name: "Config Labels Merge From Ref Missing",
+			opts: []Opts{
+				WithLabelsMergeFromRef(rLabelBase.SetTag("missing"), false),
+			},
+			ref:     rLabelApp.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+		{
+			name: "Config Label Rm Empty",
+			opts: []Opts{
+				WithConfigLabelRmEmpty(),
+			},
+			ref: rLabelEmpty.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				labels := conf.GetConfig().Config.Labels
+				if len(labels) != 1 || labels["keep"] != "value" {
+					t.Errorf("unexpected labels: %v", labels)
+				}
+			},
+		},
+		{
+			name: "Config Label Rm Empty Unchanged",
+			opts: []Opts{
+				WithConfigLabelRmEmpty(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigMediaTypeNormalize(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	// setup images with a config media type that does not match the manifest
+	rConfigMTOCI, err := ref.New(tTgtHost + "/testrepo:config-mt-oci")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rConfigMTDocker, err := ref.New(tTgtHost + "/testrepo:config-mt-docker")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rConfigMTDocker, err = Apply(ctx, rc, r3amd, WithManifestToDocker(), WithRefTgt(rConfigMTDocker))
+	if err != nil {
+		t.Fatalf("failed to setup docker image: %v", err)
+	}
+	for _, cur := range []struct {
+		src, tgt ref.Ref
+		mt       string
+	}{
+		{src: r3amd, tgt: rConfigMTOCI, mt: mediatype.Docker2ImageConfig},
+		{src: rConfigMTDocker, tgt: rConfigMTDocker, mt: mediatype.OCI1ImageConfig},
+	} {
+		m, err := rc.ManifestGet(ctx, cur.src)
+		if err != nil {
+			t.Fatalf("failed to get manifest: %v", err)
+		}
+		ociM, err := manifest.OCIManifestFromAny(m.GetOrig())
+		if err != nil {
+			t.Fatalf("failed to convert manifest: %v", err)
+		}
+		ociM.Config.MediaType = cur.mt
+		om := m.GetOrig()
+		err = manifest.OCIManifestToAny(ociM, &om)
+		if err != nil {
+			t.Fatalf("failed to convert manifest: %v", err)
+		}
+		m, err = manifest.New(manifest.WithOrig(om))
+		if err != nil {
+			t.Fatalf("failed to create manifest: %v", err)
+		}
+		err = rc.ManifestPut(ctx, cur.tgt, m)
+		if err != nil {
+			t.Fatalf("failed to put manifest: %v", err)
+		}
+	}
+	configMTCheck := func(mtConfig string) func(*testing.T, ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			m, err := rc.ManifestGet(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			cd, err := m.(manifest.Imager).GetConfig()
+			if err != nil {
+				t.Fatalf("failed to get config descriptor: %v", err)
+			}
+			mOrig, err := rc.ManifestGet(ctx, r3amd)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			cdOrig, err := mOrig.(manifest.Imager).GetConfig()
+			if err != nil {
+				t.Fatalf("failed to get config descriptor: %v", err)
+			}
+			if cd.MediaType != mtConfig {
+				t.Errorf("unexpected config media type, expected %s, received %s", mtConfig, cd.MediaType)
+			}
+			if cd.Digest != cdOrig.Digest || cd.Size != cdOrig.Size {
+				t.Errorf("config content changed, expected %s, received %s", cdOrig.Digest, cd.Digest)
+			}
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Config Media Type Normalize OCI",
+			opts: []Opts{
+				WithConfigMediaTypeNormalize(),
+			},
+			ref:   rConfigMTOCI.CommonName(),
+			check: configMTCheck(mediatype.OCI1ImageConfig),
+		},
+		{
+			name: "Config Media Type Normalize Docker",
+			opts: []Opts{
+				WithConfigMediaTypeNormalize(),
+			},
+			ref:   rConfigMTDocker.CommonName(),
+			check: configMTCheck(mediatype.Docker2ImageConfig),
+		},
+		{
+			name: "Config Media Type Normalize Unchanged",
+			opts: []Opts{
+				WithConfigMediaTypeNormalize(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigLegacyV1Strip(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with a config migrated from schema1
+	rLegacyV1, err := ref.New(tTgtHost + "/testrepo:legacy-v1")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	mLegacyV1, err := rc.ManifestGet(ctx, r3amd)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	cdLegacyV1, err := mLegacyV1.(manifest.Imager).GetConfig()
+	if err != nil {
+		t.Fatalf("failed to get config descriptor: %v", err)
+	}
+	confLegacyV1, err := rc.BlobGetOCIConfig(ctx, r3amd, cdLegacyV1)
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	rawLegacyV1, err := confLegacyV1.RawBody()
+	if err != nil {
+		t.Fatalf("failed to get config body: %v", err)
+	}
+	legacyV1 := map[string]any{}
+	err = json.Unmarshal(rawLegacyV1, &legacyV1)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	legacyV1["container"] = "4f9b3e5d0c7a"
+	legacyV1["container_config"] = map[string]any{"Hostname": "4f9b3e5d0c7a", "Cmd": []string{"/bin/sh", "-c", "#(nop) CMD [\"sh\"]"}}
+	legacyV1["docker_version"] = "1.6.2"
+	legacyV1["id"] = "a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	legacyV1["parent"] = "c3d1a6e9b3f3b7a1c0d8e2f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4"
+	if history, ok := legacyV1["history"].([]any); ok && len(history) > 0 {
+		history[0].(map[string]any)["throwaway"] = false
+	}
+	legacyV1["config"].(map[string]any)["Hostname"] = "4f9b3e5d0c7a"
+	legacyV1["config"].(map[string]any)["Image"] = "sha256:c3d1a6e9b3f3b7a1c0d8e2f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4"
+	rawLegacyV1, err = json.Marshal(legacyV1)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	cdLegacyV1 = descriptor.Descriptor{MediaType: cdLegacyV1.MediaType, Digest: digest.FromBytes(rawLegacyV1), Size: int64(len(rawLegacyV1))}
+	_, err = rc.BlobPut(ctx, rLegacyV1, cdLegacyV1, bytes.NewReader(rawLegacyV1))
+	if err != nil {
+		t.Fatalf("failed to put config: %v", err)
+	}
+	err = mLegacyV1.(manifest.Imager).SetConfig(cdLegacyV1)
+	if err != nil {
+		t.Fatalf("failed to set config: %v", err)
+	}
+	err = rc.ManifestPut(ctx, rLegacyV1, mLegacyV1)
+	if err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+	// setup an image with more layers in the history than the rootfs
+	rHistoryExtra, err := ref.New(tTgtHost + "/testrepo:history-extra")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rHistoryExtra, func(oc *v1.Image) {
+		oc.History = append(oc.History, v1.History{Created: &baseTime, CreatedBy: "ADD file.tgz /"})
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with extra history: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Legacy V1 Strip",
+			opts: []Opts{
+				WithConfigLegacyV1Strip(),
+			},
+			ref: rLegacyV1.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				confOrig, err := rc.ImageConfig(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				for _, s := range []string{"container", "docker_version", "parent", "Hostname", "throwaway", "4f9b3e5d0c7a"} {
+					if bytes.Contains(raw, []byte(s)) {
+						t.Errorf("legacy field %s found in config: %s", s, string(raw))
+					}
+				}
+				diffIDs := conf.GetConfig().RootFS.DiffIDs
+				origIDs := confOrig.GetConfig().RootFS.DiffIDs
+				if len(diffIDs) != len(origIDs) {
+					t.Fatalf("diff_ids changed, expected %v, received %v", origIDs, diffIDs)
+				}
+				for i := range diffIDs {
+					if diffIDs[i] != origIDs[i] {
+						t.Errorf("diff_id %d changed, expected %s, received %s", i, origIDs[i], diffIDs[i])
+					}
+				}
+			},
+		},
+		{
+			name: "Config Legacy V1 Strip Unchanged",
+			opts: []Opts{
+				WithConfigLegacyV1Strip(),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Config Legacy V1 Strip History Mismatch",
+			opts: []Opts{
+				WithConfigLegacyV1Strip(),
+			},
+			ref:     rHistoryExtra.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigNormalizeNewlines(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rCRLF, err := ref.New(tTgtHost + "/testrepo:crlf")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rCRLF, func(oc *v1.Image) {
+		oc.Config.Labels = map[string]string{
+			"multiline": "line1\r\nline2\r\n",
+			"single":    "value",
+		}
+		if len(oc.History) > 0 {
+			oc.History[0].CreatedBy = "RUN echo 1 \\\r\n  && echo 2"
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config with CRLF: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Normalize Newlines",
+			opts: []Opts{
+				WithConfigNormalizeNewlines(),
+			},
+			ref: rCRLF.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				if oc.Config.Labels["multiline"] != "line1\nline2\n" || oc.Config.Labels["single"] != "value" {
+					t.Errorf("unexpected labels: %v", oc.Config.Labels)
+				}
+				if len(oc.History) == 0 || oc.History[0].CreatedBy != "RUN echo 1 \\\n  && echo 2" {
+					t.Errorf("unexpected history: %v", oc.History)
+				}
+			},
+		},
+		{
+			name: "Config Normalize Newlines Unchanged",
+			opts: []Opts{
+				WithConfigNormalizeNewlines(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigHealthcheck(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rHealth, err := ref.New(tTgtHost + "/testrepo:healthcheck")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rHealth, func(oc *v1.Image) {
+		oc.Config.Healthcheck = &v1.HealthConfig{Test: []string{"CMD", "/bin/check"}, Interval: time.Minute, Retries: 3}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup healthcheck: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Config Healthcheck None",
+			opts: []Opts{
+				WithConfigHealthcheckNone(),
+			},
+			ref: rHealth.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				raw, err := conf.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get config body: %v", err)
+				}
+				if !bytes.Contains(raw, []byte(`"Healthcheck":{"Test":["NONE"]}`)) {
+					t.Errorf("healthcheck not disabled: %s", string(raw))
+				}
+			},
+		},
+		{
+			name: "Config Healthcheck None Unchanged",
+			opts: []Opts{
+				WithConfigHealthcheckNone(),
+				WithConfigHealthcheckNone(),
+			},
+			ref: rHealth.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				rAgain, err := Apply(ctx, rc, rMod, WithConfigHealthcheckNone())
+				if err != nil {
+					t.Fatalf("failed to apply: %v", err)
+				}
+				if rAgain.Digest != rMod.Digest {
+					t.Errorf("digest changed, %s to %s", rMod.Digest, rAgain.Digest)
+				}
+			},
+		},
+		{
+			name: "Config Healthcheck Rm",
+			opts: []Opts{
+				WithConfigHealthcheckRm(),
+			},
+			ref: rHealth.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if conf.GetConfig().Config.Healthcheck != nil {
+					t.Errorf("healthcheck not removed: %v", conf.GetConfig().Config.Healthcheck)
+				}
+			},
+		},
+		{
+			name: "Config Healthcheck Rm Missing",
+			opts: []Opts{
+				WithConfigHealthcheckRm(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigCmdValidate(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	r3amd := env.r3amd
+	cmdWarnings := []string{}
+	tests := []testModCase{
+		{
+			name: "Config Cmd Validate",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/usr/bin/app"}),
+				WithConfigCmd([]string{"/usr/bin/app", "--help"}),
+				WithConfigCmdValidate(func(s string) {
+					cmdWarnings = append(cmdWarnings, s)
+				}, false),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if !eqStrSlice(cmdWarnings, []string{"cmd /usr/bin/app repeats entrypoint /usr/bin/app on linux/amd64"}) {
+					t.Errorf("unexpected warnings: %v", cmdWarnings)
+				}
+			},
+		},
+		{
+			name: "Config Cmd Validate Strict",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"app"}),
+				WithConfigCmd([]string{"/usr/bin/app", "--help"}),
+				WithConfigCmdValidate(nil, true),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Config Cmd Validate Args",
+			opts: []Opts{
+				WithConfigEntrypoint([]string{"/usr/bin/app"}),
+				WithConfigCmd([]string{"--help"}),
+				WithConfigCmdValidate(nil, true),
+			},
+			ref: r3amd.CommonName(),
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConcurrency(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3, env.r3amd
+	rConcurrency, err := ref.New(tTgtHost + "/tgtrepo-concurrency:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rCreatedNone, err := ref.New(tTgtHost + "/testrepo:created-none")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rCreatedNone, func(oc *v1.Image) {
+		oc.Created = nil
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config without created time: %v", err)
+	}
+	var concurrencyReport LayerCompressionReport
+	tests := []testModCase{
+		{
+			name: "Concurrency",
+			opts: []Opts{
+				WithConcurrency(4),
+				WithLayerCompression(archive.CompressZstd),
+				WithLayerCompressionReport(func(r LayerCompressionReport) {
+					concurrencyReport = r
+				}),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				rSeq, err := Apply(ctx, rc, r3, WithLayerCompression(archive.CompressZstd))
+				if err != nil {
+					t.Fatalf("failed to apply sequentially: %v", err)
+				}
+				if rSeq.Digest != rMod.Digest {
+					t.Errorf("concurrent result does not match sequential result, %s and %s", rMod.Digest, rSeq.Digest)
+				}
+				if len(concurrencyReport.Layers) != 20 {
+					t.Errorf("unexpected number of layers in report: %d", len(concurrencyReport.Layers))
+				}
+			},
+		},
+		{
+			name: "Memory Limit",
+			opts: []Opts{
+				WithTempDir(t.TempDir()),
+				WithMemoryLimit(1024 * 1024),
+				WithLayerCompression(archive.CompressZstd),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				rSeq, err := Apply(ctx, rc, r3, WithLayerCompression(archive.CompressZstd))
+				if err != nil {
+					t.Fatalf("failed to apply without a memory limit: %v", err)
+				}
+				if rSeq.Digest != rMod.Digest {
+					t.Errorf("memory limit result does not match, %s and %s", rMod.Digest, rSeq.Digest)
+				}
+			},
+		},
+		{
+			name: "Memory Limit Negative",
+			opts: []Opts{
+				WithMemoryLimit(-1),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Temp Dir Missing",
+			opts: []Opts{
+				WithTempDir(filepath.Join(t.TempDir(), "missing")),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: os.ErrNotExist,
+		},
+		{
+			name: "Concurrency Copy",
+			opts: []Opts{
+				WithConcurrency(4),
+				WithRefTgt(rConcurrency),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+			check: func(t *testing.T, rMod ref.Ref) {
+				mSrc, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := mSrc.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for i, l := range layers {
+					_, err = rc.BlobHead(ctx, rMod, l)
+					if err != nil {
+						t.Errorf("layer %d missing from target: %v", i, err)
+					}
+				}
+			},
+		},
+		{
+			name: "Concurrency Error",
+			opts: []Opts{
+				WithConcurrency(4),
+				WithFileTimestampFromConfigCreated(),
+			},
+			ref:     rCreatedNone.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+		{
+			name: "Concurrency Invalid",
+			opts: []Opts{
+				WithConcurrency(0),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestBlobChunkSize(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, tempDir, r3amd := env.ctx, env.rc, env.tTgtHost, env.tempDir, env.r3amd
+	rChunkCopy, err := ref.New("ocidir://" + tempDir + "/chunkcopy")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Blob Chunk Size",
+			opts: []Opts{
+				WithBlobChunkSize(64 * 1024),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				content, err := testLayerFile(ctx, rc, rMod, 2, "layer2")
+				if err != nil {
+					t.Fatalf("failed to read layer2: %v", err)
+				}
+				if string(content) != "3\n" {
+					t.Errorf("unexpected content, received %q", string(content))
+				}
+				// the buffer size must not change the output
+				rDefault, err := Apply(ctx, rc, r3amd, WithFileReplace("/layer2", "../testdata/layer3.txt"))
+				if err != nil {
+					t.Fatalf("failed to apply with the default buffer: %v", err)
+				}
+				if rDefault.Digest == "" || rDefault.Digest != rMod.Digest {
+					t.Errorf("digest mismatch, expected %s, received %s", rDefault.Digest, rMod.Digest)
+				}
+			},
+		},
+		{
+			name: "Blob Chunk Size Copy",
+			opts: []Opts{
+				WithBlobChunkSize(64 * 1024),
+				WithRefTgt(rChunkCopy),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+			check: func(t *testing.T, rMod ref.Ref) {
+				if rMod.Scheme != "ocidir" {
+					t.Fatalf("unexpected target: %s", rMod.CommonName())
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for _, l := range layers {
+					br, err := rc.BlobGet(ctx, rMod, l)
+					if err != nil {
+						t.Fatalf("failed to get layer %s: %v", l.Digest.String(), err)
+					}
+					_, err = io.Copy(io.Discard, br)
+					_ = br.Close()
+					if err != nil {
+						t.Errorf("failed to read layer %s: %v", l.Digest.String(), err)
+					}
+				}
+			},
+		},
+		{
+			name: "Blob Chunk Size Invalid",
+			opts: []Opts{
+				WithBlobChunkSize(1),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestSizeReport(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, r3amd := env.ctx, env.rc, env.r3amd
+	var sizeReport SizeReport
+	tests := []testModCase{
+		{
+			name: "Size Report",
+			opts: []Opts{
+				WithLayerStripFile("/layer2"),
+				WithSizeReport(func(report SizeReport) {
+					sizeReport = report
+				}),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(sizeReport.Layers) != len(layers) {
+					t.Fatalf("unexpected number of layers, expected %d, received %d", len(layers), len(sizeReport.Layers))
+				}
+				var size, newSize int64
+				for i, l := range sizeReport.Layers {
+					if !l.Desc.Equal(layers[i]) {
+						t.Errorf("layer %d unexpected descriptor: %v", i, l.Desc)
+					}
+					if i == 2 {
+						if l.NewDesc.Digest != "" || l.Delta != -layers[i].Size {
+							t.Errorf("layer %d expected to be deleted: %v", i, l)
+						}
+					} else if l.Delta != 0 || l.NewDesc.Digest != l.Desc.Digest {
+						t.Errorf("layer %d expected to be unchanged: %v", i, l)
+					}
+					size += layers[i].Size
+					newSize += l.NewDesc.Size
+				}
+				if sizeReport.Size != size || sizeReport.NewSize != newSize || newSize >= size {
+					t.Errorf("unexpected totals: %v", sizeReport)
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestDefaultPlatform(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	plat, err := platform.Parse("linux/amd64/v3")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	rNoPlatform, err := ref.New(tTgtHost + "/testrepo:no-platform")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rNoPlatform, func(oc *v1.Image) {
+		oc.Platform = platform.Platform{}
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config without a platform: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Default Platform",
+			opts: []Opts{
+				WithDefaultPlatform(plat),
+			},
+			ref: rNoPlatform.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				p := conf.GetConfig().Platform
+				if p.OS != plat.OS || p.Architecture != plat.Architecture || p.Variant != plat.Variant {
+					t.Errorf("unexpected platform: %s", p.String())
+				}
+			},
+		},
+		{
+			name: "Default Platform Unchanged",
+			opts: []Opts{
+				WithDefaultPlatform(plat),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerAddCreatedBy(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, baseTime, r3amd := env.ctx, env.rc, env.baseTime, env.r3amd
+	tarBytes, err := os.ReadFile("../testdata/layer.tar")
+	if err != nil {
+		t.Fatalf("failed to read testdata/layer.tar: %v", err)
+	}
+	layerAddCheck := func(createdBy string, created time.Time) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			mOrig, err := rc.ManifestGet(ctx, r3amd)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+			if err != nil {
+				t.Fatalf("failed to get layers: %v", err)
+			}
+			m, err := rc.ManifestGet(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			layers, err := m.(manifest.Imager).GetLayers()
+			if err != nil {
+				t.Fatalf("failed to get layers: %v", err)
+			}
+			if len(layers) != len(layersOrig)+1 {
+				t.Fatalf("unexpected layer count, expected %d, received %d", len(layersOrig)+1, len(layers))
+			}
+			conf, err := rc.ImageConfig(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get config: %v", err)
+			}
+			oc := conf.GetConfig()
+			if len(oc.RootFS.DiffIDs) != len(layers) {
+				t.Errorf("unexpected diff_id count, expected %d, received %d", len(layers), len(oc.RootFS.DiffIDs))
+			}
+			if len(oc.History) == 0 {
+				t.Fatalf("history is empty")
+			}
+			h := oc.History[len(oc.History)-1]
+			if h.CreatedBy != createdBy {
+				t.Errorf("unexpected created_by, expected %s, received %s", createdBy, h.CreatedBy)
+			}
+			if !created.IsZero() && (h.Created == nil || !h.Created.Equal(created)) {
+				t.Errorf("unexpected created, expected %s, received %v", created.String(), h.Created)
+			}
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Layer Add Created By",
+			opts: []Opts{
+				WithLayerAddTarCreatedBy(bytes.NewReader(tarBytes), "", "COPY layer.tar /"),
+			},
+			ref:   r3amd.CommonName(),
+			check: layerAddCheck("COPY layer.tar /", time.Time{}),
+		},
+		{
+			name: "Layer Add Created By Timestamp",
+			opts: []Opts{
+				WithLayerAddTarCreatedBy(bytes.NewReader(tarBytes), mediatype.OCI1Layer, "COPY layer.tar /"),
+				WithLayerTimestamp(OptTime{Set: baseTime, BaseLayers: 5}),
+			},
+			ref:   r3amd.CommonName(),
+			check: layerAddCheck("COPY layer.tar /", baseTime),
+		},
+		{
+			name: "Layer Add Created By Invalid Media Type",
+			opts: []Opts{
+				WithLayerAddTarCreatedBy(bytes.NewReader(tarBytes), mediatype.OCI1Manifest, "COPY layer.tar /"),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrUnsupportedMediaType,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerAddArchive(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	tarBytes, err := os.ReadFile("../testdata/layer.tar")
+	if err != nil {
+		t.Fatalf("failed to read testdata/layer.tar: %v", err)
+	}
+	// setup compressed variants of the layer tar
+	archiveDir := t.TempDir()
+	archiveFiles := map[string]string{"tar": "../testdata/layer.tar"}
+	for _, comp := range []archive.CompressType{archive.CompressGzip, archive.CompressZstd} {
+		cr, err := archive.Compress(bytes.NewReader(tarBytes), comp)
+		if err != nil {
+			t.Fatalf("failed to compress layer: %v", err)
+		}
+		b, err := io.ReadAll(cr)
+		_ = cr.Close()
+		if err != nil {
+			t.Fatalf("failed to compress layer: %v", err)
+		}
+		archiveFiles[comp.String()] = filepath.Join(archiveDir, "layer.tar."+comp.String())
+		err = os.WriteFile(archiveFiles[comp.String()], b, 0644)
+		if err != nil {
+			t.Fatalf("failed to write compressed layer: %v", err)
+		}
+	}
+	// cross repo tests start from a repository without the archive blobs
+	rArchiveSrc, err := ref.New(tTgtHost + "/archivesrc:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = rc.ImageCopy(ctx, r3amd, rArchiveSrc)
+	if err != nil {
+		t.Fatalf("failed to copy image: %v", err)
+	}
+	rArchiveTgt, err := ref.New(tTgtHost + "/archivetgt:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	// sameTar is false when a file step rewrites the added layer, changing the diff_id
+	archiveCheck := func(mt string, sameTar bool) func(*testing.T, ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			m, err := rc.ManifestGet(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get manifest: %v", err)
+			}
+			layers, err := m.(manifest.Imager).GetLayers()
+			if err != nil || len(layers) == 0 {
+				t.Fatalf("failed to get layers: %v", err)
+			}
+			if layers[len(layers)-1].MediaType != mt {
+				t.Errorf("unexpected media type, expected %s, received %s", mt, layers[len(layers)-1].MediaType)
+			}
+			conf, err := rc.ImageConfig(ctx, rMod)
+			if err != nil {
+				t.Fatalf("failed to get config: %v", err)
+			}
+			diffIDs := conf.GetConfig().RootFS.DiffIDs
+			if len(diffIDs) != len(layers) || (sameTar && diffIDs[len(diffIDs)-1] != digest.FromBytes(tarBytes)) {
+				t.Errorf("unexpected diff_ids: %v", diffIDs)
+			}
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Layer Add Archive tar",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["tar"]),
+			},
+			ref:   r3amd.CommonName(),
+			check: archiveCheck(mediatype.OCI1Layer, true),
+		},
+		{
+			name: "Layer Add Archive gzip",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["gzip"]),
+			},
+			ref:   r3amd.CommonName(),
+			check: archiveCheck(mediatype.OCI1LayerGzip, true),
+		},
+		{
+			name: "Layer Add Archive zstd",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["zstd"]),
+			},
+			ref:   r3amd.CommonName(),
+			check: archiveCheck(mediatype.OCI1LayerZstd, true),
+		},
+		{
+			name: "Layer Add Archive tar Cross Repo",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["tar"]),
+				WithFileTarTime("/missing.tar", OptTime{Set: baseTime}),
+				WithRefTgt(rArchiveTgt.SetTag("archive-tar")),
+			},
+			ref:   rArchiveSrc.CommonName(),
+			check: archiveCheck(mediatype.OCI1Layer, false),
+		},
+		{
+			name: "Layer Add Archive gzip Cross Repo",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["gzip"]),
+				WithFileTarTime("/missing.tar", OptTime{Set: baseTime}),
+				WithRefTgt(rArchiveTgt.SetTag("archive-gzip")),
+			},
+			ref:   rArchiveSrc.CommonName(),
+			check: archiveCheck(mediatype.OCI1LayerGzip, false),
+		},
+		{
+			name: "Layer Add Archive zstd Cross Repo",
+			opts: []Opts{
+				WithLayerAddArchive(archiveFiles["zstd"]),
+				WithFileTarTime("/missing.tar", OptTime{Set: baseTime}),
+				WithRefTgt(rArchiveTgt.SetTag("archive-zstd")),
+			},
+			ref:   rArchiveSrc.CommonName(),
+			check: archiveCheck(mediatype.OCI1LayerZstd, false),
+		},
+		{
+			name: "Layer Add Archive Invalid",
+			opts: []Opts{
+				WithLayerAddArchive("../testdata/layer1.txt"),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerCompressionReport(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	tTgtHost := env.tTgtHost
+	var compressReport LayerCompressionReport
+	tests := []testModCase{
+		{
+			name: "Layer Compressed zstd Report",
+			opts: []Opts{
+				WithLayerCompression(archive.CompressZstd),
+				WithLayerCompressionReport(func(report LayerCompressionReport) {
+					compressReport = report
+				}),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, r ref.Ref) {
+				if len(compressReport.Layers) == 0 {
+					t.Fatalf("no layers in compression report")
+				}
+				var size, newSize, ucSize int64
+				for i, l := range compressReport.Layers {
+					if l.NewDesc.MediaType != mediatype.OCI1LayerZstd {
+						t.Errorf("layer %d unexpected media type: %s", i, l.NewDesc.MediaType)
+					}
+					if l.Desc.Digest == l.NewDesc.Digest || l.NewDesc.Size <= 0 || l.UncompressedSize <= 0 {
+						t.Errorf("layer %d unexpected entry: %v", i, l)
+					}
+					size += l.Desc.Size
+					newSize += l.NewDesc.Size
+					ucSize += l.UncompressedSize
+				}
+				if size != compressReport.Size || newSize != compressReport.NewSize || ucSize != compressReport.UncompressedSize {
+					t.Errorf("report totals mismatch: %v", compressReport)
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestFileTimestampFromConfig(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	rCreatedNone, err := ref.New(tTgtHost + "/testrepo:created-none")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	err = testConfigSetup(ctx, rc, r3amd, rCreatedNone, func(oc *v1.Image) {
+		oc.Created = nil
+	})
+	if err != nil {
+		t.Fatalf("failed to setup config without created time: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "File Timestamp From Config Created",
+			opts: []Opts{
+				WithFileTimestampFromConfigCreated(),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				created := conf.GetConfig().Created
+				if created == nil {
+					t.Fatalf("config created time missing")
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, 0)
+				if err != nil {
+					t.Fatalf("failed to read layer: %v", err)
+				}
+				for _, th := range headers {
+					if !th.ModTime.Equal(*created) {
+						t.Errorf("unexpected mod time on %s: %s", th.Name, th.ModTime.String())
+					}
+				}
+			},
+		},
+		{
+			name: "File Timestamp From Config Created Missing",
+			opts: []Opts{
+				WithFileTimestampFromConfigCreated(),
+			},
+			ref:     rCreatedNone.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestFileMode(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with a mix of file modes
+	rFileMode, err := ref.New(tTgtHost + "/testrepo:file-mode")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	modeBuf := &bytes.Buffer{}
+	modeTW := tar.NewWriter(modeBuf)
+	for _, th := range []*tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0775, ModTime: baseTime},
+		{Name: "app/run", Typeflag: tar.TypeReg, Mode: 04755, ModTime: baseTime},
+		{Name: "app/data", Typeflag: tar.TypeReg, Mode: 0600, ModTime: baseTime},
+		{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "run", Mode: 0777, ModTime: baseTime},
+		{Name: "scratch/", Typeflag: tar.TypeDir, Mode: 01777, ModTime: baseTime},
+		{Name: "entrypoint.sh", Typeflag: tar.TypeReg, Mode: 0644, ModTime: baseTime},
+	} {
+		err = modeTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+	}
+	err = modeTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rFileMode), WithLayerAddTar(modeBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup file mode layer: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "File Chmod",
+			opts: []Opts{
+				WithFileChmod(map[string]os.FileMode{"/entrypoint.sh": 0755, "app/link": 0600, "missing": 0755}),
+			},
+			ref: rFileMode.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				want := map[string]int64{"app/": 0775, "app/run": 04755, "app/data": 0600, "app/link": 0777, "scratch/": 01777, "entrypoint.sh": 0755}
+				for _, th := range headers {
+					if th.Mode != want[th.Name] {
+						t.Errorf("unexpected mode on %s: %o", th.Name, th.Mode)
+					}
+				}
+			},
+		},
+		{
+			name: "File Chmod Unchanged",
+			opts: []Opts{
+				WithFileChmod(map[string]os.FileMode{"app/data": 0600}),
+			},
+			ref:      rFileMode.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "File Mode",
+			opts: []Opts{
+				WithFileMode(0644, 0755),
+			},
+			ref: rFileMode.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				want := map[string]int64{"app/": 0755, "app/run": 0644, "app/data": 0644, "app/link": 0777, "scratch/": 01755, "entrypoint.sh": 0644}
+				for _, th := range headers {
+					if th.Mode != want[th.Name] {
+						t.Errorf("unexpected mode on %s: %o", th.Name, th.Mode)
+					}
+				}
+			},
+		},
+		{
+			name: "File Mode Keep Setuid",
+			opts: []Opts{
+				WithFileMode(0755, 0),
+				WithKeepSetuid(),
+			},
+			ref: rFileMode.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				want := map[string]int64{"app/": 0775, "app/run": 04755, "app/data": 0755, "app/link": 0777, "scratch/": 01777, "entrypoint.sh": 0755}
+				for _, th := range headers {
+					if th.Mode != want[th.Name] {
+						t.Errorf("unexpected mode on %s: %o", th.Name, th.Mode)
+					}
+				}
+			},
+		},
+		{
+			name: "File Mode Unchanged",
+			opts: []Opts{
+				WithFileMode(0, 0),
+			},
+			ref:      rFileMode.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer File Delete Directory Contents",
+			opts: []Opts{
+				WithFileDelete("app/*"),
+			},
+			ref: rFileMode.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"app/", "scratch/", "entrypoint.sh"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerCanonical(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup two images with equivalent layers written by different tools
+	rCanonA, err := ref.New(tTgtHost + "/testrepo:canonical-a")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rCanonB, err := ref.New(tTgtHost + "/testrepo:canonical-b")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	canonBufA := &bytes.Buffer{}
+	canonTWA := tar.NewWriter(canonBufA)
+	canonBufB := &bytes.Buffer{}
+	canonTWB := tar.NewWriter(canonBufB)
+	canonTime := baseTime.Add(time.Millisecond * 250)
+	for _, f := range []struct{ nameA, nameB, content string }{
+		{"./", "", ""},
+		{"./app", "app/", ""},
+		{"./app/file.txt", "app/file.txt", "canonical\n"},
+	} {
+		thA := &tar.Header{Name: f.nameA, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: canonTime, AccessTime: canonTime, Uname: "root", Gname: "root", Format: tar.FormatPAX}
+		if strings.HasSuffix(f.nameA, "/") || f.content == "" {
+			thA.Typeflag = tar.TypeDir
+			thA.Mode = 0755
+		}
+		err = canonTWA.WriteHeader(thA)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = canonTWA.Write([]byte(f.content))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+		if f.nameB == "" {
+			continue
+		}
+		thB := &tar.Header{Name: f.nameB, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime, Format: tar.FormatGNU}
+		if strings.HasSuffix(f.nameB, "/") {
+			thB.Typeflag = tar.TypeDir
+			thB.Mode = 0755
+		}
+		err = canonTWB.WriteHeader(thB)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = canonTWB.Write([]byte(f.content))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = canonTWA.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	err = canonTWB.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rCanonA), WithLayerAddTar(canonBufA, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup canonical image: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rCanonB), WithLayerAddTar(canonBufB, mediatype.OCI1Layer, nil))
+	if err != nil {
+		t.Fatalf("failed to setup canonical image: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "File Ownership",
+			opts: []Opts{
+				WithFileOwnership(1000, -1),
+			},
+			ref: rCanonA.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				for _, th := range headers {
+					if th.Uid != 1000 || th.Uname != "" {
+						t.Errorf("user not changed on %s: %d %s", th.Name, th.Uid, th.Uname)
+					}
+					if th.Gid != 0 || th.Gname != "root" {
+						t.Errorf("group changed on %s: %d %s", th.Name, th.Gid, th.Gname)
+					}
+				}
+			},
+		},
+		{
+			name: "File Ownership Unchanged",
+			opts: []Opts{
+				WithFileOwnership(-1, -1),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+		{
+			name: "File Ownership Invalid",
+			opts: []Opts{
+				WithFileOwnership(-2, 0),
+			},
+			ref:     tTgtHost + "/testrepo:v3",
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Layer Canonical Repack",
+			opts: []Opts{
+				WithCanonicalRepack(),
+			},
+			ref: rCanonA.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				rOther, err := Apply(ctx, rc, rCanonB, WithCanonicalRepack())
+				if err != nil {
+					t.Fatalf("failed to repack second image: %v", err)
+				}
+				mMod, err := rc.ManifestHead(ctx, rMod, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				mOther, err := rc.ManifestHead(ctx, rOther, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				if mMod.GetDescriptor().Digest != mOther.GetDescriptor().Digest {
+					t.Errorf("repacked images do not match, %s and %s", mMod.GetDescriptor().Digest, mOther.GetDescriptor().Digest)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+					if th.Uname != "" || !th.AccessTime.IsZero() || th.ModTime.Nanosecond() != 0 {
+						t.Errorf("header not normalized: %v", th)
+					}
+				}
+				if !eqStrSlice(names, []string{"app/", "app/file.txt"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerReproducibleHost(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup two builds of the same content with host specific metadata
+	rReproA, err := ref.New(tTgtHost + "/testrepo:repro-a")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rReproB, err := ref.New(tTgtHost + "/testrepo:repro-b")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	for i, build := range []struct {
+		r        ref.Ref
+		hostTime time.Time
+		xattr    string
+		dev      int64
+	}{
+		{r: rReproA, hostTime: baseTime.Add(time.Hour), xattr: "com.apple.quarantine", dev: 8},
+		{r: rReproB, hostTime: baseTime.Add(time.Hour * 2), xattr: "security.selinux"},
+	} {
+		reproBuf := &bytes.Buffer{}
+		reproTW := tar.NewWriter(reproBuf)
+		content := []byte("reproducible\n")
+		err = reproTW.WriteHeader(&tar.Header{
+			Name: "app/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)),
+			ModTime: baseTime, AccessTime: build.hostTime, ChangeTime: build.hostTime, Devmajor: build.dev,
+			PAXRecords: map[string]string{"SCHILY.xattr." + build.xattr: fmt.Sprintf("host-%d", i), "SCHILY.xattr.user.app": "keep"},
+			Format:     tar.FormatPAX,
+		})
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = reproTW.Write(content)
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+		err = reproTW.Close()
+		if err != nil {
+			t.Fatalf("failed to close tar: %v", err)
+		}
+		_, err = Apply(ctx, rc, r3amd, WithRefTgt(build.r), WithLayerAddTar(reproBuf, "", nil))
+		if err != nil {
+			t.Fatalf("failed to setup reproducible layer: %v", err)
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Layer Reproducible Host Metadata",
+			opts: []Opts{
+				WithLayerReproducible(),
+			},
+			ref: rReproA.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				rOther, err := Apply(ctx, rc, rReproB, WithLayerReproducible())
+				if err != nil {
+					t.Fatalf("failed to modify second image: %v", err)
+				}
+				mMod, err := rc.ManifestHead(ctx, rMod, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				mOther, err := rc.ManifestHead(ctx, rOther, regclient.WithManifestRequireDigest())
+				if err != nil {
+					t.Fatalf("failed to head manifest: %v", err)
+				}
+				if mMod.GetDescriptor().Digest != mOther.GetDescriptor().Digest {
+					t.Errorf("reproducible images do not match, %s and %s", mMod.GetDescriptor().Digest, mOther.GetDescriptor().Digest)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				if len(headers) != 1 {
+					t.Fatalf("unexpected number of entries: %d", len(headers))
+				}
+				th := headers[0]
+				if !th.AccessTime.IsZero() || !th.ChangeTime.IsZero() || th.Devmajor != 0 {
+					t.Errorf("host metadata not removed: atime %v, ctime %v, devmajor %d", th.AccessTime, th.ChangeTime, th.Devmajor)
+				}
+				if _, ok := th.PAXRecords["SCHILY.xattr.com.apple.quarantine"]; ok {
+					t.Errorf("quarantine xattr not removed")
+				}
+				if th.PAXRecords["SCHILY.xattr.user.app"] != "keep" {
+					t.Errorf("user xattr not preserved: %v", th.PAXRecords)
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerFileInventory(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	tTgtHost := env.tTgtHost
+	inventoryBuf := &bytes.Buffer{}
+	tests := []testModCase{
+		{
+			name: "Layer File Inventory",
+			opts: []Opts{
+				WithFileInventory(inventoryBuf),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+			check: func(t *testing.T, rMod ref.Ref) {
+				layer1, err := os.ReadFile("../testdata/layer1.txt")
+				if err != nil {
+					t.Fatalf("failed to read layer1.txt: %v", err)
+				}
+				found := false
+				entries := map[string]bool{}
+				dec := json.NewDecoder(inventoryBuf)
+				for {
+					var entry FileInventoryEntry
+					err := dec.Decode(&entry)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("failed to decode inventory: %v", err)
+					}
+					key := entry.Layer.String() + ":" + entry.Path
+					if entries[key] {
+						t.Errorf("duplicate entry: %s", key)
+					}
+					entries[key] = true
+					if entry.Path == "layer1" {
+						found = true
+						if entry.Digest != digest.FromBytes(layer1) || entry.Size != int64(len(layer1)) || entry.Mode == 0 {
+							t.Errorf("unexpected entry: %v", entry)
+						}
+					}
+				}
+				if !found {
+					t.Errorf("layer1 missing from inventory")
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerFileContent(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with scripts using a mix of line endings
+	rLineEnd, err := ref.New(tTgtHost + "/testrepo:line-end")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	lineEndFiles := map[string]string{
+		"scripts/crlf.sh": "#!/bin/sh\r\necho crlf\r\n",
+		"scripts/lf.sh":   "#!/bin/sh\necho lf\n",
+		"scripts/bin.sh":  "bin\x00\r\ndata\r\n",
+		"other/crlf.txt":  "other\r\n",
+	}
+	lineEndBuf := &bytes.Buffer{}
+	lineEndTW := tar.NewWriter(lineEndBuf)
+	for _, name := range []string{"scripts/crlf.sh", "scripts/lf.sh", "scripts/bin.sh", "other/crlf.txt"} {
+		err = lineEndTW.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(lineEndFiles[name])), ModTime: baseTime})
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = lineEndTW.Write([]byte(lineEndFiles[name]))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = lineEndTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rLineEnd), WithLayerAddTar(lineEndBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup line ending layer: %v", err)
+	}
+	lineEndCheck := func(want map[string]string) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			for name, content := range want {
+				b, err := testLayerFile(ctx, rc, rMod, 5, name)
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				if string(b) != content {
+					t.Errorf("unexpected content in %s, expected %q, received %q", name, content, string(b))
+				}
+			}
+		}
+	}
+	// setup an image with entries prefixed by "./", as output by docker and buildkit
+	rDotSlash, err := ref.New(tTgtHost + "/testrepo:dot-slash")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	dotSlashFiles := map[string]string{
+		"./etc/app.conf":                      "key=value\r\n",
+		"./etc/ssl/certs/ca-certificates.crt": "-----BEGIN CERTIFICATE-----\nexisting\n-----END CERTIFICATE-----\n",
+	}
+	dotSlashBuf := &bytes.Buffer{}
+	dotSlashTW := tar.NewWriter(dotSlashBuf)
+	for _, name := range []string{"./", "./etc/", "./etc/app.conf", "./etc/ssl/", "./etc/ssl/certs/", "./etc/ssl/certs/ca-certificates.crt"} {
+		th := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(dotSlashFiles[name])), ModTime: baseTime}
+		if strings.HasSuffix(name, "/") {
+			th.Typeflag = tar.TypeDir
+			th.Mode = 0755
+		}
+		err = dotSlashTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = dotSlashTW.Write([]byte(dotSlashFiles[name]))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = dotSlashTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rDotSlash), WithLayerAddTar(dotSlashBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup dot slash layer: %v", err)
+	}
+	dotSlashCheck := func(want map[string]string) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			for name, content := range want {
+				b, err := testLayerFile(ctx, rc, rMod, 5, name)
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				if string(b) != content {
+					t.Errorf("unexpected content in %s, expected %q, received %q", name, content, string(b))
+				}
+			}
+		}
+	}
+	// setup an image with a CA bundle
+	rCABundle, err := ref.New(tTgtHost + "/testrepo:ca-bundle")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	caBuf := &bytes.Buffer{}
+	caTW := tar.NewWriter(caBuf)
+	caBundle := "existing certs"
+	err = caTW.WriteHeader(&tar.Header{Name: "etc/ssl/certs/ca-certificates.crt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(caBundle)), ModTime: baseTime})
+	if err != nil {
+		t.Fatalf("failed to write tar header: %v", err)
+	}
+	_, err = caTW.Write([]byte(caBundle))
+	if err != nil {
+		t.Fatalf("failed to write tar content: %v", err)
+	}
+	err = caTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rCABundle), WithLayerAddTar(caBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup CA bundle layer: %v", err)
+	}
+	caCertPEM := []byte(`-----BEGIN CERTIFICATE-----
+MIIC/zCCAeegAwIBAgIUPrFPsUzINvS75tp6kIdsycXrrSQwDQYJKoZIhvcNAQEL
+BQAwDzENMAsGA1UEAwwERGVtbzAeFw0yMzA1MzEwMDI0NDJaFw0zMzA1MjgwMDI0
+NDJaMA8xDTALBgNVBAMMBERlbW8wggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEK
+AoIBAQDWdtttrOqNS9WhwhL+6G4annBVLP1Eis+pH5sXL1O71lXAWUSXYTqEgLlB
+g5Id8vAvS4bz2ogPnOURTsEwHp/vfPpMs1mHd71apd0b4aDNThvVK4t0y9KrMZ9I
+cVyX/tkoR/CIEkmVqiUxiG2hfZTUTuO7pKkjZHV7DOSCBp7QOVhl16grEXOCWp8X
+DAKl90WowMmtXBLX11/n9KWlwE2PaVPTp/4B4z4E44sBFATWfezDTv5ieTaKvLAN
+SGEa9cA4eqjSA/mJAxlsEOW5IZRfqNskTwpRCMzdQ0UtyvLUlWqXdPdN07RbnT08
+FipckYLaT8YtipA/Pgg1CGJLwBxRAgMBAAGjUzBRMB0GA1UdDgQWBBR6w/+PiaNa
+F9vTVx5Xob/kYfRFEDAfBgNVHSMEGDAWgBR6w/+PiaNaF9vTVx5Xob/kYfRFEDAP
+BgNVHRMBAf8EBTADAQH/MA0GCSqGSIb3DQEBCwUAA4IBAQCuoCA/3wZuMgT9fYCK
++inOPi0no+sB+l8GCx0lYAkjIPyJISqvixfHbgXg5zKubgHyDXziUpKFsvF8kloo
+7KIjWsWi7R8mONWKIc+f1WsVbFzheS6hqg+YyPwN2Kws7YDhQ3cbeajByHLNzEYm
+gVtTz6wFP+B3IMGH4yeghGMHi7PGPrtj93uhCLUHswlEEFBHE+Kzn3AcJzpmY+M5
+9T4x+na+bdlNEKuBqRYNxrNexQ1Nb82JxeR89RnPXXwdWBDw9UhiztRPWNA8nlJr
+s1j+J2mbMDUuG2N+ndivBimxP1y8bEYeHPtzskqECj08ul97hsi2ihGJUBpEjEca
+ZFjP
+-----END CERTIFICATE-----
+`)
+	var sizeHistogram FileSizeHistogram
+	replaceMode := os.FileMode(0o750) | os.ModeSetuid
+	tests := []testModCase{
+		{
+			name: "Layer File Line Ending LF",
+			opts: []Opts{
+				WithFileLineEndingConvert("scripts/*.sh", "lf"),
+			},
+			ref: rLineEnd.CommonName(),
+			check: lineEndCheck(map[string]string{
+				"scripts/crlf.sh": "#!/bin/sh\necho crlf\n",
+				"scripts/lf.sh":   lineEndFiles["scripts/lf.sh"],
+				"scripts/bin.sh":  lineEndFiles["scripts/bin.sh"],
+				"other/crlf.txt":  lineEndFiles["other/crlf.txt"],
+			}),
+		},
+		{
+			name: "Layer File Line Ending CRLF",
+			opts: []Opts{
+				WithFileLineEndingConvert("/scripts/*", "CRLF"),
+			},
+			ref: rLineEnd.CommonName(),
+			check: lineEndCheck(map[string]string{
+				"scripts/crlf.sh": lineEndFiles["scripts/crlf.sh"],
+				"scripts/lf.sh":   "#!/bin/sh\r\necho lf\r\n",
+				"scripts/bin.sh":  lineEndFiles["scripts/bin.sh"],
+			}),
+		},
+		{
+			name: "Layer File Content Dot Slash",
+			opts: []Opts{
+				WithFilePrepend("/etc/*.conf", []byte("# header\n")),
+				WithFileAppend("etc/app.conf", []byte("# footer\r\n")),
+				WithFileLineEndingConvert("etc/app.conf", "lf"),
+			},
+			ref: rDotSlash.CommonName(),
+			check: dotSlashCheck(map[string]string{
+				"etc/app.conf": "# header\nkey=value\n# footer\n",
+			}),
+		},
+		{
+			name: "Layer File CA Bundle Dot Slash",
+			opts: []Opts{
+				WithInjectCACert(caCertPEM, "", "/etc/ssl/certs/ca-certificates.crt"),
+			},
+			ref: rDotSlash.CommonName(),
+			check: dotSlashCheck(map[string]string{
+				"etc/ssl/certs/ca-certificates.crt": dotSlashFiles["./etc/ssl/certs/ca-certificates.crt"] + string(caCertPEM),
+			}),
+		},
+		{
+			name: "Layer File Line Ending Unchanged",
+			opts: []Opts{
+				WithFileLineEndingConvert("scripts/lf.sh", "lf"),
+			},
+			ref:      rLineEnd.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer File Line Ending Invalid",
+			opts: []Opts{
+				WithFileLineEndingConvert("scripts/*", "cr"),
+			},
+			ref:     rLineEnd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Layer File Size Histogram",
+			opts: []Opts{
+				WithFileSizeHistogram([]int64{100, 0, 10}, func(h FileSizeHistogram) {
+					sizeHistogram = h
+				}),
+			},
+			ref:      rLineEnd.CommonName(),
+			wantSame: true,
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				expect := FileSizeHistogram{Buckets: map[int64]int{0: 0, 10: 0, 100: 0}}
+				for i := range layers {
+					headers, err := testLayerHeaders(ctx, rc, rMod, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					for _, th := range headers {
+						if th.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(th.Name), ".wh.") {
+							continue
+						}
+						expect.Files++
+						expect.Bytes += th.Size
+						switch {
+						case th.Size <= 0:
+							expect.Buckets[0]++
+						case th.Size <= 10:
+							expect.Buckets[10]++
+						case th.Size <= 100:
+							expect.Buckets[100]++
+						default:
+							expect.Overflow++
+						}
+					}
+				}
+				if expect.Files == 0 || expect.Buckets[10] == 0 {
+					t.Fatalf("test image does not have expected files: %v", expect)
+				}
+				if sizeHistogram.Files != expect.Files || sizeHistogram.Bytes != expect.Bytes || sizeHistogram.Overflow != expect.Overflow || len(sizeHistogram.Buckets) != len(expect.Buckets) {
+					t.Errorf("unexpected histogram, expected %v, received %v", expect, sizeHistogram)
+				}
+				for b, count := range expect.Buckets {
+					if sizeHistogram.Buckets[b] != count {
+						t.Errorf("unexpected count in bucket %d, expected %d, received %d", b, count, sizeHistogram.Buckets[b])
+					}
+				}
+			},
+		},
+		{
+			name: "Layer File Size Histogram Invalid",
+			opts: []Opts{
+				WithFileSizeHistogram([]int64{}, func(h FileSizeHistogram) {}),
+			},
+			ref:     rLineEnd.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Inject CA Cert",
+			opts: []Opts{
+				WithInjectCACert(caCertPEM, "", "/etc/ssl/certs/ca-certificates.crt"),
+			},
+			ref: rCABundle.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				if len(headers) != 4 || headers[3].Mode != 0644 || headers[3].ModTime.Unix() != 0 ||
+					!strings.HasPrefix(headers[3].Name, "etc/ssl/certs/ca-") || !strings.HasSuffix(headers[3].Name, ".crt") {
+					t.Fatalf("unexpected headers in new layer: %v", headers)
+				}
+				certFile, err := testLayerFile(ctx, rc, rMod, 6, headers[3].Name)
+				if err != nil {
+					t.Fatalf("failed to read cert: %v", err)
+				}
+				if !bytes.Equal(certFile, caCertPEM) {
+					t.Errorf("unexpected cert content: %s", certFile)
+				}
+				bundle, err := testLayerFile(ctx, rc, rMod, 5, "etc/ssl/certs/ca-certificates.crt")
+				if err != nil {
+					t.Fatalf("failed to read bundle: %v", err)
+				}
+				if string(bundle) != caBundle+"\n"+string(caCertPEM) {
+					t.Errorf("unexpected bundle content: %s", bundle)
+				}
+			},
+		},
+		{
+			name: "Inject CA Cert Path",
+			opts: []Opts{
+				WithInjectCACert(caCertPEM, "/usr/local/share/ca-certificates/corp.crt", ""),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				certFile, err := testLayerFile(ctx, rc, rMod, 5, "usr/local/share/ca-certificates/corp.crt")
+				if err != nil {
+					t.Fatalf("failed to read cert: %v", err)
+				}
+				if !bytes.Equal(certFile, caCertPEM) {
+					t.Errorf("unexpected cert content: %s", certFile)
+				}
+			},
+		},
+		{
+			name: "Inject CA Cert Invalid",
+			opts: []Opts{
+				WithInjectCACert([]byte("not a cert"), "", ""),
+			},
+			ref:     r3amd.CommonName(),
+			wantErr: errs.ErrParsingFailed,
+		},
+		{
+			name: "Layer File Replace Dot Slash Mode",
+			opts: []Opts{
+				WithFileReplaceOpt("/etc/app.conf", "../testdata/layer3.txt", OptFileReplace{Mode: &replaceMode, AddMissing: true}),
+			},
+			ref: rDotSlash.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dotSlashCheck(map[string]string{"etc/app.conf": "3\n"})(t, rMod)
+				hMod, err := testLayerHeaders(ctx, rc, rMod, 5)
+				if err != nil {
+					t.Fatalf("failed to read layer: %v", err)
+				}
+				for _, th := range hMod {
+					if th.Name == "./etc/app.conf" && th.Mode != 0o4750 {
+						t.Errorf("unexpected mode, expected %o, received %o", 0o4750, th.Mode)
+					}
+				}
+				if _, err := testLayerHeaders(ctx, rc, rMod, 6); err == nil {
+					t.Errorf("unexpected layer added")
+				}
+			},
+		},
+		{
+			name: "Layer File Replace Add Missing",
+			opts: []Opts{
+				WithFileReplaceOpt("/opt/new/app.conf", "../testdata/layer3.txt", OptFileReplace{AddMissing: true}),
+			},
+			ref: rDotSlash.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				hMod, err := testLayerHeaders(ctx, rc, rMod, 6)
+				if err != nil {
+					t.Fatalf("failed to read added layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range hMod {
+					names = append(names, th.Name)
+					if th.Name == "opt/new/app.conf" && th.Mode != 0o644 {
+						t.Errorf("unexpected mode, expected %o, received %o", 0o644, th.Mode)
+					}
+				}
+				if strings.Join(names, ",") != "opt/,opt/new/,opt/new/app.conf" {
+					t.Errorf("unexpected entries in added layer: %v", names)
+				}
+				b, err := testLayerFile(ctx, rc, rMod, 6, "opt/new/app.conf")
+				if err != nil {
+					t.Fatalf("failed to read file: %v", err)
+				}
+				if string(b) != "3\n" {
+					t.Errorf("unexpected content, received %q", string(b))
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerFilePathRewrite(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with links in and out of a directory to relocate
+	rRewrite, err := ref.New(tTgtHost + "/testrepo:rewrite")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rewriteBuf := &bytes.Buffer{}
+	rewriteTW := tar.NewWriter(rewriteBuf)
+	for _, th := range []*tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: baseTime},
+		{Name: "app/bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: baseTime},
+		{Name: "app/bin/run", Typeflag: tar.TypeReg, Mode: 0755, Size: 3, ModTime: baseTime},
+		{Name: "app/bin/link-rel", Typeflag: tar.TypeSymlink, Linkname: "run", Mode: 0777, ModTime: baseTime},
+		{Name: "app/bin/link-abs", Typeflag: tar.TypeSymlink, Linkname: "/app/bin/run", Mode: 0777, ModTime: baseTime},
+		{Name: "app/hard", Typeflag: tar.TypeLink, Linkname: "app/bin/run", Mode: 0755, ModTime: baseTime},
+		{Name: "app/out", Typeflag: tar.TypeSymlink, Linkname: "../etc/config", Mode: 0777, ModTime: baseTime},
+		{Name: "app2/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: baseTime},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: baseTime},
+		{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: baseTime},
+		{Name: "etc/link-in", Typeflag: tar.TypeSymlink, Linkname: "../app/bin/run", Mode: 0777, ModTime: baseTime},
+		{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "app/bin/run", Mode: 0755, ModTime: baseTime},
+	} {
+		err = rewriteTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if th.Size > 0 {
+			_, err = rewriteTW.Write([]byte("abc"))
+			if err != nil {
+				t.Fatalf("failed to write tar content: %v", err)
+			}
+		}
+	}
+	err = rewriteTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rRewrite), WithLayerAddTar(rewriteBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup rewrite layer: %v", err)
+	}
+	// rewriteCheck compares the name and link name of each entry in the top layer
+	rewriteCheck := func(want [][2]string) func(t *testing.T, rMod ref.Ref) {
+		return func(t *testing.T, rMod ref.Ref) {
+			headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+			if err != nil {
+				t.Fatalf("failed to read top layer: %v", err)
+			}
+			if len(headers) != len(want) {
+				t.Fatalf("unexpected number of entries, expected %d, received %d", len(want), len(headers))
+			}
+			for i, th := range headers {
+				if th.Name != want[i][0] || th.Linkname != want[i][1] {
+					t.Errorf("entry %d, expected %s -> %s, received %s -> %s", i, want[i][0], want[i][1], th.Name, th.Linkname)
+				}
+			}
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Layer File Path Rewrite",
+			opts: []Opts{
+				WithFilePathRewrite("/app", "/opt/app/"),
+			},
+			ref: rRewrite.CommonName(),
+			check: rewriteCheck([][2]string{
+				{"opt/app/", ""},
+				{"opt/app/bin/", ""},
+				{"opt/app/bin/run", ""},
+				{"opt/app/bin/link-rel", "run"},
+				{"opt/app/bin/link-abs", "/opt/app/bin/run"},
+				{"opt/app/hard", "opt/app/bin/run"},
+				{"opt/app/out", "../../etc/config"},
+				{"app2/", ""},
+				{"etc/", ""},
+				{"etc/config", ""},
+				{"etc/link-in", "../opt/app/bin/run"},
+				{"etc/hard", "opt/app/bin/run"},
+			}),
+		},
+		{
+			name: "Layer File Path Rewrite Nested",
+			opts: []Opts{
+				WithFilePathRewrite("app", "app/v2"),
+			},
+			ref: rRewrite.CommonName(),
+			check: rewriteCheck([][2]string{
+				{"app/v2/", ""},
+				{"app/v2/bin/", ""},
+				{"app/v2/bin/run", ""},
+				{"app/v2/bin/link-rel", "run"},
+				{"app/v2/bin/link-abs", "/app/v2/bin/run"},
+				{"app/v2/hard", "app/v2/bin/run"},
+				{"app/v2/out", "../../etc/config"},
+				{"app2/", ""},
+				{"etc/", ""},
+				{"etc/config", ""},
+				{"etc/link-in", "../app/v2/bin/run"},
+				{"etc/hard", "app/v2/bin/run"},
+			}),
+		},
+		{
+			name: "Layer File Path Rewrite Unchanged",
+			opts: []Opts{
+				WithFilePathRewrite("missing", "other"),
+			},
+			ref:      rRewrite.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer File Path Rewrite Root",
+			opts: []Opts{
+				WithFilePathRewrite("/", "/opt"),
+			},
+			ref:     rRewrite.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerFileStripSpecial(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	// setup an image with special files in the top layer
+	rSpecial, err := ref.New(tTgtHost + "/testrepo:special")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	specialFH, err := os.Open("../testdata/layer-special.tar")
+	if err != nil {
+		t.Fatalf("failed to open special tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rSpecial), WithLayerAddTar(specialFH, "", nil))
+	_ = specialFH.Close()
+	if err != nil {
+		t.Fatalf("failed to setup special layer: %v", err)
+	}
+	specialRemoved := []string{}
+	tests := []testModCase{
+		{
+			name: "Layer File Strip Special",
+			opts: []Opts{
+				WithFileStripSpecial([]string{"/dev/null"}, func(d descriptor.Descriptor, name string) {
+					specialRemoved = append(specialRemoved, name)
+				}),
+			},
+			ref: rSpecial.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if !eqStrSlice(specialRemoved, []string{"dev/sda", "dev/zero", "tmp/fifo"}) {
+					t.Errorf("unexpected removed entries: %v", specialRemoved)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"dev/", "dev/null", "tmp/", "special.txt"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer File Strip Special Unchanged",
+			opts: []Opts{
+				WithFileStripSpecial(nil, nil),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerDoubleCompression(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	tarBytes, err := os.ReadFile("../testdata/layer.tar")
+	if err != nil {
+		t.Fatalf("failed to read testdata/layer.tar: %v", err)
+	}
+	// setup an image with a layer that was compressed twice
+	rDoubleGzip, err := ref.New(tTgtHost + "/testrepo:double-gzip")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	doubleGzip, err := archive.Compress(bytes.NewReader(tarBytes), archive.CompressGzip)
+	if err != nil {
+		t.Fatalf("failed to compress layer: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rDoubleGzip), WithLayerAddTar(doubleGzip, mediatype.OCI1LayerGzip, nil))
+	_ = doubleGzip.Close()
+	if err != nil {
+		t.Fatalf("failed to setup double compressed layer: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Layer Double Compression Repair",
+			opts: []Opts{
+				WithLayerDoubleCompressionRepair(),
+			},
+			ref: rDoubleGzip.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				mi := m.(manifest.Imager)
+				layers, err := mi.GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				for i := range layersOrig {
+					if layers[i].Digest != layersOrig[i].Digest {
+						t.Errorf("layer %d was changed", i)
+					}
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, len(layers)-1)
+				if err != nil {
+					t.Fatalf("failed to read repaired layer: %v", err)
+				}
+				if len(headers) == 0 {
+					t.Errorf("repaired layer is empty")
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				diffIDs := conf.GetConfig().RootFS.DiffIDs
+				if diffIDs[len(diffIDs)-1] != digest.FromBytes(tarBytes) {
+					t.Errorf("unexpected diff_id, expected %s, received %s", digest.FromBytes(tarBytes), diffIDs[len(diffIDs)-1])
+				}
+			},
+		},
+		{
+			name: "Layer Double Compression Repair Unchanged",
+			opts: []Opts{
+				WithLayerDoubleCompressionRepair(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerStripPythonCache(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with python caches
+	rPyCache, err := ref.New(tTgtHost + "/testrepo:pycache")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	pyBuf := &bytes.Buffer{}
+	pyTW := tar.NewWriter(pyBuf)
+	for _, f := range []struct{ name, content string }{
+		{"app/", ""},
+		{"app/main.py", "print('hello')\n"},
+		{"app/__pycache__/", ""},
+		{"app/__pycache__/main.cpython-312.pyc", "compiled"},
+		{"app/legacy.pyc", "legacy"},
+		{"app/opt.pyo", "optimized"},
+	} {
+		th := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime}
+		if strings.HasSuffix(f.name, "/") {
+			th.Typeflag = tar.TypeDir
+			th.Mode = 0755
+		}
+		err = pyTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = pyTW.Write([]byte(f.content))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = pyTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rPyCache), WithLayerAddTar(pyBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup python cache layer: %v", err)
+	}
+	var pyCacheRemoved int64
+	pyCacheNames := []string{}
+	tests := []testModCase{
+		{
+			name: "Layer Strip Python Cache",
+			opts: []Opts{
+				WithStripPythonCache(nil, func(d descriptor.Descriptor, name string, size int64) {
+					pyCacheNames = append(pyCacheNames, name)
+					pyCacheRemoved += size
+				}),
+			},
+			ref: rPyCache.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if !eqStrSlice(pyCacheNames, []string{"app/__pycache__/", "app/__pycache__/main.cpython-312.pyc", "app/legacy.pyc", "app/opt.pyo"}) {
+					t.Errorf("unexpected removed entries: %v", pyCacheNames)
+				}
+				if pyCacheRemoved != 23 {
+					t.Errorf("unexpected bytes removed, expected 23, received %d", pyCacheRemoved)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"app/", "app/main.py"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer Strip Python Cache Patterns",
+			opts: []Opts{
+				WithStripPythonCache([]string{"*.pyo"}, nil),
+			},
+			ref: rPyCache.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"app/", "app/main.py", "app/__pycache__/", "app/__pycache__/main.cpython-312.pyc", "app/legacy.pyc"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer Strip Python Cache Bad Pattern",
+			opts: []Opts{
+				WithStripPythonCache([]string{"[pyc"}, nil),
+			},
+			ref:     rPyCache.CommonName(),
+			wantErr: path.ErrBadPattern,
+		},
+		{
+			name: "Layer Strip Python Cache Unchanged",
+			opts: []Opts{
+				WithStripPythonCache(nil, nil),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerDedupSplit(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with a large layer of incompressible files for splitting
+	rSplit, err := ref.New(tTgtHost + "/testrepo:split")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	splitRand := rand.New(rand.NewSource(1))
+	splitBuf := &bytes.Buffer{}
+	splitTW := tar.NewWriter(splitBuf)
+	for i := 0; i < 5; i++ {
+		content := make([]byte, 16*1024)
+		_, _ = splitRand.Read(content)
+		err = splitTW.WriteHeader(&tar.Header{Name: fmt.Sprintf("data/file%d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: baseTime})
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = splitTW.Write(content)
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = splitTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rSplit), WithLayerAddTarCreatedBy(splitBuf, "", "COPY data /data"))
+	if err != nil {
+		t.Fatalf("failed to setup split layer: %v", err)
+	}
+	splitFS, err := testImageFS(ctx, rc, rSplit)
+	if err != nil {
+		t.Fatalf("failed to read split filesystem: %v", err)
+	}
+	// setup a base image and an app image with files duplicated from the base
+	rDedupBase, err := ref.New(tTgtHost + "/testrepo:dedup-base")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rDedup, err := ref.New(tTgtHost + "/testrepo:dedup")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	for _, setup := range []struct {
+		rSrc, rTgt ref.Ref
+		files      []struct {
+			name, content string
+			mode          int64
+		}
+	}{
+		{
+			rSrc: r3amd,
+			rTgt: rDedupBase,
+			files: []struct {
+				name, content string
+				mode          int64
+			}{
+				{"etc/", "", 0755}, {"etc/config", "base config", 0644}, {"etc/other", "other", 0644}, {"bin/", "", 0755}, {"bin/tool", "tool", 0755},
+			},
+		},
+		{
+			rSrc: rDedupBase,
+			rTgt: rDedup,
+			files: []struct {
+				name, content string
+				mode          int64
+			}{
+				{"etc/", "", 0755}, {"etc/config", "base config", 0644}, {"etc/other", "changed", 0644}, {"bin/tool", "tool", 0644}, {"app/", "", 0755}, {"app/new", "new", 0644},
+			},
+		},
+	} {
+		dedupBuf := &bytes.Buffer{}
+		dedupTW := tar.NewWriter(dedupBuf)
+		for _, f := range setup.files {
+			th := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: f.mode, Size: int64(len(f.content)), ModTime: baseTime}
+			if strings.HasSuffix(f.name, "/") {
+				th.Typeflag = tar.TypeDir
+			}
+			err = dedupTW.WriteHeader(th)
+			if err != nil {
+				t.Fatalf("failed to write tar header: %v", err)
+			}
+			_, err = dedupTW.Write([]byte(f.content))
+			if err != nil {
+				t.Fatalf("failed to write tar content: %v", err)
+			}
+		}
+		err = dedupTW.Close()
+		if err != nil {
+			t.Fatalf("failed to close tar: %v", err)
+		}
+		_, err = Apply(ctx, rc, setup.rSrc, WithRefTgt(setup.rTgt), WithLayerAddTar(dedupBuf, "", nil))
+		if err != nil {
+			t.Fatalf("failed to setup %s: %v", setup.rTgt.CommonName(), err)
+		}
+	}
+	dedupFS, err := testImageFS(ctx, rc, rDedup)
+	if err != nil {
+		t.Fatalf("failed to read dedup filesystem: %v", err)
+	}
+	var dedupRemoved int64
+	dedupNames := []string{}
+	tests := []testModCase{
+		{
+			name: "Layer Dedup Against Base",
+			opts: []Opts{
+				WithDedupAgainstBase(rDedupBase, func(d descriptor.Descriptor, name string, size int64) {
+					dedupNames = append(dedupNames, name)
+					dedupRemoved += size
+				}),
+			},
+			ref: rDedup.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if !eqStrSlice(dedupNames, []string{"etc/config"}) || dedupRemoved != 11 {
+					t.Errorf("unexpected removed files %v, bytes %d", dedupNames, dedupRemoved)
+				}
+				fs, err := testImageFS(ctx, rc, rMod)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, dedupFS) {
+					t.Errorf("filesystem changed, expected %v, received %v", dedupFS, fs)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"etc/", "etc/other", "bin/tool", "app/", "app/new"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer Dedup Against Base Itself",
+			opts: []Opts{
+				WithDedupAgainstBase(rDedupBase, nil),
+			},
+			ref:      rDedupBase.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer Dedup Against Base Mismatch",
+			opts: []Opts{
+				WithDedupAgainstBase(rSplit, nil),
+			},
+			ref:     rDedup.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+		{
+			name: "Layer Split By Size",
+			opts: []Opts{
+				WithLayerSplitBySize(40000),
+			},
+			ref: rSplit.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				fs, err := testImageFS(ctx, rc, rMod)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, splitFS) {
+					t.Errorf("filesystem changed, expected %v, received %v", splitFS, fs)
+				}
+				mOrig, err := rc.ManifestGet(ctx, rSplit)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(layers) < len(layersOrig)+2 {
+					t.Errorf("layer was not split, %d layers before, %d after", len(layersOrig), len(layers))
+				}
+				for _, l := range layers {
+					if l.Size > 40000 {
+						t.Errorf("layer %s exceeds the limit: %d", l.Digest.String(), l.Size)
+					}
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				history := []v1.History{}
+				for _, h := range oc.History {
+					if !h.EmptyLayer {
+						history = append(history, h)
+					}
+				}
+				if len(oc.RootFS.DiffIDs) != len(layers) || len(history) != len(layers) {
+					t.Fatalf("unexpected counts, layers %d, diff_ids %d, history %d", len(layers), len(oc.RootFS.DiffIDs), len(history))
+				}
+				for i := len(layersOrig) - 1; i < len(layers); i++ {
+					if history[i].CreatedBy != "COPY data /data" {
+						t.Errorf("unexpected history for layer %d: %v", i, history[i])
+					}
+				}
+			},
+		},
+		{
+			name: "Layer Split By Size Entry Too Large",
+			opts: []Opts{
+				WithLayerSplitBySize(10000),
+			},
+			ref:     rSplit.CommonName(),
+			wantErr: errs.ErrSizeLimitExceeded,
+		},
+		{
+			name: "Layer Split By Size Invalid",
+			opts: []Opts{
+				WithLayerSplitBySize(0),
+			},
+			ref:     rSplit.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Layer Split By Size Unchanged",
+			opts: []Opts{
+				WithLayerSplitBySize(1024 * 1024),
+			},
+			ref:      rSplit.CommonName(),
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerSquash(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	pAMD, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	// setup an image with overrides and whiteouts across layers for squashing
+	rSquash, err := ref.New(tTgtHost + "/testrepo:squash")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	squashOpts := []Opts{WithRefTgt(rSquash)}
+	for _, files := range [][]struct{ name, content string }{
+		{{"sq/", ""}, {"sq/a", "A1"}, {"sq/b", "B1"}, {"sq/dir/", ""}, {"sq/dir/x", "X"}, {"sq/keep", "K"}},
+		{{"sq/a", "A2"}, {"sq/.wh.b", ""}, {"sq/dir/", ""}, {"sq/dir/.wh..wh..opq", ""}, {"sq/dir/y", "Y"}, {".wh.layer1", ""}, {".wh.layer2", ""}},
+		{{"sq/b/", ""}, {"sq/b/c", "C"}, {"sq/keep/", ""}, {"sq/keep/z", "Z"}, {"layer2/", ""}, {"layer2/new", "N"}},
+	} {
+		sqBuf := &bytes.Buffer{}
+		sqTW := tar.NewWriter(sqBuf)
+		for _, f := range files {
+			th := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime}
+			if strings.HasSuffix(f.name, "/") {
+				th.Typeflag = tar.TypeDir
+				th.Mode = 0755
+			}
+			err = sqTW.WriteHeader(th)
+			if err != nil {
+				t.Fatalf("failed to write tar header: %v", err)
+			}
+			_, err = sqTW.Write([]byte(f.content))
+			if err != nil {
+				t.Fatalf("failed to write tar content: %v", err)
+			}
+		}
+		err = sqTW.Close()
+		if err != nil {
+			t.Fatalf("failed to close tar: %v", err)
+		}
+		squashOpts = append(squashOpts, WithLayerAddTar(sqBuf, "", nil))
+	}
+	_, err = Apply(ctx, rc, r3amd, squashOpts...)
+	if err != nil {
+		t.Fatalf("failed to setup squash layers: %v", err)
+	}
+	squashFS, err := testImageFS(ctx, rc, rSquash)
+	if err != nil {
+		t.Fatalf("failed to read squash filesystem: %v", err)
+	}
+	if squashFS["sq/a"] != "A2" || squashFS["sq/b/c"] != "C" || squashFS["sq/dir/x"] != "" || squashFS["layer2/new"] != "N" {
+		t.Fatalf("unexpected squash filesystem: %v", squashFS)
+	}
+	if _, ok := squashFS["layer1"]; ok {
+		t.Fatalf("unexpected squash filesystem: %v", squashFS)
+	}
+	mSquash, err := rc.ManifestGet(ctx, rSquash)
+	if err != nil {
+		t.Fatalf("failed to get squash manifest: %v", err)
+	}
+	squashLayers, err := mSquash.(manifest.Imager).GetLayers()
+	if err != nil {
+		t.Fatalf("failed to get squash layers: %v", err)
+	}
+	squashBase := len(squashLayers) - 3
+	tests := []testModCase{
+		{
+			name: "Layer Squash All",
+			opts: []Opts{
+				WithLayerSquash(0, -1),
+			},
+			ref: rSquash.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				fs, err := testImageFS(ctx, rc, rMod)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, squashFS) {
+					t.Errorf("filesystem changed, expected %v, received %v", squashFS, fs)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, 0)
+				if err != nil {
+					t.Fatalf("failed to read layer: %v", err)
+				}
+				for _, th := range headers {
+					if strings.HasPrefix(path.Base(th.Name), ".wh.") {
+						t.Errorf("whiteout included when squashing all layers: %s", th.Name)
+					}
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				histLayers := 0
+				for _, h := range oc.History {
+					if !h.EmptyLayer {
+						histLayers++
+					}
+				}
+				if len(layers) != 1 || len(oc.RootFS.DiffIDs) != 1 || histLayers != 1 {
+					t.Errorf("unexpected counts, layers %d, diff_ids %d, history %d", len(layers), len(oc.RootFS.DiffIDs), histLayers)
+				}
+			},
+		},
+		{
+			name: "Layer Squash Range",
+			opts: []Opts{
+				WithLayerSquash(squashBase, -1),
+			},
+			ref: rSquash.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				fs, err := testImageFS(ctx, rc, rMod)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, squashFS) {
+					t.Errorf("filesystem changed, expected %v, received %v", squashFS, fs)
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				if len(layers) != squashBase+1 || len(conf.GetConfig().RootFS.DiffIDs) != squashBase+1 {
+					t.Errorf("unexpected counts, layers %d, diff_ids %d", len(layers), len(conf.GetConfig().RootFS.DiffIDs))
+				}
+			},
+		},
+		{
+			name: "Layer Squash Index",
+			opts: []Opts{
+				WithLayerSquash(0, -1),
+			},
+			ref: tTgtHost + "/testrepo:v3",
+			check: func(t *testing.T, rMod ref.Ref) {
+				fsOrig, err := testImageFS(ctx, rc, r3amd)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				d, err := manifest.GetPlatformDesc(m, &pAMD)
+				if err != nil {
+					t.Fatalf("failed to get platform: %v", err)
+				}
+				fs, err := testImageFS(ctx, rc, rMod.SetDigest(d.Digest.String()))
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, fsOrig) {
+					t.Errorf("filesystem changed, expected %v, received %v", fsOrig, fs)
+				}
+			},
+		},
+		{
+			name: "Layer Squash Validate",
+			opts: []Opts{
+				WithLayerSquash(0, -1),
+				WithSquashValidate(),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layersOrig, err := mOrig.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(layersOrig) != 5 {
+					t.Fatalf("source image should have 5 layers, found %d", len(layersOrig))
+				}
+				fsOrig, err := testImageFS(ctx, rc, r3amd)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				fs, err := testImageFS(ctx, rc, rMod)
+				if err != nil {
+					t.Fatalf("failed to read filesystem: %v", err)
+				}
+				if !reflect.DeepEqual(fs, fsOrig) {
+					t.Errorf("filesystem changed, expected %v, received %v", fsOrig, fs)
+				}
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				layers, err := m.(manifest.Imager).GetLayers()
+				if err != nil {
+					t.Fatalf("failed to get layers: %v", err)
+				}
+				if len(layers) != 1 {
+					t.Fatalf("unexpected layer count, expected 1, received %d", len(layers))
+				}
+				conf, err := rc.ImageConfig(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get config: %v", err)
+				}
+				oc := conf.GetConfig()
+				ucDigest, err := layerGetUCDigest(ctx, rc, rMod, layers[0])
+				if err != nil {
+					t.Fatalf("failed to get uncompressed digest: %v", err)
+				}
+				if len(oc.RootFS.DiffIDs) != 1 || oc.RootFS.DiffIDs[0] != ucDigest {
+					t.Errorf("unexpected diff_ids, expected %s, received %v", ucDigest.String(), oc.RootFS.DiffIDs)
+				}
+			},
+		},
+		{
+			name: "Layer Squash Validate Range",
+			opts: []Opts{
+				WithLayerSquash(squashBase, -1),
+				WithSquashValidate(),
+			},
+			ref:     rSquash.CommonName(),
+			wantErr: errs.ErrMismatch,
+		},
+		{
+			name: "Layer Squash Single",
+			opts: []Opts{
+				WithLayerSquash(1, 1),
+			},
+			ref:      rSquash.CommonName(),
+			wantSame: true,
+		},
+		{
+			name: "Layer Squash Invalid Range",
+			opts: []Opts{
+				WithLayerSquash(2, 1),
+			},
+			ref:     rSquash.CommonName(),
+			wantErr: errs.ErrUnsupported,
+		},
+		{
+			name: "Layer Squash Missing",
+			opts: []Opts{
+				WithLayerSquash(0, 100),
+			},
+			ref:     rSquash.CommonName(),
+			wantErr: errs.ErrNotFound,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerStripDocs(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with documentation
+	rDocs, err := ref.New(tTgtHost + "/testrepo:docs")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	docsBuf := &bytes.Buffer{}
+	docsTW := tar.NewWriter(docsBuf)
+	for _, f := range []struct{ name, content string }{
+		{"usr/", ""},
+		{"usr/bin/", ""},
+		{"usr/bin/app", "binary"},
+		{"usr/share/", ""},
+		{"usr/share/man/", ""},
+		{"usr/share/man/man1/app.1", "manual"},
+		{"usr/share/doc/app/README", "readme"},
+		{"usr/share/info/app.info", "info"},
+		{"usr/share/locale/", ""},
+		{"usr/share/locale/en_US/LC_MESSAGES/app.mo", "english"},
+		{"usr/share/locale/fr/LC_MESSAGES/app.mo", "french"},
+	} {
+		th := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: baseTime}
+		if strings.HasSuffix(f.name, "/") {
+			th.Typeflag = tar.TypeDir
+			th.Mode = 0755
+		}
+		err = docsTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = docsTW.Write([]byte(f.content))
+		if err != nil {
+			t.Fatalf("failed to write tar content: %v", err)
+		}
+	}
+	err = docsTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rDocs), WithLayerAddTar(docsBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup docs layer: %v", err)
+	}
+	var docsRemoved int64
+	docsNames := []string{}
+	tests := []testModCase{
+		{
+			name: "Layer Strip Docs",
+			opts: []Opts{
+				WithStripDocs(nil, nil, func(d descriptor.Descriptor, name string, size int64) {
+					docsNames = append(docsNames, name)
+					docsRemoved += size
+				}),
+			},
+			ref: rDocs.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				if !eqStrSlice(docsNames, []string{"usr/share/man/", "usr/share/man/man1/app.1", "usr/share/doc/app/README", "usr/share/info/app.info"}) {
+					t.Errorf("unexpected removed entries: %v", docsNames)
+				}
+				if docsRemoved != 16 {
+					t.Errorf("unexpected bytes removed, expected 16, received %d", docsRemoved)
+				}
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"usr/", "usr/bin/", "usr/bin/app", "usr/share/", "usr/share/locale/", "usr/share/locale/en_US/LC_MESSAGES/app.mo", "usr/share/locale/fr/LC_MESSAGES/app.mo"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer Strip Docs Locale",
+			opts: []Opts{
+				WithStripDocs(append([]string{StripDocsLocalePath}, StripDocsPaths...), []string{"en*"}, nil),
+			},
+			ref: rDocs.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				headers, err := testLayerHeaders(ctx, rc, rMod, -1)
+				if err != nil {
+					t.Fatalf("failed to read top layer: %v", err)
+				}
+				names := []string{}
+				for _, th := range headers {
+					names = append(names, th.Name)
+				}
+				if !eqStrSlice(names, []string{"usr/", "usr/bin/", "usr/bin/app", "usr/share/", "usr/share/locale/", "usr/share/locale/en_US/LC_MESSAGES/app.mo"}) {
+					t.Errorf("unexpected entries: %v", names)
+				}
+			},
+		},
+		{
+			name: "Layer Strip Docs Bad Pattern",
+			opts: []Opts{
+				WithStripDocs(nil, []string{"[en"}, nil),
+			},
+			ref:     rDocs.CommonName(),
+			wantErr: path.ErrBadPattern,
+		},
+		{
+			name: "Layer Strip Docs Unchanged",
+			opts: []Opts{
+				WithStripDocs(nil, nil, nil),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestLayerFileReplaceOrder(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, baseTime, r3amd := env.ctx, env.rc, env.tTgtHost, env.baseTime, env.r3amd
+	// setup an image with unsorted entries in the top layer
+	rOrder, err := ref.New(tTgtHost + "/testrepo:order")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	orderNames := []string{"zeta", "alpha", "mid/", "mid/b", "mid/a", "beta"}
+	orderBuf := &bytes.Buffer{}
+	orderTW := tar.NewWriter(orderBuf)
+	for _, name := range orderNames {
+		th := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name)), ModTime: baseTime}
+		if strings.HasSuffix(name, "/") {
+			th.Typeflag = tar.TypeDir
+			th.Mode = 0755
+			th.Size = 0
+		}
+		err = orderTW.WriteHeader(th)
+		if err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if th.Size > 0 {
+			_, err = orderTW.Write([]byte(name))
+			if err != nil {
+				t.Fatalf("failed to write tar content: %v", err)
+			}
+		}
+	}
+	err = orderTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, r3amd, WithRefTgt(rOrder), WithLayerAddTar(orderBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup unsorted layer: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Layer File Replace Order",
+			opts: []Opts{
+				WithFileReplace("/mid/b", "../testdata/layer3.txt"),
+			},
+			ref: rOrder.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				for i := 0; i < 6; i++ {
+					hOrig, err := testLayerHeaders(ctx, rc, rOrder, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					hMod, err := testLayerHeaders(ctx, rc, rMod, i)
+					if err != nil {
+						t.Fatalf("failed to read layer %d: %v", i, err)
+					}
+					if len(hOrig) != len(hMod) {
+						t.Fatalf("layer %d entry count mismatch, expected %d, received %d", i, len(hOrig), len(hMod))
+					}
+					for j := range hOrig {
+						if hOrig[j].Name != hMod[j].Name {
+							t.Errorf("layer %d entry %d mismatch, expected %s, received %s", i, j, hOrig[j].Name, hMod[j].Name)
+						}
+					}
+				}
+			},
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestManifestSignatureStrip(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, tTgtHost, r3amd := env.ctx, env.rc, env.tTgtHost, env.r3amd
+	// setup a manifest with an embedded signature
+	rSigned, err := ref.New(tTgtHost + "/testrepo:signed")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	mSigned, err := rc.ManifestGet(ctx, r3amd)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	rawSigned, err := mSigned.RawBody()
+	if err != nil {
+		t.Fatalf("failed to get manifest body: %v", err)
+	}
+	rawSigned = append(bytes.TrimSuffix(bytes.TrimSpace(rawSigned), []byte("}")), []byte(`,"signatures":[{"header":{"alg":"ES256"},"signature":"c2ln","protected":"cHJvdGVjdGVk"}]}`)...)
+	mSigned, err = manifest.New(manifest.WithRaw(rawSigned), manifest.WithDesc(descriptor.Descriptor{MediaType: mSigned.GetDescriptor().MediaType}))
+	if err != nil {
+		t.Fatalf("failed to create signed manifest: %v", err)
+	}
+	err = rc.ManifestPut(ctx, rSigned, mSigned)
+	if err != nil {
+		t.Fatalf("failed to put signed manifest: %v", err)
+	}
+	tests := []testModCase{
+		{
+			name: "Manifest Signature Strip",
+			opts: []Opts{
+				WithManifestSignatureStrip(),
+			},
+			ref: rSigned.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				m, err := rc.ManifestGet(ctx, rMod)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				raw, err := m.RawBody()
+				if err != nil {
+					t.Fatalf("failed to get manifest body: %v", err)
+				}
+				if bytes.Contains(raw, []byte("signatures")) {
+					t.Errorf("signatures not removed: %s", string(raw))
+				}
+				if m.GetDescriptor().MediaType != mediatype.OCI1Manifest {
+					t.Errorf("unexpected media type: %s", m.GetDescriptor().MediaType)
+				}
+				mOrig, err := rc.ManifestGet(ctx, r3amd)
+				if err != nil {
+					t.Fatalf("failed to get manifest: %v", err)
+				}
+				if m.GetDescriptor().Digest != mOrig.GetDescriptor().Digest {
+					t.Errorf("unexpected digest, expected %s, received %s", mOrig.GetDescriptor().Digest, m.GetDescriptor().Digest)
+				}
+			},
+		},
+		{
+			name: "Manifest Signature Strip Unchanged",
+			opts: []Opts{
+				WithManifestSignatureStrip(),
+			},
+			ref:      tTgtHost + "/testrepo:v3",
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestDataField(t *testing.T) {
+	t.Parallel()
+	env := testModSetup(t)
+	ctx, rc, r3amd := env.ctx, env.rc, env.r3amd
+	dataCheck := func(t *testing.T, rMod ref.Ref, wantConfig, wantLayers bool) {
+		t.Helper()
+		m, err := rc.ManifestGet(ctx, rMod)
+		if err != nil {
+			t.Fatalf("failed to get manifest: %v", err)
+		}
+		mi, ok := m.(manifest.Imager)
+		if !ok {
+			t.Fatalf("manifest is not an image")
+		}
+		cd, err := mi.GetConfig()
+		if err != nil {
+			t.Fatalf("failed to get config descriptor: %v", err)
+		}
+		if (len(cd.Data) > 0) != wantConfig {
+			t.Errorf("unexpected config data field, expected %t, size %d", wantConfig, len(cd.Data))
+		}
+		layers, err := mi.GetLayers()
+		if err != nil {
+			t.Fatalf("failed to get layers: %v", err)
+		}
+		for i, l := range layers {
+			if (len(l.Data) > 0) != wantLayers {
+				t.Errorf("unexpected layer %d data field, expected %t, size %d", i, wantLayers, len(l.Data))
+			}
+		}
+	}
+	tests := []testModCase{
+		{
+			name: "Data field config only",
+			opts: []Opts{
+				WithData(1024 * 1024),
+				WithDataLayer(0),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dataCheck(t, rMod, true, false)
+			},
+		},
+		{
+			name: "Data field config without global",
+			opts: []Opts{
+				WithDataConfig(1024 * 1024),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dataCheck(t, rMod, true, false)
+			},
+		},
+		{
+			name: "Data field layers only",
+			opts: []Opts{
+				WithData(1024 * 1024),
+				WithDataConfig(0),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dataCheck(t, rMod, false, true)
+			},
+		},
+		{
+			name: "Data field layers without global",
+			opts: []Opts{
+				WithDataLayer(1024 * 1024),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dataCheck(t, rMod, false, true)
+			},
+		},
+		{
+			name: "Data field layers override global",
+			opts: []Opts{
+				WithData(0),
+				WithDataLayer(1024 * 1024),
+			},
+			ref: r3amd.CommonName(),
+			check: func(t *testing.T, rMod ref.Ref) {
+				dataCheck(t, rMod, false, true)
+			},
+		},
+		{
+			name: "Data field none",
+			opts: []Opts{
+				WithData(1024 * 1024),
+				WithDataConfig(0),
+				WithDataLayer(0),
+			},
+			ref:      r3amd.CommonName(),
+			wantSame: true,
+		},
+	}
+	testModRun(t, env, tests)
+}
+
+func TestConfigCreatedFromEnv(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	envVar := "REGCLIENT_TEST_COMMIT_TIME"
+	t.Run("seconds", func(t *testing.T) {
+		t.Setenv(envVar, "1577836800")
+		rMod, err := Apply(ctx, rc, r, WithConfigCreatedFromEnv(envVar))
+		if err != nil {
+			t.Fatalf("failed to apply: %v", err)
+		}
+		m, err := rc.ManifestGet(ctx, rMod)
+		if err != nil {
+			t.Fatalf("failed to get manifest: %v", err)
+		}
+		dl, err := m.(manifest.Indexer).GetManifestList()
+		if err != nil {
+			t.Fatalf("failed to get manifest list: %v", err)
+		}
+		for _, d := range dl {
+			conf, err := rc.ImageConfig(ctx, rMod.SetDigest(d.Digest.String()))
+			if err != nil {
+				t.Fatalf("failed to get config: %v", err)
+			}
+			created := conf.GetConfig().Created
+			if created == nil || created.Unix() != 1577836800 {
+				t.Errorf("unexpected created time: %v", created)
+			}
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv(envVar, "not a time")
+		_, err := Apply(ctx, rc, r, WithConfigCreatedFromEnv(envVar))
+		if !errors.Is(err, errs.ErrParsingFailed) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("unset", func(t *testing.T) {
+		t.Setenv(envVar, "")
+		_, err := Apply(ctx, rc, r, WithConfigCreatedFromEnv(envVar))
+		if !errors.Is(err, errs.ErrNotFound) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDiscardPush(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	blobsBefore, err := os.ReadDir(filepath.Join(tempDir, "testrepo", "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("failed to read blobs: %v", err)
+	}
+	rc := regclient.New()
+	rSrc, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rTgt := rSrc.SetTag("discard")
+	var report DiscardPushReport
+	rMod, err := Apply(ctx, rc, rSrc,
+		WithRefTgt(rTgt),
+		WithFileReplace("/layer2", "../testdata/layer3.txt"),
+		WithLayerCompression(archive.CompressZstd),
+		WithDiscardPush(func(r DiscardPushReport) {
+			report = r
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if report.Blobs == 0 || report.Manifests == 0 || report.Bytes == 0 || report.Duration <= 0 {
+		t.Errorf("unexpected report: %v", report)
+	}
+	_, err = rc.ManifestHead(ctx, rMod)
+	if err == nil {
+		t.Errorf("target manifest was pushed")
+	}
+	blobsAfter, err := os.ReadDir(filepath.Join(tempDir, "testrepo", "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("failed to read blobs: %v", err)
+	}
+	if len(blobsBefore) != len(blobsAfter) {
+		t.Errorf("blobs were pushed, before %d, after %d", len(blobsBefore), len(blobsAfter))
+	}
+}
+
+func TestFileReplaceMissing(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	blobsBefore, err := os.ReadDir(filepath.Join(tempDir, "testrepo", "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("failed to read blobs: %v", err)
+	}
+	rc := regclient.New()
+	rSrc, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	// the missing file must be detected before the replaced layer is pushed
+	_, err = Apply(ctx, rc, rSrc,
+		WithRefTgt(rSrc.SetTag("replace")),
+		WithFileReplace("/layer2", "../testdata/layer3.txt"),
+		WithFileReplace("/missing", "../testdata/layer3.txt"),
+	)
+	if !errors.Is(err, errs.ErrFileNotFound) {
+		t.Fatalf("unexpected error, expected %v, received %v", errs.ErrFileNotFound, err)
+	}
+	blobsAfter, err := os.ReadDir(filepath.Join(tempDir, "testrepo", "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("failed to read blobs: %v", err)
+	}
+	if len(blobsBefore) != len(blobsAfter) {
+		t.Errorf("blobs were pushed, before %d, after %d", len(blobsBefore), len(blobsAfter))
+	}
+}
+
+func TestFileInventoryNoPush(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	layer3, err := os.ReadFile("../testdata/layer3.txt")
+	if err != nil {
+		t.Fatalf("failed to read layer3.txt: %v", err)
+	}
+	tt := []struct {
+		name string
+		opt  Opts
+	}{
+		{
+			name: "Discard Push",
+			opt:  WithDiscardPush(nil),
+		},
+		{
+			name: "Dry Run",
+			opt:  WithDryRun(func(DryRunReport) {}),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+			if err != nil {
+				t.Fatalf("failed to setup tempDir: %v", err)
+			}
+			rc := regclient.New()
+			rSrc, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+			if err != nil {
+				t.Fatalf("failed to parse ref: %v", err)
+			}
+			inventoryBuf := &bytes.Buffer{}
+			var hist FileSizeHistogram
+			// replaced layers are not pushed, so the inventory must be collected from the layer walk
+			_, err = Apply(ctx, rc, rSrc,
+				WithRefTgt(rSrc.SetTag("inventory")),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+				WithFileInventory(inventoryBuf),
+				WithFileSizeHistogram([]int64{1024}, func(h FileSizeHistogram) {
+					hist = h
+				}),
+				tc.opt,
+			)
+			if err != nil {
+				t.Fatalf("failed to apply: %v", err)
+			}
+			found := false
+			files := 0
+			dec := json.NewDecoder(inventoryBuf)
+			for {
+				var entry FileInventoryEntry
+				err := dec.Decode(&entry)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("failed to decode inventory: %v", err)
+				}
+				files++
+				if entry.Path == "layer2" {
+					found = true
+					if entry.Digest != digest.FromBytes(layer3) || entry.Size != int64(len(layer3)) {
+						t.Errorf("unexpected entry: %v", entry)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("replaced file not found in inventory")
+			}
+			if hist.Files == 0 || hist.Files != files {
+				t.Errorf("unexpected histogram, expected %d files, received %v", files, hist)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	p, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	d, err := manifest.GetPlatformDesc(m, &p)
+	if err != nil {
+		t.Fatalf("failed to get platform: %v", err)
+	}
+	rAMD := r.SetDigest(d.Digest.String())
+	var report DryRunReport
+	rMod, err := Apply(ctx, rc, rAMD,
+		WithLabel("dry-run", "true"),
+		WithLayerRmIndex(1),
+		WithDryRun(func(r DryRunReport) {
+			report = r
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if report.Ref.Digest == "" || report.Ref.Digest != rMod.Digest || len(report.Manifests) != 1 {
+		t.Fatalf("unexpected report: %v", report)
+	}
+	dm := report.Manifests[0]
+	if dm.Change != "replaced" || dm.Desc.Digest != d.Digest || dm.NewDesc.Digest.String() != rMod.Digest || !dm.ConfigChanged {
+		t.Errorf("unexpected manifest entry: %v", dm)
+	}
+	if len(dm.Layers) < 2 || dm.Layers[0].Change != "unchanged" || dm.Layers[1].Change != "deleted" || dm.Layers[1].NewDesc.Digest != "" {
+		t.Errorf("unexpected layers: %v", dm.Layers)
+	}
+	_, err = rc.ManifestHead(ctx, rMod)
+	if err == nil {
+		t.Errorf("dry run pushed the manifest")
+	}
+	_, err = rc.BlobHead(ctx, rMod, descriptor.Descriptor{Digest: dm.ConfigDesc.Digest})
+	if err == nil {
+		t.Errorf("dry run pushed the config")
+	}
+	rReal, err := Apply(ctx, rc, rAMD, WithLabel("dry-run", "true"), WithLayerRmIndex(1))
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if rReal.Digest != report.Ref.Digest {
+		t.Errorf("dry run digest %s does not match apply %s", report.Ref.Digest, rReal.Digest)
+	}
+}
+
+func TestApplyDryRun(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	opts := []Opts{
+		WithRefTgt(r.SetTag("dry-run")),
+		WithLabel("dry-run", "true"),
+		WithFileReplace("/layer2", "../testdata/layer3.txt"),
+		WithLayerCompression(archive.CompressZstd),
+	}
+	rDry, report, err := ApplyDryRun(ctx, rc, r, opts...)
+	if err != nil {
+		t.Fatalf("failed to apply dry run: %v", err)
+	}
+	if report.Ref.Digest == "" || len(report.Manifests) < 2 {
+		t.Fatalf("unexpected report, digest %s, manifest count %d", report.Ref.Digest, len(report.Manifests))
+	}
+	_, err = rc.ManifestHead(ctx, rDry)
+	if err == nil {
+		t.Errorf("dry run pushed the manifest")
+	}
+	// compare every digest in the report to the result of a real apply
+	rReal, err := Apply(ctx, rc, r, opts...)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	mReal, err := rc.ManifestHead(ctx, rReal)
+	if err != nil {
+		t.Fatalf("failed to head manifest: %v", err)
+	}
+	if mReal.GetDescriptor().Digest.String() != report.Ref.Digest {
+		t.Errorf("dry run digest %s does not match apply %s", report.Ref.Digest, mReal.GetDescriptor().Digest.String())
+	}
+	for _, dm := range report.Manifests {
+		if dm.Change == "deleted" {
+			continue
+		}
+		m, err := rc.ManifestGet(ctx, rReal.SetDigest(dm.NewDesc.Digest.String()))
+		if err != nil {
+			t.Errorf("manifest %s from the dry run was not pushed: %v", dm.NewDesc.Digest.String(), err)
+			continue
+		}
+		mi, ok := m.(manifest.Imager)
+		if !ok {
+			continue
+		}
+		cd, err := mi.GetConfig()
+		if err != nil {
+			t.Fatalf("failed to get config: %v", err)
+		}
+		if cd.Digest != dm.ConfigDesc.Digest {
+			t.Errorf("config digest mismatch, dry run %s, apply %s", dm.ConfigDesc.Digest.String(), cd.Digest.String())
+		}
+		layers, err := mi.GetLayers()
+		if err != nil {
+			t.Fatalf("failed to get layers: %v", err)
+		}
+		dryLayers := []DryRunLayer{}
+		for _, dl := range dm.Layers {
+			if dl.Change != "deleted" {
+				dryLayers = append(dryLayers, dl)
+			}
+		}
+		if len(layers) != len(dryLayers) {
+			t.Fatalf("layer count mismatch, dry run %d, apply %d", len(dryLayers), len(layers))
+		}
+		for i := range layers {
+			if layers[i].Digest != dryLayers[i].NewDesc.Digest || layers[i].MediaType != dryLayers[i].NewDesc.MediaType {
+				t.Errorf("layer %d mismatch, dry run %v, apply %v", i, dryLayers[i].NewDesc, layers[i])
+			}
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	rSrc, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	for _, concurrency := range []int{1, 3} {
+		t.Run(fmt.Sprintf("concurrency-%d", concurrency), func(t *testing.T) {
+			// callbacks are serialized, so the maps are not locked
+			// layers shared between platforms are processed more than once, so bytes are not checked for an increase
+			complete := map[string]bool{}
+			phases := map[ProgressPhase]int{}
+			_, err := Apply(ctx, rc, rSrc,
+				WithRefTgt(rSrc.SetTag(fmt.Sprintf("progress-%d", concurrency))),
+				WithFileReplace("/layer2", "../testdata/layer3.txt"),
+				WithConcurrency(concurrency),
+				WithProgress(func(ev ProgressEvent) {
+					key := ev.Digest.String() + ev.Phase.String()
+					if ev.Bytes <= 0 || (ev.Total > 0 && ev.Bytes > ev.Total) {
+						t.Errorf("unexpected bytes for %s, %d of %d", key, ev.Bytes, ev.Total)
+					}
+					if ev.Total > 0 {
+						complete[key] = complete[key] || ev.Bytes == ev.Total
+					}
+					phases[ev.Phase]++
+				}),
+			)
+			if err != nil {
+				t.Fatalf("failed to apply: %v", err)
+			}
+			for _, phase := range []ProgressPhase{ProgressPull, ProgressRewrite, ProgressPush} {
+				if phases[phase] == 0 {
+					t.Errorf("no events for phase %s", phase)
+				}
+			}
+			for key, done := range complete {
+				if !done {
+					t.Errorf("incomplete progress for %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	sb := &spillBuffer{dir: tempDir, limit: 8}
+	_, err := sb.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if sb.fh != nil {
+		t.Errorf("temp file created below the limit")
+	}
+	_, err = sb.Write([]byte(" world"))
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("failed to read temp dir: %v", err)
+	}
+	if sb.fh == nil || len(entries) != 1 {
+		t.Errorf("temp file not created above the limit")
+	}
+	rdr, err := sb.Reader()
+	if err != nil {
+		t.Fatalf("failed to get reader: %v", err)
+	}
+	b, err := io.ReadAll(rdr)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(b) != "hello world" || sb.Size() != 11 {
+		t.Errorf("unexpected content %q, size %d", b, sb.Size())
+	}
+	err = sb.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	entries, err = os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("failed to read temp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp file not removed")
+	}
+	if err = sb.Close(); err == nil {
+		t.Errorf("second close did not fail")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	regTgt := olareg.New(oConfig.Config{
+		Storage: oConfig.ConfigStorage{
+			StoreType: oConfig.StoreMem,
+		},
+	})
+	// each push starts an upload session with a post, and the uploads in the first failPush sessions fail with failStatus
+	var mu sync.Mutex
+	failStatus, failPush, pushCount := 0, 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			mu.Lock()
+			if req.Method == http.MethodPost {
+				pushCount++
+			}
+			fail := failPush >= pushCount && (req.Method == http.MethodPut || req.Method == http.MethodPatch)
+			mu.Unlock()
+			if fail {
+				_, _ = io.Copy(io.Discard, req.Body)
+				w.WriteHeader(failStatus)
+				return
+			}
+		}
+		regTgt.ServeHTTP(w, req)
+	}))
+	t.Cleanup(func() {
+		ts.Close()
+		_ = regTgt.Close()
+	})
+	tsURL, _ := url.Parse(ts.URL)
+	tsHost := tsURL.Host
+	rc := regclient.New(
+		regclient.WithConfigHost(config.Host{
+			Name:     tsHost,
+			Hostname: tsHost,
+			TLS:      config.TLSDisabled,
+		}),
+		regclient.WithRegOpts(reg.WithDelay(time.Millisecond, time.Millisecond*5)),
+	)
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rSrc, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	rBase, err := ref.New(tsHost + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	// copy the source first so only the modified layers are uploaded by Apply
+	err = rc.ImageCopy(ctx, rSrc, rBase)
+	if err != nil {
+		t.Fatalf("failed to copy image: %v", err)
+	}
+	tt := []struct {
+		name       string
+		status     int
+		fail       int
+		opts       []Opts
+		expectErr  error
+		expectPush int
+	}{
+		{
+			name:   "server error retried",
+			status: http.StatusServiceUnavailable,
+			fail:   2,
+			opts:   []Opts{WithRetry(3, time.Millisecond)},
+		},
+		{
+			name:       "server error without retry",
+			status:     http.StatusServiceUnavailable,
+			fail:       1,
+			expectErr:  errs.ErrHTTPStatus,
+			expectPush: 1,
+		},
+		{
+			name:       "attempts exceeded",
+			status:     http.StatusServiceUnavailable,
+			fail:       100,
+			opts:       []Opts{WithRetry(2, time.Millisecond)},
+			expectErr:  errs.ErrHTTPStatus,
+			expectPush: 3,
+		},
+		{
+			name:       "client error not retried",
+			status:     http.StatusBadRequest,
+			fail:       100,
+			opts:       []Opts{WithRetry(3, time.Millisecond)},
+			expectErr:  errs.ErrHTTPStatus,
+			expectPush: 1,
+		},
+		{
+			name:      "invalid attempts",
+			opts:      []Opts{WithRetry(0, time.Millisecond)},
+			expectErr: errs.ErrUnsupported,
+		},
+		{
+			name:      "invalid delay",
+			opts:      []Opts{WithRetry(1, -time.Millisecond)},
+			expectErr: errs.ErrUnsupported,
+		},
+	}
+	for i, tc := range tt {
+		// subtests share the server counters and run sequentially
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			failStatus, failPush, pushCount = tc.status, tc.fail, 0
+			mu.Unlock()
+			// a unique file for each test ensures the modified layers are pushed
+			tempFile := filepath.Join(t.TempDir(), "layer.txt")
+			err := os.WriteFile(tempFile, []byte(fmt.Sprintf("retry test %d\n", i)), 0644)
+			if err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+			opts := append([]Opts{
+				WithRefTgt(rBase.SetTag(fmt.Sprintf("retry-%d", i))),
+				WithFileReplace("/layer2", tempFile),
+			}, tc.opts...)
+			rMod, err := Apply(ctx, rc, rBase, opts...)
+			mu.Lock()
+			pushes := pushCount
+			mu.Unlock()
+			if tc.expectErr != nil {
+				if err == nil {
+					t.Fatalf("apply did not fail")
+				}
+				if !errors.Is(err, tc.expectErr) {
+					t.Errorf("unexpected error, expected %v, received %v", tc.expectErr, err)
+				}
+				if tc.expectPush > 0 && pushes != tc.expectPush {
+					t.Errorf("unexpected number of pushes, expected %d, received %d", tc.expectPush, pushes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to apply: %v", err)
+			}
+			if pushes <= tc.fail {
+				t.Errorf("push was not retried, %d pushes", pushes)
+			}
+			_, err = rc.ManifestHead(ctx, rMod)
+			if err != nil {
+				t.Errorf("failed to head modified manifest: %v", err)
+			}
+		})
+	}
+}
+
+func TestBlobChunkWrap(t *testing.T) {
+	t.Parallel()
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	dc := dagConfig{blobChunkSize: 4096}
+	rdr := dc.blobChunkWrap(bytes.NewReader(content))
+	rs, ok := rdr.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("buffered reader does not support seeking")
+	}
+	buf := make([]byte, 10)
+	_, err := io.ReadFull(rs, buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	// the current offset excludes the data in the buffer
+	offset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	if offset != 10 {
+		t.Errorf("unexpected offset, expected 10, received %d", offset)
+	}
+	_, err = rs.Seek(5, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	b, err := io.ReadAll(rs)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(b, content[5:]) {
+		t.Errorf("unexpected content after seek")
+	}
+	// readers without seek are still buffered
+	if _, ok := dc.blobChunkWrap(io.MultiReader(bytes.NewReader(content))).(io.Seeker); ok {
+		t.Errorf("unexpected seeker")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v1")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	// build the expected digests for the amd64 image from the index and the config diff_ids
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	plat := platform.Platform{OS: "linux", Architecture: "amd64"}
+	d, err := manifest.GetPlatformDesc(m, &plat)
+	if err != nil {
+		t.Fatalf("failed to get platform: %v", err)
+	}
+	mAmd, err := rc.ManifestGet(ctx, r.SetDigest(d.Digest.String()))
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	cd, err := mAmd.(manifest.Imager).GetConfig()
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	oc, err := rc.BlobGetOCIConfig(ctx, r, cd)
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	prefix := plat.String() + "/"
+	expected := map[string]digest.Digest{
+		"manifest":          m.GetDescriptor().Digest,
+		prefix + "manifest": d.Digest,
+		prefix + "config":   cd.Digest,
+	}
+	for i, diffID := range oc.GetConfig().RootFS.DiffIDs {
+		expected[fmt.Sprintf("%slayer/%d", prefix, i)] = diffID
+	}
+	t.Run("match", func(t *testing.T) {
+		err := Verify(ctx, rc, r, expected)
+		if err != nil {
+			t.Errorf("failed to verify: %v", err)
+		}
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		bad := map[string]digest.Digest{}
+		for k, v := range expected {
+			bad[k] = v
+		}
+		bad[prefix+"layer/0"] = digest.FromString("bad layer")
+		bad[prefix+"config"] = digest.FromString("bad config")
+		bad[prefix+"layer/99"] = digest.FromString("missing layer")
+		err := Verify(ctx, rc, r, bad)
+		if err == nil {
+			t.Fatalf("verify did not fail")
+		}
+		if !errors.Is(err, errs.ErrMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		for _, k := range []string{prefix + "layer/0", prefix + "config", prefix + "layer/99"} {
+			if !strings.Contains(err.Error(), k) {
+				t.Errorf("error does not include %s: %v", k, err)
+			}
+		}
+		if strings.Contains(err.Error(), prefix+"manifest") {
+			t.Errorf("error includes a matching key: %v", err)
+		}
+	})
+	t.Run("missing image", func(t *testing.T) {
+		err := Verify(ctx, rc, r.SetTag("missing"), expected)
+		if err == nil || errors.Is(err, errs.ErrMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestGetFile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	p, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	d, err := manifest.GetPlatformDesc(m, &p)
+	if err != nil {
+		t.Fatalf("failed to get platform: %v", err)
+	}
+	rAMD := r.SetDigest(d.Digest.String())
+	// add a layer with a whiteout for layer1
+	rWh := r.SetTag("whiteout")
+	whBuf := &bytes.Buffer{}
+	whTW := tar.NewWriter(whBuf)
+	err = whTW.WriteHeader(&tar.Header{Name: ".wh.layer1", Typeflag: tar.TypeReg, Mode: 0644})
+	if err != nil {
+		t.Fatalf("failed to write tar header: %v", err)
+	}
+	err = whTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	_, err = Apply(ctx, rc, rAMD, WithRefTgt(rWh), WithLayerAddTar(whBuf, "", nil))
+	if err != nil {
+		t.Fatalf("failed to setup whiteout layer: %v", err)
+	}
+	expect, err := os.ReadFile("../testdata/layer1.txt")
+	if err != nil {
+		t.Fatalf("failed to read layer1.txt: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     ref.Ref
+		file    string
+		expect  []byte
+		wantErr error
+	}{
+		{
+			name:   "file",
+			ref:    rAMD,
+			file:   "/layer1",
+			expect: expect,
+		},
+		{
+			name:   "relative",
+			ref:    rAMD,
+			file:   "layer1",
+			expect: expect,
+		},
+		{
+			name:    "missing",
+			ref:     rAMD,
+			file:    "/missing",
+			wantErr: errs.ErrFileNotFound,
+		},
+		{
+			name:    "directory",
+			ref:     rAMD,
+			file:    "/dir",
+			wantErr: errs.ErrFileNotFound,
+		},
+		{
+			name:    "whiteout",
+			ref:     rWh,
+			file:    "/layer1",
+			wantErr: errs.ErrFileNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := GetFile(ctx, rc, tt.ref, tt.file)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("unexpected error, expected %v, received %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get file: %v", err)
+			}
+			if !bytes.Equal(b, tt.expect) {
+				t.Errorf("unexpected content, expected %s, received %s", string(tt.expect), string(b))
+			}
+		})
+	}
+}
+
+func TestPathRel(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		base, target, expect string
+	}{
+		{base: "a/b", target: "a/b/c", expect: "c"},
+		{base: "a/b", target: "a/c", expect: "../c"},
+		{base: "opt/app", target: "etc/config", expect: "../../etc/config"},
+		{base: "", target: "etc/config", expect: "etc/config"},
+		{base: "a/b", target: "a/b", expect: "."},
+		{base: "a/b", target: "", expect: "../.."},
+	}
+	for _, tt := range tests {
+		result := pathRel(tt.base, tt.target)
+		if result != tt.expect {
+			t.Errorf("pathRel(%q, %q), expected %q, received %q", tt.base, tt.target, tt.expect, result)
+		}
+	}
+}
+
+func TestInspectCompression(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	dl, err := m.(manifest.Indexer).GetManifestList()
+	if err != nil {
+		t.Fatalf("failed to get manifest list: %v", err)
+	}
+	p, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	d, err := manifest.GetPlatformDesc(m, &p)
+	if err != nil {
+		t.Fatalf("failed to get platform: %v", err)
+	}
+	rAMD := r.SetDigest(d.Digest.String())
+	rZstd := r.SetTag("zstd")
+	_, err = Apply(ctx, rc, rAMD, WithRefTgt(rZstd), WithLayerCompression(archive.CompressZstd))
+	if err != nil {
+		t.Fatalf("failed to setup zstd image: %v", err)
+	}
+
+	t.Run("index", func(t *testing.T) {
+		report, err := InspectCompression(ctx, rc, r)
+		if err != nil {
+			t.Fatalf("failed to inspect: %v", err)
+		}
+		if len(report.Images) != len(dl) {
+			t.Fatalf("unexpected number of images, expected %d, received %d", len(dl), len(report.Images))
+		}
+		count := 0
+		for i, ci := range report.Images {
+			if ci.Desc.Digest != dl[i].Digest {
+				t.Errorf("unexpected digest for image %d, expected %s, received %s", i, dl[i].Digest, ci.Desc.Digest)
+			}
+			if ci.Platform == nil || !platform.Match(*ci.Platform, *dl[i].Platform) {
+				t.Errorf("unexpected platform for image %d: %v", i, ci.Platform)
+			}
+			for _, cl := range ci.Layers {
+				if !cl.Tar || cl.Compression != archive.CompressGzip {
+					t.Errorf("unexpected layer %s, tar %t, compression %s", cl.Desc.MediaType, cl.Tar, cl.Compression.String())
+				}
+				count++
+			}
+		}
+		if report.Counts[archive.CompressGzip] != count || report.Other != 0 {
+			t.Errorf("unexpected counts: %v, other %d", report.Counts, report.Other)
+		}
+		mAfter, err := rc.ManifestHead(ctx, r)
+		if err != nil {
+			t.Fatalf("failed to head manifest: %v", err)
+		}
+		if mAfter.GetDescriptor().Digest != m.GetDescriptor().Digest {
+			t.Errorf("image was modified")
+		}
+	})
+	t.Run("image", func(t *testing.T) {
+		report, err := InspectCompression(ctx, rc, rZstd)
+		if err != nil {
+			t.Fatalf("failed to inspect: %v", err)
+		}
+		if len(report.Images) != 1 || report.Images[0].Platform != nil {
+			t.Fatalf("unexpected images: %v", report.Images)
+		}
+		if len(report.Images[0].Layers) == 0 || report.Counts[archive.CompressZstd] != len(report.Images[0].Layers) {
+			t.Errorf("unexpected counts: %v", report.Counts)
+		}
+		for _, cl := range report.Images[0].Layers {
+			if cl.Desc.MediaType != mediatype.OCI1LayerZstd || cl.Compression != archive.CompressZstd {
+				t.Errorf("unexpected layer %s, compression %s", cl.Desc.MediaType, cl.Compression.String())
+			}
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		_, err := InspectCompression(ctx, rc, r.SetTag("missing"))
+		if err == nil {
+			t.Errorf("inspect of missing image did not fail")
+		}
+	})
+}
+
+func TestExternalLayerInline(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	p, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	d, err := manifest.GetPlatformDesc(m, &p)
+	if err != nil {
+		t.Fatalf("failed to get platform: %v", err)
+	}
+	rAMD := r.SetDigest(d.Digest.String())
+	// serve an external layer that is not included in the repository
+	extBuf := &bytes.Buffer{}
+	extTW := tar.NewWriter(extBuf)
+	err = extTW.WriteHeader(&tar.Header{Name: "external.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 8})
+	if err != nil {
+		t.Fatalf("failed to write tar header: %v", err)
+	}
+	_, err = extTW.Write([]byte("external"))
+	if err != nil {
+		t.Fatalf("failed to write tar content: %v", err)
+	}
+	err = extTW.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	extDiffID := digest.FromBytes(extBuf.Bytes())
+	extRdr, err := archive.Compress(extBuf, archive.CompressGzip)
+	if err != nil {
+		t.Fatalf("failed to compress layer: %v", err)
+	}
+	extBytes, err := io.ReadAll(extRdr)
+	if err != nil {
+		t.Fatalf("failed to read compressed layer: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/layer", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(extBytes)
+	})
+	mux.HandleFunc("/bad", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), len(extBytes)))
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	extDesc := descriptor.Descriptor{
+		MediaType: mediatype.OCI1ForeignLayerGzip,
+		Digest:    digest.FromBytes(extBytes),
+		Size:      int64(len(extBytes)),
+	}
+	// create images referencing the external layer, each in a separate repository
+	extImage := func(repo string, urls []string) ref.Ref {
+		t.Helper()
+		err := copyfs.Copy(filepath.Join(tempDir, repo), "../testdata/testrepo")
+		if err != nil {
+			t.Fatalf("failed to setup %s: %v", repo, err)
+		}
+		rExt, err := ref.New("ocidir://" + tempDir + "/" + repo + ":external")
+		if err != nil {
+			t.Fatalf("failed to parse ref: %v", err)
+		}
+		rAMD := rExt.SetDigest(rAMD.Digest)
+		mAMD, err := rc.ManifestGet(ctx, rAMD)
+		if err != nil {
+			t.Fatalf("failed to get manifest: %v", err)
+		}
+		om, err := manifest.OCIManifestFromAny(mAMD.GetOrig())
+		if err != nil {
+			t.Fatalf("failed to convert manifest: %v", err)
+		}
+		conf, err := rc.BlobGetOCIConfig(ctx, rAMD, om.Config)
+		if err != nil {
+			t.Fatalf("failed to get config: %v", err)
+		}
+		oc := conf.GetConfig()
+		oc.RootFS.DiffIDs = append(oc.RootFS.DiffIDs, extDiffID)
+		oc.History = append(oc.History, v1.History{CreatedBy: "external"})
+		conf.SetConfig(oc)
+		cBytes, err := conf.RawBody()
+		if err != nil {
+			t.Fatalf("failed to get config body: %v", err)
+		}
+		om.Config, err = rc.BlobPut(ctx, rAMD, conf.GetDescriptor(), bytes.NewReader(cBytes))
+		if err != nil {
+			t.Fatalf("failed to put config: %v", err)
+		}
+		dExt := extDesc
+		dExt.URLs = urls
+		om.Layers = append(om.Layers, dExt)
+		mExt, err := manifest.New(manifest.WithOrig(om))
+		if err != nil {
+			t.Fatalf("failed to create manifest: %v", err)
+		}
+		err = rc.ManifestPut(ctx, rExt, mExt)
+		if err != nil {
+			t.Fatalf("failed to put manifest: %v", err)
+		}
+		return rExt
+	}
+	rExt := extImage("ext-inline", []string{ts.URL + "/missing", ts.URL + "/layer"})
+	rBad := extImage("ext-bad", []string{ts.URL + "/bad"})
+	rMissing := extImage("ext-missing", []string{ts.URL + "/missing"})
+	rClient := extImage("ext-client", []string{ts.URL + "/missing", ts.URL + "/layer"})
+
+	t.Run("inline", func(t *testing.T) {
+		rTgt := rExt.SetTag("inline")
+		rMod, err := Apply(ctx, rc, rExt, WithRefTgt(rTgt), WithExternalLayerInline())
+		if err != nil {
+			t.Fatalf("failed to apply: %v", err)
+		}
+		mMod, err := rc.ManifestGet(ctx, rMod)
+		if err != nil {
+			t.Fatalf("failed to get manifest: %v", err)
+		}
+		layers, err := mMod.(manifest.Imager).GetLayers()
+		if err != nil {
+			t.Fatalf("failed to get layers: %v", err)
+		}
+		top := layers[len(layers)-1]
+		if len(top.URLs) > 0 || top.MediaType != mediatype.OCI1LayerGzip || top.Digest != extDesc.Digest {
+			t.Errorf("unexpected layer: %v", top)
+		}
+		br, err := rc.BlobGet(ctx, rMod, top)
+		if err != nil {
+			t.Fatalf("failed to get inlined layer: %v", err)
+		}
+		b, err := io.ReadAll(br)
+		_ = br.Close()
+		if err != nil {
+			t.Fatalf("failed to read inlined layer: %v", err)
+		}
+		if !bytes.Equal(b, extBytes) {
+			t.Errorf("inlined layer content does not match")
+		}
+	})
+	t.Run("http client", func(t *testing.T) {
+		rtc := &roundTripCount{rt: http.DefaultTransport}
+		hc := &http.Client{Transport: rtc}
+		_, err := Apply(ctx, rc, rClient, WithRefTgt(rClient.SetTag("inline")), WithExternalLayerInline(), WithHTTPClient(hc))
+		if err != nil {
+			t.Fatalf("failed to apply: %v", err)
+		}
+		// one request for the missing url and one for the layer
+		if rtc.count.Load() != 2 {
+			t.Errorf("unexpected request count on the http client, expected 2, received %d", rtc.count.Load())
+		}
+	})
+	t.Run("digest mismatch", func(t *testing.T) {
+		_, err := Apply(ctx, rc, rBad, WithRefTgt(rBad.SetTag("inline")), WithExternalLayerInline())
+		if !errors.Is(err, errs.ErrDigestMismatch) {
+			t.Errorf("unexpected error, expected %v, received %v", errs.ErrDigestMismatch, err)
+		}
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		_, err := Apply(ctx, rc, rMissing, WithRefTgt(rMissing.SetTag("inline")), WithExternalLayerInline())
+		if !errors.Is(err, errs.ErrNotFound) {
+			t.Errorf("unexpected error, expected %v, received %v", errs.ErrNotFound, err)
+		}
+	})
+}
+
+// roundTripCount counts the requests sent by an http client.
+type roundTripCount struct {
+	rt    http.RoundTripper
+	count atomic.Int32
+}
+
+func (rtc *roundTripCount) RoundTrip(req *http.Request) (*http.Response, error) {
+	rtc.count.Add(1)
+	return rtc.rt.RoundTrip(req)
+}
+
+func TestInList(t *testing.T) {
+	t.Parallel()
+	t.Run("match", func(t *testing.T) {
+		if !inListStr(mediatype.Docker2LayerGzip, mtKnownTar) {
+			t.Errorf("did not find docker layer in known tar list")
+		}
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		if inListStr(mediatype.Docker2LayerGzip, mtKnownConfig) {
+			t.Errorf("found docker layer in known config list")
+		}
+	})
+}
+
+// BenchmarkApplySmallLayers rewrites an image with 100 tiny gzip layers to measure the allocations in the layer walk.
+func BenchmarkApplySmallLayers(b *testing.B) {
+	ctx := context.Background()
+	rc := regclient.New()
+	r, err := ref.New("ocidir://" + b.TempDir() + "/repo:small")
+	if err != nil {
+		b.Fatalf("failed to parse ref: %v", err)
+	}
+	layers := []descriptor.Descriptor{}
+	diffIDs := []digest.Digest{}
+	for i := 0; i < 100; i++ {
+		tarBuf := &bytes.Buffer{}
+		tw := tar.NewWriter(tarBuf)
+		content := []byte(fmt.Sprintf("layer %d\n", i))
+		err = tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("file-%d", i), Typeflag: tar.TypeReg, Mode: 0666, Size: int64(len(content))})
+		if err != nil {
+			b.Fatalf("failed to write tar header: %v", err)
+		}
+		_, err = tw.Write(content)
+		if err != nil {
+			b.Fatalf("failed to write tar content: %v", err)
+		}
+		err = tw.Close()
+		if err != nil {
+			b.Fatalf("failed to close tar: %v", err)
+		}
+		diffIDs = append(diffIDs, digest.FromBytes(tarBuf.Bytes()))
+		cr, err := archive.Compress(tarBuf, archive.CompressGzip)
+		if err != nil {
+			b.Fatalf("failed to compress layer: %v", err)
+		}
+		gzBytes, err := io.ReadAll(cr)
+		_ = cr.Close()
+		if err != nil {
+			b.Fatalf("failed to compress layer: %v", err)
+		}
+		d := descriptor.Descriptor{MediaType: mediatype.OCI1LayerGzip, Digest: digest.FromBytes(gzBytes), Size: int64(len(gzBytes))}
+		_, err = rc.BlobPut(ctx, r, d, bytes.NewReader(gzBytes))
+		if err != nil {
+			b.Fatalf("failed to put layer: %v", err)
+		}
+		layers = append(layers, d)
+	}
+	confBytes, err := json.Marshal(v1.Image{
+		Platform: platform.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		b.Fatalf("failed to marshal config: %v", err)
+	}
+	cd := descriptor.Descriptor{MediaType: mediatype.OCI1ImageConfig, Digest: digest.FromBytes(confBytes), Size: int64(len(confBytes))}
+	_, err = rc.BlobPut(ctx, r, cd, bytes.NewReader(confBytes))
+	if err != nil {
+		b.Fatalf("failed to put config: %v", err)
+	}
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: mediatype.OCI1Manifest,
+		Config:    cd,
+		Layers:    layers,
+	}))
+	if err != nil {
+		b.Fatalf("failed to create manifest: %v", err)
+	}
+	err = rc.ManifestPut(ctx, r, m)
+	if err != nil {
+		b.Fatalf("failed to put manifest: %v", err)
+	}
+	rTgt := r.SetTag("out")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = Apply(ctx, rc, r, WithRefTgt(rTgt), WithFileUmask(0022))
+		if err != nil {
+			b.Fatalf("failed to apply: %v", err)
+		}
+	}
+}
+
+// BenchmarkApplyReadBuffer compares the layer walk with and without [WithReadBuffer] on a synthetic gzip layer.
+func BenchmarkApplyReadBuffer(b *testing.B) {
+	ctx := context.Background()
+	rc := regclient.New()
+	r, size := benchLayerSetup(ctx, b, rc, 16*1024*1024)
+	tt := []struct {
+		name string
+		opts []Opts
+	}{
+		{
+			name: "Unbuffered",
+		},
+		{
+			name: "64KiB",
+			opts: []Opts{WithReadBuffer(64 * 1024)},
+		},
+		{
+			name: "1MiB",
+			opts: []Opts{WithReadBuffer(1024 * 1024)},
+		},
+	}
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			opts := append([]Opts{WithFileUmask(0022), WithDiscardPush(nil)}, tc.opts...)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Apply(ctx, rc, r, opts...)
+				if err != nil {
+					b.Fatalf("failed to apply: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkApplyBlobChunkSize compares buffer sizes from [WithBlobChunkSize] when rewriting a synthetic gzip layer.
+func BenchmarkApplyBlobChunkSize(b *testing.B) {
+	ctx := context.Background()
+	rc := regclient.New()
+	r, size := benchLayerSetup(ctx, b, rc, 16*1024*1024)
+	tt := []struct {
+		name string
+		opts []Opts
+	}{
+		{
+			name: "Default",
+		},
+		{
+			name: "4KiB",
+			opts: []Opts{WithBlobChunkSize(4 * 1024)},
+		},
+		{
+			name: "1MiB",
+			opts: []Opts{WithBlobChunkSize(1024 * 1024)},
+		},
+	}
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			opts := append([]Opts{WithFileUmask(0022), WithDiscardPush(nil)}, tc.opts...)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Apply(ctx, rc, r, opts...)
+				if err != nil {
+					b.Fatalf("failed to apply: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkApplyBlobChunkSizeLatency compares buffer sizes from [WithBlobChunkSize] when copying a 2GB layer
+// between two registries over a simulated high latency link. The layer is reduced to 64MiB with -short.
+func BenchmarkApplyBlobChunkSizeLatency(b *testing.B) {
+	ctx := context.Background()
+	layerSize := int64(2 * 1024 * 1024 * 1024)
+	if testing.Short() {
+		layerSize = 64 * 1024 * 1024
+	}
+	srcDir := b.TempDir()
+	tgtDir := b.TempDir()
+	// create the source image in an OCI Layout that is served by the source registry
+	rLayout, err := ref.New("ocidir://" + srcDir + "/bench:v1")
+	if err != nil {
+		b.Fatalf("failed to parse ref: %v", err)
+	}
+	rcLayout := regclient.New()
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{Name: "data", Typeflag: tar.TypeReg, Mode: 0644, Size: layerSize})
+		if err == nil {
+			_, err = io.CopyN(tw, benchPatternReader{}, layerSize)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	ld, err := rcLayout.BlobPut(ctx, rLayout, descriptor.Descriptor{MediaType: mediatype.OCI1Layer}, pr)
+	if err != nil {
+		b.Fatalf("failed to put layer: %v", err)
+	}
+	ld.MediaType = mediatype.OCI1Layer
+	confBytes, err := json.Marshal(v1.Image{
+		Platform: platform.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{ld.Digest}},
+	})
+	if err != nil {
+		b.Fatalf("failed to marshal config: %v", err)
+	}
+	cd := descriptor.Descriptor{MediaType: mediatype.OCI1ImageConfig, Digest: digest.FromBytes(confBytes), Size: int64(len(confBytes))}
+	_, err = rcLayout.BlobPut(ctx, rLayout, cd, bytes.NewReader(confBytes))
+	if err != nil {
+		b.Fatalf("failed to put config: %v", err)
+	}
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: mediatype.OCI1Manifest,
+		Config:    cd,
+		Layers:    []descriptor.Descriptor{ld},
+	}))
+	if err != nil {
+		b.Fatalf("failed to create manifest: %v", err)
+	}
+	err = rcLayout.ManifestPut(ctx, rLayout, m)
+	if err != nil {
+		b.Fatalf("failed to put manifest: %v", err)
+	}
+	// run the registries behind a listener that delays every read and write
+	hosts := []config.Host{}
+	regStart := func(dir string) string {
+		reg := olareg.New(oConfig.Config{
+			Storage: oConfig.ConfigStorage{
+				StoreType: oConfig.StoreDir,
+				RootDir:   dir,
+			},
+		})
+		ts := httptest.NewUnstartedServer(reg)
+		ts.Listener = latencyListener{Listener: ts.Listener, delay: 200 * time.Microsecond}
+		ts.Start()
+		b.Cleanup(func() {
+			ts.Close()
+			_ = reg.Close()
+		})
+		tsURL, _ := url.Parse(ts.URL)
+		hosts = append(hosts, config.Host{Name: tsURL.Host, Hostname: tsURL.Host, TLS: config.TLSDisabled})
+		return tsURL.Host
+	}
+	srcHost := regStart(srcDir)
+	tgtHost := regStart(tgtDir)
+	rc := regclient.New(regclient.WithConfigHost(hosts...))
+	rSrc, err := ref.New(srcHost + "/bench:v1")
+	if err != nil {
+		b.Fatalf("failed to parse ref: %v", err)
+	}
+	tt := []struct {
+		name string
+		opts []Opts
+	}{
+		{
+			name: "Default",
+		},
+		{
+			name: "64KiB",
+			opts: []Opts{WithBlobChunkSize(64 * 1024)},
+		},
+		{
+			name: "1MiB",
+			opts: []Opts{WithBlobChunkSize(1024 * 1024)},
+		},
+		{
+			name: "16MiB",
+			opts: []Opts{WithBlobChunkSize(16 * 1024 * 1024)},
+		},
+	}
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(ld.Size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// each copy goes to a new repository so the layer is not skipped
+				repo := fmt.Sprintf("bench-%s-%d", strings.ToLower(tc.name), i)
+				rTgt, err := ref.New(tgtHost + "/" + repo + ":v1")
+				if err != nil {
+					b.Fatalf("failed to parse ref: %v", err)
+				}
+				opts := append([]Opts{WithRefTgt(rTgt)}, tc.opts...)
+				_, err = Apply(ctx, rc, rSrc, opts...)
+				if err != nil {
+					b.Fatalf("failed to apply: %v", err)
+				}
+				b.StopTimer()
+				err = os.RemoveAll(filepath.Join(tgtDir, repo))
+				if err != nil {
+					b.Fatalf("failed to remove %s: %v", repo, err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// benchPatternReader returns a repeating byte pattern for generating large layers.
+type benchPatternReader struct{}
+
+func (benchPatternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return len(p), nil
+}
+
+// latencyListener delays each read and write on accepted connections to simulate a high latency link.
+type latencyListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (ll latencyListener) Accept() (net.Conn, error) {
+	c, err := ll.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return latencyConn{Conn: c, delay: ll.delay}, nil
+}
+
+type latencyConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (lc latencyConn) Read(p []byte) (int, error) {
+	time.Sleep(lc.delay)
+	return lc.Conn.Read(p)
+}
+
+func (lc latencyConn) Write(p []byte) (int, error) {
+	time.Sleep(lc.delay)
+	return lc.Conn.Write(p)
+}
+
+// benchLayerSetup pushes an image with a single gzip layer containing a file of the given size, returning the ref and uncompressed layer size.
+func benchLayerSetup(ctx context.Context, b *testing.B, rc *regclient.RegClient, fileSize int) (ref.Ref, int64) {
+	b.Helper()
+	r, err := ref.New("ocidir://" + b.TempDir() + "/repo:bench")
+	if err != nil {
+		b.Fatalf("failed to parse ref: %v", err)
+	}
+	content := make([]byte, fileSize)
+	rng := rand.New(rand.NewSource(1))
+	_, _ = rng.Read(content[:fileSize/2]) // half random data to limit the compression ratio
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	err = tw.WriteHeader(&tar.Header{Name: "data", Typeflag: tar.TypeReg, Mode: 0666, Size: int64(len(content))})
+	if err != nil {
+		b.Fatalf("failed to write tar header: %v", err)
+	}
+	_, err = tw.Write(content)
+	if err != nil {
+		b.Fatalf("failed to write tar content: %v", err)
+	}
+	err = tw.Close()
+	if err != nil {
+		b.Fatalf("failed to close tar: %v", err)
+	}
+	size := int64(tarBuf.Len())
+	diffID := digest.FromBytes(tarBuf.Bytes())
+	cr, err := archive.Compress(tarBuf, archive.CompressGzip)
+	if err != nil {
+		b.Fatalf("failed to compress layer: %v", err)
+	}
+	gzBytes, err := io.ReadAll(cr)
+	_ = cr.Close()
+	if err != nil {
+		b.Fatalf("failed to compress layer: %v", err)
+	}
+	ld := descriptor.Descriptor{MediaType: mediatype.OCI1LayerGzip, Digest: digest.FromBytes(gzBytes), Size: int64(len(gzBytes))}
+	_, err = rc.BlobPut(ctx, r, ld, bytes.NewReader(gzBytes))
+	if err != nil {
+		b.Fatalf("failed to put layer: %v", err)
+	}
+	confBytes, err := json.Marshal(v1.Image{
+		Platform: platform.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}},
+	})
+	if err != nil {
+		b.Fatalf("failed to marshal config: %v", err)
+	}
+	cd := descriptor.Descriptor{MediaType: mediatype.OCI1ImageConfig, Digest: digest.FromBytes(confBytes), Size: int64(len(confBytes))}
+	_, err = rc.BlobPut(ctx, r, cd, bytes.NewReader(confBytes))
+	if err != nil {
+		b.Fatalf("failed to put config: %v", err)
+	}
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: mediatype.OCI1Manifest,
+		Config:    cd,
+		Layers:    []descriptor.Descriptor{ld},
+	}))
+	if err != nil {
+		b.Fatalf("failed to create manifest: %v", err)
+	}
+	err = rc.ManifestPut(ctx, r, m)
+	if err != nil {
+		b.Fatalf("failed to put manifest: %v", err)
+	}
+	return r, size
+}
+
+// testModEnv is a source and target registry loaded with the testdata, and a client configured for both.
+type testModEnv struct {
+	ctx       context.Context
+	rc        *regclient.RegClient
+	tTgtHost  string
+	tempDir   string
+	baseTime  time.Time
+	r3        ref.Ref
+	r3amd     ref.Ref
+	m3DescAmd *descriptor.Descriptor
+}
+
+// testModSetup starts the registries used by the [Apply] tests, each test has its own registries for the images it creates.
+func testModSetup(t *testing.T) testModEnv {
+	t.Helper()
+	ctx := context.Background()
+	baseTime, err := time.Parse(time.RFC3339, "2020-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("failed to parse test time: %v", err)
+	}
+	bTrue := true
+	regSrc := olareg.New(oConfig.Config{
+		Storage: oConfig.ConfigStorage{
+			StoreType: oConfig.StoreMem,
+			RootDir:   "../testdata",
+			ReadOnly:  &bTrue,
+		},
+	})
+	tSrc := httptest.NewServer(regSrc)
+	tSrcURL, _ := url.Parse(tSrc.URL)
+	tSrcHost := tSrcURL.Host
+	regTgt := olareg.New(oConfig.Config{
+		Storage: oConfig.ConfigStorage{
+			StoreType: oConfig.StoreMem,
+			RootDir:   "../testdata",
+		},
+	})
+	tTgt := httptest.NewServer(regTgt)
+	tTgtURL, _ := url.Parse(tTgt.URL)
+	tTgtHost := tTgtURL.Host
+	t.Cleanup(func() {
+		tSrc.Close()
+		_ = regSrc.Close()
+		tTgt.Close()
+		_ = regTgt.Close()
+	})
+	tempDir := t.TempDir()
+	err = copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+
+	// create regclient
+	rcHosts := []config.Host{
+		{
+			Name:     tSrcHost,
+			Hostname: tSrcHost,
+			TLS:      config.TLSDisabled,
+		},
+		{
+			Name:     tTgtHost,
+			Hostname: tTgtHost,
+			TLS:      config.TLSDisabled,
+		},
+		{
+			Name:     "registry.example.org",
+			Hostname: tSrcHost,
+			TLS:      config.TLSDisabled,
+		},
+	}
+	delayInit, _ := time.ParseDuration("0.05s")
+	delayMax, _ := time.ParseDuration("0.10s")
+	rc := regclient.New(
+		regclient.WithConfigHost(rcHosts...),
+		regclient.WithRegOpts(reg.WithDelay(delayInit, delayMax)),
+	)
+
+	r3, err := ref.New(tTgtHost + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m3, err := rc.ManifestGet(ctx, r3)
+	if err != nil {
+		t.Fatalf("failed to retrieve v3 ref: %v", err)
+	}
+	pAMD, err := platform.Parse("linux/amd64")
+	if err != nil {
+		t.Fatalf("failed to parse platform: %v", err)
+	}
+	m3DescAmd, err := manifest.GetPlatformDesc(m3, &pAMD)
+	if err != nil {
+		t.Fatalf("failed to get amd64 descriptor: %v", err)
+	}
+	r3amd, err := ref.New(fmt.Sprintf("%s/testrepo@%s", tTgtHost, m3DescAmd.Digest.String()))
+	if err != nil {
+		t.Fatalf("failed to parse platform specific descriptor: %v", err)
+	}
+	return testModEnv{
+		ctx:       ctx,
+		rc:        rc,
+		tTgtHost:  tTgtHost,
+		tempDir:   tempDir,
+		baseTime:  baseTime,
+		r3:        r3,
+		r3amd:     r3amd,
+		m3DescAmd: m3DescAmd,
+	}
+}
+
+// testModCase is a call to [Apply] and the expected result.
+type testModCase struct {
+	name     string
+	opts     []Opts
+	ref      string
+	wantErr  error
+	wantSame bool                      // if the resulting image should be unchanged
+	check    func(*testing.T, ref.Ref) // optional validation of the modified image
+}
+
+// testModRun runs each test in order, later tests may use the images pushed by earlier tests.
+func testModRun(t *testing.T, env testModEnv, tests []testModCase) {
+	t.Helper()
+	ctx, rc := env.ctx, env.rc
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rSrc, err := ref.New(tt.ref)
+			if err != nil {
+				t.Fatalf("failed creating ref: %v", err)
+			}
+			// run mod with opts
+			rMod, err := Apply(ctx, rc, rSrc, tt.opts...)
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Errorf("ModImage did not fail")
+				} else if !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
+					t.Errorf("unexpected error, wanted %v, received %v", tt.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			mSrc, err := rc.ManifestHead(ctx, rSrc, regclient.WithManifestRequireDigest())
+			if err != nil {
+				t.Fatalf("failed to get manifest from src: %v", err)
+			}
+			mTgt, err := rc.ManifestHead(ctx, rMod, regclient.WithManifestRequireDigest())
+			if err != nil {
+				t.Fatalf("failed to get manifest from mod \"%s\": %v", rMod.CommonName(), err)
+			}
+
+			if tt.wantSame {
+				if mSrc.GetDescriptor().Digest != mTgt.GetDescriptor().Digest {
+					t.Errorf("digest changed")
+				}
+			} else {
+				if mSrc.GetDescriptor().Digest == mTgt.GetDescriptor().Digest {
+					t.Errorf("digest did not change")
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, rMod)
+			}
+		})
+	}
+}
+
+// testConfigSetup pushes a copy of an image with a modified config for use as a test fixture.
+func testConfigSetup(ctx context.Context, rc *regclient.RegClient, rSrc, rTgt ref.Ref, fn func(*v1.Image)) error {
+	m, err := rc.ManifestGet(ctx, rSrc)
+	if err != nil {
+		return err
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return fmt.Errorf("manifest is not an image: %s", rSrc.CommonName())
+	}
+	cd, err := mi.GetConfig()
+	if err != nil {
+		return err
+	}
+	conf, err := rc.BlobGetOCIConfig(ctx, rSrc, cd)
+	if err != nil {
+		return err
+	}
+	oc := conf.GetConfig()
+	fn(&oc)
+	conf.SetConfig(oc)
+	cBytes, err := conf.RawBody()
+	if err != nil {
+		return err
+	}
+	cd = conf.GetDescriptor()
+	_, err = rc.BlobPut(ctx, rTgt, cd, bytes.NewReader(cBytes))
+	if err != nil {
+		return err
+	}
+	err = mi.SetConfig(cd)
+	if err != nil {
+		return err
+	}
+	return rc.ManifestPut(ctx, rTgt, m)
+}
+
+// testLayerHeaders returns the list of tar headers in a layer, negative indexes are counted from the last layer.
+// testLayerModTimes compares the file mod times in each layer of rMod to the value returned by expect for the matching file in rOrig.
+func testLayerModTimes(ctx context.Context, t *testing.T, rc *regclient.RegClient, rOrig, rMod ref.Ref, expect func(i int, orig time.Time) time.Time) {
+	t.Helper()
+	m, err := rc.ManifestGet(ctx, rOrig)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	layers, err := m.(manifest.Imager).GetLayers()
+	if err != nil {
+		t.Fatalf("failed to get layers: %v", err)
+	}
+	for i := range layers {
+		headersOrig, err := testLayerHeaders(ctx, rc, rOrig, i)
+		if err != nil {
+			t.Fatalf("failed to read layer %d: %v", i, err)
+		}
+		headersMod, err := testLayerHeaders(ctx, rc, rMod, i)
+		if err != nil {
+			t.Fatalf("failed to read layer %d: %v", i, err)
+		}
+		if len(headersOrig) != len(headersMod) {
+			t.Fatalf("layer %d header count changed from %d to %d", i, len(headersOrig), len(headersMod))
+		}
+		for j, th := range headersMod {
+			want := expect(i, headersOrig[j].ModTime)
+			if !th.ModTime.Equal(want) {
+				t.Errorf("unexpected mod time in layer %d on %s: %s, expected %s", i, th.Name, th.ModTime.String(), want.String())
+			}
+		}
+	}
+}
+
+func testLayerHeaders(ctx context.Context, rc *regclient.RegClient, r ref.Ref, i int) ([]*tar.Header, error) {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, fmt.Errorf("manifest is not an image")
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		i = len(layers) + i
+	}
+	if i < 0 || i >= len(layers) {
+		return nil, fmt.Errorf("layer %d not found", i)
+	}
+	br, err := rc.BlobGet(ctx, r, layers[i])
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	dr, err := archive.Decompress(br)
+	if err != nil {
+		return nil, err
+	}
+	headers := []*tar.Header{}
+	tr := tar.NewReader(dr)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, th)
+	}
+	return headers, nil
+}
+
+// testImageFS returns the filesystem from stacking the layers of an image, mapping each path to the content of regular files.
+// Directories are mapped to "dir", and other entries to their link name.
+func testImageFS(ctx context.Context, rc *regclient.RegClient, r ref.Ref) (map[string]string, error) {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, fmt.Errorf("manifest is not an image")
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	fs := map[string]string{}
+	rmTree := func(name string) {
+		for k := range fs {
+			if k == name || strings.HasPrefix(k, name+"/") {
+				delete(fs, k)
+			}
+		}
+	}
+	for _, l := range layers {
+		type fsEntry struct {
+			name  string
+			value string
+			dir   bool
+		}
+		entries := []fsEntry{}
+		whiteouts := []string{}
+		err := func() error {
+			br, err := rc.BlobGet(ctx, r, l)
+			if err != nil {
+				return err
+			}
+			defer br.Close()
+			dr, err := archive.Decompress(br)
+			if err != nil {
+				return err
+			}
+			tr := tar.NewReader(dr)
+			for {
+				th, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				name := strings.Trim(path.Clean("/"+th.Name), "/")
+				if strings.HasPrefix(path.Base(name), ".wh.") {
+					whiteouts = append(whiteouts, name)
+					continue
+				}
+				e := fsEntry{name: name, value: th.Linkname}
+				switch th.Typeflag {
+				case tar.TypeDir:
+					e.value = "dir"
+					e.dir = true
+				case tar.TypeReg:
+					b, err := io.ReadAll(tr)
+					if err != nil {
+						return err
+					}
+					e.value = string(b)
+				}
+				entries = append(entries, e)
+			}
+		}()
+		if err != nil {
+			return nil, err
+		}
+		for _, wh := range whiteouts {
+			dir, base := path.Split(wh)
+			dir = strings.TrimSuffix(dir, "/")
+			if base == ".wh..wh..opq" {
+				for k := range fs {
+					if strings.HasPrefix(k, dir+"/") || (dir == "" && k != "") {
+						delete(fs, k)
+					}
+				}
+			} else {
+				rmTree(path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			}
+		}
+		for _, e := range entries {
+			if !e.dir || fs[e.name] != "dir" {
+				rmTree(e.name)
+			}
+			fs[e.name] = e.value
+		}
+	}
+	return fs, nil
+}
+
+// testLayerFile returns the content of a file from layer i of the image.
+func testLayerFile(ctx context.Context, rc *regclient.RegClient, r ref.Ref, i int, name string) ([]byte, error) {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, fmt.Errorf("manifest is not an image")
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(layers) {
+		return nil, fmt.Errorf("layer %d not found", i)
+	}
+	br, err := rc.BlobGet(ctx, r, layers[i])
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	dr, err := archive.Decompress(br)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(dr)
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if tarNameClean(th.Name) == name {
+			return io.ReadAll(tr)
+		}
+	}
 }
@@ -2,9 +2,13 @@ package mod
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/regclient/regclient/types/errs"
 )
 
 const epocEnv = "SOURCE_DATE_EPOC"
@@ -34,14 +38,38 @@ func timeEpocEnv() (time.Time, error) {
 	return time.Unix(secI, 0), nil
 }
 
+// timeParse parses a time from either Unix seconds or RFC3339.
+func timeParse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if secI, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secI, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse time %q as Unix seconds or RFC3339%.0w", s, errs.ErrParsingFailed)
+	}
+	return t, nil
+}
+
 // timeModOpt adjusts time t according to the opts.
 // The bool indicates if the time was changed.
 func timeModOpt(t time.Time, opt OptTime) (time.Time, bool) {
-	if !opt.After.IsZero() && !t.After(opt.After) {
-		return t, false
+	tNew := t
+	if !opt.Set.IsZero() && (opt.After.IsZero() || t.After(opt.After)) {
+		tNew = opt.Set
+	}
+	if !opt.Clamp.IsZero() && tNew.After(opt.Clamp) {
+		tNew = opt.Clamp
 	}
-	if !t.Equal(opt.Set) {
-		return opt.Set, true
+	if !tNew.Equal(t) {
+		return tNew, true
 	}
 	return t, false
 }
+
+// timeClampSet saves the earliest clamp from the timestamp options.
+func (dc *dagConfig) timeClampSet(t time.Time) {
+	if !t.IsZero() && (dc.timeClamp.IsZero() || t.Before(dc.timeClamp)) {
+		dc.timeClamp = t
+	}
+}
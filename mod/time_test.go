@@ -1,10 +1,13 @@
 package mod
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/regclient/regclient/types/errs"
 )
 
 func TestTimeNow(t *testing.T) {
@@ -32,3 +35,56 @@ func TestTimeNow(t *testing.T) {
 		}
 	})
 }
+
+func TestTimeParse(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		value   string
+		expect  time.Time
+		wantErr error
+	}{
+		{
+			name:   "seconds",
+			value:  "1577836800",
+			expect: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "rfc3339",
+			value:  "2020-01-01T00:00:00Z",
+			expect: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "rfc3339 offset",
+			value:  " 2020-01-01T02:00:00+02:00\n",
+			expect: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "invalid",
+			value:   "yesterday",
+			wantErr: errs.ErrParsingFailed,
+		},
+		{
+			name:    "empty",
+			value:   "",
+			wantErr: errs.ErrParsingFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := timeParse(tt.value)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("unexpected error, expected %v, received %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !result.Equal(tt.expect) {
+				t.Errorf("unexpected time, expected %s, received %s", tt.expect.String(), result.String())
+			}
+		})
+	}
+}
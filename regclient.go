@@ -35,6 +35,7 @@ type RegClient struct {
 	hostDefault *config.Host
 	log         *logrus.Logger
 	regOpts     []reg.Opts
+	ocidirOpts  []ocidir.Opts
 	schemes     map[string]scheme.API
 	userAgent   string
 }
@@ -45,11 +46,12 @@ type Opt func(*RegClient)
 // New returns a registry client.
 func New(opts ...Opt) *RegClient {
 	var rc = RegClient{
-		hosts:     map[string]*config.Host{},
-		userAgent: DefaultUserAgent,
-		log:       &logrus.Logger{Out: io.Discard},
-		regOpts:   []reg.Opts{},
-		schemes:   map[string]scheme.API{},
+		hosts:      map[string]*config.Host{},
+		userAgent:  DefaultUserAgent,
+		log:        &logrus.Logger{Out: io.Discard},
+		regOpts:    []reg.Opts{},
+		ocidirOpts: []ocidir.Opts{},
+		schemes:    map[string]scheme.API{},
 	}
 
 	info := version.GetInfo()
@@ -80,9 +82,10 @@ func New(opts ...Opt) *RegClient {
 
 	// setup scheme's
 	rc.schemes["reg"] = reg.New(rc.regOpts...)
-	rc.schemes["ocidir"] = ocidir.New(
+	rc.ocidirOpts = append(rc.ocidirOpts,
 		ocidir.WithLog(rc.log),
 	)
+	rc.schemes["ocidir"] = ocidir.New(rc.ocidirOpts...)
 
 	rc.log.WithFields(logrus.Fields{
 		"VCSRef": info.VCSRef,
@@ -182,6 +185,16 @@ func WithLog(log *logrus.Logger) Opt {
 	}
 }
 
+// WithReferrersFallbackTag sets the format of the tag used to track referrers when the referrers API is not available.
+// This applies to registries and OCI Layouts, see [github.com/regclient/regclient/types/referrer.FallbackTagFormat] for the format.
+// Other tools look for the default format, so this should only be changed when every tool shares the same format.
+func WithReferrersFallbackTag(format string) Opt {
+	return func(rc *RegClient) {
+		rc.regOpts = append(rc.regOpts, reg.WithReferrersFallbackTag(format))
+		rc.ocidirOpts = append(rc.ocidirOpts, ocidir.WithReferrersFallbackTag(format))
+	}
+}
+
 // WithRegOpts passes through opts to the reg scheme.
 func WithRegOpts(opts ...reg.Opts) Opt {
 	return func(rc *RegClient) {
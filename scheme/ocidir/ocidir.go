@@ -21,6 +21,7 @@ import (
 	"github.com/regclient/regclient/types/mediatype"
 	v1 "github.com/regclient/regclient/types/oci/v1"
 	"github.com/regclient/regclient/types/ref"
+	"github.com/regclient/regclient/types/referrer"
 )
 
 const (
@@ -37,6 +38,7 @@ type OCIDir struct {
 	modRefs     map[string]*ociGC
 	throttle    map[string]*pqueue.Queue[reqmeta.Data]
 	throttleDef int
+	fallbackTag string
 	mu          sync.Mutex
 }
 
@@ -46,9 +48,10 @@ type ociGC struct {
 }
 
 type ociConf struct {
-	gc       bool
-	log      *logrus.Logger
-	throttle int
+	gc          bool
+	log         *logrus.Logger
+	throttle    int
+	fallbackTag string
 }
 
 // Opts are used for passing options to ocidir
@@ -57,9 +60,10 @@ type Opts func(*ociConf)
 // New creates a new OCIDir with options
 func New(opts ...Opts) *OCIDir {
 	conf := ociConf{
-		log:      &logrus.Logger{Out: io.Discard},
-		gc:       true,
-		throttle: defThrottle,
+		log:         &logrus.Logger{Out: io.Discard},
+		gc:          true,
+		throttle:    defThrottle,
+		fallbackTag: referrer.FallbackTagDefault,
 	}
 	for _, opt := range opts {
 		opt(&conf)
@@ -70,6 +74,7 @@ func New(opts ...Opts) *OCIDir {
 		modRefs:     map[string]*ociGC{},
 		throttle:    map[string]*pqueue.Queue[reqmeta.Data]{},
 		throttleDef: conf.throttle,
+		fallbackTag: conf.fallbackTag,
 	}
 }
 
@@ -89,6 +94,15 @@ func WithLog(log *logrus.Logger) Opts {
 	}
 }
 
+// WithReferrersFallbackTag sets the format of the tag used to track referrers.
+// The default is [referrer.FallbackTagDefault], see [referrer.FallbackTagFormat] for the format.
+// Requests for referrers return an error when the format does not generate a valid tag.
+func WithReferrersFallbackTag(format string) Opts {
+	return func(c *ociConf) {
+		c.fallbackTag = format
+	}
+}
+
 // WithThrottle provides a number of concurrent write actions (blob/manifest put)
 func WithThrottle(count int) Opts {
 	return func(c *ociConf) {
@@ -63,7 +63,7 @@ func (o *OCIDir) referrerList(ctx context.Context, r ref.Ref, opts ...scheme.Ref
 	rl.Subject = r
 
 	// pull referrer list by tag
-	rlTag, err := referrer.FallbackTag(r)
+	rlTag, err := referrer.FallbackTagFormat(r, o.fallbackTag)
 	if err != nil {
 		return rl, err
 	}
@@ -126,7 +126,7 @@ func (o *OCIDir) referrerDelete(ctx context.Context, r ref.Ref, m manifest.Manif
 	}
 
 	// push updated referrer list by tag
-	rlTag, err := referrer.FallbackTag(rSubject)
+	rlTag, err := referrer.FallbackTagFormat(rSubject, o.fallbackTag)
 	if err != nil {
 		return err
 	}
@@ -170,7 +170,7 @@ func (o *OCIDir) referrerPut(ctx context.Context, r ref.Ref, m manifest.Manifest
 	}
 
 	// push updated referrer list by tag
-	rlTag, err := referrer.FallbackTag(rSubject)
+	rlTag, err := referrer.FallbackTagFormat(rSubject, o.fallbackTag)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,7 @@ package ocidir
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/regclient/regclient/internal/copyfs"
 	"github.com/regclient/regclient/scheme"
 	"github.com/regclient/regclient/types/descriptor"
+	"github.com/regclient/regclient/types/errs"
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
 	v1 "github.com/regclient/regclient/types/oci/v1"
@@ -311,3 +313,72 @@ func mapStringStringEq(a, b map[string]string) bool {
 	}
 	return true
 }
+
+func TestReferrerFallbackTag(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	err := copyfs.Copy(filepath.Join(tempDir, "testrepo"), "../../testdata/testrepo")
+	if err != nil {
+		t.Fatalf("failed to setup tempDir: %v", err)
+	}
+	o := New(WithReferrersFallbackTag("%[2]s.%[1]s.att"))
+	mRef, err := ref.New("ocidir://" + tempDir + "/testrepo:v3")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	m, err := o.ManifestGet(ctx, mRef)
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	mDesc := m.GetDescriptor()
+	artifact := v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: mediatype.OCI1Manifest,
+		Config: descriptor.Descriptor{
+			MediaType: "application/example.sbom",
+			Size:      8,
+			Digest:    digest.FromString("example1"),
+		},
+		Layers: []descriptor.Descriptor{
+			{
+				MediaType: mediatype.OCI1LayerGzip,
+				Size:      8,
+				Digest:    digest.FromString("example2"),
+			},
+		},
+		Subject: &mDesc,
+	}
+	artifactM, err := manifest.New(manifest.WithOrig(artifact))
+	if err != nil {
+		t.Fatalf("failed creating artifact manifest: %v", err)
+	}
+	err = o.ManifestPut(ctx, mRef.SetDigest(artifactM.GetDescriptor().Digest.String()), artifactM, scheme.WithManifestChild())
+	if err != nil {
+		t.Fatalf("failed to put artifact: %v", err)
+	}
+	expectTag := mDesc.Digest.Hex() + ".sha256.att"
+	rl, err := o.ReferrerList(ctx, mRef)
+	if err != nil {
+		t.Fatalf("failed to list referrers: %v", err)
+	}
+	if len(rl.Descriptors) != 1 || rl.Descriptors[0].Digest != artifactM.GetDescriptor().Digest {
+		t.Errorf("unexpected referrers: %v", rl.Descriptors)
+	}
+	if len(rl.Tags) != 1 || rl.Tags[0] != expectTag {
+		t.Errorf("unexpected tags, expected %s, received %v", expectTag, rl.Tags)
+	}
+	// the default format does not see the referrers
+	rlDef, err := New().ReferrerList(ctx, mRef)
+	if err != nil {
+		t.Fatalf("failed to list referrers: %v", err)
+	}
+	if len(rlDef.Descriptors) != 0 {
+		t.Errorf("unexpected referrers with the default format: %v", rlDef.Descriptors)
+	}
+	// an invalid format returns an error
+	_, err = New(WithReferrersFallbackTag("%s/%s")).ReferrerList(ctx, mRef)
+	if !errors.Is(err, errs.ErrInvalidReference) {
+		t.Errorf("unexpected error, expected %v, received %v", errs.ErrInvalidReference, err)
+	}
+}
@@ -243,7 +243,7 @@ func (reg *Reg) referrerListByTag(ctx context.Context, r ref.Ref) (referrer.Refe
 		Subject: r,
 		Tags:    []string{},
 	}
-	rlTag, err := referrer.FallbackTag(r)
+	rlTag, err := referrer.FallbackTagFormat(r, reg.fallbackTag)
 	if err != nil {
 		return rl, err
 	}
@@ -313,7 +313,7 @@ func (reg *Reg) referrerDelete(ctx context.Context, r ref.Ref, m manifest.Manife
 		return err
 	}
 	// push updated referrer list by tag
-	rlTag, err := referrer.FallbackTag(rSubject)
+	rlTag, err := referrer.FallbackTagFormat(rSubject, reg.fallbackTag)
 	if err != nil {
 		return err
 	}
@@ -371,7 +371,7 @@ func (reg *Reg) referrerPut(ctx context.Context, r ref.Ref, m manifest.Manifest)
 		}
 	}
 	// push updated referrer list by tag
-	rlTag, err := referrer.FallbackTag(rSubject)
+	rlTag, err := referrer.FallbackTagFormat(rSubject, reg.fallbackTag)
 	if err != nil {
 		return err
 	}
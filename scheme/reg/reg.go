@@ -52,6 +52,7 @@ type Reg struct {
 	blobMaxPut      int64
 	manifestMaxPull int64
 	manifestMaxPush int64
+	fallbackTag     string
 	cacheMan        *cache.Cache[ref.Ref, manifest.Manifest]
 	cacheRL         *cache.Cache[ref.Ref, referrer.ReferrerList]
 	muHost          sync.Mutex
@@ -82,6 +83,7 @@ func New(opts ...Opts) *Reg {
 		blobMaxPut:      defaultBlobMax,
 		manifestMaxPull: defaultManifestMaxPull,
 		manifestMaxPush: defaultManifestMaxPush,
+		fallbackTag:     referrer.FallbackTagDefault,
 		hosts:           map[string]*config.Host{},
 		features:        map[featureKey]*featureVal{},
 	}
@@ -251,6 +253,15 @@ func WithManifestMax(push, pull int64) Opts {
 	}
 }
 
+// WithReferrersFallbackTag sets the format of the tag used to track referrers when the registry does not support the referrers API.
+// The default is [referrer.FallbackTagDefault], see [referrer.FallbackTagFormat] for the format.
+// Requests for referrers return an error when the format does not generate a valid tag.
+func WithReferrersFallbackTag(format string) Opts {
+	return func(r *Reg) {
+		r.fallbackTag = format
+	}
+}
+
 // WithRetryLimit restricts the number of retries (defaults to 5)
 func WithRetryLimit(l int) Opts {
 	return func(r *Reg) {
@@ -87,3 +87,20 @@ var (
 	// ErrHTTPUnauthorized when authentication fails
 	ErrHTTPUnauthorized = fmt.Errorf("unauthorized%.0w", ErrHTTPStatus)
 )
+
+// HTTPStatusError includes the http status code with the error returned for an unexpected response.
+// Use [errors.As] to retrieve the status code from a wrapped error.
+type HTTPStatusError struct {
+	StatusCode int   // status code in the http response
+	Err        error // error for the status code, which wraps ErrHTTPStatus
+}
+
+// Error returns the message of the wrapped error.
+func (e *HTTPStatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error for the status code.
+func (e *HTTPStatusError) Unwrap() error {
+	return e.Err
+}
@@ -4,7 +4,9 @@ package referrer
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"sort"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/opencontainers/go-digest"
@@ -144,15 +146,51 @@ func (rl ReferrerList) MarshalPretty() ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// FallbackTag returns the ref that should be used when the registry does not support the referrers API
+// FallbackTagDefault is the format of the fallback tag defined by the OCI distribution spec, "<alg>-<ref>".
+const FallbackTagDefault = "%s-%s"
+
+var fallbackTagRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// FallbackTag returns the ref that should be used when the registry does not support the referrers API.
+// The tag format is defined by the OCI distribution spec as "<alg>-<ref>",
+// where ref is the digest hex value truncated to 64 characters, e.g. "sha256-0123...cdef".
+// See [FallbackTagFormat] to use a different format.
 func FallbackTag(r ref.Ref) (ref.Ref, error) {
+	return FallbackTagFormat(r, FallbackTagDefault)
+}
+
+// FallbackTagFormat returns the fallback tag ref using a custom format.
+// The format is passed to [fmt.Sprintf] with the digest algorithm and hex value as arguments,
+// e.g. "%[2]s.%[1]s.referrers", and the hex value is truncated to 64 characters.
+// An error is returned if the result is not a valid tag or does not include the hex value.
+// Other tools look for the [FallbackTagDefault] format, so changing this hides the referrers from those tools.
+func FallbackTagFormat(r ref.Ref, format string) (ref.Ref, error) {
 	dig, err := digest.Parse(r.Digest)
 	if err != nil {
 		return r, fmt.Errorf("failed to parse digest for referrers: %w", err)
 	}
-	rr := r.SetTag(fmt.Sprintf("%s-%s", dig.Algorithm(), stringMax(dig.Hex(), 64)))
-	return rr, nil
+	tag, err := fallbackTagFormat(format, dig)
+	if err != nil {
+		return r, err
+	}
+	return r.SetTag(tag), nil
 }
+
+// FallbackTagValidate returns an error if the format would not generate a valid fallback tag.
+func FallbackTagValidate(format string) error {
+	_, err := fallbackTagFormat(format, digest.FromString(""))
+	return err
+}
+
+func fallbackTagFormat(format string, dig digest.Digest) (string, error) {
+	hex := stringMax(dig.Hex(), 64)
+	tag := fmt.Sprintf(format, dig.Algorithm(), hex)
+	if !fallbackTagRE.MatchString(tag) || !strings.Contains(tag, hex) {
+		return "", fmt.Errorf("fallback tag format %q generated an invalid tag %q%.0w", format, tag, errs.ErrInvalidReference)
+	}
+	return tag, nil
+}
+
 func stringMax(s string, max int) string {
 	if len(s) <= max {
 		return s
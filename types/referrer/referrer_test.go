@@ -11,6 +11,7 @@ import (
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/mediatype"
 	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/ref"
 )
 
 const bOCIImg = `
@@ -359,3 +360,82 @@ func TestDelete(t *testing.T) {
 		t.Errorf("number of descriptors, expected 0, received %d", len(rl.Descriptors))
 	}
 }
+
+func TestFallbackTag(t *testing.T) {
+	t.Parallel()
+	dig := digest.FromString("example")
+	r, err := ref.New("registry.example.com/repo@" + dig.String())
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	tests := []struct {
+		name        string
+		format      string
+		expectTag   string
+		expectedErr error
+	}{
+		{
+			name:      "Default",
+			format:    FallbackTagDefault,
+			expectTag: "sha256-" + dig.Hex(),
+		},
+		{
+			name:      "Custom",
+			format:    "%[2]s.%[1]s.referrers",
+			expectTag: dig.Hex() + ".sha256.referrers",
+		},
+		{
+			name:        "Invalid Character",
+			format:      "%s:%s",
+			expectedErr: errs.ErrInvalidReference,
+		},
+		{
+			name:        "Missing Hex",
+			format:      "%[1]s-referrers",
+			expectedErr: errs.ErrInvalidReference,
+		},
+		{
+			name:        "Missing Args",
+			format:      "referrers",
+			expectedErr: errs.ErrInvalidReference,
+		},
+		{
+			name:        "Too Long",
+			format:      "%s-%s-%[2]s",
+			expectedErr: errs.ErrInvalidReference,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errValidate := FallbackTagValidate(tt.format)
+			rTag, err := FallbackTagFormat(r, tt.format)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Errorf("unexpected error, expected %v, received %v", tt.expectedErr, err)
+				}
+				if !errors.Is(errValidate, tt.expectedErr) {
+					t.Errorf("unexpected validate error, expected %v, received %v", tt.expectedErr, errValidate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to format tag: %v", err)
+			}
+			if errValidate != nil {
+				t.Errorf("failed to validate format: %v", errValidate)
+			}
+			if rTag.Tag != tt.expectTag || rTag.Digest != "" || rTag.Repository != r.Repository {
+				t.Errorf("unexpected ref, expected tag %s, received %s", tt.expectTag, rTag.CommonName())
+			}
+		})
+	}
+	t.Run("Default Matches FallbackTag", func(t *testing.T) {
+		rTag, err := FallbackTag(r)
+		if err != nil {
+			t.Fatalf("failed to get fallback tag: %v", err)
+		}
+		if rTag.Tag != "sha256-"+dig.Hex() {
+			t.Errorf("unexpected tag: %s", rTag.Tag)
+		}
+	})
+}